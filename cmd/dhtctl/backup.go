@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"dht/internal/backup"
+	"dht/internal/models"
+)
+
+// runBackup asks every node to snapshot and upload itself under a shared
+// backup ID, then records a cluster manifest next to the node backups
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	nodesFlag := fs.String("nodes", envOr("DHT_NODES", defaultNodes), "comma-separated DHT node URLs")
+	dest := fs.String("dest", "", "backup destination URI (file:///path or http(s)://bucket-url)")
+	timeout := fs.Duration("timeout", 30*time.Minute, "overall backup timeout")
+	fs.Parse(args)
+
+	if *dest == "" {
+		return fmt.Errorf("-dest is required")
+	}
+	if _, err := backup.Open(*dest); err != nil {
+		return err
+	}
+
+	nodes := splitNodes(*nodesFlag)
+	if len(nodes) == 0 {
+		return fmt.Errorf("no nodes given")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	cm := &backup.ClusterManifest{
+		BackupID:  backup.NewBackupID(time.Now()),
+		CreatedAt: time.Now().UTC(),
+		Nodes:     make([]backup.NodeBackup, len(nodes)),
+	}
+
+	client := &http.Client{}
+	var wg sync.WaitGroup
+	for i, nodeURL := range nodes {
+		wg.Add(1)
+		go func(i int, nodeURL string) {
+			defer wg.Done()
+			cm.Nodes[i] = backupNode(ctx, client, nodeURL, *dest, cm.BackupID)
+		}(i, nodeURL)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, nb := range cm.Nodes {
+		if nb.Error != "" {
+			failed++
+			fmt.Printf("FAILED  %s: %s\n", nb.NodeURL, nb.Error)
+			continue
+		}
+		fmt.Printf("OK      %s (%s): %d entries -> %s\n", nb.NodeURL, nb.NodeID, nb.Manifest.Entries, nb.Location)
+	}
+
+	location, err := backup.WriteClusterManifest(ctx, *dest, cm)
+	if err != nil {
+		return fmt.Errorf("failed to write cluster manifest: %w", err)
+	}
+	fmt.Printf("Cluster manifest: %s\n", location)
+
+	if failed > 0 {
+		return fmt.Errorf("%d/%d node backups failed", failed, len(nodes))
+	}
+	return nil
+}
+
+// backupNode triggers POST /admin/backup on a single node
+func backupNode(ctx context.Context, client *http.Client, nodeURL, dest, backupID string) backup.NodeBackup {
+	result := backup.NodeBackup{NodeURL: nodeURL}
+
+	body, _ := json.Marshal(map[string]string{
+		"destination": dest,
+		"backup_id":   backupID,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "POST", nodeURL+"/admin/backup", bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	var nodeResp struct {
+		Node     string           `json:"node"`
+		Location string           `json:"location"`
+		Manifest *backup.Manifest `json:"manifest"`
+		Error    *models.APIError `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&nodeResp); err != nil {
+		result.Error = fmt.Sprintf("invalid response (status %d)", resp.StatusCode)
+		return result
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		result.Error = fmt.Sprintf("status %d", resp.StatusCode)
+		if nodeResp.Error != nil {
+			result.Error += ": " + nodeResp.Error.Error()
+		}
+		return result
+	}
+
+	result.NodeID = nodeResp.Node
+	result.Location = nodeResp.Location
+	result.Manifest = nodeResp.Manifest
+	return result
+}
+
+// runRestorePlan prints how to restore each node from a cluster backup
+func runRestorePlan(args []string) error {
+	fs := flag.NewFlagSet("restore-plan", flag.ExitOnError)
+	dest := fs.String("dest", "", "backup destination URI used for the backup")
+	backupID := fs.String("backup-id", "", "cluster backup ID")
+	fs.Parse(args)
+
+	if *dest == "" || *backupID == "" {
+		return fmt.Errorf("-dest and -backup-id are required")
+	}
+
+	store, err := backup.Open(*dest)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	rc, err := store.Get(ctx, "cluster/"+*backupID+".json")
+	if err != nil {
+		return fmt.Errorf("failed to fetch cluster manifest: %w", err)
+	}
+	defer rc.Close()
+
+	var cm backup.ClusterManifest
+	if err := json.NewDecoder(rc).Decode(&cm); err != nil {
+		return fmt.Errorf("failed to decode cluster manifest: %w", err)
+	}
+
+	fmt.Printf("# Cluster backup %s (taken %s)\n", cm.BackupID, cm.CreatedAt.Format(time.RFC3339))
+	for _, nb := range cm.Nodes {
+		if nb.Error != "" {
+			fmt.Printf("# %s: no backup (%s)\n", nb.NodeURL, nb.Error)
+			continue
+		}
+		fmt.Printf("NODE_ID=%s dhtnode -restore-from=%s   # %s, %d entries\n",
+			nb.NodeID, nb.Location, nb.NodeURL, nb.Manifest.Entries)
+	}
+	return nil
+}
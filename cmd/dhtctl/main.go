@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultNodes mirrors the gateway's static node list
+const defaultNodes = "http://localhost:8082,http://localhost:8083,http://localhost:8084"
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		err = runBackup(os.Args[2:])
+	case "restore-plan":
+		err = runRestorePlan(os.Args[2:])
+	case "pitr":
+		err = runPITR(os.Args[2:])
+	case "metrics":
+		err = runMetrics(os.Args[2:])
+	case "help", "-h", "--help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: dhtctl <command> [flags]
+
+Commands:
+  backup         Back up every node in the cluster to object storage
+  restore-plan   Print the per-node restore commands for a cluster backup
+  pitr           Recover a node (or key prefix) to a point in time
+  metrics        Show cluster-wide metrics aggregated by the gateway
+
+Run 'dhtctl <command> -h' for command flags.`)
+}
+
+// splitNodes parses a comma-separated node list
+func splitNodes(list string) []string {
+	var nodes []string
+	for _, node := range strings.Split(list, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, strings.TrimRight(node, "/"))
+		}
+	}
+	return nodes
+}
+
+// envOr returns the environment variable or a default
+func envOr(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"dht/internal/models"
+)
+
+// clusterMetrics mirrors the gateway's GET /metrics/cluster response
+type clusterMetrics struct {
+	NodesTotal          int                        `json:"nodes_total"`
+	NodesReporting      int                        `json:"nodes_reporting"`
+	TotalKeys           int64                      `json:"total_keys"`
+	EstimatedUniqueKeys int64                      `json:"estimated_unique_keys"`
+	TotalValueBytes     int64                      `json:"total_value_bytes"`
+	TotalWALBytes       int64                      `json:"total_wal_bytes"`
+	KeySkew             float64                    `json:"key_skew"`
+	Replication         *models.ReplicationMetrics `json:"replication"`
+	Nodes               []struct {
+		Node       string  `json:"node"`
+		NodeID     string  `json:"node_id"`
+		Available  bool    `json:"available"`
+		Phi        float64 `json:"phi"`
+		Keys       int64   `json:"keys"`
+		ValueBytes int64   `json:"value_bytes"`
+		WALBytes   int64   `json:"wal_bytes"`
+		KeyShare   float64 `json:"key_share"`
+		Error      string  `json:"error"`
+	} `json:"nodes"`
+}
+
+// runMetrics prints the cluster-wide metrics aggregated by the gateway
+func runMetrics(args []string) error {
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	gateway := fs.String("gateway", envOr("DHT_GATEWAY", "http://localhost:8080"), "gateway URL")
+	asJSON := fs.Bool("json", false, "print the raw JSON response")
+	fs.Parse(args)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimRight(*gateway, "/") + "/metrics/cluster")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gateway returned status %d", resp.StatusCode)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if *asJSON {
+		fmt.Println(string(raw))
+		return nil
+	}
+
+	var m clusterMetrics
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+
+	fmt.Printf("Nodes:        %d/%d reporting\n", m.NodesReporting, m.NodesTotal)
+	fmt.Printf("Keys:         %d copies (~%d unique)\n", m.TotalKeys, m.EstimatedUniqueKeys)
+	fmt.Printf("Value bytes:  %d\n", m.TotalValueBytes)
+	fmt.Printf("WAL bytes:    %d\n", m.TotalWALBytes)
+	fmt.Printf("Key skew:     %.2f (busiest node vs. mean)\n", m.KeySkew)
+	if r := m.Replication; r != nil {
+		fmt.Printf("Replication:  queue=%d max_lag=%.0fms avg_ack=%.1fms failed=%d retrying=%d\n",
+			r.QueueSize, r.MaxReplicationLag, r.AverageAckTime, r.FailedReplicas, r.RetriesInProgress)
+	} else {
+		fmt.Println("Replication:  replicator unreachable")
+	}
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tID\tSTATUS\tPHI\tKEYS\tSHARE\tVALUE BYTES\tWAL BYTES")
+	for _, n := range m.Nodes {
+		status := "up"
+		if !n.Available {
+			status = "suspected"
+		}
+		if n.Error != "" {
+			fmt.Fprintf(tw, "%s\t-\t%s\t%.1f\t-\t-\t-\t%s\n", n.Node, status, n.Phi, n.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%d\t%.1f%%\t%d\t%d\n",
+			n.Node, n.NodeID, status, n.Phi, n.Keys, n.KeyShare*100, n.ValueBytes, n.WALBytes)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"dht/internal/backup"
+)
+
+// runPITR rebuilds a node's state as of a timestamp from archived snapshots
+// and WAL, and uploads it as a new backup ready for dhtnode -restore-from
+func runPITR(args []string) error {
+	fs := flag.NewFlagSet("pitr", flag.ExitOnError)
+	dest := fs.String("dest", "", "backup destination URI holding the node's backups")
+	nodeID := fs.String("node", "", "node ID to recover (e.g. node-1)")
+	to := fs.String("to", "", "target timestamp (RFC 3339, e.g. 2025-01-01T12:00:00Z)")
+	prefix := fs.String("prefix", "", "only recover keys with this prefix")
+	dryRun := fs.Bool("dry-run", false, "only print the recovery plan")
+	fs.Parse(args)
+
+	if *dest == "" || *nodeID == "" || *to == "" {
+		return fmt.Errorf("-dest, -node and -to are required")
+	}
+
+	target, err := time.Parse(time.RFC3339, *to)
+	if err != nil {
+		return fmt.Errorf("invalid -to timestamp: %w", err)
+	}
+
+	store, err := backup.Open(*dest)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	plan, err := backup.PlanPointInTime(ctx, store, *nodeID, target)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Target:        %s\n", target.Format(time.RFC3339))
+	fmt.Printf("Base snapshot: %s (taken %s)\n", plan.Base.BackupID, plan.Base.CreatedAt.Format(time.RFC3339))
+	fmt.Printf("WAL archive:   %s (taken %s)\n", plan.WAL.BackupID, plan.WAL.CreatedAt.Format(time.RFC3339))
+	if *dryRun {
+		return nil
+	}
+
+	workDir, err := os.MkdirTemp("", "dhtctl-pitr-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	result, err := backup.RecoverToPointInTime(ctx, *dest, *nodeID, target, *prefix, workDir)
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range result.Warnings {
+		fmt.Printf("WARNING: %s\n", warning)
+	}
+	fmt.Printf("Replayed %d WAL entries (last at %s), %d already expired\n",
+		result.Replayed, result.LastApplied.Format(time.RFC3339Nano), result.Skipped)
+	fmt.Printf("Recovered %d entries -> %s\n", result.Manifest.Entries, result.Location)
+	fmt.Printf("\nRestore with:\n  NODE_ID=%s dhtnode -restore-from=%s\n", *nodeID, result.Location)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"dht/internal/backup"
+	"dht/internal/storage"
+)
+
+// restoreFromBackup replaces the node's state with the backup at uri
+// The downloaded snapshot becomes the node's local snapshot and the WAL is
+// truncated to continue from the backup's sequence number, so a later
+// restart recovers exactly the restored state.
+func (n *DHTNode) restoreFromBackup(uri string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	manifest, localPath, err := backup.Download(ctx, uri, n.dataDir)
+	if err != nil {
+		return err
+	}
+
+	if manifest.NodeID != n.nodeID {
+		log.Printf("Warning: restoring backup of %s onto %s\n", manifest.NodeID, n.nodeID)
+	}
+
+	n.storage.Clear()
+	loaded, err := storage.LoadSnapshot(localPath, n.storage)
+	if err != nil {
+		return fmt.Errorf("failed to load snapshot: %w", err)
+	}
+
+	if err := os.Rename(localPath, n.snapshotPath); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+	info := &storage.SnapshotInfo{
+		Path:      n.snapshotPath,
+		Entries:   manifest.Entries,
+		Size:      manifest.SnapshotSize,
+		SHA256:    manifest.SHA256,
+		CreatedAt: manifest.CreatedAt,
+		WALSeq:    manifest.WALSeq,
+	}
+	if err := storage.WriteSnapshotManifest(info, manifest.WALSeq); err != nil {
+		return err
+	}
+
+	if err := n.wal.Restart(manifest.WALSeq); err != nil {
+		return fmt.Errorf("failed to truncate WAL: %w", err)
+	}
+
+	log.Printf("Restored %d entries from backup %s (%s, taken %s)\n",
+		loaded, manifest.BackupID, uri, manifest.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+// writeSnapshot writes a local snapshot of the current state and its
+// manifest, which records the WAL sequence number it was taken at
+func (n *DHTNode) writeSnapshot() (*storage.SnapshotInfo, error) {
+	n.snapshotMu.Lock()
+	defer n.snapshotMu.Unlock()
+
+	seq := n.wal.LastSeq()
+	info, err := storage.WriteSnapshot(n.storage, n.snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	info.WALSeq = seq
+	if err := storage.WriteSnapshotManifest(info, seq); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// handleSnapshot writes a local snapshot of the current state
+func (n *DHTNode) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	info, err := n.writeSnapshot()
+	if err != nil {
+		log.Printf("Snapshot failed: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to write snapshot")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"node":       n.nodeID,
+		"path":       info.Path,
+		"entries":    info.Entries,
+		"size":       info.Size,
+		"sha256":     info.SHA256,
+		"created_at": info.CreatedAt,
+	})
+}
+
+// handleBackup snapshots the node and uploads the snapshot plus a manifest
+// to the requested destination, which must be one the operator allowed
+func (n *DHTNode) handleBackup(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Destination string `json:"destination"`
+		BackupID    string `json:"backup_id,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Destination == "" {
+		respondError(w, http.StatusBadRequest, "Destination is required")
+		return
+	}
+
+	if err := n.backupPolicy.Validate(req.Destination); err != nil {
+		respondError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if _, err := backup.Open(req.Destination); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	info, err := n.writeSnapshot()
+	if err != nil {
+		log.Printf("Snapshot failed: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to write snapshot")
+		return
+	}
+
+	backupID := req.BackupID
+	if backupID == "" {
+		backupID = backup.NewBackupID(info.CreatedAt)
+	}
+
+	// Archive the WAL alongside the snapshot for point-in-time recovery
+	walArchive := fmt.Sprintf("%s/%s-wal-archive.log", n.dataDir, n.nodeID)
+	if err := n.archiveWAL(walArchive); err != nil {
+		log.Printf("WAL archive failed: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to archive WAL")
+		return
+	}
+	defer os.Remove(walArchive)
+
+	manifest, location, err := backup.Upload(r.Context(), req.Destination, n.nodeID, backupID, info, walArchive)
+	if err != nil {
+		log.Printf("Backup upload failed: %v\n", err)
+		respondError(w, http.StatusBadGateway, "Failed to upload backup")
+		return
+	}
+
+	log.Printf("Backup %s uploaded to %s (%d entries)\n", backupID, location, manifest.Entries)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"node":     n.nodeID,
+		"location": location,
+		"manifest": manifest,
+	})
+}
+
+// archiveWAL copies the current WAL to path
+func (n *DHTNode) archiveWAL(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := n.wal.CopyTo(file); err != nil {
+		return err
+	}
+	return file.Sync()
+}
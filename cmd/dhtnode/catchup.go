@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"dht/internal/hashring"
+	"dht/internal/httpx"
+	"dht/internal/storage"
+)
+
+// defaultSyncBuckets is how many ranges a primary's keys are split into
+// when comparing them with a replica
+const defaultSyncBuckets = 256
+
+// syncRequest selects the keys a primary holds for one of its replicas
+type syncRequest struct {
+	Primary  string   `json:"primary"`
+	Replica  string   `json:"replica"`
+	Ring     []string `json:"ring"`
+	Replicas int      `json:"replicas"` // Replication factor of keys without their own
+	Buckets  int      `json:"buckets"`
+
+	// Only lists the buckets whose entries are wanted (entries only)
+	Only []int `json:"only,omitempty"`
+}
+
+// syncDigest hashes the (key, version) pairs of each bucket; empty buckets
+// hash to ""
+type syncDigest struct {
+	AsOf    uint64   `json:"as_of"`
+	Keys    int      `json:"keys"`
+	Buckets []string `json:"buckets"`
+}
+
+// syncEntry is a primary's copy of a key sent to a catching-up replica
+type syncEntry struct {
+	Key        string        `json:"key"`
+	Value      []byte        `json:"value"`
+	Owner      int64         `json:"owner"`
+	Version    uint64        `json:"version"`
+	ExpiresAt  *time.Time    `json:"expires_at,omitempty"`
+	SlidingTTL time.Duration `json:"sliding_ttl,omitempty"`
+	Replicas   int           `json:"replicas,omitempty"`
+}
+
+// syncEntries are the keys of the requested buckets. AsOf is the primary's
+// WAL position before they were read: a key missing from them was deleted
+// (or expired) if the replica's copy is no newer.
+type syncEntries struct {
+	AsOf    uint64      `json:"as_of"`
+	Entries []syncEntry `json:"entries"`
+}
+
+// catchUpRequest describes the ring a node returning from downtime is
+// part of; self is its URL as the ring knows it
+type catchUpRequest struct {
+	Self     string   `json:"self"`
+	Ring     []string `json:"ring"`
+	Replicas int      `json:"replicas"`
+	Buckets  int      `json:"buckets"`
+}
+
+// catchUpPeer is the outcome of catching up with one primary
+type catchUpPeer struct {
+	Peer      string `json:"peer"`
+	Buckets   int    `json:"buckets_differing"`
+	Pulled    int    `json:"pulled"`
+	Deleted   int    `json:"deleted"`
+	Skipped   int    `json:"skipped,omitempty"`
+	Error     string `json:"error,omitempty"`
+	AsOf      uint64 `json:"as_of,omitempty"`
+	PeerKeys  int    `json:"peer_keys"`
+	LocalKeys int    `json:"local_keys"`
+}
+
+// syncBucket returns the bucket key falls in
+func syncBucket(key string, buckets int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// normalize fills in defaults and checks the request
+func (req *syncRequest) normalize() error {
+	if req.Primary == "" || req.Replica == "" || len(req.Ring) == 0 {
+		return fmt.Errorf("primary, replica and ring are required")
+	}
+	if req.Replicas <= 0 {
+		req.Replicas = 3
+	}
+	if req.Buckets <= 0 {
+		req.Buckets = defaultSyncBuckets
+	}
+	return nil
+}
+
+// syncKeys returns the local entries whose primary is req.Primary and whose
+// placement includes req.Replica
+func (n *DHTNode) syncKeys(req *syncRequest) map[string]*storage.Entry {
+	ring := hashring.NewHashRing(req.Ring)
+	keys := make(map[string]*storage.Entry)
+	for key, entry := range n.storage.GetAll() {
+		replicas := req.Replicas
+		if entry.Replicas > 0 {
+			replicas = entry.Replicas
+		}
+		placement := ring.LocateKey(key, replicas)
+		if len(placement) == 0 || placement[0] != req.Primary || !contains(placement[1:], req.Replica) {
+			continue
+		}
+		keys[key] = entry
+	}
+	return keys
+}
+
+// digestKeys hashes the (key, version) pairs of each bucket
+func digestKeys(keys map[string]uint64, buckets int) []string {
+	byBucket := make([][]string, buckets)
+	for key := range keys {
+		b := syncBucket(key, buckets)
+		byBucket[b] = append(byBucket[b], key)
+	}
+
+	digest := make([]string, buckets)
+	for b, bucketKeys := range byBucket {
+		if len(bucketKeys) == 0 {
+			continue
+		}
+		sort.Strings(bucketKeys)
+		h := sha256.New()
+		for _, key := range bucketKeys {
+			fmt.Fprintf(h, "%s\x00%d\n", key, keys[key])
+		}
+		digest[b] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digest
+}
+
+// handleSyncDigest handles POST /sync/digest: a primary hashes the keys a
+// replica should hold, by bucket, so the replica can tell which ranges it
+// is missing writes in
+func (n *DHTNode) handleSyncDigest(w http.ResponseWriter, r *http.Request) {
+	var req syncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := req.normalize(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	asOf := n.wal.LastSeq()
+	versions := make(map[string]uint64)
+	for key, entry := range n.syncKeys(&req) {
+		versions[key] = entry.Version
+	}
+
+	respondJSON(w, http.StatusOK, syncDigest{
+		AsOf:    asOf,
+		Keys:    len(versions),
+		Buckets: digestKeys(versions, req.Buckets),
+	})
+}
+
+// handleSyncEntries handles POST /sync/entries, returning the keys of the
+// requested buckets a replica should hold
+func (n *DHTNode) handleSyncEntries(w http.ResponseWriter, r *http.Request) {
+	var req syncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := req.normalize(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wanted := make(map[int]bool, len(req.Only))
+	for _, b := range req.Only {
+		wanted[b] = true
+	}
+
+	response := syncEntries{AsOf: n.wal.LastSeq(), Entries: []syncEntry{}}
+	for key, entry := range n.syncKeys(&req) {
+		if !wanted[syncBucket(key, req.Buckets)] {
+			continue
+		}
+		response.Entries = append(response.Entries, syncEntry{
+			Key:        key,
+			Value:      entry.Value,
+			Owner:      entry.Owner,
+			Version:    entry.Version,
+			ExpiresAt:  entry.ExpiresAt,
+			SlidingTTL: entry.SlidingTTL,
+			Replicas:   entry.Replicas,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, response)
+}
+
+// handleCatchUp handles POST /admin/catchup: a node back from downtime
+// compares the keys it replicates with each of their primaries and pulls
+// the writes it missed, instead of waiting for replication retries that
+// may have long been given up. Copies the primary no longer has are
+// deleted, unless they are newer than what the primary has seen.
+func (n *DHTNode) handleCatchUp(w http.ResponseWriter, r *http.Request) {
+	if n.rejectIfStandby(w) || n.rejectIfIntegrityHeld(w) {
+		return
+	}
+
+	var req catchUpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Self == "" || len(req.Ring) == 0 {
+		respondError(w, http.StatusBadRequest, "self and ring are required")
+		return
+	}
+	if !contains(req.Ring, req.Self) {
+		respondError(w, http.StatusBadRequest, "self is not in the ring")
+		return
+	}
+
+	// Digest and entry requests only read, so they are safe to retry
+	client := httpx.New(httpx.Config{
+		Timeout:           30 * time.Second,
+		MaxRetries:        2,
+		IdempotentMethods: []string{"POST"},
+	})
+
+	start := time.Now()
+	peers := make([]catchUpPeer, 0, len(req.Ring)-1)
+	pulled, deleted, failed := 0, 0, 0
+	for _, peer := range req.Ring {
+		if peer == req.Self {
+			continue
+		}
+		result := n.catchUpWith(client, peer, &req)
+		if result.Error != "" {
+			log.Printf("Catch-up: with %s failed: %s\n", peer, result.Error)
+			failed++
+		}
+		pulled += result.Pulled
+		deleted += result.Deleted
+		peers = append(peers, result)
+	}
+
+	log.Printf("Catch-up: pulled=%d deleted=%d from %d peers (%d failed) in %v\n",
+		pulled, deleted, len(peers), failed, time.Since(start))
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"node":        n.nodeID,
+		"peers":       peers,
+		"pulled":      pulled,
+		"deleted":     deleted,
+		"failed":      failed,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
+
+// catchUpWith pulls the writes this node missed of the keys primary holds
+// for it. Only the buckets whose digests differ are transferred.
+func (n *DHTNode) catchUpWith(client *httpx.Client, primary string, req *catchUpRequest) catchUpPeer {
+	result := catchUpPeer{Peer: primary}
+	scope := syncRequest{
+		Primary:  primary,
+		Replica:  req.Self,
+		Ring:     req.Ring,
+		Replicas: req.Replicas,
+		Buckets:  req.Buckets,
+	}
+	scope.normalize()
+
+	var remote syncDigest
+	if err := postJSON(client, primary+"/sync/digest", scope, &remote); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if len(remote.Buckets) != scope.Buckets {
+		result.Error = fmt.Sprintf("digest has %d buckets, expected %d", len(remote.Buckets), scope.Buckets)
+		return result
+	}
+	result.PeerKeys = remote.Keys
+
+	// A replica's copy is at the primary's version it was replicated from
+	local := n.syncKeys(&scope)
+	versions := make(map[string]uint64, len(local))
+	for key, entry := range local {
+		versions[key] = entry.SourceVersion
+	}
+	result.LocalKeys = len(versions)
+
+	digest := digestKeys(versions, scope.Buckets)
+	for b := range digest {
+		if digest[b] != remote.Buckets[b] {
+			scope.Only = append(scope.Only, b)
+		}
+	}
+	result.Buckets = len(scope.Only)
+	if len(scope.Only) == 0 {
+		return result
+	}
+
+	var entries syncEntries
+	if err := postJSON(client, primary+"/sync/entries", scope, &entries); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.AsOf = entries.AsOf
+
+	present := make(map[string]bool, len(entries.Entries))
+	for _, entry := range entries.Entries {
+		present[entry.Key] = true
+		applied, err := n.applyCatchUpEntry(&entry)
+		switch {
+		case err != nil:
+			result.Error = err.Error()
+			return result
+		case applied:
+			result.Pulled++
+		}
+	}
+
+	// Copies the primary no longer has were deleted there while this node
+	// was away. Copies without a source version came from a rebalance or
+	// another primary, so they are left for rebalancing to sort out.
+	inOnly := make(map[int]bool, len(scope.Only))
+	for _, b := range scope.Only {
+		inOnly[b] = true
+	}
+	for key, version := range versions {
+		if present[key] || !inOnly[syncBucket(key, scope.Buckets)] {
+			continue
+		}
+		if version == 0 || version > entries.AsOf {
+			result.Skipped++
+			continue
+		}
+		removed, err := n.deleteCatchUpKey(key, version)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if removed {
+			result.Deleted++
+		}
+	}
+
+	return result
+}
+
+// applyCatchUpEntry stores a primary's copy of a key as a replicated write,
+// unless this node already has that version or a newer one. Keys locked by
+// a pending transaction are left alone.
+func (n *DHTNode) applyCatchUpEntry(entry *syncEntry) (bool, error) {
+	ttl := time.Duration(0)
+	switch {
+	case entry.SlidingTTL > 0:
+		ttl = entry.SlidingTTL
+	case entry.ExpiresAt != nil:
+		ttl = time.Until(*entry.ExpiresAt)
+		if ttl <= 0 {
+			return false, nil
+		}
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	if _, locked := n.storage.LockedBy(entry.Key); locked {
+		return false, nil
+	}
+	if current, err := n.storage.GetEntry(entry.Key); err == nil && current.SourceVersion >= entry.Version {
+		return false, nil
+	}
+
+	opts := storage.WriteOptions{
+		Owner:         entry.Owner,
+		SlidingTTL:    entry.SlidingTTL,
+		SourceVersion: entry.Version,
+		Replicas:      entry.Replicas,
+	}
+	seq, err := n.wal.AppendWithOptions("SET", entry.Key, entry.Value, ttl, opts)
+	if err != nil {
+		return false, fmt.Errorf("WAL append failed: %w", err)
+	}
+	opts.Version = seq
+
+	if err := n.storage.SetWithOptions(entry.Key, entry.Value, ttl, opts); err != nil {
+		return false, fmt.Errorf("failed to store %s: %w", entry.Key, err)
+	}
+	n.indexes.Update(opts.Owner, entry.Key, entry.Value)
+	return true, nil
+}
+
+// deleteCatchUpKey removes a copy the primary deleted, if it is still the
+// one replicated at sourceVersion
+func (n *DHTNode) deleteCatchUpKey(key string, sourceVersion uint64) (bool, error) {
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	if _, locked := n.storage.LockedBy(key); locked {
+		return false, nil
+	}
+	entry, err := n.storage.GetEntry(key)
+	if err != nil || entry.SourceVersion != sourceVersion {
+		return false, nil
+	}
+
+	if err := n.wal.Append("DELETE", key, nil, 0); err != nil {
+		return false, fmt.Errorf("WAL append failed: %w", err)
+	}
+	n.indexes.Remove(key)
+	if err := n.storage.DeleteIfVersion(key, entry.Version); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// postJSON posts body to url and decodes the JSON response into out
+func postJSON(client *httpx.Client, url string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
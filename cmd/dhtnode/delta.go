@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dht/internal/delta"
+	"dht/internal/models"
+	"dht/internal/storage"
+)
+
+// handleDeltaPatch applies a binary delta to a stored value and returns the
+// new value. A delta only makes sense against the value it was made from, so
+// If-Match with that version is required.
+func (n *DHTNode) handleDeltaPatch(w http.ResponseWriter, r *http.Request, key string) {
+	if strings.TrimSpace(r.Header.Get("If-Match")) == "" {
+		respondErrorCode(w, http.StatusPreconditionRequired, models.ErrCodeConditionFailed,
+			"Delta writes require If-Match with the version the delta was made against", nil)
+		return
+	}
+
+	// The delta is only needed until it has been applied
+	buf := storage.GetBuffer()
+	defer storage.PutBuffer(buf)
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		respondError(w, http.StatusBadRequest, "Failed to read body")
+		return
+	}
+	defer r.Body.Close()
+
+	// Hold the write lock so the read-modify-write is not interleaved with other writes
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	if n.rejectIfLocked(w, key) || n.rejectIfPreconditionFailed(w, r, key) {
+		return
+	}
+
+	entry, err := n.storage.GetEntry(key)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	patched, stats, err := delta.Apply(entry.Value, buf.Bytes())
+	if err != nil {
+		switch {
+		case errors.Is(err, delta.ErrOutOfRange):
+			respondError(w, http.StatusUnprocessableEntity, err.Error())
+		default:
+			respondError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	ttl := time.Duration(0)
+	opts := storage.WriteOptions{Owner: ownerFromRequest(r), Replicas: entry.Replicas}
+	if entry.SlidingTTL > 0 {
+		// A delta is an access, so a sliding key gets its full TTL back
+		ttl = entry.SlidingTTL
+		opts.SlidingTTL = entry.SlidingTTL
+	} else if entry.ExpiresAt != nil {
+		// Keep the key's original expiry. A zero TTL would store the key
+		// without one, so a key that expired since it was read is gone.
+		ttl = time.Until(*entry.ExpiresAt)
+		if ttl <= 0 {
+			respondError(w, http.StatusNotFound, "Key not found")
+			return
+		}
+	}
+
+	// The new value is logged as a regular SET
+	seq, err := n.wal.AppendWithOptions("SET", key, patched, ttl, opts)
+	if err != nil {
+		log.Printf("WAL append failed: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to write to WAL")
+		return
+	}
+	opts.Version = seq
+
+	if err := n.storage.SetWithOptions(key, patched, ttl, opts); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to store value")
+		return
+	}
+	n.indexes.Update(opts.Owner, key, patched)
+	n.storage.RecordWrite(key)
+
+	sum := sha256.Sum256(patched)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Node-ID", n.nodeID)
+	w.Header().Set("X-Version", strconv.FormatUint(seq, 10))
+	w.Header().Set("X-Checksum", hex.EncodeToString(sum[:]))
+	w.Header().Set("X-Delta-Operations", strconv.Itoa(stats.Operations))
+	if ttl > 0 {
+		w.Header().Set("X-Expires-At", time.Now().Add(ttl).UTC().Format(time.RFC3339Nano))
+	}
+	if opts.SlidingTTL > 0 {
+		w.Header().Set("X-Sliding-TTL", opts.SlidingTTL.String())
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(patched)
+}
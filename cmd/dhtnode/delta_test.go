@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"dht/internal/delta"
+	"dht/internal/jsondoc"
+)
+
+func TestDeltaPatch(t *testing.T) {
+	const stored = "hello, world"
+	tests := []struct {
+		name        string
+		contentType string
+		ifMatch     string // "current" for the stored version
+		body        []byte
+		status      int
+		want        string // the stored value afterwards
+	}{
+		{name: "applied", ifMatch: "current", body: delta.New().Write(7, []byte("there")).Bytes(), status: http.StatusOK, want: "hello, there"},
+		{name: "no operations", ifMatch: "current", body: delta.New().Bytes(), status: http.StatusOK, want: stored},
+		{name: "no If-Match", body: delta.New().Write(0, []byte("H")).Bytes(), status: http.StatusPreconditionRequired, want: stored},
+		{name: "stale version", ifMatch: "999", body: delta.New().Write(0, []byte("H")).Bytes(), status: http.StatusPreconditionFailed, want: stored},
+		{name: "bad header", ifMatch: "current", body: []byte("not a delta"), status: http.StatusBadRequest, want: stored},
+		{name: "truncated", ifMatch: "current", body: delta.New().Write(0, []byte("HELLO")).Bytes()[:8], status: http.StatusBadRequest, want: stored},
+		{name: "unknown operation", ifMatch: "current", body: append(delta.New().Bytes(), 'X'), status: http.StatusBadRequest, want: stored},
+		{name: "out of range", ifMatch: "current", body: delta.New().Write(0, []byte("H")).Delete(5, 100).Bytes(), status: http.StatusUnprocessableEntity, want: stored},
+		{name: "merge patch", contentType: jsondoc.MergePatchContentType, body: []byte(`{"a":1}`), status: http.StatusUnsupportedMediaType, want: stored},
+		{name: "json patch", contentType: jsondoc.JSONPatchContentType, body: []byte(`[]`), status: http.StatusUnsupportedMediaType, want: stored},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode(t)
+			w := serve(node.handlePut, "PUT", "value", []byte(stored), http.Header{"X-User-Id": {"1"}})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			version := w.Header().Get("X-Version")
+
+			header := http.Header{"X-User-Id": {"1"}, "Content-Type": {delta.ContentType}}
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+			switch tt.ifMatch {
+			case "":
+			case "current":
+				header.Set("If-Match", version)
+			default:
+				header.Set("If-Match", tt.ifMatch)
+			}
+
+			w = serve(node.handlePatch, "PATCH", "value", tt.body, header)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			entry, err := node.storage.GetEntry("value")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(entry.Value) != tt.want {
+				t.Fatalf("stored %q, want %q", entry.Value, tt.want)
+			}
+			if tt.status != http.StatusOK && strconv.FormatUint(entry.Version, 10) != version {
+				t.Fatalf("a rejected delta changed the version to %d", entry.Version)
+			}
+		})
+	}
+}
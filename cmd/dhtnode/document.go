@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dht/internal/delta"
+	"dht/internal/jsondoc"
+	"dht/internal/storage"
+)
+
+// writeDocumentPath writes the sub-document of entry selected by a JSONPath
+func (n *DHTNode) writeDocumentPath(w http.ResponseWriter, entry *storage.Entry, path string) {
+	sub, err := jsondoc.Get(entry.Value, path)
+	if err != nil {
+		switch {
+		case errors.Is(err, jsondoc.ErrNotJSON):
+			respondError(w, http.StatusUnprocessableEntity, "Value is not a JSON document")
+		case errors.Is(err, jsondoc.ErrPathNotFound):
+			respondError(w, http.StatusNotFound, "Path not found")
+		default:
+			respondError(w, http.StatusBadRequest, "Invalid path: "+err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Node-ID", n.nodeID)
+	w.Header().Set("X-Updated-At", entry.UpdatedAt.UTC().Format(time.RFC3339Nano))
+	w.Header().Set("X-Version", strconv.FormatUint(entry.Version, 10))
+	setSourceVersion(w, entry)
+	w.WriteHeader(http.StatusOK)
+	w.Write(sub)
+}
+
+// handlePatch applies a binary delta to a stored value. JSON merge and JSON
+// patches are applied by the gateway, which reads the document, patches it and
+// writes it back with If-Match so the result is replicated like any other write.
+func (n *DHTNode) handlePatch(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		respondError(w, http.StatusBadRequest, "Key is required")
+		return
+	}
+
+	if n.rejectIfStandby(w) || n.rejectIfIntegrityHeld(w) || n.rejectIfFrozen(w, r) {
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != delta.ContentType {
+		respondError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+delta.ContentType)
+		return
+	}
+	n.handleDeltaPatch(w, r, key)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"dht/internal/models"
+)
+
+// writeFreeze records why and since when client writes are paused
+type writeFreeze struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// handleFreeze pauses client writes on this node
+// Replicated writes and transaction commit/abort still go through so
+// in-flight work drains and the node reaches a quiescent state.
+func (n *DHTNode) handleFreeze(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	freeze := &writeFreeze{Reason: req.Reason, Since: time.Now()}
+	if !n.freeze.CompareAndSwap(nil, freeze) {
+		// Already frozen; keep the original reason and time
+		freeze = n.freeze.Load()
+	} else {
+		log.Printf("Writes frozen (reason: %q)\n", req.Reason)
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"node":   n.nodeID,
+		"frozen": true,
+		"reason": freeze.Reason,
+		"since":  freeze.Since,
+	})
+}
+
+// handleUnfreeze resumes client writes on this node
+func (n *DHTNode) handleUnfreeze(w http.ResponseWriter, r *http.Request) {
+	if n.freeze.Swap(nil) != nil {
+		log.Println("Writes unfrozen")
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"node":   n.nodeID,
+		"frozen": false,
+	})
+}
+
+// handleFreezeStatus reports whether client writes are paused
+func (n *DHTNode) handleFreezeStatus(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{
+		"node":   n.nodeID,
+		"frozen": false,
+	}
+	if freeze := n.freeze.Load(); freeze != nil {
+		status["frozen"] = true
+		status["reason"] = freeze.Reason
+		status["since"] = freeze.Since
+	}
+
+	respondJSON(w, http.StatusOK, status)
+}
+
+// rejectIfFrozen responds 503 to client writes while writes are frozen
+func (n *DHTNode) rejectIfFrozen(w http.ResponseWriter, r *http.Request) bool {
+	freeze := n.freeze.Load()
+	if freeze == nil || r.Header.Get("X-Replication") == "true" {
+		return false
+	}
+
+	respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeWritesFrozen, "Writes are frozen cluster-wide", map[string]interface{}{
+		"reason": freeze.Reason,
+		"since":  freeze.Since,
+	})
+	return true
+}
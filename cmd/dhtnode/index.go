@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"dht/internal/storage"
+)
+
+// handleListIndexes lists the indexed fields of the requesting tenant
+func (n *DHTNode) handleListIndexes(w http.ResponseWriter, r *http.Request) {
+	fields := n.indexes.Fields(ownerFromRequest(r))
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"indexes": fields,
+		"count":   len(fields),
+	})
+}
+
+// handleCreateIndex declares an index on a JSON field for the requesting
+// tenant and backfills it from existing keys
+func (n *DHTNode) handleCreateIndex(w http.ResponseWriter, r *http.Request) {
+	def := storage.IndexDefinition{
+		Owner: ownerFromRequest(r),
+		Field: r.PathValue("field"),
+	}
+
+	if err := storage.ValidateField(def.Field); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid field: "+err.Error())
+		return
+	}
+
+	// Block writes while backfilling so no update is missed
+	n.writeMu.Lock()
+	err := n.indexes.Define(def, n.storage)
+	n.writeMu.Unlock()
+	if err != nil {
+		log.Printf("Failed to create index %s for user %d: %v\n", def.Field, def.Owner, err)
+		respondError(w, http.StatusInternalServerError, "Failed to create index")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"field":   def.Field,
+		"node":    n.nodeID,
+	})
+}
+
+// handleDropIndex removes an index of the requesting tenant
+func (n *DHTNode) handleDropIndex(w http.ResponseWriter, r *http.Request) {
+	def := storage.IndexDefinition{
+		Owner: ownerFromRequest(r),
+		Field: r.PathValue("field"),
+	}
+
+	if err := n.indexes.Drop(def); err != nil {
+		respondError(w, http.StatusNotFound, "Index not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"field":   def.Field,
+		"node":    n.nodeID,
+	})
+}
+
+// handleIndexQuery returns the requesting tenant's keys whose indexed field
+// equals ?value=
+func (n *DHTNode) handleIndexQuery(w http.ResponseWriter, r *http.Request) {
+	def := storage.IndexDefinition{
+		Owner: ownerFromRequest(r),
+		Field: r.PathValue("field"),
+	}
+
+	keys, err := n.indexes.Lookup(def, r.URL.Query().Get("value"))
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Index not found")
+		return
+	}
+
+	// Postings are not updated when keys expire, so filter those out here
+	live := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if n.storage.Exists(key) {
+			live = append(live, key)
+		}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"keys":  live,
+		"count": len(live),
+		"node":  n.nodeID,
+	})
+}
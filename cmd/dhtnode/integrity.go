@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"dht/internal/models"
+	"dht/internal/storage"
+)
+
+// integrityState is the startup integrity check and what an operator did
+// about it
+type integrityState struct {
+	*storage.IntegrityReport
+	WritesHeld     bool       `json:"writes_held"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	Note           string     `json:"note,omitempty"`
+}
+
+// integrityPath is where discrepancies are kept until acknowledged, so a
+// restart does not make them disappear
+func (n *DHTNode) integrityPath() string {
+	return fmt.Sprintf("%s/%s-integrity.json", n.dataDir, n.nodeID)
+}
+
+// checkIntegrity verifies the local snapshot and WAL before they are loaded,
+// logging what it finds. With INTEGRITY_STRICT, writes are held when
+// anything is wrong until an operator acknowledges it.
+func (n *DHTNode) checkIntegrity() *storage.IntegrityReport {
+	report := storage.CheckIntegrity(n.snapshotPath, n.wal)
+
+	// Discrepancies found before a restart stand until acknowledged
+	if data, err := os.ReadFile(n.integrityPath()); err == nil {
+		var previous storage.IntegrityReport
+		if json.Unmarshal(data, &previous) == nil {
+			seen := make(map[string]bool)
+			for _, d := range report.Discrepancies {
+				seen[d] = true
+			}
+			for _, d := range previous.Discrepancies {
+				if !seen[d] {
+					report.Discrepancies = append(report.Discrepancies, d)
+				}
+			}
+			report.OK = len(report.Discrepancies) == 0
+		}
+	}
+
+	for _, warning := range report.Warnings {
+		log.Printf("Integrity: Warning: %s\n", warning)
+	}
+
+	state := &integrityState{IntegrityReport: report}
+	if report.OK {
+		log.Printf("Integrity: Snapshot and WAL are consistent (WAL seq %d-%d)\n", report.WAL.FirstSeq, report.WAL.LastSeq)
+	} else {
+		for _, d := range report.Discrepancies {
+			log.Printf("Integrity: %s\n", d)
+		}
+		if data, err := json.MarshalIndent(report, "", "  "); err == nil {
+			if err := os.WriteFile(n.integrityPath(), data, 0644); err != nil {
+				log.Printf("Warning: Failed to record integrity discrepancies: %v\n", err)
+			}
+		}
+		if n.integrityStrict {
+			state.WritesHeld = true
+			log.Printf("Integrity: Holding writes until acknowledged with POST /admin/integrity/ack\n")
+		}
+	}
+
+	n.integrity.Store(state)
+	return report
+}
+
+// handleIntegrity reports the startup integrity check
+func (n *DHTNode) handleIntegrity(w http.ResponseWriter, r *http.Request) {
+	state := n.integrity.Load()
+	if state == nil {
+		respondError(w, http.StatusServiceUnavailable, "Integrity check has not run yet")
+		return
+	}
+	respondJSON(w, http.StatusOK, state)
+}
+
+// handleIntegrityAck records that an operator has seen the discrepancies
+// ({"note": "..."} optional) and releases held writes
+func (n *DHTNode) handleIntegrityAck(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	state := n.integrity.Load()
+	if state == nil {
+		respondError(w, http.StatusServiceUnavailable, "Integrity check has not run yet")
+		return
+	}
+
+	if err := os.Remove(n.integrityPath()); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to clear integrity discrepancies: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to acknowledge integrity check")
+		return
+	}
+
+	now := time.Now()
+	acked := &integrityState{IntegrityReport: state.IntegrityReport, AcknowledgedAt: &now, Note: req.Note}
+	n.integrity.Store(acked)
+	log.Printf("Integrity: %d discrepancies acknowledged (note: %q)\n", len(state.Discrepancies), req.Note)
+
+	respondJSON(w, http.StatusOK, acked)
+}
+
+// rejectIfIntegrityHeld responds 503 to writes held after a failed
+// integrity check
+func (n *DHTNode) rejectIfIntegrityHeld(w http.ResponseWriter) bool {
+	state := n.integrity.Load()
+	if state == nil || !state.WritesHeld {
+		return false
+	}
+
+	respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeUnavailable, "Writes are held until the startup integrity check is acknowledged", map[string]interface{}{
+		"discrepancies": state.Discrepancies,
+	})
+	return true
+}
@@ -3,26 +3,87 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"dht/internal/backup"
+	"dht/internal/buildinfo"
+	"dht/internal/deadline"
+	"dht/internal/httpx"
+	"dht/internal/middleware"
+	"dht/internal/models"
+	"dht/internal/requestid"
 	"dht/internal/storage"
 )
 
 type DHTNode struct {
-	storage *storage.Storage
-	wal     *storage.WAL
-	port    string
-	nodeID  string
+	storage      *storage.Storage
+	wal          *storage.WAL
+	port         string
+	nodeID       string
+	dataDir      string
+	snapshotPath string
+
+	// Destinations /admin/backup may write to
+	backupPolicy backup.DestinationPolicy
+
+	// Serializes local snapshot writes with WAL compaction, which keeps the
+	// deletes the snapshot still needs
+	snapshotMu     sync.Mutex
+	lastCompaction atomic.Pointer[walCompaction]
+
+	// Secondary indexes on JSON fields, maintained on every write
+	indexes *storage.Indexes
+
+	// Serializes writes so read-modify-write operations (PATCH) see a stable value
+	writeMu sync.Mutex
+
+	// Multi-key transactions: prepared intents and outcomes live in storage;
+	// txnClient asks a transaction's decision node how it ended
+	txnTimeout time.Duration
+	txnClient  *httpx.Client
+
+	// Set while client writes are paused cluster-wide (nil = accepting writes)
+	freeze atomic.Pointer[writeFreeze]
+
+	// Warm standby state
+	standby      atomic.Bool
+	primaryURL   string
+	stopStandby  context.CancelFunc
+	streamClient *httpx.Client
+
+	// Closed when the server starts shutting down (ends long-lived streams)
+	shutdown chan struct{}
+
+	// Startup recovery state; traffic is refused until ready
+	ready           atomic.Bool
+	restoreProgress *storage.RestoreProgress
+
+	// Startup integrity check; with integrityStrict, failing it holds
+	// writes until acknowledged
+	integrity       atomic.Pointer[integrityState]
+	integrityStrict bool
+
+	// Reported with the build in /health and /version
+	configFingerprint string
 }
 
 func main() {
+	restoreFrom := flag.String("restore-from", os.Getenv("RESTORE_FROM"), "restore node state from a backup URI before serving")
+	flag.Parse()
+
 	// Get configuration from environment
 	port := os.Getenv("DHTNODE_PORT")
 	if port == "" {
@@ -37,9 +98,53 @@ func main() {
 	// Initialize storage
 	store := storage.NewStorage()
 
+	// Optionally store identical values once, shared by content hash
+	if dedup, _ := strconv.ParseBool(os.Getenv("DEDUP_ENABLED")); dedup {
+		minSize := 64
+		if size, err := strconv.Atoi(os.Getenv("DEDUP_MIN_SIZE")); err == nil && size > 0 {
+			minSize = size
+		}
+		store.EnableDedup(minSize)
+		log.Printf("Content-addressed deduplication enabled (values >= %d bytes)\n", minSize)
+	}
+
+	// Sampled per-key access statistics (ACCESS_STATS_SAMPLE_RATE=0 disables them)
+	sampleRate := 10
+	if rate, err := strconv.Atoi(os.Getenv("ACCESS_STATS_SAMPLE_RATE")); err == nil && rate >= 0 {
+		sampleRate = rate
+	}
+	if sampleRate > 0 {
+		maxKeys := 100000
+		if max, err := strconv.Atoi(os.Getenv("ACCESS_STATS_MAX_KEYS")); err == nil && max > 0 {
+			maxKeys = max
+		}
+		store.EnableAccessStats(sampleRate, maxKeys)
+	}
+
+	// Optionally extend fixed TTLs by a random share so bulk fills do not expire together
+	if jitter, err := strconv.ParseFloat(os.Getenv("TTL_JITTER"), 64); err == nil && jitter > 0 {
+		maxJitter := durationEnv("TTL_JITTER_MAX", time.Hour)
+		store.EnableTTLJitter(jitter, maxJitter)
+		log.Printf("TTL jitter enabled (up to %.0f%% of the TTL, at most %v)\n", jitter*100, maxJitter)
+	}
+
 	// Initialize WAL
-	walPath := fmt.Sprintf("data/%s-wal.log", nodeID)
-	os.MkdirAll("data", 0755)
+	dataDir := "data"
+	walPath := fmt.Sprintf("%s/%s-wal.log", dataDir, nodeID)
+	os.MkdirAll(dataDir, 0755)
+
+	// Optionally spill cold values to disk once memory passes a watermark
+	// (TIER_MEMORY_WATERMARK=0 keeps everything in memory)
+	if watermark, err := strconv.ParseInt(os.Getenv("TIER_MEMORY_WATERMARK"), 10, 64); err == nil && watermark > 0 {
+		minSize := 256
+		if size, err := strconv.Atoi(os.Getenv("TIER_MIN_SIZE")); err == nil && size > 0 {
+			minSize = size
+		}
+		if err := store.EnableTiering(fmt.Sprintf("%s/%s-cold", dataDir, nodeID), watermark, minSize); err != nil {
+			log.Fatalf("Failed to initialize disk tier: %v\n", err)
+		}
+		log.Printf("Disk tier enabled (memory watermark %d bytes, values >= %d bytes)\n", watermark, minSize)
+	}
 
 	wal, err := storage.NewWAL(walPath)
 	if err != nil {
@@ -47,36 +152,109 @@ func main() {
 	}
 	defer wal.Close()
 
-	// Restore from WAL
-	if err := wal.Restore(store); err != nil {
-		log.Printf("Warning: Failed to restore from WAL: %v\n", err)
+	indexes, err := storage.NewIndexes(fmt.Sprintf("%s/%s-indexes.json", dataDir, nodeID))
+	if err != nil {
+		log.Fatalf("Failed to load index definitions: %v\n", err)
 	}
 
 	node := &DHTNode{
-		storage: store,
-		wal:     wal,
-		port:    port,
-		nodeID:  nodeID,
+		storage:      store,
+		wal:          wal,
+		indexes:      indexes,
+		port:         port,
+		nodeID:       nodeID,
+		dataDir:      dataDir,
+		snapshotPath: fmt.Sprintf("%s/%s-snapshot.gob", dataDir, nodeID),
+		shutdown:     make(chan struct{}),
+		txnTimeout:   30 * time.Second,
+		txnClient:    httpx.New(httpx.Config{Timeout: 5 * time.Second}),
+
+		restoreProgress: &storage.RestoreProgress{},
+
+		configFingerprint: configFingerprint(),
+	}
+
+	if timeout, err := time.ParseDuration(os.Getenv("TXN_INTENT_TIMEOUT")); err == nil && timeout > 0 {
+		node.txnTimeout = timeout
+	}
+	node.integrityStrict, _ = strconv.ParseBool(os.Getenv("INTEGRITY_STRICT"))
+
+	// Backups may only be written below the operator's root and base URLs
+	node.backupPolicy.Root = os.Getenv("BACKUP_ROOT")
+	if node.backupPolicy.Root != "" && !filepath.IsAbs(node.backupPolicy.Root) {
+		log.Fatalf("BACKUP_ROOT must be an absolute path\n")
+	}
+	for _, base := range strings.Split(os.Getenv("BACKUP_URLS"), ",") {
+		if base = strings.TrimSpace(base); base != "" {
+			node.backupPolicy.URLs = append(node.backupPolicy.URLs, base)
+		}
+	}
+
+	restoreWorkers := runtime.NumCPU()
+	if workers, err := strconv.Atoi(os.Getenv("RESTORE_WORKERS")); err == nil && workers > 0 {
+		restoreWorkers = workers
 	}
 
 	// Setup HTTP server (we'll use HTTP instead of gRPC for simplicity)
 	mux := http.NewServeMux()
 	mux.HandleFunc("PUT /store/{key}", node.handlePut)
 	mux.HandleFunc("GET /store/{key}", node.handleGet)
+	mux.HandleFunc("GET /store/{key}/stats", node.handleKeyStats)
+	mux.HandleFunc("GET /store/{key}/meta", node.handleKeyMeta)
 	mux.HandleFunc("DELETE /store/{key}", node.handleDelete)
+	mux.HandleFunc("PATCH /store/{key}", node.handlePatch)
 	mux.HandleFunc("GET /metrics", node.handleMetrics)
 	mux.HandleFunc("GET /health", node.handleHealth)
+	mux.HandleFunc("GET /version", buildinfo.Handler("dhtnode", node.configFingerprint))
+	mux.HandleFunc("GET /ready", node.handleReady)
 	mux.HandleFunc("GET /store", node.handleListKeys)
+	mux.HandleFunc("GET /scan", node.handleScan)
+	mux.HandleFunc("POST /admin/snapshot", node.handleSnapshot)
+	mux.HandleFunc("POST /admin/compact", node.handleCompact)
+	mux.HandleFunc("GET /admin/integrity", node.handleIntegrity)
+	mux.HandleFunc("POST /admin/integrity/ack", node.handleIntegrityAck)
+	mux.HandleFunc("POST /admin/backup", node.handleBackup)
+	mux.HandleFunc("POST /admin/promote", node.handlePromote)
+	mux.HandleFunc("GET /wal/stream", node.handleWALStream)
+	mux.HandleFunc("GET /wal/snapshot", node.handleWALSnapshot)
+	mux.HandleFunc("GET /admin/indexes", node.handleListIndexes)
+	mux.HandleFunc("PUT /admin/indexes/{field}", node.handleCreateIndex)
+	mux.HandleFunc("DELETE /admin/indexes/{field}", node.handleDropIndex)
+	mux.HandleFunc("GET /index/{field}", node.handleIndexQuery)
+	mux.HandleFunc("POST /txn/{id}/prepare", node.handleTxnPrepare)
+	mux.HandleFunc("POST /txn/{id}/commit", node.handleTxnCommit)
+	mux.HandleFunc("POST /txn/{id}/abort", node.handleTxnAbort)
+	mux.HandleFunc("POST /txn/{id}/resolve", node.handleTxnResolve)
+	mux.HandleFunc("GET /admin/txns", node.handleListTxns)
+	mux.HandleFunc("GET /admin/hotkeys", node.handleHotKeys)
+	mux.HandleFunc("GET /admin/freeze", node.handleFreezeStatus)
+	mux.HandleFunc("POST /admin/freeze", node.handleFreeze)
+	mux.HandleFunc("POST /admin/unfreeze", node.handleUnfreeze)
+	mux.HandleFunc("POST /admin/rebalance", node.handleRebalance)
+	mux.HandleFunc("POST /admin/copy", node.handleCopy)
+	mux.HandleFunc("POST /admin/catchup", node.handleCatchUp)
+	mux.HandleFunc("POST /sync/digest", node.handleSyncDigest)
+	mux.HandleFunc("POST /sync/entries", node.handleSyncEntries)
+	mux.HandleFunc("POST /admin/usage", node.handleUsage)
+	mux.HandleFunc("GET /admin/namespaces", node.handleNamespaces)
+	mux.HandleFunc("GET /admin/keyspace", node.handleKeyspace)
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%s", port),
-		Handler:      LoggingMiddleware(mux),
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Handler:      requestid.Middleware(deadline.Middleware(middleware.Logging(node.ReadinessMiddleware(mux)))),
+		ReadTimeout:  durationEnv("SERVER_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout: durationEnv("SERVER_WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:  durationEnv("SERVER_IDLE_TIMEOUT", 60*time.Second),
+	}
+	// Gateways and replicators multiplex their calls over h2c
+	maxStreams := 250
+	if streams, err := strconv.Atoi(os.Getenv("HTTP2_MAX_CONCURRENT_STREAMS")); err == nil && streams > 0 {
+		maxStreams = streams
 	}
+	httpx.AcceptH2C(srv, maxStreams)
+	srv.RegisterOnShutdown(func() { close(node.shutdown) })
 
-	// Start server
+	// Start server (health and progress are served while recovering)
 	go func() {
 		log.Printf("DHT Node %s starting on port %s\n", nodeID, port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -84,6 +262,45 @@ func main() {
 		}
 	}()
 
+	// Recover state, then start accepting traffic
+	go func() {
+		node.recoverState(*restoreFrom, restoreWorkers)
+
+		// A warm standby streams the primary's WAL and refuses writes; it is
+		// marked one before it is ready, so no write slips in between
+		var standbyCtx context.Context
+		if primary := os.Getenv("STANDBY_OF"); primary != "" {
+			var stopStandby context.CancelFunc
+			standbyCtx, stopStandby = context.WithCancel(context.Background())
+			node.primaryURL = strings.TrimRight(primary, "/")
+			node.stopStandby = stopStandby
+			// runStandby reconnects itself, so the client does not retry
+			node.streamClient = httpx.New(httpx.Config{})
+			node.standby.Store(true)
+		}
+
+		node.ready.Store(true)
+		log.Printf("DHT Node %s ready (%d keys)\n", nodeID, store.KeyCount())
+
+		// Settle transactions left prepared by a coordinator that went away
+		go node.expireTxns()
+
+		// Compact the WAL in the background when configured
+		if interval := durationEnv("WAL_COMPACT_INTERVAL", 0); interval > 0 {
+			minSize := int64(64 << 20)
+			if size, err := strconv.ParseInt(os.Getenv("WAL_COMPACT_MIN_SIZE"), 10, 64); err == nil && size >= 0 {
+				minSize = size
+			}
+			go node.compactPeriodically(interval, minSize)
+			log.Printf("WAL compaction every %v once the WAL reaches %d bytes\n", interval, minSize)
+		}
+
+		// Stream the primary's WAL when configured as a warm standby
+		if standbyCtx != nil {
+			go node.runStandby(standbyCtx)
+		}
+	}()
+
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -100,6 +317,88 @@ func main() {
 	log.Println("Server exited gracefully")
 }
 
+// recoverState loads the node's state from a backup, or from the local
+// snapshot plus WAL, logging progress periodically
+func (n *DHTNode) recoverState(restoreFrom string, workers int) {
+	if restoreFrom != "" {
+		// Replace local state with the backup, which also replaces any
+		// discrepancies found in the old state
+		if err := n.restoreFromBackup(restoreFrom); err != nil {
+			log.Fatalf("Failed to restore from backup: %v\n", err)
+		}
+		os.Remove(n.integrityPath())
+		n.checkIntegrity()
+		n.indexes.Rebuild(n.storage)
+		return
+	}
+
+	// Verify the snapshot and WAL, continuing sequence numbers after the
+	// snapshot even if the WAL was truncated when it was taken
+	if report := n.checkIntegrity(); report.Snapshot != nil {
+		n.wal.SetLastSeq(report.Snapshot.WALSeq)
+	}
+
+	// Load the latest local snapshot, then replay the WAL on top of it
+	if loaded, err := storage.LoadSnapshot(n.snapshotPath, n.storage); err == nil {
+		log.Printf("Snapshot: Loaded %d entries from %s\n", loaded, n.snapshotPath)
+	} else if !os.IsNotExist(err) {
+		log.Printf("Warning: Failed to load snapshot: %v\n", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				st := n.restoreProgress.Status()
+				log.Printf("WAL restore: %.1f%% (%d entries, %d/%d bytes), ETA %v\n",
+					st.Percent, st.EntriesApplied, st.BytesRead, st.TotalBytes,
+					(time.Duration(st.ETAMs) * time.Millisecond).Round(time.Second))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := n.wal.RestoreParallel(n.storage, workers, n.restoreProgress); err != nil {
+		log.Printf("Warning: Failed to restore from WAL: %v\n", err)
+	}
+	close(done)
+
+	n.indexes.Rebuild(n.storage)
+}
+
+// ReadinessMiddleware refuses traffic with 503 until recovery completes
+// Health, readiness and metrics endpoints stay available throughout.
+func (n *DHTNode) ReadinessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !n.ready.Load() {
+			switch r.URL.Path {
+			case "/health", "/ready", "/version", "/metrics":
+			default:
+				w.Header().Set("Retry-After", "5")
+				respondError(w, http.StatusServiceUnavailable, "Node is restoring")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleReady returns 200 once the node accepts traffic, 503 before
+func (n *DHTNode) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !n.ready.Load() {
+		respondJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"ready":   false,
+			"restore": n.restoreProgress.Status(),
+		})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"ready": true})
+}
+
 // handlePut handles PUT requests
 func (n *DHTNode) handlePut(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
@@ -108,8 +407,12 @@ func (n *DHTNode) handlePut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read value from body
-	value, err := io.ReadAll(r.Body)
+	if n.rejectIfStandby(w) || n.rejectIfIntegrityHeld(w) || n.rejectIfFrozen(w, r) {
+		return
+	}
+
+	// Read value from body; the stored entry and its WAL record share this slice
+	value, err := storage.ReadValue(r.Body, r.ContentLength)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, "Failed to read body")
 		return
@@ -125,24 +428,69 @@ func (n *DHTNode) handlePut(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Write to WAL first (write-ahead logging)
-	if err := n.wal.Append("SET", key, value, ttl); err != nil {
+	opts := storage.WriteOptions{Owner: ownerFromRequest(r)}
+	if replicas, err := strconv.Atoi(r.Header.Get("X-Replication-Factor")); err == nil && replicas > 0 {
+		opts.Replicas = replicas
+	}
+	if r.Header.Get("X-Replication") == "true" {
+		opts.SourceVersion, _ = strconv.ParseUint(r.Header.Get("X-Source-Version"), 10, 64)
+	}
+
+	// Sliding TTL: every read pushes the expiry out by the full TTL again
+	if sliding, _ := strconv.ParseBool(r.URL.Query().Get("sliding")); sliding {
+		if ttl <= 0 {
+			respondError(w, http.StatusBadRequest, "Sliding expiry requires a ttl")
+			return
+		}
+		opts.SlidingTTL = ttl
+	}
+
+	// Spread fixed expiries. Replicated and re-written keys carry the TTL
+	// their primary already settled on, so every copy expires together.
+	jitter, err := strconv.ParseBool(r.URL.Query().Get("jitter"))
+	if err != nil {
+		jitter = true
+	}
+	if jitter && opts.SlidingTTL == 0 && r.Header.Get("X-Replication") != "true" {
+		ttl = n.storage.JitterTTL(ttl)
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	if n.rejectIfLocked(w, key) || n.rejectIfPreconditionFailed(w, r, key) {
+		return
+	}
+
+	// Write to WAL first (write-ahead logging); the entry's sequence number is the new version
+	seq, err := n.wal.AppendWithOptions("SET", key, value, ttl, opts)
+	if err != nil {
 		log.Printf("WAL append failed: %v\n", err)
 		respondError(w, http.StatusInternalServerError, "Failed to write to WAL")
 		return
 	}
+	opts.Version = seq
 
 	// Then write to storage
-	if err := n.storage.Set(key, value, ttl); err != nil {
+	if err := n.storage.SetWithOptions(key, value, ttl, opts); err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to store value")
 		return
 	}
+	n.indexes.Update(opts.Owner, key, value)
+	n.storage.RecordWrite(key)
 
-	respondJSON(w, http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"success": true,
 		"key":     key,
 		"node":    n.nodeID,
-	})
+		"version": seq,
+	}
+	w.Header().Set("X-Version", strconv.FormatUint(seq, 10))
+	if entry, err := n.storage.GetEntry(key); err == nil && entry.ExpiresAt != nil {
+		w.Header().Set("X-Expires-At", entry.ExpiresAt.UTC().Format(time.RFC3339Nano))
+		response["expires_at"] = entry.ExpiresAt.UTC()
+	}
+	respondJSON(w, http.StatusOK, response)
 }
 
 // handleGet handles GET requests
@@ -153,17 +501,65 @@ func (n *DHTNode) handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	value, err := n.storage.Get(key)
+	entry, err := n.storage.GetEntry(key)
 	if err != nil {
 		respondError(w, http.StatusNotFound, "Key not found")
 		return
 	}
 
+	n.storage.RecordRead(key)
+
+	// A successful read extends a sliding TTL (standbys only apply the
+	// primary's refreshes), and the response reports the extended expiry
+	if entry.SlidingTTL > 0 && !n.standby.Load() {
+		if expiresAt, ok := n.touch(key); ok {
+			entry.ExpiresAt = &expiresAt
+		}
+	}
+
+	// Return only the selected part of a JSON document
+	if path := r.URL.Query().Get("path"); path != "" {
+		n.writeDocumentPath(w, entry, path)
+		return
+	}
+
 	// Return the raw value with appropriate content type
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("X-Node-ID", n.nodeID)
+	w.Header().Set("X-Updated-At", entry.UpdatedAt.UTC().Format(time.RFC3339Nano))
+	w.Header().Set("X-Version", strconv.FormatUint(entry.Version, 10))
+	setSourceVersion(w, entry)
+	if entry.ExpiresAt != nil {
+		w.Header().Set("X-Expires-At", entry.ExpiresAt.UTC().Format(time.RFC3339Nano))
+	}
+	if entry.SlidingTTL > 0 {
+		w.Header().Set("X-Sliding-TTL", entry.SlidingTTL.String())
+	}
 	w.WriteHeader(http.StatusOK)
-	w.Write(value)
+	w.Write(entry.Value)
+}
+
+// setSourceVersion reports the primary's version a replicated copy was
+// written from, so the gateway can tell whether it includes a given write
+func setSourceVersion(w http.ResponseWriter, entry *storage.Entry) {
+	if entry.SourceVersion > 0 {
+		w.Header().Set("X-Source-Version", strconv.FormatUint(entry.SourceVersion, 10))
+	}
+}
+
+// touch refreshes a sliding TTL and returns the new expiry, logging it when
+// it has drifted far enough from the one recoverable from the WAL
+func (n *DHTNode) touch(key string) (time.Time, bool) {
+	expiresAt, persist, ok := n.storage.Touch(key)
+	if !ok || !persist {
+		return expiresAt, ok
+	}
+
+	// The TOUCH entry records the full TTL from its timestamp
+	if err := n.wal.Append("TOUCH", key, nil, time.Until(expiresAt)); err != nil {
+		log.Printf("WAL append of TTL refresh failed: %v\n", err)
+	}
+	return expiresAt, true
 }
 
 // handleDelete handles DELETE requests
@@ -174,6 +570,30 @@ func (n *DHTNode) handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if n.rejectIfStandby(w) || n.rejectIfIntegrityHeld(w) || n.rejectIfFrozen(w, r) {
+		return
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	if n.rejectIfLocked(w, key) || n.rejectIfPreconditionFailed(w, r, key) {
+		return
+	}
+
+	// A replicated delete removes the write the primary deleted, or an older
+	// one, but never a newer write that reached this replica first
+	entry, err := n.storage.GetEntry(key)
+	if err == nil && r.Header.Get("X-Replication") == "true" {
+		deleted, _ := strconv.ParseUint(r.Header.Get("X-Source-Version"), 10, 64)
+		if deleted > 0 && entry.SourceVersion > deleted {
+			respondErrorCode(w, http.StatusPreconditionFailed, models.ErrCodeConditionFailed,
+				"Precondition failed: a newer write of the key has been replicated",
+				map[string]interface{}{"source_version": entry.SourceVersion})
+			return
+		}
+	}
+
 	// Write to WAL first
 	if err := n.wal.Append("DELETE", key, nil, 0); err != nil {
 		log.Printf("WAL append failed: %v\n", err)
@@ -181,16 +601,25 @@ func (n *DHTNode) handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Then delete from storage
-	if err := n.storage.Delete(key); err != nil {
+	// Then delete from storage, only the version checked above
+	n.indexes.Remove(key)
+	if entry == nil {
+		n.storage.Delete(key)
+		respondError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+	if err := n.storage.DeleteIfVersion(key, entry.Version); err != nil {
 		respondError(w, http.StatusNotFound, "Key not found")
 		return
 	}
 
+	// The deleted version lets replicas skip newer writes of the key
+	w.Header().Set("X-Version", strconv.FormatUint(entry.Version, 10))
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"success": true,
 		"key":     key,
 		"node":    n.nodeID,
+		"version": entry.Version,
 	})
 }
 
@@ -199,10 +628,29 @@ func (n *DHTNode) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	walSize, _ := n.wal.Size()
 
 	metrics := map[string]interface{}{
-		"node_id":   n.nodeID,
-		"key_count": n.storage.KeyCount(),
-		"wal_size":  walSize,
-		"timestamp": time.Now().Unix(),
+		"node_id":     n.nodeID,
+		"key_count":   n.storage.KeyCount(),
+		"value_bytes": n.storage.ValueBytes(),
+		"wal_size":    walSize,
+		"wal_seq":     n.wal.LastSeq(),
+		"timestamp":   time.Now().Unix(),
+	}
+	if dedup := n.storage.DedupStats(); dedup.Enabled {
+		metrics["dedup"] = dedup
+	}
+	if tiering := n.storage.TieringStats(); tiering.Enabled {
+		metrics["tiering"] = tiering
+	}
+	if state := n.integrity.Load(); state != nil {
+		metrics["integrity_ok"] = state.OK
+		metrics["integrity_discrepancies"] = len(state.Discrepancies)
+		metrics["integrity_writes_held"] = state.WritesHeld
+	}
+	if compaction := n.lastCompaction.Load(); compaction != nil {
+		metrics["wal_compaction"] = compaction
+	}
+	if fraction, max := n.storage.TTLJitter(); fraction > 0 {
+		metrics["ttl_jitter"] = map[string]interface{}{"fraction": fraction, "max": max.String()}
 	}
 
 	respondJSON(w, http.StatusOK, metrics)
@@ -210,14 +658,27 @@ func (n *DHTNode) handleMetrics(w http.ResponseWriter, r *http.Request) {
 
 // handleHealth returns health status
 func (n *DHTNode) handleHealth(w http.ResponseWriter, r *http.Request) {
-	respondJSON(w, http.StatusOK, map[string]string{
+	health := map[string]interface{}{
 		"status":  "healthy",
 		"node_id": n.nodeID,
-	})
+		"role":    "primary",
+		"restore": n.restoreProgress.Status(),
+		"build":   buildinfo.Get("dhtnode", n.configFingerprint),
+	}
+	if !n.ready.Load() {
+		health["status"] = "restoring"
+	}
+	if n.standby.Load() {
+		health["role"] = "standby"
+		health["standby_of"] = n.primaryURL
+		health["applied_seq"] = n.wal.LastSeq()
+	}
+
+	respondJSON(w, http.StatusOK, health)
 }
 
 func (n *DHTNode) handleListKeys(w http.ResponseWriter, r *http.Request) {
-	allEntries := n.storage.GetAll()
+	allEntries := n.storage.GetAllMetadata()
 
 	keys := make([]map[string]interface{}, 0)
 	for key, entry := range allEntries {
@@ -236,34 +697,101 @@ func (n *DHTNode) handleListKeys(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ownerFromRequest returns the tenant a request acts for (X-User-ID), 0 if unset
+func ownerFromRequest(r *http.Request) int64 {
+	owner, _ := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+	return owner
+}
+
+// rejectIfPreconditionFailed enforces the conditional request headers of a
+// write: If-Match requires the key's current version (or any version for
+// "*"), If-None-Match: * requires the key to be absent. Caller must hold
+// n.writeMu so the check and the write see the same version.
+func (n *DHTNode) rejectIfPreconditionFailed(w http.ResponseWriter, r *http.Request, key string) bool {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if ifMatch == "" && ifNoneMatch == "" {
+		return false
+	}
+
+	entry, err := n.storage.GetEntry(key)
+	exists := err == nil
+	var current uint64
+	if exists {
+		current = entry.Version
+	}
+
+	failed := false
+	switch {
+	case ifNoneMatch == "*":
+		failed = exists
+	case ifNoneMatch != "":
+		respondError(w, http.StatusBadRequest, "If-None-Match only supports *")
+		return true
+	}
+	switch {
+	case ifMatch == "*":
+		failed = failed || !exists
+	case ifMatch != "":
+		expected, err := strconv.ParseUint(strings.Trim(ifMatch, `"`), 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "If-Match must be a version number")
+			return true
+		}
+		failed = failed || !exists || current != expected
+	}
+
+	if failed {
+		respondErrorCode(w, http.StatusPreconditionFailed, models.ErrCodeConditionFailed,
+			"Precondition failed: the key's version does not match",
+			map[string]interface{}{"exists": exists, "current_version": current})
+		return true
+	}
+	return false
+}
+
 // Helper functions
+
+// durationEnv returns the duration in an environment variable or a default
+func durationEnv(key string, defaultValue time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return defaultValue
+}
+
+// configFingerprint identifies the node's settings, which are all read from
+// the environment
+func configFingerprint() string {
+	settings := make(map[string]string)
+	for _, key := range []string{
+		"DHTNODE_PORT", "NODE_ID", "STANDBY_OF", "RESTORE_FROM", "RESTORE_WORKERS",
+		"DEDUP_ENABLED", "DEDUP_MIN_SIZE", "ACCESS_STATS_SAMPLE_RATE", "ACCESS_STATS_MAX_KEYS",
+		"TTL_JITTER", "TTL_JITTER_MAX", "TIER_MEMORY_WATERMARK", "TIER_MIN_SIZE", "TXN_INTENT_TIMEOUT",
+		"WAL_COMPACT_INTERVAL", "WAL_COMPACT_MIN_SIZE", "INTEGRITY_STRICT", "BACKUP_ROOT", "BACKUP_URLS",
+		"SERVER_READ_TIMEOUT", "SERVER_WRITE_TIMEOUT", "SERVER_IDLE_TIMEOUT",
+		"HTTP2_MAX_CONCURRENT_STREAMS",
+	} {
+		settings[key] = os.Getenv(key)
+	}
+	return buildinfo.Fingerprint(settings)
+}
+
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(data)
 }
 
+// respondError writes the standard error body with the default code for status
 func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, map[string]string{"error": message})
-}
-
-// LoggingMiddleware logs HTTP requests
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(wrapped, r)
-		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapped.statusCode, duration)
-	})
-}
-
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
+	respondErrorCode(w, status, models.CodeForStatus(status), message, nil)
 }
 
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+// respondErrorCode writes the standard error body, tagged with the request ID
+// the middleware set on the response
+func respondErrorCode(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	apiErr := models.NewAPIError(code, message, details)
+	apiErr.RequestID = w.Header().Get(requestid.Header)
+	respondJSON(w, status, models.ErrorResponse{Error: apiErr})
 }
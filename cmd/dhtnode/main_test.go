@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dht/internal/delta"
+	"dht/internal/httpx"
+	"dht/internal/storage"
+)
+
+// newTestNode returns a ready node keeping its WAL, snapshot and index
+// definitions in a temporary directory
+func newTestNode(tb testing.TB) *DHTNode {
+	tb.Helper()
+	dir := tb.TempDir()
+
+	wal, err := storage.NewWAL(filepath.Join(dir, "node-test-wal.log"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { wal.Close() })
+	indexes, err := storage.NewIndexes(filepath.Join(dir, "node-test-indexes.json"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	node := &DHTNode{
+		storage:      storage.NewStorage(),
+		wal:          wal,
+		indexes:      indexes,
+		nodeID:       "node-test",
+		dataDir:      dir,
+		snapshotPath: filepath.Join(dir, "node-test-snapshot.gob"),
+		shutdown:     make(chan struct{}),
+		txnTimeout:   30 * time.Second,
+		txnClient:    httpx.New(httpx.Config{}),
+
+		restoreProgress: &storage.RestoreProgress{},
+	}
+	node.ready.Store(true)
+	return node
+}
+
+// serve runs one request through handler, filling in the {key} path value
+func serve(handler http.HandlerFunc, method, key string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, "http://node/store/"+key, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	r.SetPathValue("key", key)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// BenchmarkPut measures PUT /store/{key}: reading the value, the WAL append
+// and the store, as listed under "Value Buffers" in the README
+func BenchmarkPut(b *testing.B) {
+	for _, size := range []int{1 << 10, 16 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			node := newTestNode(b)
+			value := bytes.Repeat([]byte("v"), size)
+			header := http.Header{"X-User-Id": {"1"}}
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := serve(node.handlePut, "PUT", fmt.Sprintf("key-%d", i%1024), value, header)
+				if w.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPatch measures a delta PATCH overwriting a few bytes of a stored
+// value, whose delta body is read into a pooled buffer
+func BenchmarkPatch(b *testing.B) {
+	for _, size := range []int{1 << 10, 16 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			node := newTestNode(b)
+			header := http.Header{"X-User-Id": {"1"}}
+			w := serve(node.handlePut, "PUT", "value", bytes.Repeat([]byte("v"), size), header)
+			if w.Code != http.StatusOK {
+				b.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			version := w.Header().Get("X-Version")
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				patch := delta.New().Write(size/2, []byte(fmt.Sprintf("%08d", i%1e8))).Bytes()
+				patchHeader := http.Header{"X-User-Id": {"1"}, "Content-Type": {delta.ContentType}, "If-Match": {version}}
+				w := serve(node.handlePatch, "PATCH", "value", patch, patchHeader)
+				if w.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				version = w.Header().Get("X-Version")
+			}
+		})
+	}
+}
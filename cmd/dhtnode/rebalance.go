@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"dht/internal/hashring"
+	"dht/internal/httpx"
+	"dht/internal/storage"
+)
+
+// rebalanceRequest describes a ring change; self is this node's URL as the
+// ring knows it
+type rebalanceRequest struct {
+	Self     string   `json:"self"`
+	Previous []string `json:"previous"`
+	Ring     []string `json:"ring"`
+	Replicas int      `json:"replicas"` // Replication factor of keys without their own
+
+	// Replaced maps nodes that left the ring to the replacements that hold
+	// their keys (see the gateway's node rollouts)
+	Replaced map[string]string `json:"replaced,omitempty"`
+}
+
+// handleRebalance copies local keys to the nodes that gained them in a ring
+// change. For each key, only the first node of its old placement that is
+// still in the ring pushes it, so every copy is sent once and comes from a
+// node that held the key all along. A replaced node's place in the old
+// placement is taken by its replacement.
+func (n *DHTNode) handleRebalance(w http.ResponseWriter, r *http.Request) {
+	var req rebalanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Self == "" || len(req.Ring) == 0 {
+		respondError(w, http.StatusBadRequest, "self and ring are required")
+		return
+	}
+	if req.Replicas <= 0 {
+		req.Replicas = 3
+	}
+
+	oldRing := hashring.NewHashRing(req.Previous)
+	newRing := hashring.NewHashRing(req.Ring)
+	// Pushes are whole-value replica writes, safe to send twice
+	client := httpx.New(httpx.Config{
+		Timeout:           10 * time.Second,
+		MaxRetries:        2,
+		IdempotentMethods: []string{"PUT"},
+	})
+
+	start := time.Now()
+	scanned, copied, failed := 0, 0, 0
+	for key, entry := range n.storage.GetAll() {
+		scanned++
+
+		// Keys written with their own replication factor keep it
+		replicas := req.Replicas
+		if entry.Replicas > 0 {
+			replicas = entry.Replicas
+		}
+
+		oldNodes := oldRing.LocateKey(key, replicas)
+		for i, node := range oldNodes {
+			if replacement, exists := req.Replaced[node]; exists {
+				oldNodes[i] = replacement
+			}
+		}
+		pusher := ""
+		for _, node := range oldNodes {
+			if newRing.HasNode(node) {
+				pusher = node
+				break
+			}
+		}
+		if pusher != req.Self {
+			continue
+		}
+
+		for _, target := range newRing.LocateKey(key, replicas) {
+			if target == req.Self || contains(oldNodes, target) {
+				continue
+			}
+			if err := pushEntry(client, target, entry, false); err != nil {
+				log.Printf("Rebalance: copying %s to %s failed: %v\n", key, target, err)
+				failed++
+				continue
+			}
+			copied++
+		}
+	}
+
+	log.Printf("Rebalance: scanned=%d copied=%d failed=%d in %v\n", scanned, copied, failed, time.Since(start))
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"node":        n.nodeID,
+		"scanned":     scanned,
+		"copied":      copied,
+		"failed":      failed,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
+
+// handleCopy copies every local key to a target node that does not have it
+// yet, to fill a node taking over from this one. Keys the target already
+// holds were written there since, so they are left alone.
+func (n *DHTNode) handleCopy(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Target == "" {
+		respondError(w, http.StatusBadRequest, "target is required")
+		return
+	}
+
+	client := httpx.New(httpx.Config{
+		Timeout:           10 * time.Second,
+		MaxRetries:        2,
+		IdempotentMethods: []string{"PUT"},
+	})
+
+	start := time.Now()
+	scanned, copied, skipped, failed := 0, 0, 0, 0
+	for key := range n.storage.GetAllMetadata() {
+		scanned++
+
+		// Deleted while copying
+		entry, err := n.storage.GetEntry(key)
+		if err != nil {
+			continue
+		}
+
+		err = pushEntry(client, req.Target, entry, true)
+		switch {
+		case errors.Is(err, errAlreadyPresent):
+			skipped++
+		case err != nil:
+			log.Printf("Copy: copying %s to %s failed: %v\n", key, req.Target, err)
+			failed++
+		default:
+			copied++
+		}
+	}
+
+	log.Printf("Copy to %s: scanned=%d copied=%d skipped=%d failed=%d in %v\n", req.Target, scanned, copied, skipped, failed, time.Since(start))
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"node":        n.nodeID,
+		"target":      req.Target,
+		"scanned":     scanned,
+		"copied":      copied,
+		"skipped":     skipped,
+		"failed":      failed,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
+
+// errAlreadyPresent means an if-absent push found the key on the target
+var errAlreadyPresent = errors.New("key already present on target")
+
+// pushEntry writes entry to nodeURL as a replicated write, keeping its owner
+// and remaining TTL. With ifAbsent, a key the target already has is left
+// alone and errAlreadyPresent returned.
+func pushEntry(client *httpx.Client, nodeURL string, entry *storage.Entry, ifAbsent bool) error {
+	reqURL := fmt.Sprintf("%s/store/%s", nodeURL, url.PathEscape(entry.Key))
+	switch {
+	case entry.SlidingTTL > 0:
+		reqURL += "?ttl=" + entry.SlidingTTL.String() + "&sliding=true"
+	case entry.ExpiresAt != nil:
+		remaining := time.Until(*entry.ExpiresAt)
+		if remaining <= 0 {
+			return nil
+		}
+		reqURL += "?ttl=" + remaining.String()
+	}
+
+	req, err := http.NewRequest("PUT", reqURL, bytes.NewReader(entry.Value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Replication", "true")
+	req.Header.Set("X-User-ID", fmt.Sprintf("%d", entry.Owner))
+	if entry.Replicas > 0 {
+		req.Header.Set("X-Replication-Factor", strconv.Itoa(entry.Replicas))
+	}
+	if ifAbsent {
+		req.Header.Set("If-None-Match", "*")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if ifAbsent && resp.StatusCode == http.StatusPreconditionFailed {
+		return errAlreadyPresent
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
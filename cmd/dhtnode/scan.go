@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// globToRegexp translates a key glob into an anchored regular expression
+// * matches any run of characters (including ':' and '/'), ? matches one
+// character, and [...] character classes are passed through.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// handleScan returns keys matching ?glob= or ?regex=, sorted, starting after
+// ?after= and limited to ?limit= keys
+func (n *DHTNode) handleScan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	glob, expr := query.Get("glob"), query.Get("regex")
+	if (glob == "") == (expr == "") {
+		respondError(w, http.StatusBadRequest, "Exactly one of glob or regex is required")
+		return
+	}
+
+	var pattern *regexp.Regexp
+	var err error
+	if glob != "" {
+		pattern, err = globToRegexp(glob)
+	} else {
+		pattern, err = regexp.Compile(expr)
+	}
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid pattern: "+err.Error())
+		return
+	}
+
+	limit := defaultScanLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxScanLimit {
+			respondError(w, http.StatusBadRequest, "Invalid limit. Must be between 1 and 1000")
+			return
+		}
+	}
+	after := query.Get("after")
+
+	matches := make([]string, 0)
+	for key := range n.storage.GetAllMetadata() {
+		if key > after && pattern.MatchString(key) {
+			matches = append(matches, key)
+		}
+	}
+	sort.Strings(matches)
+
+	hasMore := len(matches) > limit
+	if hasMore {
+		matches = matches[:limit]
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"keys":     matches,
+		"count":    len(matches),
+		"has_more": hasMore,
+		"node":     n.nodeID,
+	})
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dht/internal/storage"
+)
+
+const (
+	// heartbeatInterval is how often an idle WAL stream sends a heartbeat
+	heartbeatInterval = 5 * time.Second
+	// streamIdleTimeout is how long a standby waits without data before reconnecting
+	streamIdleTimeout = 3 * heartbeatInterval
+)
+
+// errResyncRequired means the primary no longer has the WAL entries a
+// standby needs and the standby must bootstrap from a snapshot
+var errResyncRequired = errors.New("primary WAL does not cover requested sequence")
+
+// handleWALStream streams WAL entries with Seq > from as newline-delimited JSON,
+// first from the WAL file and then live as they are appended
+func (n *DHTNode) handleWALStream(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid from sequence")
+		return
+	}
+
+	// Subscribe before reading the file so no entry falls in between
+	live, cancel := n.wal.Subscribe()
+	defer cancel()
+
+	// Collect the backlog, checking the WAL still covers from+1
+	var backlog []*storage.WALEntry
+	n.wal.ReadEntries(func(entry *storage.WALEntry) error {
+		if entry.Seq > from {
+			backlog = append(backlog, entry)
+		}
+		return nil
+	})
+
+	// Compaction drops superseded writes and deletes up to the seq it covered
+	if len(backlog) > 0 && backlog[0].Seq != from+1 || len(backlog) == 0 && n.wal.LastSeq() > from ||
+		from < n.wal.CompactedThrough() {
+		respondError(w, http.StatusConflict, "Requested sequence is no longer in the WAL; bootstrap from snapshot")
+		return
+	}
+
+	// Streams are long-lived, so lift the server write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	lastSent := from
+
+	send := func(entry *storage.WALEntry) bool {
+		if err := encoder.Encode(entry); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	for _, entry := range backlog {
+		if !send(entry) {
+			return
+		}
+		lastSent = entry.Seq
+	}
+	rc.Flush()
+
+	log.Printf("WAL stream: standby %s caught up to seq=%d\n", r.RemoteAddr, lastSent)
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case entry, ok := <-live:
+			if !ok {
+				// Subscriber fell behind; the standby reconnects from its last seq
+				log.Printf("WAL stream: standby %s fell behind at seq=%d\n", r.RemoteAddr, lastSent)
+				return
+			}
+			if entry.Seq <= lastSent {
+				continue
+			}
+			if !send(entry) {
+				return
+			}
+			lastSent = entry.Seq
+		case <-heartbeat.C:
+			if !send(&storage.WALEntry{Seq: lastSent, Operation: "HEARTBEAT", Timestamp: time.Now()}) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-n.shutdown:
+			return
+		}
+	}
+}
+
+// handleWALSnapshot streams a full snapshot for standby bootstrap
+// X-WAL-Seq is read before the snapshot is taken, so replaying the WAL from
+// that sequence on top of the snapshot converges to the primary's state.
+func (n *DHTNode) handleWALSnapshot(w http.ResponseWriter, r *http.Request) {
+	seq := n.wal.LastSeq()
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-WAL-Seq", strconv.FormatUint(seq, 10))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := storage.EncodeSnapshot(n.storage, w); err != nil {
+		log.Printf("WAL snapshot stream failed: %v\n", err)
+	}
+}
+
+// runStandby keeps the node in sync with its primary until ctx is cancelled
+func (n *DHTNode) runStandby(ctx context.Context) {
+	log.Printf("Running as warm standby of %s\n", n.primaryURL)
+
+	backoff := time.Second
+	needBootstrap := n.wal.LastSeq() == 0
+
+	for ctx.Err() == nil {
+		var err error
+		if needBootstrap {
+			err = n.bootstrapFromPrimary(ctx)
+			if err == nil {
+				needBootstrap = false
+			}
+		} else {
+			err = n.streamFromPrimary(ctx)
+			if errors.Is(err, errResyncRequired) {
+				needBootstrap = true
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Standby: %v (retrying in %v)\n", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+// bootstrapFromPrimary replaces local state with a snapshot of the primary
+func (n *DHTNode) bootstrapFromPrimary(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", n.primaryURL+"/wal/snapshot", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.streamClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("snapshot request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot request failed with status %d", resp.StatusCode)
+	}
+
+	seq, err := strconv.ParseUint(resp.Header.Get("X-WAL-Seq"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid X-WAL-Seq header: %w", err)
+	}
+
+	n.storage.Clear()
+	loaded, err := storage.ReadSnapshot(resp.Body, n.storage)
+	if err != nil {
+		return fmt.Errorf("failed to load primary snapshot: %w", err)
+	}
+	n.indexes.Rebuild(n.storage)
+
+	// Persist the bootstrapped state locally and restart the WAL from seq
+	n.wal.SetLastSeq(seq)
+	if _, err := n.writeSnapshot(); err != nil {
+		return err
+	}
+	if err := n.wal.Truncate(); err != nil {
+		return err
+	}
+
+	log.Printf("Standby: bootstrapped %d entries from %s at seq=%d\n", loaded, n.primaryURL, seq)
+	return nil
+}
+
+// streamFromPrimary applies the primary's WAL stream until it ends
+func (n *DHTNode) streamFromPrimary(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	from := n.wal.LastSeq()
+	reqURL := fmt.Sprintf("%s/wal/stream?from=%d", n.primaryURL, from)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.streamClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("stream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return errResyncRequired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stream request failed with status %d", resp.StatusCode)
+	}
+
+	log.Printf("Standby: streaming WAL from %s (seq>%d)\n", n.primaryURL, from)
+
+	// Reconnect if the primary goes quiet (no entries and no heartbeats)
+	watchdog := time.AfterFunc(streamIdleTimeout, cancel)
+	defer watchdog.Stop()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		watchdog.Reset(streamIdleTimeout)
+
+		var entry storage.WALEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("invalid stream entry: %w", err)
+		}
+		if entry.Operation == "HEARTBEAT" {
+			continue
+		}
+		if err := n.applyStreamedEntry(&entry); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("stream interrupted: %w", err)
+	}
+	return fmt.Errorf("stream closed by primary")
+}
+
+// applyStreamedEntry writes a primary WAL entry to the local WAL and storage
+func (n *DHTNode) applyStreamedEntry(entry *storage.WALEntry) error {
+	if entry.Seq <= n.wal.LastSeq() {
+		return nil
+	}
+
+	if err := n.wal.AppendEntry(entry); err != nil {
+		return fmt.Errorf("failed to append streamed entry: %w", err)
+	}
+
+	// Keep the primary's expiry rather than restarting the TTL
+	storage.ApplyWALEntry(n.storage, entry)
+
+	writes := []*storage.WALEntry{entry}
+	if entry.Operation == "COMMIT" {
+		writes, _ = entry.TxnWrites()
+	}
+	for _, write := range writes {
+		switch write.Operation {
+		case "SET":
+			n.indexes.Update(write.Owner, write.Key, write.Value)
+		case "DELETE":
+			n.indexes.Remove(write.Key)
+		}
+	}
+	return nil
+}
+
+// handlePromote turns a warm standby into a primary that accepts writes
+func (n *DHTNode) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if !n.standby.Load() {
+		respondError(w, http.StatusConflict, "Node is not a standby")
+		return
+	}
+
+	n.stopStandby()
+	n.standby.Store(false)
+
+	log.Printf("Promoted to primary at seq=%d (was standby of %s)\n", n.wal.LastSeq(), n.primaryURL)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"node":    n.nodeID,
+		"role":    "primary",
+		"seq":     n.wal.LastSeq(),
+	})
+}
+
+// rejectIfStandby responds 503 to client writes while the node is a standby
+func (n *DHTNode) rejectIfStandby(w http.ResponseWriter) bool {
+	if n.standby.Load() {
+		respondError(w, http.StatusServiceUnavailable, "Node is a warm standby; promote it before writing")
+		return true
+	}
+	return false
+}
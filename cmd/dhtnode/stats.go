@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+)
+
+// handleKeyStats returns the sampled access statistics of a key
+func (n *DHTNode) handleKeyStats(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	rate := n.storage.AccessSampleRate()
+	if rate == 0 {
+		respondError(w, http.StatusNotFound, "Access statistics are disabled")
+		return
+	}
+
+	if !n.storage.Exists(key) {
+		respondError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	stats, _ := n.storage.AccessStats(key)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"key":         key,
+		"reads":       stats.Reads,
+		"writes":      stats.Writes,
+		"last_read":   stats.LastRead,
+		"last_write":  stats.LastWrite,
+		"sample_rate": rate,
+		"node":        n.nodeID,
+	})
+}
+
+// handleKeyMeta describes this node's copy of a key without returning the
+// value or counting as a read, so replicas can be compared
+func (n *DHTNode) handleKeyMeta(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	entry, err := n.storage.GetEntry(key)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	sum := sha256.Sum256(entry.Value)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"key":            key,
+		"version":        entry.Version,
+		"source_version": entry.SourceVersion,
+		"updated_at":     entry.UpdatedAt,
+		"expires_at":     entry.ExpiresAt,
+		"size":           len(entry.Value),
+		"checksum":       hex.EncodeToString(sum[:]),
+		"replicas":       entry.Replicas,
+		"node":           n.nodeID,
+	})
+}
+
+// handleHotKeys lists the most accessed keys of the requesting tenant
+func (n *DHTNode) handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	rate := n.storage.AccessSampleRate()
+	if rate == 0 {
+		respondError(w, http.StatusNotFound, "Access statistics are disabled")
+		return
+	}
+
+	limit := 10
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			respondError(w, http.StatusBadRequest, "Invalid limit. Must be between 1 and 1000")
+			return
+		}
+		limit = parsed
+	}
+
+	by := r.URL.Query().Get("by")
+	switch by {
+	case "":
+		by = "total"
+	case "reads", "writes", "total":
+	default:
+		respondError(w, http.StatusBadRequest, "Invalid by. Must be 'reads', 'writes' or 'total'")
+		return
+	}
+
+	keys := n.storage.TopKeys(ownerFromRequest(r), by, limit)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"keys":        keys,
+		"count":       len(keys),
+		"by":          by,
+		"sample_rate": rate,
+		"node":        n.nodeID,
+	})
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"dht/internal/models"
+	"dht/internal/proto"
+	"dht/internal/storage"
+)
+
+// txnResolveInterval is how often a participant asks the decision node about
+// a transaction it holds past the intent timeout
+const txnResolveInterval = 5 * time.Second
+
+// errTxnCommitted is returned when aborting a transaction that committed
+var errTxnCommitted = errors.New("transaction already committed")
+
+// handleTxnPrepare checks a transaction's conditions on this node's keys and
+// locks them, logging the intent so it survives a restart
+func (n *DHTNode) handleTxnPrepare(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if n.rejectIfStandby(w) {
+		return
+	}
+
+	var req proto.TxnPrepare
+	if err := proto.DecodeRequest(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.Ops) == 0 {
+		respondError(w, http.StatusBadRequest, "Transaction has no operations")
+		return
+	}
+
+	seen := make(map[string]bool)
+	writes := false
+	for _, op := range req.Ops {
+		switch op.Op {
+		case "get", "put", "delete", "check":
+		default:
+			respondError(w, http.StatusBadRequest, "Invalid op "+op.Op)
+			return
+		}
+		if op.Key == "" || seen[op.Key] {
+			respondError(w, http.StatusBadRequest, "Every operation needs a distinct key")
+			return
+		}
+		seen[op.Key] = true
+		writes = writes || op.IsWrite()
+	}
+
+	// Read-only transactions are allowed while writes are frozen
+	if writes && (n.rejectIfIntegrityHeld(w) || n.rejectIfFrozen(w, r)) {
+		return
+	}
+
+	txn := &storage.PreparedTxn{
+		ID:           id,
+		Owner:        ownerFromRequest(r),
+		Ops:          req.Ops,
+		PreparedAt:   time.Now(),
+		DecisionNode: req.DecisionNode,
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	if _, done := n.storage.TxnOutcome(id); done {
+		respondError(w, http.StatusConflict, "Transaction already finished")
+		return
+	}
+
+	reads, err := n.storage.PrepareTxn(txn)
+	if err != nil {
+		code := models.ErrCodeTxnConflict
+		if errors.Is(err, storage.ErrTxnConditionFailed) {
+			code = models.ErrCodeConditionFailed
+		}
+		respondErrorCode(w, http.StatusConflict, code, err.Error(), nil)
+		return
+	}
+
+	// Log the intent so a restart keeps the keys locked until the outcome is known
+	payload, _ := storage.PrepareEntry(txn)
+	if _, err := n.wal.AppendWithOptions("PREPARE", id, payload, 0, storage.WriteOptions{Owner: txn.Owner}); err != nil {
+		n.storage.AbortTxn(id)
+		log.Printf("WAL append failed: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to write to WAL")
+		return
+	}
+
+	log.Printf("TXN %s prepared (%d ops, owner=%d)\n", id, len(req.Ops), txn.Owner)
+
+	proto.Respond(w, r, http.StatusOK, &proto.TxnPrepared{
+		Success: true,
+		TxnID:   id,
+		Node:    n.nodeID,
+		Reads:   reads,
+	})
+}
+
+// handleTxnCommit applies a prepared transaction's writes as one WAL entry
+func (n *DHTNode) handleTxnCommit(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if n.rejectIfStandby(w) {
+		return
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	// A retried commit is answered from the recorded outcome
+	if outcome, done := n.storage.TxnOutcome(id); done {
+		if !outcome.Committed {
+			respondError(w, http.StatusConflict, "Transaction was aborted")
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"txn_id":  id,
+			"node":    n.nodeID,
+			"version": outcome.Version,
+		})
+		return
+	}
+
+	txn, exists := n.storage.GetTxn(id)
+	if !exists {
+		respondError(w, http.StatusNotFound, "Transaction not found")
+		return
+	}
+
+	seq, err := n.commitTxn(txn)
+	if err != nil {
+		log.Printf("WAL append failed: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to write to WAL")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"txn_id":  id,
+		"node":    n.nodeID,
+		"version": seq,
+	})
+}
+
+// commitTxn logs and applies a prepared transaction's writes, returning the
+// version they got; caller must hold writeMu
+func (n *DHTNode) commitTxn(txn *storage.PreparedTxn) (uint64, error) {
+	writes := make([]storage.TxnOp, 0, len(txn.Ops))
+	for _, op := range txn.Ops {
+		if op.IsWrite() {
+			writes = append(writes, storage.TxnOp{Op: op.Op, Key: op.Key, Value: op.Value, TTL: op.TTL, Replicas: op.Replicas})
+		}
+	}
+
+	// All writes go into a single entry, so a crash applies all or none of them
+	payload, _ := json.Marshal(writes)
+	seq, err := n.wal.AppendWithOptions("COMMIT", txn.ID, payload, 0, storage.WriteOptions{Owner: txn.Owner})
+	if err != nil {
+		return 0, err
+	}
+
+	n.storage.CommitTxn(txn.ID, seq)
+	for _, op := range writes {
+		if op.Op == "put" {
+			n.indexes.Update(txn.Owner, op.Key, op.Value)
+			n.storage.RecordWrite(op.Key)
+		} else {
+			n.indexes.Remove(op.Key)
+		}
+	}
+
+	log.Printf("TXN %s committed at seq=%d (%d writes)\n", txn.ID, seq, len(writes))
+	return seq, nil
+}
+
+// handleTxnAbort releases a prepared transaction's locks; aborting an
+// unknown transaction succeeds so the coordinator can abort blindly
+func (n *DHTNode) handleTxnAbort(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if n.rejectIfStandby(w) {
+		return
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	if err := n.abortTxn(id); errors.Is(err, errTxnCommitted) {
+		respondError(w, http.StatusConflict, "Transaction already committed")
+		return
+	} else if err != nil {
+		log.Printf("WAL append failed: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to write to WAL")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"txn_id":  id,
+		"node":    n.nodeID,
+	})
+}
+
+// abortTxn logs and releases a prepared transaction. One never prepared here
+// is logged as aborted too, so a prepare arriving late is refused even after
+// a restart. Caller must hold writeMu.
+func (n *DHTNode) abortTxn(id string) error {
+	if outcome, done := n.storage.TxnOutcome(id); done {
+		if outcome.Committed {
+			return errTxnCommitted
+		}
+		return nil
+	}
+	if err := n.wal.Append("ABORT", id, nil, 0); err != nil {
+		return err
+	}
+	n.storage.AbortTxn(id)
+	return nil
+}
+
+// handleTxnResolve tells a participant how a transaction this node decides
+// ended: "committed", "aborted" or still "prepared". One never prepared here
+// cannot commit any more and is aborted on the spot. The participant passes
+// when it prepared; if that is longer ago than outcomes are kept, a missing
+// outcome may have been forgotten and the answer is "unknown".
+func (n *DHTNode) handleTxnResolve(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if n.rejectIfStandby(w) {
+		return
+	}
+
+	var preparedAt time.Time
+	if param := r.URL.Query().Get("prepared_at"); param != "" {
+		t, err := time.Parse(time.RFC3339Nano, param)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid prepared_at")
+			return
+		}
+		preparedAt = t
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	resp := map[string]interface{}{
+		"txn_id": id,
+		"node":   n.nodeID,
+		"state":  "aborted",
+	}
+	if outcome, done := n.storage.TxnOutcome(id); done {
+		if outcome.Committed {
+			resp["state"] = "committed"
+			resp["version"] = outcome.Version
+		}
+	} else if _, prepared := n.storage.GetTxn(id); prepared {
+		resp["state"] = "prepared"
+	} else if !preparedAt.IsZero() && time.Since(preparedAt) > n.txnOutcomeRetention() {
+		resp["state"] = "unknown"
+	} else if err := n.abortTxn(id); err != nil {
+		log.Printf("WAL append failed: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to write to WAL")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// handleListTxns lists prepared transactions still holding locks
+func (n *DHTNode) handleListTxns(w http.ResponseWriter, r *http.Request) {
+	txns := n.storage.PreparedTxns()
+
+	list := make([]map[string]interface{}, 0, len(txns))
+	for _, txn := range txns {
+		keys := make([]string, 0, len(txn.Ops))
+		for _, op := range txn.Ops {
+			keys = append(keys, op.Key)
+		}
+		list = append(list, map[string]interface{}{
+			"txn_id":      txn.ID,
+			"owner":       txn.Owner,
+			"keys":        keys,
+			"prepared_at": txn.PreparedAt,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"txns":  list,
+		"count": len(list),
+	})
+}
+
+// txnOutcomeRetention is how long a transaction's outcome is kept, for
+// coordinator retries and participants resolving it
+func (n *DHTNode) txnOutcomeRetention() time.Duration {
+	return 10 * n.txnTimeout
+}
+
+// expireTxns settles prepared transactions left undecided for txnTimeout, so
+// a failed gateway cannot hold keys locked forever. The decision node aborts
+// its own; the other participants ask it how the transaction ended, since it
+// may have committed there.
+func (n *DHTNode) expireTxns() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastResolve time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.shutdown:
+			return
+		}
+
+		// Standbys follow the primary's decisions
+		if n.standby.Load() || !n.ready.Load() {
+			continue
+		}
+
+		now := time.Now()
+		resolve := now.Sub(lastResolve) >= txnResolveInterval
+		n.settleTxns(now, resolve)
+		if resolve {
+			lastResolve = now
+		}
+	}
+}
+
+// settleTxns settles the transactions expired at now, asking decision nodes
+// only if resolve is set, and forgets old outcomes
+func (n *DHTNode) settleTxns(now time.Time, resolve bool) {
+	for _, txn := range n.storage.PreparedTxns() {
+		if now.Sub(txn.PreparedAt) < n.txnTimeout {
+			continue
+		}
+		if txn.DecisionNode != "" {
+			if resolve {
+				n.resolveTxn(txn)
+			}
+			continue
+		}
+		n.writeMu.Lock()
+		if err := n.abortTxn(txn.ID); errors.Is(err, errTxnCommitted) {
+			// Committed since the list was taken
+		} else if err != nil {
+			log.Printf("Failed to abort expired transaction %s: %v\n", txn.ID, err)
+		} else {
+			log.Printf("TXN %s aborted after %v without a decision\n", txn.ID, n.txnTimeout)
+		}
+		n.writeMu.Unlock()
+	}
+
+	n.storage.ForgetTxnOutcomes(now.Add(-n.txnOutcomeRetention()))
+}
+
+// resolveTxn settles an expired transaction as its decision node says it
+// ended. While that is not known the intent is kept, keys locked: the
+// transaction may have committed elsewhere, and aborting it here would apply
+// it on some nodes only.
+func (n *DHTNode) resolveTxn(txn *storage.PreparedTxn) {
+	target := fmt.Sprintf("%s/txn/%s/resolve?prepared_at=%s", txn.DecisionNode, url.PathEscape(txn.ID),
+		url.QueryEscape(txn.PreparedAt.Format(time.RFC3339Nano)))
+	var decision struct {
+		State string `json:"state"`
+	}
+	if err := postJSON(n.txnClient, target, nil, &decision); err != nil {
+		log.Printf("TXN %s in doubt, keeping its keys locked: %v\n", txn.ID, err)
+		return
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+
+	// The coordinator may have finished it meanwhile
+	if _, prepared := n.storage.GetTxn(txn.ID); !prepared {
+		return
+	}
+
+	switch decision.State {
+	case "committed":
+		if _, err := n.commitTxn(txn); err != nil {
+			log.Printf("Failed to commit transaction %s decided by %s: %v\n", txn.ID, txn.DecisionNode, err)
+		}
+	case "aborted":
+		if err := n.abortTxn(txn.ID); err != nil {
+			log.Printf("Failed to abort transaction %s decided by %s: %v\n", txn.ID, txn.DecisionNode, err)
+		} else {
+			log.Printf("TXN %s aborted as decided by %s\n", txn.ID, txn.DecisionNode)
+		}
+	default:
+		log.Printf("TXN %s in doubt, keeping its keys locked: %s reports it %s\n", txn.ID, txn.DecisionNode, decision.State)
+	}
+}
+
+// rejectIfLocked responds 409 to a write on a key held by a prepared transaction
+func (n *DHTNode) rejectIfLocked(w http.ResponseWriter, key string) bool {
+	if id, locked := n.storage.LockedBy(key); locked {
+		respondErrorCode(w, http.StatusConflict, models.ErrCodeKeyLocked, "Key is locked by pending transaction "+id, map[string]interface{}{
+			"txn_id": id,
+		})
+		return true
+	}
+	return false
+}
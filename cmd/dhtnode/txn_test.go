@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// txnRequest is one call of the two-phase commit protocol to the node
+type txnRequest struct {
+	call   string // prepare, commit, abort or put (a plain write of key "a")
+	id     string
+	ops    string // prepare: the JSON operations
+	status int
+}
+
+func TestTxnProtocol(t *testing.T) {
+	const putA = `[{"op":"put","key":"a","value":"djI="}]` // "v2"
+
+	tests := []struct {
+		name     string
+		requests []txnRequest
+		want     string // value of key "a" at the end
+	}{
+		{
+			name: "commit",
+			requests: []txnRequest{
+				{call: "prepare", id: "t1", ops: putA, status: http.StatusOK},
+				{call: "commit", id: "t1", status: http.StatusOK},
+			},
+			want: "v2",
+		},
+		{
+			name: "retried commit",
+			requests: []txnRequest{
+				{call: "prepare", id: "t1", ops: putA, status: http.StatusOK},
+				{call: "commit", id: "t1", status: http.StatusOK},
+				{call: "commit", id: "t1", status: http.StatusOK},
+				{call: "abort", id: "t1", status: http.StatusConflict},
+			},
+			want: "v2",
+		},
+		{
+			name: "abort",
+			requests: []txnRequest{
+				{call: "prepare", id: "t1", ops: putA, status: http.StatusOK},
+				{call: "abort", id: "t1", status: http.StatusOK},
+				{call: "commit", id: "t1", status: http.StatusConflict},
+				{call: "prepare", id: "t1", ops: putA, status: http.StatusConflict},
+			},
+			want: "v1",
+		},
+		{
+			name: "blind abort",
+			requests: []txnRequest{
+				{call: "abort", id: "t1", status: http.StatusOK},
+				{call: "prepare", id: "t1", ops: putA, status: http.StatusConflict},
+			},
+			want: "v1",
+		},
+		{
+			name: "commit without prepare",
+			requests: []txnRequest{
+				{call: "commit", id: "t1", status: http.StatusNotFound},
+			},
+			want: "v1",
+		},
+		{
+			name: "prepared key rejects other writers",
+			requests: []txnRequest{
+				{call: "prepare", id: "t1", ops: putA, status: http.StatusOK},
+				{call: "prepare", id: "t2", ops: putA, status: http.StatusConflict},
+				{call: "put", status: http.StatusConflict},
+				{call: "commit", id: "t1", status: http.StatusOK},
+				{call: "put", status: http.StatusOK},
+			},
+			want: "v3",
+		},
+		{
+			name: "condition fails",
+			requests: []txnRequest{
+				{call: "prepare", id: "t1", ops: `[{"op":"check","key":"a","if_version":99}]`, status: http.StatusConflict},
+				{call: "put", status: http.StatusOK},
+			},
+			want: "v3",
+		},
+		{
+			name: "duplicate keys",
+			requests: []txnRequest{
+				{call: "prepare", id: "t1", ops: `[{"op":"get","key":"a"},{"op":"delete","key":"a"}]`, status: http.StatusBadRequest},
+			},
+			want: "v1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode(t)
+			header := http.Header{"X-User-Id": {"1"}}
+			if w := serve(node.handlePut, "PUT", "a", []byte("v1"), header); w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			for i, req := range tt.requests {
+				var w *httptest.ResponseRecorder
+				switch req.call {
+				case "put":
+					w = serve(node.handlePut, "PUT", "a", []byte("v3"), header)
+				default:
+					w = txnCall(node, req.call, req.id, req.ops, "")
+				}
+				if w.Code != req.status {
+					t.Fatalf("request %d (%s %s): status %d, want %d: %s", i, req.call, req.id, w.Code, req.status, w.Body)
+				}
+			}
+
+			value, err := node.storage.Get("a")
+			if err != nil || string(value) != tt.want {
+				t.Fatalf("a = %q (%v), want %q", value, err, tt.want)
+			}
+			if txns := node.storage.PreparedTxns(); len(txns) != 0 {
+				t.Fatalf("%d transactions still prepared", len(txns))
+			}
+		})
+	}
+}
+
+// txnCall sends one call of the protocol to node; ops and decisionNode make
+// up the body of a prepare
+func txnCall(node *DHTNode, call, id, ops, decisionNode string) *httptest.ResponseRecorder {
+	handler := map[string]http.HandlerFunc{
+		"prepare": node.handleTxnPrepare,
+		"commit":  node.handleTxnCommit,
+		"abort":   node.handleTxnAbort,
+	}[call]
+	var body []byte
+	if ops != "" {
+		body, _ = json.Marshal(map[string]interface{}{"ops": json.RawMessage(ops), "decision_node": decisionNode})
+	}
+	r := httptest.NewRequest("POST", "/txn/"+id+"/"+call, bytes.NewReader(body))
+	r.SetPathValue("id", id)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-User-Id", "1")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// resolveCall asks node how transaction id ended, as a participant that
+// prepared it at preparedAt would
+func resolveCall(node *DHTNode, id string, preparedAt time.Time) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/txn/"+id+"/resolve?prepared_at="+url.QueryEscape(preparedAt.Format(time.RFC3339Nano)), nil)
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	node.handleTxnResolve(w, r)
+	return w
+}
+
+func TestTxnResolve(t *testing.T) {
+	const putA = `[{"op":"put","key":"a","value":"djI="}]`
+
+	tests := []struct {
+		name       string
+		calls      []string      // protocol calls for t1 on the decision node first
+		prepared   time.Duration // how long ago the participant prepared
+		state      string
+		version    bool
+		prepareNow int // status of a prepare of t1 afterwards
+	}{
+		{name: "committed", calls: []string{"prepare", "commit"}, state: "committed", version: true, prepareNow: http.StatusConflict},
+		{name: "aborted", calls: []string{"prepare", "abort"}, state: "aborted", prepareNow: http.StatusConflict},
+		{name: "undecided", calls: []string{"prepare"}, state: "prepared", prepareNow: http.StatusConflict},
+		{name: "never prepared is aborted for good", state: "aborted", prepareNow: http.StatusConflict},
+		{name: "committed long ago", calls: []string{"prepare", "commit"}, prepared: time.Hour, state: "committed", version: true, prepareNow: http.StatusConflict},
+		{name: "unknown outcome may have been forgotten", prepared: time.Hour, state: "unknown", prepareNow: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode(t)
+			for _, call := range tt.calls {
+				if w := txnCall(node, call, "t1", putA, ""); w.Code != http.StatusOK {
+					t.Fatalf("%s: status %d: %s", call, w.Code, w.Body)
+				}
+			}
+
+			w := resolveCall(node, "t1", time.Now().Add(-tt.prepared))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var decision struct {
+				State   string `json:"state"`
+				Version uint64 `json:"version"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &decision); err != nil {
+				t.Fatal(err)
+			}
+			if decision.State != tt.state || (decision.Version != 0) != tt.version {
+				t.Fatalf("got %s, want state %s (version reported: %t)", w.Body, tt.state, tt.version)
+			}
+
+			if w := txnCall(node, "prepare", "t1", putA, ""); w.Code != tt.prepareNow {
+				t.Fatalf("prepare afterwards: status %d, want %d: %s", w.Code, tt.prepareNow, w.Body)
+			}
+		})
+	}
+}
+
+// TestTxnExpiry checks how a participant settles a transaction it held past
+// the intent timeout: never aborting one its decision node committed
+func TestTxnExpiry(t *testing.T) {
+	const putA = `[{"op":"put","key":"a","value":"djI="}]` // "v2"
+
+	tests := []struct {
+		name     string
+		decider  []string      // protocol calls for t1 on the decision node; nil if it is the participant itself
+		down     bool          // the decision node does not answer
+		after    time.Duration // since the participant prepared
+		resolve  bool
+		prepared bool // still prepared on the participant afterwards
+		want     string
+	}{
+		{name: "committed by the decision node", decider: []string{"prepare", "commit"}, after: time.Minute, resolve: true, want: "v2"},
+		{name: "aborted by the decision node", decider: []string{"prepare", "abort"}, after: time.Minute, resolve: true, want: "v1"},
+		{name: "never prepared on the decision node", decider: []string{}, after: time.Minute, resolve: true, want: "v1"},
+		{name: "undecided on the decision node", decider: []string{"prepare"}, after: time.Minute, resolve: true, prepared: true, want: "v1"},
+		{name: "decision node down", decider: []string{"prepare", "commit"}, down: true, after: time.Minute, resolve: true, prepared: true, want: "v1"},
+		{name: "not asked between resolve intervals", decider: []string{"prepare", "commit"}, after: time.Minute, prepared: true, want: "v1"},
+		{name: "not expired yet", decider: []string{"prepare", "commit"}, after: time.Second, resolve: true, prepared: true, want: "v1"},
+		{name: "decision node itself", after: time.Minute, want: "v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decider := newTestNode(t)
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /txn/{id}/resolve", decider.handleTxnResolve)
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			for _, call := range tt.decider {
+				if w := txnCall(decider, call, "t1", `[{"op":"put","key":"b","value":"djI="}]`, ""); w.Code != http.StatusOK {
+					t.Fatalf("%s on the decision node: status %d: %s", call, w.Code, w.Body)
+				}
+			}
+			decisionNode := ""
+			if tt.decider != nil {
+				decisionNode = server.URL
+			}
+			if tt.down {
+				server.Close()
+			}
+
+			node := newTestNode(t)
+			if w := serve(node.handlePut, "PUT", "a", []byte("v1"), http.Header{"X-User-Id": {"1"}}); w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if w := txnCall(node, "prepare", "t1", putA, decisionNode); w.Code != http.StatusOK {
+				t.Fatalf("prepare: status %d: %s", w.Code, w.Body)
+			}
+
+			node.settleTxns(time.Now().Add(tt.after), tt.resolve)
+
+			if _, prepared := node.storage.GetTxn("t1"); prepared != tt.prepared {
+				t.Fatalf("prepared=%t, want %t", prepared, tt.prepared)
+			}
+			value, err := node.storage.Get("a")
+			if err != nil || string(value) != tt.want {
+				t.Fatalf("a = %q (%v), want %q", value, err, tt.want)
+			}
+			if _, locked := node.storage.LockedBy("a"); locked != tt.prepared {
+				t.Fatalf("a locked=%t, want %t", locked, tt.prepared)
+			}
+		})
+	}
+}
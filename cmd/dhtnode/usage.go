@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dht/internal/hashring"
+	"dht/internal/namespace"
+	"dht/internal/storage"
+)
+
+// usageRequest describes the ring the gateway meters against; self is this
+// node's URL as the ring knows it
+type usageRequest struct {
+	Self string   `json:"self"`
+	Ring []string `json:"ring"`
+}
+
+// handleUsage reports the storage held per tenant. Keys are counted towards
+// "owners" only on their primary, so the gateway can add up every node's
+// report without counting replicas; "stored" covers every local key.
+func (n *DHTNode) handleUsage(w http.ResponseWriter, r *http.Request) {
+	var req usageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Self == "" || len(req.Ring) == 0 {
+		respondError(w, http.StatusBadRequest, "self and ring are required")
+		return
+	}
+
+	ring := hashring.NewHashRing(req.Ring)
+	start := time.Now()
+
+	owners := n.storage.UsageByOwner(func(key string) bool {
+		return ring.GetNode(key) == req.Self
+	})
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"node":         n.nodeID,
+		"owners":       owners,
+		"stored_keys":  n.storage.KeyCount(),
+		"stored_bytes": n.storage.ValueBytes(),
+		"duration_ms":  time.Since(start).Milliseconds(),
+	})
+}
+
+// handleNamespaces reports the keys and bytes held per tenant and namespace.
+// Given the ring (?self=<url>&ring=<url>&ring=...) only the keys this node
+// is primary for are counted, so the gateway can add up every node's
+// report; otherwise every local key is. ?owner= limits it to one tenant.
+func (n *DHTNode) handleNamespaces(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	self, ringNodes := query.Get("self"), query["ring"]
+	if (self == "") != (len(ringNodes) == 0) {
+		respondError(w, http.StatusBadRequest, "self and ring must be given together")
+		return
+	}
+
+	owner := int64(-1)
+	if ownerStr := query.Get("owner"); ownerStr != "" {
+		parsed, err := strconv.ParseInt(ownerStr, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid owner")
+			return
+		}
+		owner = parsed
+	}
+
+	var include func(key string) bool
+	if self != "" {
+		ring := hashring.NewHashRing(ringNodes)
+		include = func(key string) bool { return ring.GetNode(key) == self }
+	}
+
+	usage := n.storage.UsageByNamespace(include)
+	if owner >= 0 {
+		filtered := usage[:0]
+		for _, u := range usage {
+			if u.Owner == owner {
+				filtered = append(filtered, u)
+			}
+		}
+		usage = filtered
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"node":         n.nodeID,
+		"primary_only": self != "",
+		"namespaces":   usage,
+		"count":        len(usage),
+	})
+}
+
+// handleKeyspace analyzes the shape of the stored data: value size and TTL
+// histograms, the largest keys and the keys and bytes per prefix. Like
+// handleNamespaces, given the ring only the keys this node is primary for
+// are counted.
+func (n *DHTNode) handleKeyspace(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	self, ringNodes := query.Get("self"), query["ring"]
+	if (self == "") != (len(ringNodes) == 0) {
+		respondError(w, http.StatusBadRequest, "self and ring must be given together")
+		return
+	}
+
+	opts := storage.KeyspaceOptions{
+		Top:         10,
+		Delimiter:   namespace.Separator,
+		Depth:       1,
+		MaxPrefixes: 50,
+	}
+	if ownerStr := query.Get("owner"); ownerStr != "" {
+		parsed, err := strconv.ParseInt(ownerStr, 10, 64)
+		if err != nil || parsed < 1 {
+			respondError(w, http.StatusBadRequest, "Invalid owner")
+			return
+		}
+		opts.Owner = parsed
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int
+		max  int
+	}{
+		{"top", &opts.Top, 1000},
+		{"prefixes", &opts.MaxPrefixes, 1000},
+		{"depth", &opts.Depth, 8},
+	} {
+		if str := query.Get(p.name); str != "" {
+			parsed, err := strconv.Atoi(str)
+			if err != nil || parsed < 1 || parsed > p.max {
+				respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s. Must be between 1 and %d", p.name, p.max))
+				return
+			}
+			*p.dst = parsed
+		}
+	}
+	if query.Has("delimiter") {
+		opts.Delimiter = query.Get("delimiter")
+	}
+
+	if self != "" {
+		ring := hashring.NewHashRing(ringNodes)
+		opts.Include = func(key string) bool { return ring.GetNode(key) == self }
+	}
+
+	start := time.Now()
+	stats := n.storage.AnalyzeKeyspace(opts)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"node":         n.nodeID,
+		"primary_only": self != "",
+		"keyspace":     stats,
+		"duration_ms":  time.Since(start).Milliseconds(),
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkpoint records how far a load got. Every record before Offset has
+// been written (or failed and was logged); records after it may have been
+// written too, and are written again on resume.
+type checkpoint struct {
+	Input     string    `json:"input"`
+	Format    string    `json:"format"`
+	Size      int64     `json:"size"` // of the input, which must not change between runs
+	Offset    int64     `json:"offset"`
+	Records   uint64    `json:"records"` // before Offset, over every run
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// loadCheckpoint reads the checkpoint at path, nil if there is none
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+// save writes the checkpoint to path, replacing the previous one atomically
+func (cp *checkpoint) save(path string) error {
+	cp.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// mismatch reports why cp cannot resume a load of input, empty if it can
+func (cp *checkpoint) mismatch(input, format string, size int64) string {
+	switch {
+	case cp.Input != input:
+		return fmt.Sprintf("it is for %s", cp.Input)
+	case cp.Format != format:
+		return fmt.Sprintf("it is for the %s format", cp.Format)
+	case cp.Size != size:
+		return fmt.Sprintf("the input was %d bytes then and is %d bytes now", cp.Size, size)
+	case cp.Offset > size:
+		return fmt.Sprintf("its offset %d is past the end of the input", cp.Offset)
+	}
+	return ""
+}
+
+// watermark follows the records finished out of order by the workers and
+// keeps the offset before which every record is finished
+type watermark struct {
+	mu      sync.Mutex
+	next    uint64           // seq of the oldest record not finished
+	offset  int64            // input offset up to which every record is finished
+	records uint64           // finished records before offset, over every run
+	done    map[uint64]int64 // finished records past next: seq -> end offset
+}
+
+func newWatermark(offset int64, records uint64) *watermark {
+	return &watermark{offset: offset, records: records, done: make(map[uint64]int64)}
+}
+
+// finish marks the record with the given seq and end offset finished
+func (w *watermark) finish(seq uint64, offset int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.done[seq] = offset
+	for {
+		end, ok := w.done[w.next]
+		if !ok {
+			return
+		}
+		delete(w.done, w.next)
+		w.next++
+		w.offset = end
+		w.records++
+	}
+}
+
+// position returns the offset before which every record is finished and
+// how many records that is
+func (w *watermark) position() (int64, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.offset, w.records
+}
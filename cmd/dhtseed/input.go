@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Input formats
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+	formatRedis = "redis" // redis-dump JSON lines
+)
+
+// Records that are left out without being an error
+var (
+	errExpired = errors.New("already expired")
+	errSkipped = errors.New("in another database")
+)
+
+// record is one key to load
+type record struct {
+	seq    uint64 // position in this run's input, from 0
+	start  int64  // input offset of the record's first byte
+	offset int64  // input offset just past the record
+
+	key   string
+	value []byte
+	ttl   time.Duration
+	err   error // the record could not be mapped to a key
+}
+
+// recordReader reads records from the input in order; next returns io.EOF
+// after the last one
+type recordReader interface {
+	next() (*record, error)
+}
+
+// mapping turns the fields of an input record into a key, value and TTL
+type mapping struct {
+	keyField      string
+	valueField    string
+	ttlField      string
+	expireAtField string
+
+	keyPrefix     string
+	valueEncoding string        // "raw" or "base64"
+	ttlUnit       time.Duration // of numeric TTLs
+	defaultTTL    time.Duration // for records without one
+	maxTTL        time.Duration // caps every TTL, 0 for no cap
+
+	redisDB int // only this redis-dump database, -1 for all
+}
+
+// build maps the raw fields of a record; ttl and expireAt are empty when the
+// record has none
+func (m *mapping) build(rec *record, key string, value []byte, ttl, expireAt string) *record {
+	rec.key = m.keyPrefix + key
+	if !validKey(rec.key) {
+		rec.err = fmt.Errorf("invalid key %q", rec.key)
+		return rec
+	}
+
+	if m.valueEncoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(string(value))
+		if err != nil {
+			rec.err = fmt.Errorf("key %q: invalid base64 value: %v", rec.key, err)
+			return rec
+		}
+		value = decoded
+	}
+	rec.value = value
+
+	rec.ttl, rec.err = m.mapTTL(ttl, expireAt)
+	if rec.err != nil && rec.err != errExpired {
+		rec.err = fmt.Errorf("key %q: %v", rec.key, rec.err)
+	}
+	return rec
+}
+
+// mapTTL returns the TTL of a record: the time left until expireAt if set,
+// else ttl, else the default, capped at the maximum
+func (m *mapping) mapTTL(ttl, expireAt string) (time.Duration, error) {
+	var d time.Duration
+	switch {
+	case expireAt != "":
+		at, err := parseTime(expireAt)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q", m.expireAtField, expireAt)
+		}
+		if d = time.Until(at); d <= 0 {
+			return 0, errExpired
+		}
+	case ttl != "":
+		var err error
+		if d, err = parseTTL(ttl, m.ttlUnit); err != nil {
+			return 0, fmt.Errorf("invalid %s %q", m.ttlField, ttl)
+		}
+	}
+
+	if d <= 0 {
+		d = m.defaultTTL
+	}
+	if m.maxTTL > 0 && (d <= 0 || d > m.maxTTL) {
+		d = m.maxTTL
+	}
+	return d, nil
+}
+
+// parseTTL reads a TTL given as a number of units or a Go duration. Zero
+// and negative TTLs (Redis reports -1 for keys without one) mean none.
+func parseTTL(s string, unit time.Duration) (time.Duration, error) {
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		if n <= 0 {
+			return 0, nil
+		}
+		return time.Duration(n * float64(unit)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseTime reads a Unix timestamp in seconds or an RFC 3339 time
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// validKey reports whether key can be stored and read back through the
+// gateway, which passes keys on to the nodes in URLs without escaping them
+func validKey(key string) bool {
+	if key == "" || !utf8.ValidString(key) {
+		return false
+	}
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f || strings.ContainsRune("/?#%", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// csvReader reads a CSV file whose first row names the columns
+type csvReader struct {
+	r       *csv.Reader
+	base    int64 // offset of the reader's first byte in the input
+	m       *mapping
+	columns map[string]int
+	seq     uint64
+}
+
+// newCSVReader reads the header from header, then records from body, which
+// starts at offset base of the input
+func newCSVReader(header, body io.Reader, base int64, delimiter rune, m *mapping) (*csvReader, error) {
+	hr := csv.NewReader(header)
+	hr.Comma = delimiter
+	names, err := hr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CSV header: %w", err)
+	}
+	columns := make(map[string]int, len(names))
+	for i, name := range names {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, field := range []string{m.keyField, m.valueField} {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("CSV header has no %q column", field)
+		}
+	}
+
+	cr := &csvReader{m: m, columns: columns, base: base}
+	if body == nil {
+		// Records follow the header in the same reader
+		cr.r, cr.base = hr, 0
+	} else {
+		cr.r = csv.NewReader(body)
+		cr.r.Comma = delimiter
+	}
+	cr.r.FieldsPerRecord = len(names)
+	cr.r.ReuseRecord = true
+	return cr, nil
+}
+
+// headerEnd returns the offset just past the header row
+func (cr *csvReader) headerEnd() int64 {
+	return cr.base + cr.r.InputOffset()
+}
+
+func (cr *csvReader) next() (*record, error) {
+	start := cr.base + cr.r.InputOffset()
+	fields, err := cr.r.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+	rec := &record{seq: cr.seq, start: start, offset: cr.base + cr.r.InputOffset()}
+	cr.seq++
+	if err != nil {
+		var parseErr *csv.ParseError
+		if !errors.As(err, &parseErr) {
+			return nil, err
+		}
+		rec.err = parseErr.Err
+		return rec, nil
+	}
+
+	field := func(name string) string {
+		if i, ok := cr.columns[name]; ok && name != "" {
+			return fields[i]
+		}
+		return ""
+	}
+	return cr.m.build(rec, field(cr.m.keyField), []byte(field(cr.m.valueField)), field(cr.m.ttlField), field(cr.m.expireAtField)), nil
+}
+
+// jsonlReader reads one JSON object per line; formatRedis reads the lines
+// written by redis-dump
+type jsonlReader struct {
+	r      *bufio.Reader
+	offset int64
+	redis  bool
+	m      *mapping
+	seq    uint64
+}
+
+func newJSONLReader(r io.Reader, offset int64, redis bool, m *mapping) *jsonlReader {
+	return &jsonlReader{r: bufio.NewReaderSize(r, 1<<20), offset: offset, redis: redis, m: m}
+}
+
+func (jr *jsonlReader) next() (*record, error) {
+	for {
+		data, err := jr.r.ReadBytes('\n')
+		if len(data) == 0 {
+			if err == nil {
+				continue
+			}
+			return nil, err
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		start := jr.offset
+		jr.offset += int64(len(data))
+		if data = bytes.TrimSpace(data); len(data) == 0 {
+			continue
+		}
+
+		rec := &record{seq: jr.seq, start: start, offset: jr.offset}
+		jr.seq++
+		if jr.redis {
+			return jr.redisRecord(rec, data), nil
+		}
+		return jr.jsonRecord(rec, data), nil
+	}
+}
+
+// jsonRecord maps an object of the jsonl format. A string value is stored
+// as its contents, any other value as its JSON encoding.
+func (jr *jsonlReader) jsonRecord(rec *record, data []byte) *record {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		rec.err = fmt.Errorf("invalid JSON: %v", err)
+		return rec
+	}
+
+	var key string
+	if err := json.Unmarshal(fields[jr.m.keyField], &key); err != nil || key == "" {
+		rec.err = fmt.Errorf("no string %q field", jr.m.keyField)
+		return rec
+	}
+	value, ok := jsonValue(fields[jr.m.valueField])
+	if !ok {
+		rec.err = fmt.Errorf("key %q: no %q field", key, jr.m.valueField)
+		return rec
+	}
+	return jr.m.build(rec, key, value, jsonScalar(fields[jr.m.ttlField]), jsonScalar(fields[jr.m.expireAtField]))
+}
+
+// redisRecord maps a line of redis-dump output, such as
+// {"db":0,"key":"k","ttl":-1,"type":"string","value":"v","size":1}.
+// Strings are stored as they are; hashes, lists, sets and sorted sets as
+// the JSON redis-dump gives for them.
+func (jr *jsonlReader) redisRecord(rec *record, data []byte) *record {
+	var entry struct {
+		DB    int             `json:"db"`
+		Key   string          `json:"key"`
+		TTL   json.RawMessage `json:"ttl"`
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		rec.err = fmt.Errorf("invalid JSON: %v", err)
+		return rec
+	}
+	if jr.m.redisDB >= 0 && entry.DB != jr.m.redisDB {
+		rec.err = errSkipped
+		return rec
+	}
+
+	value, ok := jsonValue(entry.Value)
+	if !ok || entry.Key == "" || entry.Type == "none" {
+		rec.err = fmt.Errorf("key %q: no value", entry.Key)
+		return rec
+	}
+	return jr.m.build(rec, entry.Key, value, jsonScalar(entry.TTL), "")
+}
+
+// jsonValue returns the bytes to store for a JSON value
+func jsonValue(raw json.RawMessage) ([]byte, bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, false
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []byte(s), true
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return nil, false
+	}
+	return compact.Bytes(), true
+}
+
+// jsonScalar returns a string or number field as text, empty if missing
+func jsonScalar(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
@@ -0,0 +1,600 @@
+// dhtseed bulk-loads keys from CSV, JSON lines or redis-dump output into the
+// cluster, through the gateway or straight to the nodes, and can resume a
+// load that was interrupted.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"dht/internal/hashring"
+	"dht/internal/httpx"
+	"dht/internal/namespace"
+)
+
+// checkpointInterval is how often the checkpoint is saved during a load
+const checkpointInterval = 5 * time.Second
+
+// maxPrintedFailures bounds the failed records printed to stderr; the
+// failed file gets every one
+const maxPrintedFailures = 20
+
+// options holds the command line
+type options struct {
+	input, format string
+	mapping       mapping
+	delimiter     string
+
+	gateway, apiKey, consistency string
+	direct                       bool
+	nodes                        string
+	userID                       int64
+	replicas                     int
+
+	workers  int
+	rate     float64
+	retries  int
+	timeout  time.Duration
+	h2c      bool
+	progress time.Duration
+
+	checkpoint, failed string
+	fresh, dryRun      bool
+}
+
+func main() {
+	var opts options
+	m := &opts.mapping
+	flag.StringVar(&opts.format, "format", "", "input format: csv, jsonl or redis (default: from the file extension)")
+	flag.StringVar(&opts.gateway, "gateway", envOr("DHT_GATEWAY", "http://localhost:8080"), "gateway URL")
+	flag.StringVar(&opts.apiKey, "api-key", os.Getenv("DHT_API_KEY"), "API key the keys are written with (gateway mode)")
+	flag.StringVar(&opts.consistency, "consistency", "", "strong or eventual (default: the namespace's, else eventual; gateway mode)")
+	flag.BoolVar(&opts.direct, "direct", false, "write to the nodes directly instead of through the gateway")
+	flag.StringVar(&opts.nodes, "nodes", os.Getenv("DHT_NODES"), "comma-separated node URLs for -direct, exactly as the gateway lists them (default: the gateway's ring)")
+	flag.Int64Var(&opts.userID, "user-id", 0, "user the keys belong to (-direct)")
+	flag.IntVar(&opts.replicas, "replicas", namespace.DefaultReplicationFactor, "nodes holding each key, primary included (-direct)")
+	flag.IntVar(&opts.workers, "workers", 16, "writes in flight at once")
+	flag.Float64Var(&opts.rate, "rate", 0, "most records written per second (0 for no limit)")
+	flag.IntVar(&opts.retries, "retries", 3, "retries of a write that failed or was rate limited")
+	flag.DurationVar(&opts.timeout, "timeout", 30*time.Second, "deadline of each write, retries included")
+	flag.BoolVar(&opts.h2c, "h2c", false, "call the gateway or nodes over h2c (HTTP/2 without TLS)")
+	flag.DurationVar(&opts.progress, "progress", 10*time.Second, "how often progress is reported")
+	flag.StringVar(&opts.checkpoint, "checkpoint", "", "checkpoint file (default: <input>.checkpoint)")
+	flag.StringVar(&opts.failed, "failed", "", "file failed records are written to (default: <input>.failed.jsonl)")
+	flag.BoolVar(&opts.fresh, "fresh", false, "ignore an existing checkpoint and start from the beginning")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "read and map the input without writing anything")
+
+	flag.StringVar(&m.keyField, "key-field", "key", "column or field holding the key")
+	flag.StringVar(&m.valueField, "value-field", "value", "column or field holding the value")
+	flag.StringVar(&m.ttlField, "ttl-field", "ttl", "column or field holding the TTL, as a number of -ttl-unit or a duration")
+	flag.StringVar(&m.expireAtField, "expire-at-field", "expire_at", "column or field holding the expiry, as Unix seconds or RFC 3339 (wins over -ttl-field)")
+	flag.StringVar(&m.keyPrefix, "key-prefix", "", "prefix added to every key, e.g. a namespace such as 'imported:'")
+	flag.StringVar(&m.valueEncoding, "value-encoding", "raw", "raw, or base64 for binary values")
+	flag.DurationVar(&m.ttlUnit, "ttl-unit", time.Second, "unit of numeric TTLs")
+	flag.DurationVar(&m.defaultTTL, "ttl", 0, "TTL of records without one (0 for none)")
+	flag.DurationVar(&m.maxTTL, "max-ttl", 0, "longest TTL given to any key, including keys without one (0 for no cap)")
+	flag.IntVar(&m.redisDB, "redis-db", -1, "only load this database of a redis-dump (-1 for all)")
+	flag.StringVar(&opts.delimiter, "delimiter", ",", "CSV field delimiter")
+
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: dhtseed [flags] <input | ->
+
+Loads the records of a CSV file (with a header row), a JSON lines file or
+redis-dump output ('-' for stdin) into the cluster. Writes go through the
+gateway with an API key, or with -direct to the nodes holding each key.
+
+An interrupted load of a file resumes where it stopped when run again with
+the same flags. Records that could not be written are saved to the failed
+file, which can be loaded again with -format jsonl -value-encoding base64.
+
+Flags:`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts.input = flag.Arg(0)
+
+	if err := run(&opts); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// stats counts the records of a run
+type stats struct {
+	read, written, bytes      atomic.Int64
+	expired, skipped, invalid atomic.Int64
+	failed                    atomic.Int64
+}
+
+func run(opts *options) error {
+	m := &opts.mapping
+	if opts.format == "" {
+		opts.format = formatFor(opts.input)
+		if opts.format == "" {
+			return fmt.Errorf("cannot tell the format of %s; set -format", opts.input)
+		}
+	}
+	if opts.format == formatRedis {
+		// redis-dump lines always look the same
+		m.keyField, m.valueField, m.ttlField, m.expireAtField, m.ttlUnit = "key", "value", "ttl", "", time.Second
+	}
+	if err := validate(opts); err != nil {
+		return err
+	}
+
+	// Open the input and find where to start
+	in := io.Reader(os.Stdin)
+	var file *os.File
+	var size, offset int64
+	var records uint64
+	if opts.input != "-" {
+		path, err := filepath.Abs(opts.input)
+		if err != nil {
+			return err
+		}
+		opts.input = path
+		if file, err = os.Open(path); err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		size, in = info.Size(), file
+
+		if opts.checkpoint == "" {
+			opts.checkpoint = path + ".checkpoint"
+		}
+		if opts.failed == "" {
+			opts.failed = path + ".failed.jsonl"
+		}
+	} else if opts.failed == "" {
+		opts.failed = "dhtseed.failed.jsonl"
+	}
+
+	resume := false
+	if file != nil && !opts.dryRun && !opts.fresh {
+		cp, err := loadCheckpoint(opts.checkpoint)
+		if err != nil {
+			return err
+		}
+		if cp != nil {
+			if reason := cp.mismatch(opts.input, opts.format, size); reason != "" {
+				return fmt.Errorf("cannot resume from %s: %s (use -fresh to start over)", opts.checkpoint, reason)
+			}
+			offset, records, resume = cp.Offset, cp.Records, true
+			fmt.Fprintf(os.Stderr, "Resuming at byte %d of %d (%d records done, checkpoint from %s)\n",
+				offset, size, records, cp.UpdatedAt.Format(time.RFC3339))
+		}
+	}
+
+	reader, err := openReader(opts, file, in, offset)
+	if err != nil {
+		return err
+	}
+	if cr, ok := reader.(*csvReader); ok && offset == 0 {
+		// Nothing before the first record needs loading again
+		offset = cr.headerEnd()
+	}
+
+	client := httpx.New(httpx.Config{
+		Timeout:             opts.timeout,
+		MaxRetries:          opts.retries,
+		RetryBackoff:        50 * time.Millisecond,
+		MaxBackoff:          5 * time.Second,
+		IdempotentMethods:   []string{"GET", "PUT"}, // rewriting a record leaves the same value
+		MaxIdleConnsPerHost: opts.workers,
+		H2C:                 opts.h2c,
+	})
+	var w writer
+	if !opts.dryRun {
+		if w, err = newWriter(opts, client); err != nil {
+			return err
+		}
+	}
+
+	failures := &failureLog{path: opts.failed, appendTo: resume}
+	if opts.dryRun {
+		failures.path = ""
+	} else if !resume {
+		// Failures of an earlier load are not this one's
+		if err := os.Remove(opts.failed); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	defer failures.close()
+
+	// The first signal stops reading and lets the writes in flight finish;
+	// a second one exits at once
+	stopCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-stopCtx.Done()
+		stop()
+	}()
+	// A write no later record would get past stops the load too
+	loadCtx, abort := context.WithCancelCause(stopCtx)
+	defer abort(nil)
+
+	st := &stats{}
+	mark := newWatermark(offset, records)
+	started := time.Now()
+	saveCheckpoint := func() {
+		if file == nil || opts.dryRun {
+			return
+		}
+		at, done := mark.position()
+		cp := &checkpoint{Input: opts.input, Format: opts.format, Size: size, Offset: at, Records: done}
+		if err := cp.save(opts.checkpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "Saving the checkpoint failed: %v\n", err)
+		}
+	}
+
+	// Report progress and save the checkpoint until the load ends
+	reportDone := make(chan struct{})
+	var reporting sync.WaitGroup
+	reporting.Add(1)
+	go func() {
+		defer reporting.Done()
+		progress := time.NewTicker(opts.progress)
+		defer progress.Stop()
+		checkpoints := time.NewTicker(checkpointInterval)
+		defer checkpoints.Stop()
+		for {
+			select {
+			case <-progress.C:
+				reportProgress(st, mark, offset, size, started)
+			case <-checkpoints.C:
+				saveCheckpoint()
+			case <-reportDone:
+				return
+			}
+		}
+	}()
+
+	// Write the records
+	queue := make(chan *record, opts.workers*2)
+	pace := newPacer(opts.rate)
+	var workers sync.WaitGroup
+	for i := 0; i < opts.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for rec := range queue {
+				// Records left once stopped are written on resume
+				if pace.wait(loadCtx) != nil {
+					continue
+				}
+				err := w.write(context.Background(), rec)
+				var fatal fatalError
+				if errors.As(err, &fatal) {
+					abort(fatal)
+					continue
+				}
+				if err != nil {
+					st.failed.Add(1)
+					failures.add(rec, err)
+				} else {
+					st.written.Add(1)
+					st.bytes.Add(int64(len(rec.value)))
+				}
+				mark.finish(rec.seq, rec.offset)
+			}
+		}()
+	}
+
+	readErr := feed(loadCtx, reader, queue, st, mark, failures, opts.dryRun)
+	close(queue)
+	workers.Wait()
+	close(reportDone)
+	reporting.Wait()
+
+	interrupted := loadCtx.Err() != nil && readErr == nil
+	complete := readErr == nil && !interrupted
+	if complete && file != nil && !opts.dryRun {
+		if err := os.Remove(opts.checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Removing the checkpoint failed: %v\n", err)
+		}
+	} else {
+		saveCheckpoint()
+	}
+
+	printSummary(st, time.Since(started), opts.dryRun)
+	if err := failures.close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", opts.failed, err)
+	}
+
+	switch {
+	case readErr != nil:
+		return fmt.Errorf("reading the input failed: %w (rerun to resume after the last record read)", readErr)
+	case interrupted && stopCtx.Err() == nil:
+		return fmt.Errorf("stopped: %w; rerun to resume once it is fixed", context.Cause(loadCtx))
+	case interrupted:
+		if file == nil {
+			return fmt.Errorf("interrupted; input from stdin cannot be resumed")
+		}
+		return fmt.Errorf("interrupted; rerun with the same flags to resume from %s", opts.checkpoint)
+	case st.failed.Load()+st.invalid.Load() > 0 && failures.path != "":
+		return fmt.Errorf("%d records could not be loaded; see %s", st.failed.Load()+st.invalid.Load(), opts.failed)
+	case st.invalid.Load() > 0:
+		return fmt.Errorf("%d records are invalid", st.invalid.Load())
+	}
+	return nil
+}
+
+// validate checks the options before anything is read or written
+func validate(opts *options) error {
+	m := &opts.mapping
+	switch opts.format {
+	case formatCSV, formatJSONL, formatRedis:
+	default:
+		return fmt.Errorf("unknown -format %q", opts.format)
+	}
+	if m.valueEncoding != "raw" && m.valueEncoding != "base64" {
+		return fmt.Errorf("-value-encoding must be raw or base64")
+	}
+	if utf8.RuneCountInString(opts.delimiter) != 1 {
+		return fmt.Errorf("-delimiter must be a single character")
+	}
+	if m.ttlUnit <= 0 || m.defaultTTL < 0 || m.maxTTL < 0 {
+		return fmt.Errorf("-ttl-unit must be positive, -ttl and -max-ttl not negative")
+	}
+	if opts.workers < 1 || opts.rate < 0 || opts.retries < 0 || opts.timeout <= 0 || opts.progress <= 0 {
+		return fmt.Errorf("-workers, -timeout and -progress must be positive, -rate and -retries not negative")
+	}
+	if opts.consistency != "" && opts.consistency != "strong" && opts.consistency != "eventual" {
+		return fmt.Errorf("-consistency must be strong or eventual")
+	}
+	if opts.dryRun {
+		return nil
+	}
+
+	if opts.direct {
+		if opts.userID <= 0 {
+			return fmt.Errorf("-direct needs -user-id")
+		}
+		if opts.replicas < 1 || opts.replicas > namespace.MaxReplicationFactor {
+			return fmt.Errorf("-replicas must be between 1 and %d", namespace.MaxReplicationFactor)
+		}
+		if opts.consistency != "" {
+			return fmt.Errorf("-consistency only applies without -direct, which writes every replica before going on")
+		}
+		return nil
+	}
+	if opts.apiKey == "" {
+		return fmt.Errorf("-api-key (or DHT_API_KEY) is required unless -direct is set")
+	}
+	return nil
+}
+
+// formatFor guesses the format from a file's extension
+func formatFor(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv", ".tsv":
+		return formatCSV
+	case ".jsonl", ".ndjson":
+		return formatJSONL
+	}
+	return ""
+}
+
+// openReader returns the reader for the input, starting at offset. CSV
+// needs the header first, which is read from the start of the file.
+func openReader(opts *options, file *os.File, in io.Reader, offset int64) (recordReader, error) {
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	delimiter, _ := utf8.DecodeRuneInString(opts.delimiter)
+	if opts.format == formatCSV && strings.EqualFold(filepath.Ext(opts.input), ".tsv") && opts.delimiter == "," {
+		delimiter = '\t'
+	}
+
+	switch opts.format {
+	case formatCSV:
+		if offset == 0 {
+			return newCSVReader(in, nil, 0, delimiter, &opts.mapping)
+		}
+		return newCSVReader(io.NewSectionReader(file, 0, offset), in, offset, delimiter, &opts.mapping)
+	default:
+		return newJSONLReader(in, offset, opts.format == formatRedis, &opts.mapping), nil
+	}
+}
+
+// newWriter returns the gateway or direct writer
+func newWriter(opts *options, client *httpx.Client) (writer, error) {
+	gateway := strings.TrimRight(opts.gateway, "/")
+	if !opts.direct {
+		return &gatewayWriter{client: client, gateway: gateway, apiKey: opts.apiKey, consistency: opts.consistency, retries: opts.retries}, nil
+	}
+
+	nodes := splitNodes(opts.nodes)
+	source := "-nodes"
+	if len(nodes) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+		defer cancel()
+		var err error
+		if nodes, err = ringNodes(ctx, client, gateway); err != nil {
+			return nil, fmt.Errorf("failed to get the ring from %s: %w", gateway, err)
+		}
+		source = gateway
+	}
+	fmt.Fprintf(os.Stderr, "Writing to %d nodes (ring from %s): %s\n", len(nodes), source, strings.Join(nodes, ", "))
+	return &directWriter{client: client, ring: hashring.NewHashRing(nodes), userID: opts.userID, replicas: opts.replicas}, nil
+}
+
+// feed reads records into queue until the input ends, ctx is done or
+// reading fails. Records that are not written are settled here.
+func feed(ctx context.Context, reader recordReader, queue chan<- *record, st *stats, mark *watermark, failures *failureLog, dryRun bool) error {
+	for ctx.Err() == nil {
+		rec, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		st.read.Add(1)
+
+		switch {
+		case rec.err == errExpired:
+			st.expired.Add(1)
+		case rec.err == errSkipped:
+			st.skipped.Add(1)
+		case rec.err != nil:
+			st.invalid.Add(1)
+			failures.add(rec, rec.err)
+		case dryRun:
+			st.written.Add(1)
+			st.bytes.Add(int64(len(rec.value)))
+		default:
+			select {
+			case queue <- rec:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		mark.finish(rec.seq, rec.offset)
+	}
+	return nil
+}
+
+// reportProgress prints one line about the load so far
+func reportProgress(st *stats, mark *watermark, start, size int64, started time.Time) {
+	elapsed := time.Since(started)
+	line := fmt.Sprintf("Progress: %d read, %d written, %d failed, %.0f/s",
+		st.read.Load(), st.written.Load(), st.failed.Load()+st.invalid.Load(),
+		float64(st.written.Load())/elapsed.Seconds())
+
+	if size > 0 {
+		at, _ := mark.position()
+		line += fmt.Sprintf(", %.1f%% of input", float64(at)*100/float64(size))
+		if done := at - start; done > 0 {
+			eta := time.Duration(float64(elapsed) * float64(size-at) / float64(done))
+			line += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+		}
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// printSummary prints the totals of the run
+func printSummary(st *stats, elapsed time.Duration, dryRun bool) {
+	written := "written"
+	if dryRun {
+		written = "would be written"
+	}
+	fmt.Fprintf(os.Stderr, "%d records read in %v: %d %s (%d value bytes, %.0f/s), %d expired, %d skipped, %d invalid, %d failed\n",
+		st.read.Load(), elapsed.Round(time.Millisecond), st.written.Load(), written, st.bytes.Load(),
+		float64(st.written.Load())/elapsed.Seconds(), st.expired.Load(), st.skipped.Load(), st.invalid.Load(), st.failed.Load())
+}
+
+// failedRecord is a line of the failed file, in the jsonl input format with
+// base64 values so the file can be loaded again
+type failedRecord struct {
+	Key    string `json:"key,omitempty"`
+	Value  []byte `json:"value,omitempty"`
+	TTL    string `json:"ttl,omitempty"`
+	Offset int64  `json:"offset"` // of the record in the input
+	Error  string `json:"error"`
+}
+
+// failureLog appends records that could not be loaded to a file, created
+// on the first failure; with no path they are only printed
+type failureLog struct {
+	path     string
+	appendTo bool // keep the failures of earlier runs
+
+	mu      sync.Mutex
+	printed int
+	file    *os.File
+	enc     *json.Encoder
+	err     error
+}
+
+func (l *failureLog) add(rec *record, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.printed < maxPrintedFailures {
+		fmt.Fprintf(os.Stderr, "Record at byte %d: %v\n", rec.start, err)
+		if l.printed++; l.printed == maxPrintedFailures {
+			fmt.Fprintln(os.Stderr, "Further failed records are not printed")
+		}
+	}
+	if l.path == "" || l.err != nil {
+		return
+	}
+	if l.file == nil {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if l.appendTo {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		if l.file, l.err = os.OpenFile(l.path, flags, 0o600); l.err != nil {
+			return
+		}
+		l.enc = json.NewEncoder(l.file)
+	}
+
+	entry := failedRecord{Offset: rec.start, Error: err.Error()}
+	if rec.err == nil {
+		entry.Key, entry.Value = rec.key, rec.value
+		if rec.ttl > 0 {
+			entry.TTL = rec.ttl.String()
+		}
+	}
+	l.err = l.enc.Encode(entry)
+}
+
+// close closes the file, returning the first error met
+func (l *failureLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		if err := l.file.Close(); l.err == nil {
+			l.err = err
+		}
+		l.file = nil
+	}
+	return l.err
+}
+
+// splitNodes parses a comma-separated node list
+func splitNodes(list string) []string {
+	var nodes []string
+	for _, node := range strings.Split(list, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, strings.TrimRight(node, "/"))
+		}
+	}
+	return nodes
+}
+
+// envOr returns the environment variable or a default
+func envOr(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
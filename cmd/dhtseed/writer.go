@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"dht/internal/hashring"
+	"dht/internal/httpx"
+	"dht/internal/models"
+	"dht/internal/namespace"
+)
+
+// A write the gateway refused with 429 is retried after rateLimitBackoff,
+// doubled for each further retry up to maxRateLimitBackoff
+const (
+	rateLimitBackoff    = 100 * time.Millisecond
+	maxRateLimitBackoff = 10 * time.Second
+)
+
+// writer stores records in the cluster
+type writer interface {
+	write(ctx context.Context, rec *record) error
+}
+
+// fatalError is a failed write that every later one would repeat, such as
+// a rejected API key; it stops the load
+type fatalError struct {
+	error
+}
+
+// gatewayWriter writes through PUT /v1/kv/{key}, so every write is
+// authenticated, counted against the tenant's rate limit and quota,
+// encrypted and replicated as if a client made it
+type gatewayWriter struct {
+	client      *httpx.Client
+	gateway     string
+	apiKey      string
+	consistency string
+	retries     int
+}
+
+func (g *gatewayWriter) write(ctx context.Context, rec *record) error {
+	reqURL := g.gateway + "/v1/kv/" + url.PathEscape(rec.key)
+	if rec.ttl > 0 {
+		reqURL += "?ttl=" + rec.ttl.String()
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, bytes.NewReader(rec.value))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-API-Key", g.apiKey)
+		if g.consistency != "" {
+			req.Header.Set("X-Consistency", g.consistency)
+		}
+
+		resp, err := g.client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < g.retries {
+			resp.Body.Close()
+			if err := sleep(ctx, min(rateLimitBackoff<<attempt, maxRateLimitBackoff)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = checkResponse(resp)
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return fatalError{err}
+		}
+		return err
+	}
+}
+
+// directWriter writes to the nodes themselves, placing each key with the
+// gateway's hash ring: on its primary first, then on its replicas with the
+// primary's version, as the replicator does. It skips the gateway's
+// authentication, quotas, encryption and namespace policies.
+type directWriter struct {
+	client   *httpx.Client
+	ring     *hashring.HashRing
+	userID   int64
+	replicas int // nodes holding each key, primary included
+}
+
+func (d *directWriter) write(ctx context.Context, rec *record) error {
+	nodes := d.ring.LocateKey(rec.key, d.replicas)
+	if len(nodes) == 0 {
+		return fmt.Errorf("no nodes in the ring")
+	}
+
+	resp, err := d.put(ctx, nodes[0], rec.key, rec.value, rec.ttl, 0)
+	if err != nil {
+		return fmt.Errorf("primary %s: %w", nodes[0], err)
+	}
+	version, _ := strconv.ParseUint(resp.Header.Get("X-Version"), 10, 64)
+
+	// The primary may have jittered the TTL; replicas expire the key with it
+	ttl := rec.ttl
+	if t, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Expires-At")); err == nil {
+		ttl = max(time.Until(t), time.Millisecond)
+	}
+
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes[1:] {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			if _, err := d.put(ctx, node, rec.key, rec.value, ttl, version); err != nil {
+				errs[i] = fmt.Errorf("replica %s: %w", node, err)
+			}
+		}(i, node)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put stores a value on one node; a non-zero version marks a replicated copy
+// of the primary's write
+func (d *directWriter) put(ctx context.Context, node, key string, value []byte, ttl time.Duration, version uint64) (*http.Response, error) {
+	reqURL := node + "/store/" + url.PathEscape(key)
+	if ttl > 0 {
+		reqURL += "?ttl=" + ttl.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-User-ID", strconv.FormatInt(d.userID, 10))
+	if d.replicas != namespace.DefaultReplicationFactor {
+		req.Header.Set("X-Replication-Factor", strconv.Itoa(d.replicas))
+	}
+	if version > 0 {
+		req.Header.Set("X-Replication", "true")
+		req.Header.Set("X-Source-Version", strconv.FormatUint(version, 10))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp, checkResponse(resp)
+}
+
+// checkResponse closes resp and turns anything but 2xx into an error
+// carrying the service's error message
+func checkResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	var errResp models.ErrorResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&errResp); err == nil && errResp.Error != nil {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, errResp.Error.Message)
+	}
+	return fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// ringNodes asks the gateway which nodes its hash ring holds
+func ringNodes(ctx context.Context, client *httpx.Client, gateway string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", gateway+"/health", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway returned status %d", resp.StatusCode)
+	}
+
+	var health struct {
+		Nodes []string `json:"nodes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if len(health.Nodes) == 0 {
+		return nil, fmt.Errorf("the gateway's ring is empty")
+	}
+	return health.Nodes, nil
+}
+
+// pacer spaces writes out to at most a given rate across all workers
+type pacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newPacer(perSecond float64) *pacer {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &pacer{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the caller may write; a nil pacer never blocks
+func (p *pacer) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	// Time not used while idle is not saved up for a burst
+	if p.next.Before(now) {
+		p.next = now
+	}
+	at := p.next
+	p.next = p.next.Add(p.interval)
+	p.mu.Unlock()
+
+	return sleep(ctx, time.Until(at))
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"dht/internal/models"
+	"dht/internal/namespace"
+	"dht/internal/proto"
+)
+
+// canaryNamespace holds the sentinel keys; tenants writing to it will trip
+// the canary
+const canaryNamespace = "_canary" + namespace.Separator
+
+// canaryRecentAlerts bounds the alerts kept for GET /admin/canary
+const canaryRecentAlerts = 100
+
+// canaryPoll is how often replicas are re-read while waiting for an
+// eventual write to reach them
+const canaryPoll = 100 * time.Millisecond
+
+// Kinds of canary alert
+const (
+	alertLostWrite         = "lost_write"         // the primary does not hold a write it acknowledged
+	alertStrongUnacked     = "strong_unacked"     // a strong write was not acknowledged by a majority
+	alertStrongStale       = "strong_stale"       // a replica that acknowledged a strong write does not hold it
+	alertStalenessExceeded = "staleness_exceeded" // an eventual write did not reach a replica in time
+	alertStaleKey          = "stale_key"          // a sampled key's replica stayed behind its primary
+	alertDivergedKey       = "diverged_key"       // a sampled key's replica holds a different value
+)
+
+// CanaryAlert is one violated guarantee
+type CanaryAlert struct {
+	At          time.Time `json:"at"`
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Node        string    `json:"node"`
+	Consistency string    `json:"consistency,omitempty"`
+	Detail      string    `json:"detail"`
+}
+
+// SentinelResult is the outcome of writing one sentinel key
+type SentinelResult struct {
+	Key         string `json:"key"`
+	Primary     string `json:"primary"`
+	Consistency string `json:"consistency"`
+	Written     bool   `json:"written"`
+	Error       string `json:"error,omitempty"`
+
+	// ConvergedMs is how long the write took to reach every reachable
+	// replica, nil if it did not within CANARY_MAX_STALENESS
+	ConvergedMs *int64 `json:"converged_ms,omitempty"`
+}
+
+// CanaryReport is the outcome of one canary pass
+type CanaryReport struct {
+	StartedAt  time.Time        `json:"started_at"`
+	DurationMs int64            `json:"duration_ms"`
+	OK         bool             `json:"ok"` // no alerts
+	Sentinels  []SentinelResult `json:"sentinels"`
+	SampleNode string           `json:"sample_node,omitempty"`
+	Sampled    int              `json:"sampled_keys"`
+	StaleKeys  int              `json:"stale_keys"`
+	Diverged   int              `json:"diverged_keys"`
+	Alerts     []CanaryAlert    `json:"alerts"`
+}
+
+// CanaryStats are running totals since the gateway started
+type CanaryStats struct {
+	Passes           int64 `json:"passes"`
+	FailedPasses     int64 `json:"failed_passes"` // passes that raised alerts
+	SentinelWrites   int64 `json:"sentinel_writes"`
+	SentinelFailures int64 `json:"sentinel_failures"`
+	KeysCompared     int64 `json:"keys_compared"`
+	StaleKeys        int64 `json:"stale_keys"`
+	DivergedKeys     int64 `json:"diverged_keys"`
+	Alerts           int64 `json:"alerts"`
+
+	// Slowest time an eventual sentinel write took to reach every replica,
+	// in the last pass and ever
+	LastConvergenceMs int64 `json:"last_convergence_ms"`
+	MaxConvergenceMs  int64 `json:"max_convergence_ms"`
+
+	LastPassAt *time.Time `json:"last_pass_at,omitempty"`
+	LastPassOK bool       `json:"last_pass_ok"`
+}
+
+// Canary keeps the latest canary pass and its totals; passes never overlap
+type Canary struct {
+	host string // keeps the sentinel keys of gateways apart
+
+	running sync.Mutex
+	mu      sync.RWMutex
+	last    *CanaryReport
+	stats   CanaryStats
+	recent  []CanaryAlert
+}
+
+// NewCanary creates an idle canary
+func NewCanary() *Canary {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "gateway"
+	}
+	return &Canary{host: host}
+}
+
+// Last returns the most recent pass, nil if none has run yet
+func (c *Canary) Last() *CanaryReport {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.last
+}
+
+// Stats returns the running totals
+func (c *Canary) Stats() CanaryStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stats
+}
+
+// Recent returns the latest alerts, oldest first
+func (c *Canary) Recent() []CanaryAlert {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]CanaryAlert{}, c.recent...)
+}
+
+func (c *Canary) record(report *CanaryReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.last = report
+	c.stats.Passes++
+	if !report.OK {
+		c.stats.FailedPasses++
+	}
+	c.stats.LastConvergenceMs = 0
+	for _, sentinel := range report.Sentinels {
+		if !sentinel.Written {
+			c.stats.SentinelFailures++
+			continue
+		}
+		c.stats.SentinelWrites++
+		if sentinel.Consistency == "eventual" && sentinel.ConvergedMs != nil {
+			c.stats.LastConvergenceMs = max(c.stats.LastConvergenceMs, *sentinel.ConvergedMs)
+		}
+	}
+	c.stats.MaxConvergenceMs = max(c.stats.MaxConvergenceMs, c.stats.LastConvergenceMs)
+	c.stats.KeysCompared += int64(report.Sampled)
+	c.stats.StaleKeys += int64(report.StaleKeys)
+	c.stats.DivergedKeys += int64(report.Diverged)
+	c.stats.Alerts += int64(len(report.Alerts))
+	c.stats.LastPassAt = &report.StartedAt
+	c.stats.LastPassOK = report.OK
+
+	c.recent = append(c.recent, report.Alerts...)
+	if len(c.recent) > canaryRecentAlerts {
+		c.recent = c.recent[len(c.recent)-canaryRecentAlerts:]
+	}
+}
+
+// runCanaryLoop runs a canary pass every interval
+func (h *Handler) runCanaryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval*9/10)
+		h.runCanary(ctx)
+		cancel()
+	}
+}
+
+// runCanary writes a sentinel key with each consistency level to every ring
+// node as primary and checks the guarantees of each write, then compares the
+// replicas of a sample of real keys. Violations are logged and sent to the
+// alert webhook.
+func (h *Handler) runCanary(ctx context.Context) *CanaryReport {
+	h.canary.running.Lock()
+	defer h.canary.running.Unlock()
+
+	report := &CanaryReport{StartedAt: time.Now(), Sentinels: []SentinelResult{}, Alerts: []CanaryAlert{}}
+	var mu sync.Mutex
+	alert := func(a CanaryAlert) {
+		a.At = time.Now()
+		log.Printf("Canary ALERT %s: key=%s node=%s: %s\n", a.Kind, a.Key, a.Node, a.Detail)
+		mu.Lock()
+		report.Alerts = append(report.Alerts, a)
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range h.ring.GetAllNodes() {
+		for _, consistency := range []string{"strong", "eventual"} {
+			key := h.sentinelKey(node, consistency)
+			if key == "" {
+				continue
+			}
+			wg.Add(1)
+			go func(key, consistency string) {
+				defer wg.Done()
+				result := h.checkSentinel(ctx, key, consistency, alert)
+				mu.Lock()
+				report.Sentinels = append(report.Sentinels, result)
+				mu.Unlock()
+			}(key, consistency)
+		}
+	}
+	wg.Wait()
+	sort.Slice(report.Sentinels, func(i, j int) bool { return report.Sentinels[i].Key < report.Sentinels[j].Key })
+
+	if h.config.CanarySampleKeys > 0 {
+		h.compareSample(ctx, report, alert)
+	}
+
+	report.OK = len(report.Alerts) == 0
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+	if !report.OK && h.config.CanaryAlertWebhook != "" {
+		if err := h.sendCanaryAlerts(ctx, report.Alerts); err != nil {
+			log.Printf("Canary: sending alerts failed: %v\n", err)
+		}
+	}
+
+	log.Printf("Canary: %d sentinels, %d keys compared, %d alerts in %v\n",
+		len(report.Sentinels), report.Sampled, len(report.Alerts), time.Since(report.StartedAt))
+	h.canary.record(report)
+	return report
+}
+
+// sentinelKey returns this gateway's sentinel key for consistency whose
+// primary is node, empty if none was found
+func (h *Handler) sentinelKey(node, consistency string) string {
+	for i := 0; i < 10000; i++ {
+		// Keys travel unescaped in some node URLs, so they hold no slashes
+		key := fmt.Sprintf("%s%s-%s-%d", canaryNamespace, h.canary.host, consistency, i)
+		if nodes := h.ring.LocateKey(key, 1); len(nodes) > 0 && nodes[0] == node {
+			return key
+		}
+	}
+	return ""
+}
+
+// checkSentinel writes key the way PUT /v1/kv/{key} does and checks that
+// the write is where its consistency level promises
+func (h *Handler) checkSentinel(ctx context.Context, key, consistency string, alert func(CanaryAlert)) SentinelResult {
+	nodes := h.locateKey(ctx, key)
+	if len(nodes) == 0 {
+		return SentinelResult{Key: key, Consistency: consistency, Error: "no nodes available"}
+	}
+	result := SentinelResult{Key: key, Primary: nodes[0], Consistency: consistency}
+
+	value := []byte(fmt.Sprintf("canary %s %d", consistency, time.Now().UnixNano()))
+	sum := sha256.Sum256(value)
+	checksum := hex.EncodeToString(sum[:])
+
+	// Sentinels outlive a few passes, so they expire soon after the canary stops
+	ttl := max(3*h.config.CanaryInterval, time.Hour)
+	version, err := h.writeSentinel(ctx, nodes[0], key, value, ttl)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Written = true
+
+	if primary := h.readKeyCopy(ctx, nodes[0], key, 0); primary.Reachable && (primary.Copy == nil || primary.Copy.Checksum != checksum) {
+		alert(CanaryAlert{Kind: alertLostWrite, Key: key, Node: nodes[0], Consistency: consistency,
+			Detail: fmt.Sprintf("primary acknowledged version %d but does not hold it", version)})
+	}
+
+	replicas := nodes[1:]
+	if len(replicas) == 0 {
+		zero := int64(0)
+		result.ConvergedMs = &zero
+		return result
+	}
+
+	replReq := models.ReplicationRequest{
+		Key:          key,
+		Value:        value,
+		Operation:    "SET",
+		TTL:          ttl,
+		Consistency:  consistency,
+		PrimaryNode:  nodes[0],
+		ReplicaNodes: replicas,
+		Version:      version,
+	}
+	start := time.Now()
+	acked, err := h.replicateSentinel(ctx, &replReq)
+	if err != nil {
+		result.Error = err.Error()
+		if consistency == "strong" {
+			alert(CanaryAlert{Kind: alertStrongUnacked, Key: key, Node: nodes[0], Consistency: consistency, Detail: err.Error()})
+		}
+		return result
+	}
+
+	// A strong write returns once a majority acknowledged it; those copies
+	// must be readable at once, the others follow like eventual writes
+	pending := make(map[string]replicaStatus, len(replicas))
+	for _, node := range replicas {
+		if !acked[node] {
+			pending[node] = replicaStatus{}
+			continue
+		}
+		status := h.readKeyCopy(ctx, node, key, 0)
+		if status.Reachable && (status.Copy == nil || status.Copy.Checksum != checksum) {
+			alert(CanaryAlert{Kind: alertStrongStale, Key: key, Node: node, Consistency: consistency,
+				Detail: fmt.Sprintf("acknowledged version %d but holds %s", version, describeCopy(status.Copy))})
+		}
+	}
+
+	// Wait for every other reachable replica to hold the write
+	deadline := start.Add(h.config.CanaryMaxStaleness)
+	for {
+		for node := range pending {
+			status := h.readKeyCopy(ctx, node, key, 0)
+			if !status.Reachable || (status.Copy != nil && status.Copy.Checksum == checksum) {
+				delete(pending, node)
+				continue
+			}
+			pending[node] = status
+		}
+		if len(pending) == 0 {
+			converged := time.Since(start).Milliseconds()
+			result.ConvergedMs = &converged
+			return result
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(canaryPoll)
+	}
+
+	for node, status := range pending {
+		alert(CanaryAlert{Kind: alertStalenessExceeded, Key: key, Node: node, Consistency: consistency,
+			Detail: fmt.Sprintf("version %d not replicated after %v; replica holds %s", version, h.config.CanaryMaxStaleness, describeCopy(status.Copy))})
+	}
+	return result
+}
+
+// writeSentinel stores a sentinel on its primary, returning the version
+func (h *Handler) writeSentinel(ctx context.Context, primary, key string, value []byte, ttl time.Duration) (uint64, error) {
+	reqURL := fmt.Sprintf("%s/store/%s?ttl=%s&jitter=false", primary, url.PathEscape(key), ttl)
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, bytes.NewReader(value))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-User-ID", "0")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("primary responded with status %d", resp.StatusCode)
+	}
+	return strconv.ParseUint(resp.Header.Get("X-Version"), 10, 64)
+}
+
+// replicateSentinel hands a sentinel write to the replicator and returns the
+// nodes that acknowledged it (none for eventual writes, which are queued)
+func (h *Handler) replicateSentinel(ctx context.Context, replReq *models.ReplicationRequest) (map[string]bool, error) {
+	req, err := h.replicationRequest(ctx, replReq)
+	if err != nil || req == nil {
+		return nil, err
+	}
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if replReq.Consistency == "eventual" {
+		if resp.StatusCode != http.StatusAccepted {
+			return nil, fmt.Errorf("replicator responded with status %d", resp.StatusCode)
+		}
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp models.ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Error != nil {
+			return nil, fmt.Errorf("replicator responded with status %d: %s", resp.StatusCode, errResp.Error.Message)
+		}
+		return nil, fmt.Errorf("replicator responded with status %d", resp.StatusCode)
+	}
+
+	var replResp models.ReplicationResponse
+	if err := proto.DecodeResponse(resp, &replResp); err != nil {
+		return nil, fmt.Errorf("invalid response from replicator: %w", err)
+	}
+	acked := make(map[string]bool, len(replResp.AckedNodes))
+	for _, node := range replResp.AckedNodes {
+		acked[node] = true
+	}
+	return acked, nil
+}
+
+// compareSample checks the replicas of up to CANARY_SAMPLE_KEYS keys of a
+// random node. Keys whose replicas disagree with the primary are checked
+// again after CANARY_MAX_STALENESS, so writes still being replicated are
+// not reported.
+func (h *Handler) compareSample(ctx context.Context, report *CanaryReport, alert func(CanaryAlert)) {
+	ring := h.ring.GetAllNodes()
+	if len(ring) == 0 {
+		return
+	}
+	node := ring[rand.Intn(len(ring))]
+	report.SampleNode = node
+
+	// Start at a random point of the node's sorted keyspace
+	after := string(rune('0' + rand.Intn('z'-'0')))
+	keys, err := h.sampleKeys(ctx, node, after)
+	if err == nil && len(keys) < h.config.CanarySampleKeys {
+		keys, err = h.sampleKeys(ctx, node, "")
+	}
+	if err != nil {
+		log.Printf("Canary: sampling keys of %s failed: %v\n", node, err)
+		return
+	}
+
+	type suspect struct {
+		key     string
+		version uint64
+	}
+	var suspects []suspect
+	for _, key := range keys {
+		primary, differing := h.compareKeyCopies(ctx, key)
+		if primary == nil {
+			continue
+		}
+		report.Sampled++
+		if len(differing) > 0 {
+			suspects = append(suspects, suspect{key, primary.Version})
+		}
+	}
+	if len(suspects) == 0 {
+		return
+	}
+
+	select {
+	case <-time.After(h.config.CanaryMaxStaleness):
+	case <-ctx.Done():
+		return
+	}
+	for _, s := range suspects {
+		primary, differing := h.compareKeyCopies(ctx, s.key)
+		// A key written meanwhile proves nothing
+		if primary == nil || primary.Version != s.version {
+			continue
+		}
+		stale, diverged := false, false
+		for _, status := range differing {
+			kind := alertStaleKey
+			if status.State == "diverged" {
+				kind, diverged = alertDivergedKey, true
+			} else {
+				stale = true
+			}
+			alert(CanaryAlert{Kind: kind, Key: s.key, Node: status.Node,
+				Detail: fmt.Sprintf("%s for over %v: primary at version %d, replica holds %s", status.State, h.config.CanaryMaxStaleness, primary.Version, describeCopy(status.Copy))})
+		}
+		if diverged {
+			report.Diverged++
+		} else if stale {
+			report.StaleKeys++
+		}
+	}
+}
+
+// sampleKeys lists up to CANARY_SAMPLE_KEYS keys of node after the given
+// key, leaving out sentinels
+func (h *Handler) sampleKeys(ctx context.Context, node, after string) ([]string, error) {
+	query := url.Values{
+		"glob":  {"*"},
+		"after": {after},
+		"limit": {strconv.Itoa(h.config.CanarySampleKeys)},
+	}
+	res := h.sendToNode(ctx, "GET", node+"/scan?"+query.Encode(), 0, nil)
+	if res.err != nil {
+		return nil, res.err
+	}
+	if res.status != http.StatusOK {
+		return nil, fmt.Errorf("node returned status %d", res.status)
+	}
+
+	var scan struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.Unmarshal(res.body, &scan); err != nil {
+		return nil, err
+	}
+	keys := scan.Keys[:0]
+	for _, key := range scan.Keys {
+		if namespace.Of(key)+namespace.Separator != canaryNamespace {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// compareKeyCopies reads key from its primary and replicas and returns the
+// primary's copy with the reachable replicas that are not in sync; the copy
+// is nil if the primary does not hold the key or cannot be reached
+func (h *Handler) compareKeyCopies(ctx context.Context, key string) (*keyCopy, []replicaStatus) {
+	// The key's own replication factor decides its placement; the primary
+	// is the same whatever the factor
+	nodes, _ := h.rollouts.Route(key, h.ring.LocateKey(key, namespace.DefaultReplicationFactor))
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	primary := h.readKeyCopy(ctx, nodes[0], key, 0)
+	if primary.Copy == nil {
+		return nil, nil
+	}
+	if primary.Copy.Replicas > 0 && primary.Copy.Replicas != len(nodes) {
+		nodes, _ = h.rollouts.Route(key, h.ring.LocateKey(key, primary.Copy.Replicas))
+	}
+
+	var differing []replicaStatus
+	for _, node := range nodes[1:] {
+		status := h.readKeyCopy(ctx, node, key, 0)
+		if !status.Reachable {
+			continue
+		}
+		status.State = compareCopies(primary.Copy, status.Copy)
+		if status.State != "in_sync" {
+			differing = append(differing, status)
+		}
+	}
+	return primary.Copy, differing
+}
+
+// describeCopy summarizes a node's copy for an alert
+func describeCopy(c *keyCopy) string {
+	if c == nil {
+		return "no copy"
+	}
+	if c.SourceVersion > 0 {
+		return fmt.Sprintf("source version %d", c.SourceVersion)
+	}
+	return fmt.Sprintf("a copy updated at %s", c.UpdatedAt.Format(time.RFC3339Nano))
+}
+
+// sendCanaryAlerts POSTs a pass's alerts to CANARY_ALERT_WEBHOOK
+func (h *Handler) sendCanaryAlerts(ctx context.Context, alerts []CanaryAlert) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"service": "gateway",
+		"host":    h.canary.host,
+		"alerts":  alerts,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.config.CanaryAlertWebhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// CanaryStatus handles GET /admin/canary
+// Returns the latest pass, the running totals and the recent alerts.
+func (h *Handler) CanaryStatus(w http.ResponseWriter, r *http.Request) {
+	last := h.canary.Last()
+	if last == nil {
+		respondError(w, http.StatusNotFound, "No canary pass has run yet")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"last":          last,
+		"stats":         h.canary.Stats(),
+		"recent_alerts": h.canary.Recent(),
+	})
+}
+
+// RunCanary handles POST /admin/canary, running a canary pass now
+func (h *Handler) RunCanary(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 4*h.config.CanaryMaxStaleness+h.config.WriteTimeout)
+	defer cancel()
+
+	respondJSON(w, http.StatusOK, h.runCanary(ctx))
+}
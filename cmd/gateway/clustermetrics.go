@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"dht/internal/models"
+)
+
+// clusterMetricsTimeout bounds how long a scrape waits for slow nodes
+const clusterMetricsTimeout = 5 * time.Second
+
+// nodeMetrics is one node's contribution to the cluster metrics
+type nodeMetrics struct {
+	Node       string  `json:"node"`
+	NodeID     string  `json:"node_id,omitempty"`
+	Available  bool    `json:"available"`
+	Phi        float64 `json:"phi"`
+	Keys       int64   `json:"keys"`
+	ValueBytes int64   `json:"value_bytes"`
+	WALBytes   int64   `json:"wal_bytes"`
+	WALSeq     uint64  `json:"wal_seq"`
+	KeyShare   float64 `json:"key_share"` // fraction of all stored copies
+	Error      string  `json:"error,omitempty"`
+}
+
+// ClusterMetrics handles GET /metrics/cluster
+// It scrapes every node's /metrics and the replicator's, and merges them into
+// cluster-wide figures. Totals count every replica copy.
+func (h *Handler) ClusterMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), clusterMetricsTimeout)
+	defer cancel()
+
+	replication := make(chan *models.ReplicationMetrics, 1)
+	go func() {
+		replication <- h.scrapeReplicator(ctx)
+	}()
+
+	results := h.broadcast(ctx, "GET", "/metrics", 0, nil)
+
+	nodes := make([]nodeMetrics, len(results))
+	var totalKeys, totalBytes, totalWAL, maxKeys int64
+	minKeys := int64(-1)
+	reporting := 0
+	for i, res := range results {
+		nm := nodeMetrics{
+			Node:      res.node,
+			Available: h.nodeAvailable(res.node),
+			Phi:       math.Round(h.detector.Phi(res.node)*100) / 100,
+		}
+
+		var body struct {
+			NodeID     string `json:"node_id"`
+			KeyCount   int64  `json:"key_count"`
+			ValueBytes int64  `json:"value_bytes"`
+			WALSize    int64  `json:"wal_size"`
+			WALSeq     uint64 `json:"wal_seq"`
+		}
+		switch {
+		case res.err != nil:
+			nm.Error = res.err.Error()
+		case res.status != http.StatusOK:
+			nm.Error = fmt.Sprintf("status %d", res.status)
+		case json.Unmarshal(res.body, &body) != nil:
+			nm.Error = "invalid metrics response"
+		default:
+			nm.NodeID = body.NodeID
+			nm.Keys = body.KeyCount
+			nm.ValueBytes = body.ValueBytes
+			nm.WALBytes = body.WALSize
+			nm.WALSeq = body.WALSeq
+
+			reporting++
+			totalKeys += body.KeyCount
+			totalBytes += body.ValueBytes
+			totalWAL += body.WALSize
+			if body.KeyCount > maxKeys {
+				maxKeys = body.KeyCount
+			}
+			if minKeys < 0 || body.KeyCount < minKeys {
+				minKeys = body.KeyCount
+			}
+		}
+		nodes[i] = nm
+	}
+
+	// Skew is the busiest node's key count relative to the mean; 1 is perfectly even
+	skew := 0.0
+	if reporting > 0 && totalKeys > 0 {
+		mean := float64(totalKeys) / float64(reporting)
+		skew = math.Round(float64(maxKeys)/mean*100) / 100
+		for i := range nodes {
+			if nodes[i].Error == "" {
+				nodes[i].KeyShare = math.Round(float64(nodes[i].Keys)/float64(totalKeys)*1000) / 1000
+			}
+		}
+	}
+	if minKeys < 0 {
+		minKeys = 0
+	}
+
+	replicas := 3
+	if len(results) < replicas {
+		replicas = len(results)
+	}
+	uniqueKeys := int64(0)
+	if replicas > 0 {
+		uniqueKeys = totalKeys / int64(replicas)
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"nodes_total":           len(results),
+		"nodes_reporting":       reporting,
+		"total_keys":            totalKeys,
+		"estimated_unique_keys": uniqueKeys,
+		"total_value_bytes":     totalBytes,
+		"total_wal_bytes":       totalWAL,
+		"key_skew":              skew,
+		"min_node_keys":         minKeys,
+		"max_node_keys":         maxKeys,
+		"replication":           <-replication,
+		"nodes":                 nodes,
+		"timestamp":             time.Now().Unix(),
+	})
+}
+
+// scrapeReplicator fetches the replicator's metrics; nil if it is unreachable
+func (h *Handler) scrapeReplicator(ctx context.Context) *models.ReplicationMetrics {
+	replicatorURL := fmt.Sprintf("http://localhost:%s/metrics", h.config.ReplicatorPort)
+	req, err := http.NewRequestWithContext(ctx, "GET", replicatorURL, nil)
+	if err != nil {
+		return nil
+	}
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var metrics models.ReplicationMetrics
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		return nil
+	}
+	return &metrics
+}
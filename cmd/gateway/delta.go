@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dht/internal/delta"
+	"dht/internal/models"
+	"dht/internal/requestid"
+)
+
+// patchDelta handles PATCH /v1/kv/{key} with a binary delta
+// The primary applies the delta to the value at the version named by
+// If-Match, so a client changing a few bytes of a large value sends only
+// those. The new value is replicated whole. Values encrypted by the gateway
+// cannot be patched by the node, so tenants with encryption enabled cannot
+// use deltas.
+func (h *Handler) patchDelta(w http.ResponseWriter, r *http.Request, key string) {
+	ifMatch := strings.Trim(strings.TrimSpace(r.Header.Get("If-Match")), `"`)
+	if ifMatch == "" {
+		respondErrorCode(w, http.StatusPreconditionRequired, models.ErrCodeConditionFailed,
+			"Delta writes require If-Match with the version the delta was made against", nil)
+		return
+	}
+	if _, err := strconv.ParseUint(ifMatch, 10, 64); err != nil {
+		respondError(w, http.StatusBadRequest, "If-Match must be a version number")
+		return
+	}
+
+	if tenantKey(r) != nil {
+		respondError(w, http.StatusUnsupportedMediaType, "Delta writes are not available with encryption at rest")
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	consistency := requestConsistency(r, key)
+	if consistency != "strong" && consistency != "eventual" {
+		respondError(w, http.StatusBadRequest, "Invalid consistency level. Must be 'strong' or 'eventual'")
+		return
+	}
+
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	session, ok := readSession(w, r)
+	if !ok {
+		return
+	}
+
+	nodes := h.locateKey(r.Context(), key)
+	if len(nodes) == 0 {
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
+		return
+	}
+
+	primaryNode := nodes[0]
+	replicaNodes := nodes[1:]
+
+	if h.rejectIfSuspected(w, primaryNode) {
+		return
+	}
+
+	log.Printf("PATCH (delta, %d bytes) key=%s primary=%s replicas=%v (user=%d, consistency=%s)\n",
+		len(patch), key, primaryNode, replicaNodes, userID, consistency)
+
+	req, err := http.NewRequestWithContext(r.Context(), "PATCH", fmt.Sprintf("%s/store/%s", primaryNode, key), bytes.NewReader(patch))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create request")
+		return
+	}
+	req.Header.Set("Content-Type", delta.ContentType)
+	req.Header.Set("X-User-ID", fmt.Sprintf("%d", userID))
+	req.Header.Set("If-Match", ifMatch)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		log.Printf("Error forwarding request to primary node: %v\n", err)
+		respondNodeError(w, err, "Primary node unavailable")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		forwardResponse(w, resp)
+		return
+	}
+	defer resp.Body.Close()
+
+	// The whole new value is needed to replicate it
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading patched value from primary node: %v\n", err)
+		respondNodeError(w, err, "Primary node unavailable")
+		return
+	}
+	version, _ := strconv.ParseUint(resp.Header.Get("X-Version"), 10, 64)
+	operations, _ := strconv.Atoi(resp.Header.Get("X-Delta-Operations"))
+
+	// Replicas keep the key's remaining TTL
+	ttl, sliding := time.Duration(0), false
+	if slidingTTL, err := time.ParseDuration(resp.Header.Get("X-Sliding-TTL")); err == nil {
+		ttl, sliding = slidingTTL, true
+	} else if expiresAt, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Expires-At")); err == nil {
+		ttl = time.Until(expiresAt)
+		if ttl <= 0 {
+			ttl = time.Millisecond
+		}
+	}
+
+	if len(replicaNodes) > 0 || h.rollouts.Active() {
+		replReq := models.ReplicationRequest{
+			Key:          key,
+			Value:        value,
+			Operation:    "SET",
+			TTL:          ttl,
+			Sliding:      sliding,
+			Consistency:  consistency,
+			PrimaryNode:  primaryNode,
+			ReplicaNodes: replicaNodes,
+			UserID:       userID,
+			RequestID:    requestid.FromContext(r.Context()),
+			Version:      version,
+
+			ReplicationFactor: replicationFactor(r.Context(), key),
+		}
+
+		h.triggerReplication(r.Context(), &replReq, consistency)
+	}
+
+	session.Record(key, primaryNode, version, false)
+	session.Set(w)
+
+	// The new value is not sent back; its size and checksum let the client
+	// check it matches its own copy
+	w.Header().Set("X-Primary-Node", primaryNode)
+	w.Header().Set("X-Version", strconv.FormatUint(version, 10))
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":      true,
+		"key":          key,
+		"version":      version,
+		"size":         len(value),
+		"checksum":     resp.Header.Get("X-Checksum"),
+		"operations":   operations,
+		"delta_bytes":  len(patch),
+		"primary_node": primaryNode,
+		"consistency":  consistency,
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"dht/internal/discovery"
+)
+
+// ringChange is one membership change applied to the ring
+type ringChange struct {
+	event    *RingEvent
+	previous []string
+}
+
+// startDiscovery follows the Kubernetes provider, starting from the states
+// the ring was seeded with
+func (h *Handler) startDiscovery(provider *discovery.Kubernetes, initial map[string]discovery.State) {
+	h.ringMu.Lock()
+	h.discovered = initial
+	h.ringMu.Unlock()
+
+	go provider.Watch(context.Background(), h.applyDiscovery)
+}
+
+// applyDiscovery reconciles the ring with the node states reported by
+// discovery. Only transitions act: a node joins when it becomes ready and
+// leaves when it starts terminating or disappears. A node that merely turns
+// unready stays (the failure detector handles outages), and a node evicted
+// while still reported ready is not re-added until its pod changes state.
+func (h *Handler) applyDiscovery(states map[string]discovery.State) {
+	h.ringMu.Lock()
+	defer h.ringMu.Unlock()
+
+	nodes := make([]string, 0, len(states)+len(h.discovered))
+	for node := range states {
+		nodes = append(nodes, node)
+	}
+	for node := range h.discovered {
+		if _, exists := states[node]; !exists {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+
+	var changes []ringChange
+	for _, node := range nodes {
+		state, exists := states[node]
+		previous, known := h.discovered[node]
+
+		switch {
+		case exists && state == discovery.Ready && (!known || previous != discovery.Ready):
+			if h.ring.HasNode(node) {
+				continue
+			}
+			ring := h.ring.GetAllNodes()
+			h.ring.AddNode(node)
+			h.detector.Watch(node)
+			changes = append(changes, ringChange{
+				event:    h.recordRingChange("added", node, "pod ready"),
+				previous: ring,
+			})
+			log.Printf("Discovery: node %s is ready, added to the ring\n", node)
+
+		case (!exists || state == discovery.Terminating) && h.ring.HasNode(node):
+			reason := "pod removed"
+			if exists {
+				reason = "pod terminating"
+			}
+			ring := h.ring.GetAllNodes()
+			h.ring.RemoveNode(node)
+			h.detector.Remove(node)
+			delete(h.suspectedSince, node)
+			changes = append(changes, ringChange{
+				event:    h.recordRingChange("removed", node, reason),
+				previous: ring,
+			})
+			log.Printf("Discovery: node %s left (%s), removed from the ring\n", node, reason)
+		}
+	}
+	h.discovered = states
+
+	// Rebalance one change at a time so each copy plan sees the ring it
+	// was made for
+	if len(changes) > 0 {
+		go func() {
+			for _, change := range changes {
+				h.rebalance(change.event, change.previous, change.event.Ring, nil)
+			}
+		}()
+	}
+}
+
+// recordRingChange logs a discovery-driven membership change; caller must
+// hold h.ringMu
+func (h *Handler) recordRingChange(eventType, node, reason string) *RingEvent {
+	event := &RingEvent{
+		Time:   time.Now(),
+		Type:   eventType,
+		Node:   node,
+		Reason: reason + " (kubernetes discovery)",
+		Ring:   h.ring.GetAllNodes(),
+		Epoch:  h.ring.Epoch(),
+	}
+	h.ringEvents.Record(event)
+	return event
+}
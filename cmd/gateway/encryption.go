@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"dht/internal/envelope"
+	"dht/internal/middleware"
+	"dht/internal/models"
+)
+
+// kmsCacheTTL bounds how long a key resolved from a KMS reference is reused,
+// so rotated key files or variables are picked up
+const kmsCacheTTL = time.Minute
+
+type cachedKey struct {
+	key      []byte
+	loadedAt time.Time
+}
+
+// TenantKeyResolver turns the encryption info returned by API key
+// validation into a usable data-encryption key
+type TenantKeyResolver struct {
+	kek      []byte
+	kms      envelope.KMSPolicy
+	kmsCache map[string]cachedKey
+	mu       sync.Mutex
+}
+
+// NewTenantKeyResolver creates a resolver; kek may be nil if only KMS
+// references are used, and kms limits the keys those may point to
+func NewTenantKeyResolver(kek []byte, kms envelope.KMSPolicy) *TenantKeyResolver {
+	return &TenantKeyResolver{
+		kek:      kek,
+		kms:      kms,
+		kmsCache: make(map[string]cachedKey),
+	}
+}
+
+// Resolve returns the tenant's data-encryption key
+func (tr *TenantKeyResolver) Resolve(enc *models.TenantEncryption) ([]byte, error) {
+	switch enc.Source {
+	case "key":
+		if tr.kek == nil {
+			return nil, fmt.Errorf("gateway has no key-encryption key configured")
+		}
+		key, err := envelope.Unwrap(tr.kek, enc.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap tenant key: %w", err)
+		}
+		if enc.KeyID != "" && envelope.KeyID(key) != enc.KeyID {
+			return nil, fmt.Errorf("unwrapped tenant key does not match key id %s", enc.KeyID)
+		}
+		return key, nil
+	case "kms":
+		tr.mu.Lock()
+		cached, ok := tr.kmsCache[enc.KMSURI]
+		tr.mu.Unlock()
+		if ok && time.Since(cached.loadedAt) < kmsCacheTTL {
+			return cached.key, nil
+		}
+
+		key, err := tr.kms.Resolve(enc.KMSURI)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", enc.KMSURI, err)
+		}
+
+		tr.mu.Lock()
+		tr.kmsCache[enc.KMSURI] = cachedKey{key: key, loadedAt: time.Now()}
+		tr.mu.Unlock()
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unknown key source %q", enc.Source)
+	}
+}
+
+// tenantKey returns the requesting tenant's data-encryption key, or nil if
+// the tenant's values are stored in plaintext
+func tenantKey(r *http.Request) []byte {
+	return middleware.TenantKey(r.Context())
+}
+
+// openValue decrypts a value read from a node. Values written before the
+// tenant enabled encryption are returned as-is.
+func openValue(dek []byte, key string, value []byte) ([]byte, error) {
+	if dek == nil || !envelope.IsSealed(value) {
+		return value, nil
+	}
+	return envelope.Open(dek, []byte(key), value)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRingEvents is how many ring membership events are kept for the admin API
+const maxRingEvents = 100
+
+// RingEvent is an entry of the ring membership audit log
+type RingEvent struct {
+	Time      time.Time                `json:"time"`
+	Type      string                   `json:"type"` // "evicted", "recovered", "added", "removed" or "replaced"
+	Node      string                   `json:"node"`
+	Reason    string                   `json:"reason"`
+	Phi       float64                  `json:"phi,omitempty"`
+	Ring      []string                 `json:"ring"`
+	Epoch     uint64                   `json:"epoch"` // Ring epoch after the event
+	Rebalance []map[string]interface{} `json:"rebalance,omitempty"`
+	CatchUp   map[string]interface{}   `json:"catch_up,omitempty"`
+}
+
+// RingEvents keeps the most recent ring membership events
+type RingEvents struct {
+	events []*RingEvent
+	mu     sync.RWMutex
+}
+
+// Record appends an event, dropping the oldest beyond maxRingEvents
+func (re *RingEvents) Record(event *RingEvent) {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	re.events = append(re.events, event)
+	if len(re.events) > maxRingEvents {
+		re.events = re.events[len(re.events)-maxRingEvents:]
+	}
+}
+
+// SetRebalance attaches the per-node outcome of the rebalance an event triggered
+func (re *RingEvents) SetRebalance(event *RingEvent, results []map[string]interface{}) {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	event.Rebalance = results
+}
+
+// SetCatchUp attaches the outcome of the catch-up a recovery triggered
+func (re *RingEvents) SetCatchUp(event *RingEvent, result map[string]interface{}) {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	event.CatchUp = result
+}
+
+// List returns copies of all events, newest first
+func (re *RingEvents) List() []RingEvent {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+
+	events := make([]RingEvent, 0, len(re.events))
+	for i := len(re.events) - 1; i >= 0; i-- {
+		events = append(events, *re.events[i])
+	}
+	return events
+}
+
+// checkEvictions evicts a node that has been suspected down for longer than
+// the grace period. Nothing is evicted while most of the ring looks down,
+// since that points at a problem on the gateway's side rather than the nodes'.
+// A suspected node that comes back is told to catch up on the writes it missed.
+func (h *Handler) checkEvictions() {
+	h.ringMu.Lock()
+	defer h.ringMu.Unlock()
+
+	nodes := h.ring.GetAllNodes()
+	now := time.Now()
+	suspected := 0
+	for _, node := range nodes {
+		if h.nodeAvailable(node) {
+			if since, exists := h.suspectedSince[node]; exists {
+				delete(h.suspectedSince, node)
+				log.Printf("Node %s recovered after %v suspected down\n", node, now.Sub(since).Round(time.Second))
+				event := &RingEvent{
+					Time:   now,
+					Type:   "recovered",
+					Node:   node,
+					Reason: "suspected down for " + now.Sub(since).Round(time.Second).String(),
+					Ring:   nodes,
+					Epoch:  h.ring.Epoch(),
+				}
+				h.ringEvents.Record(event)
+				go h.catchUp(event)
+			}
+			continue
+		}
+		suspected++
+		if _, exists := h.suspectedSince[node]; !exists {
+			h.suspectedSince[node] = now
+		}
+	}
+
+	grace := h.config.NodeEvictionGrace
+	if grace <= 0 || len(nodes) < 2 || suspected*2 > len(nodes) {
+		return
+	}
+
+	// One node per round, so the next check sees the rebalanced ring
+	for _, node := range nodes {
+		since, exists := h.suspectedSince[node]
+		if !exists || now.Sub(since) < grace {
+			continue
+		}
+
+		phi := h.detector.Phi(node)
+		log.Printf("Evicting node %s: suspected down for %v (phi=%.1f)\n", node, now.Sub(since).Round(time.Second), phi)
+
+		h.ring.RemoveNode(node)
+		h.detector.Remove(node)
+		delete(h.suspectedSince, node)
+
+		event := &RingEvent{
+			Time:   now,
+			Type:   "evicted",
+			Node:   node,
+			Reason: "suspected down for " + now.Sub(since).Round(time.Second).String(),
+			Phi:    phi,
+			Ring:   h.ring.GetAllNodes(),
+			Epoch:  h.ring.Epoch(),
+		}
+		h.ringEvents.Record(event)
+		go h.rebalance(event, nodes, event.Ring, nil)
+		return
+	}
+}
+
+// rebalance asks every node of the new ring to copy the keys it is
+// responsible for to the nodes that gained them. replaced maps nodes that
+// left the ring to the replacements holding their keys.
+func (h *Handler) rebalance(event *RingEvent, previous, ring []string, replaced map[string]string) {
+	// Copying a node's worth of keys can take much longer than a normal request
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	results := make([]map[string]interface{}, len(ring))
+	var wg sync.WaitGroup
+	for i, nodeURL := range ring {
+		wg.Add(1)
+		go func(i int, nodeURL string) {
+			defer wg.Done()
+
+			result := map[string]interface{}{"node": nodeURL}
+			results[i] = result
+
+			payload, _ := json.Marshal(map[string]interface{}{
+				"self":     nodeURL,
+				"previous": previous,
+				"ring":     ring,
+				"replicas": 3,
+				"replaced": replaced,
+			})
+			req, err := http.NewRequestWithContext(ctx, "POST", nodeURL+"/admin/rebalance", bytes.NewReader(payload))
+			if err != nil {
+				result["error"] = err.Error()
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := h.httpClient.Do(req)
+			if err != nil {
+				result["error"] = err.Error()
+				return
+			}
+			defer resp.Body.Close()
+
+			var body map[string]interface{}
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&body) != nil {
+				result["error"] = "rebalance failed with status " + resp.Status
+				return
+			}
+			for _, field := range []string{"scanned", "copied", "failed"} {
+				result[field] = body[field]
+			}
+		}(i, nodeURL)
+	}
+	wg.Wait()
+
+	log.Printf("Rebalance after %s of %s finished on %d nodes\n", event.Type, event.Node, len(ring))
+	h.ringEvents.SetRebalance(event, results)
+}
+
+// catchUp asks a node back from downtime to pull the writes it missed from
+// the primaries of the keys it replicates. Replication retries for it may
+// long have been given up.
+func (h *Handler) catchUp(event *RingEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	result := map[string]interface{}{"node": event.Node}
+	defer h.ringEvents.SetCatchUp(event, result)
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"self":     event.Node,
+		"ring":     event.Ring,
+		"replicas": 3,
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", event.Node+"/admin/catchup", bytes.NewReader(payload))
+	if err != nil {
+		result["error"] = err.Error()
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		result["error"] = err.Error()
+		log.Printf("Catch-up of %s failed: %v\n", event.Node, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var body map[string]interface{}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&body) != nil {
+		result["error"] = "catch-up failed with status " + resp.Status
+		log.Printf("Catch-up of %s failed with status %s\n", event.Node, resp.Status)
+		return
+	}
+	for _, field := range []string{"pulled", "deleted", "failed"} {
+		result[field] = body[field]
+	}
+	log.Printf("Catch-up of %s finished: pulled=%v deleted=%v\n", event.Node, body["pulled"], body["deleted"])
+}
+
+// AddNode handles POST /admin/nodes, (re)admitting a node to the ring
+// An evicted node is not re-added automatically: its data is stale, so an
+// operator decides when it rejoins. Keys it now owns are copied to it.
+func (h *Handler) AddNode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Node string `json:"node"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Node == "" {
+		respondError(w, http.StatusBadRequest, "node is required")
+		return
+	}
+	req.Node = strings.TrimRight(req.Node, "/")
+
+	h.ringMu.Lock()
+	defer h.ringMu.Unlock()
+
+	if h.ring.HasNode(req.Node) {
+		respondError(w, http.StatusConflict, "Node is already in the ring")
+		return
+	}
+
+	previous := h.ring.GetAllNodes()
+	h.ring.AddNode(req.Node)
+	h.detector.Watch(req.Node)
+
+	event := &RingEvent{
+		Time:   time.Now(),
+		Type:   "added",
+		Node:   req.Node,
+		Reason: "added by operator",
+		Ring:   h.ring.GetAllNodes(),
+		Epoch:  h.ring.Epoch(),
+	}
+	h.ringEvents.Record(event)
+	added := *event
+	go h.rebalance(event, previous, event.Ring, nil)
+
+	log.Printf("Node %s added to the ring\n", req.Node)
+	respondJSON(w, http.StatusOK, added)
+}
+
+// RingHistory handles GET /admin/ring/events
+func (h *Handler) RingHistory(w http.ResponseWriter, r *http.Request) {
+	events := h.ringEvents.List()
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"events": events,
+		"count":  len(events),
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"dht/internal/models"
+)
+
+// WriteFreeze is the cluster-wide write pause toggled through the admin API
+type WriteFreeze struct {
+	frozen bool
+	reason string
+	since  time.Time
+	mu     sync.RWMutex
+}
+
+// Freeze pauses writes, keeping the original reason if already frozen
+func (wf *WriteFreeze) Freeze(reason string) {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+
+	if wf.frozen {
+		return
+	}
+	wf.frozen = true
+	wf.reason = reason
+	wf.since = time.Now()
+}
+
+// Unfreeze resumes writes
+func (wf *WriteFreeze) Unfreeze() {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+
+	wf.frozen = false
+	wf.reason = ""
+	wf.since = time.Time{}
+}
+
+// Status returns whether writes are frozen, why and since when
+func (wf *WriteFreeze) Status() (frozen bool, reason string, since time.Time) {
+	wf.mu.RLock()
+	defer wf.mu.RUnlock()
+
+	return wf.frozen, wf.reason, wf.since
+}
+
+// rejectIfFrozen responds 503 with code "writes_frozen" while writes are frozen
+func (h *Handler) rejectIfFrozen(w http.ResponseWriter) bool {
+	frozen, reason, since := h.freeze.Status()
+	if !frozen {
+		return false
+	}
+
+	respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeWritesFrozen, "Writes are frozen cluster-wide", map[string]interface{}{
+		"reason": reason,
+		"since":  since,
+	})
+	return true
+}
+
+// FreezeWrites handles POST /admin/freeze
+// The freeze is applied here and pushed to every node, so writes arriving
+// through other gateways are refused as well.
+func (h *Handler) FreezeWrites(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	h.freeze.Freeze(req.Reason)
+	log.Printf("Writes frozen cluster-wide (reason: %q)\n", req.Reason)
+
+	results := h.broadcast(r.Context(), "POST", "/admin/freeze", 0, req)
+	h.respondFreezeStatus(w, results)
+}
+
+// UnfreezeWrites handles POST /admin/unfreeze
+func (h *Handler) UnfreezeWrites(w http.ResponseWriter, r *http.Request) {
+	h.freeze.Unfreeze()
+	log.Println("Writes unfrozen cluster-wide")
+
+	results := h.broadcast(r.Context(), "POST", "/admin/unfreeze", 0, nil)
+	h.respondFreezeStatus(w, results)
+}
+
+// FreezeStatus handles GET /admin/freeze
+func (h *Handler) FreezeStatus(w http.ResponseWriter, r *http.Request) {
+	results := h.broadcast(r.Context(), "GET", "/admin/freeze", 0, nil)
+	h.respondFreezeStatus(w, results)
+}
+
+// respondFreezeStatus reports the gateway's freeze state alongside each node's
+func (h *Handler) respondFreezeStatus(w http.ResponseWriter, results []nodeResult) {
+	nodes := make([]map[string]interface{}, 0, len(results))
+	unreachable := 0
+	for _, res := range results {
+		node := map[string]interface{}{"url": res.node}
+		var body struct {
+			Frozen bool `json:"frozen"`
+		}
+		if res.err != nil || res.status != http.StatusOK || json.Unmarshal(res.body, &body) != nil {
+			node["error"] = "unreachable"
+			unreachable++
+		} else {
+			node["frozen"] = body.Frozen
+		}
+		nodes = append(nodes, node)
+	}
+
+	frozen, reason, since := h.freeze.Status()
+	status := map[string]interface{}{
+		"frozen":            frozen,
+		"nodes":             nodes,
+		"nodes_unreachable": unreachable,
+	}
+	if frozen {
+		status["reason"] = reason
+		status["since"] = since
+	}
+
+	respondJSON(w, http.StatusOK, status)
+}
@@ -2,35 +2,111 @@ package main
 
 import (
 	"bytes"
-	_ "context"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
+	"dht/internal/buildinfo"
 	"dht/internal/config"
+	"dht/internal/discovery"
+	"dht/internal/envelope"
+	"dht/internal/failure"
 	"dht/internal/hashring"
+	"dht/internal/httpx"
+	"dht/internal/middleware"
 	"dht/internal/models"
+	"dht/internal/proto"
+	"dht/internal/requestid"
 )
 
 type Handler struct {
 	config           *config.Config
 	ring             *hashring.HashRing
 	rateLimiterStore *RateLimiterStore
-	httpClient       *http.Client
+	negativeCache    *NegativeCache
+	freeze           *WriteFreeze
+	detector         *failure.Detector
+	httpClient       *httpx.Client
+	backends         *httpx.Metrics
+
+	// Ring membership changes (evictions, re-adds, discovery) and their audit log
+	ringMu         sync.Mutex
+	suspectedSince map[string]time.Time       // guarded by ringMu
+	discovered     map[string]discovery.State // guarded by ringMu
+	ringEvents     *RingEvents
+
+	// Per-tenant storage metering
+	meter *StorageMeter
+
+	// Continuous checks of replication guarantees
+	canary *Canary
+
+	// Background refreshes of stale-while-revalidate reads
+	revalidator *Revalidator
+
+	// Gradual replacements of ring nodes
+	rollouts *Rollouts
+
+	// Reported with the build in /health and /version
+	configFingerprint string
 }
 
 func NewHandler(cfg *config.Config, ring *hashring.HashRing, rls *RateLimiterStore) *Handler {
-	return &Handler{
+	detectorCfg := failure.DefaultConfig(cfg.HeartbeatInterval)
+	detectorCfg.Threshold = cfg.PhiThreshold
+	detector := failure.NewDetector(detectorCfg)
+	for _, node := range ring.GetAllNodes() {
+		detector.Watch(node)
+	}
+
+	h := &Handler{
 		config:           cfg,
 		ring:             ring,
 		rateLimiterStore: rls,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		negativeCache:    NewNegativeCache(cfg.NegativeCacheTTL, cfg.NegativeCacheSize),
+		freeze:           &WriteFreeze{},
+		detector:         detector,
+		suspectedSince:   make(map[string]time.Time),
+		ringEvents:       &RingEvents{},
+		backends:         httpx.NewMetrics(),
+		meter:            &StorageMeter{},
+		canary:           NewCanary(),
+		revalidator:      NewRevalidator(),
+		rollouts:         NewRollouts(),
+
+		configFingerprint: cfg.Fingerprint(),
+	}
+	// Calls are bounded by their request's deadline rather than a client timeout
+	h.httpClient = httpx.New(httpx.Config{
+		MaxRetries:   cfg.HTTPMaxRetries,
+		RetryBackoff: cfg.HTTPRetryBackoff,
+		H2C:          cfg.H2C,
+		Observer:     h.observeCall,
+	})
+
+	// Start heartbeating nodes for the failure detector
+	go h.monitorNodes(cfg.HeartbeatInterval)
+
+	// Start metering tenant storage
+	if cfg.MeteringInterval > 0 {
+		go h.meterStorage(cfg.MeteringInterval)
+	}
+
+	// Start checking consistency with sentinel writes
+	if cfg.CanaryInterval > 0 {
+		go h.runCanaryLoop(cfg.CanaryInterval)
 	}
+
+	return h
 }
 
 // PutKey handles PUT /v1/kv/:key
@@ -41,6 +117,10 @@ func (h *Handler) PutKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectIfFrozen(w) {
+		return
+	}
+
 	// Read request body (the value to store)
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -49,11 +129,7 @@ func (h *Handler) PutKey(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Get consistency level from header (default: eventual)
-	consistency := r.Header.Get("X-Consistency")
-	if consistency == "" {
-		consistency = "eventual"
-	}
+	consistency := requestConsistency(r, key)
 
 	// Validate consistency level
 	if consistency != "strong" && consistency != "eventual" {
@@ -70,26 +146,77 @@ func (h *Handler) PutKey(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Sliding TTL: reads refresh the expiry (session stores, idle-expiry caches)
+	sliding, _ := strconv.ParseBool(r.URL.Query().Get("sliding"))
+	if sliding && ttl <= 0 {
+		respondError(w, http.StatusBadRequest, "Sliding expiry requires a ttl")
+		return
+	}
+
 	// Get user ID from context (set by auth middleware)
-	userID := r.Context().Value("user_id").(int64)
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	session, ok := readSession(w, r)
+	if !ok {
+		return
+	}
+
+	// Encrypt with the tenant key so nodes only ever store ciphertext
+	valueBytes := len(body)
+	if dek := tenantKey(r); dek != nil {
+		body, err = envelope.Seal(dek, []byte(key), body)
+		if err != nil {
+			log.Printf("Error encrypting value: %v\n", err)
+			respondError(w, http.StatusInternalServerError, "Failed to encrypt value")
+			return
+		}
+	}
 
 	// Use hash ring to determine primary and replica nodes
-	nodes := h.ring.LocateKey(key, 3) // Get 3 nodes (1 primary + 2 replicas)
+	nodes := h.locateKey(r.Context(), key) // Primary first, then its replicas
 	if len(nodes) == 0 {
-		respondError(w, http.StatusServiceUnavailable, "No nodes available")
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
 		return
 	}
 
 	primaryNode := nodes[0]
 	replicaNodes := nodes[1:]
 
+	if h.rejectIfSuspected(w, primaryNode) {
+		return
+	}
+
+	if isDryRun(r) {
+		respondDryRun(w, "PUT", key, primaryNode, replicaNodes, consistency, map[string]interface{}{
+			"value_bytes":  valueBytes,
+			"stored_bytes": len(body),
+			"encrypted":    tenantKey(r) != nil,
+			"ttl":          ttl.String(),
+			"sliding":      sliding,
+
+			"replication_factor": len(nodes),
+		})
+		return
+	}
+
 	log.Printf("PUT key=%s primary=%s replicas=%v (user=%d, consistency=%s)\n",
 		key, primaryNode, replicaNodes, userID, consistency)
 
+	// The key may have been cached as missing
+	h.negativeCache.Invalidate(key)
+
 	// Write to primary node first
 	reqURL := fmt.Sprintf("%s/store/%s", primaryNode, key)
 	if ttl > 0 {
 		reqURL = fmt.Sprintf("%s?ttl=%s", reqURL, ttl.String())
+		if sliding {
+			reqURL += "&sliding=true"
+		}
+		if r.URL.Query().Get("jitter") == "false" {
+			reqURL += "&jitter=false"
+		}
 	}
 
 	req, err := http.NewRequestWithContext(r.Context(), "PUT", reqURL, bytes.NewReader(body))
@@ -101,12 +228,13 @@ func (h *Handler) PutKey(w http.ResponseWriter, r *http.Request) {
 
 	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
 	req.Header.Set("X-User-ID", fmt.Sprintf("%d", userID))
+	setReplicationFactor(req, key)
 
 	// Send request to primary DHT node
 	resp, err := h.httpClient.Do(req)
 	if err != nil {
 		log.Printf("Error forwarding request to primary node: %v\n", err)
-		respondError(w, http.StatusServiceUnavailable, "Primary node unavailable")
+		respondNodeError(w, err, "Primary node unavailable")
 		return
 	}
 	defer resp.Body.Close()
@@ -119,29 +247,55 @@ func (h *Handler) PutKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The primary may have jittered the TTL; replicas expire the key with it
+	var expiresAt *time.Time
+	if t, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Expires-At")); err == nil && !sliding {
+		expiresAt = &t
+		ttl = time.Until(t)
+		if ttl <= 0 {
+			ttl = time.Millisecond
+		}
+	}
+
+	version, _ := strconv.ParseUint(resp.Header.Get("X-Version"), 10, 64)
+
 	// Trigger replication if there are replica nodes
-	if len(replicaNodes) > 0 {
+	if len(replicaNodes) > 0 || h.rollouts.Active() {
 		replReq := models.ReplicationRequest{
 			Key:          key,
 			Value:        body,
 			Operation:    "SET",
 			TTL:          ttl,
+			Sliding:      sliding,
 			Consistency:  consistency,
 			PrimaryNode:  primaryNode,
 			ReplicaNodes: replicaNodes,
 			UserID:       userID,
+			RequestID:    requestid.FromContext(r.Context()),
+			Version:      version,
+
+			ReplicationFactor: replicationFactor(r.Context(), key),
 		}
 
-		h.triggerReplication(&replReq, consistency)
+		h.triggerReplication(r.Context(), &replReq, consistency)
 	}
 
+	// Later reads of the session must see this version
+	session.Record(key, primaryNode, version, false)
+	session.Set(w)
+
 	// Return success response
-	respondJSON(w, http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"success":      true,
 		"key":          key,
 		"primary_node": primaryNode,
 		"replicas":     len(replicaNodes),
-	})
+		"version":      version,
+	}
+	if expiresAt != nil {
+		response["expires_at"] = expiresAt
+	}
+	respondJSON(w, http.StatusOK, response)
 }
 
 // GetKey handles GET /v1/kv/:key
@@ -152,45 +306,112 @@ func (h *Handler) GetKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get consistency level from header (default: eventual)
-	consistency := r.Header.Get("X-Consistency")
-	if consistency == "" {
-		consistency = "eventual"
+	consistency := requestConsistency(r, key)
+
+	// max_staleness implies a stale read bounded by the given age
+	maxStaleness := time.Duration(0)
+	if msStr := r.URL.Query().Get("max_staleness"); msStr != "" {
+		ms, err := time.ParseDuration(msStr)
+		if err != nil || ms <= 0 {
+			respondError(w, http.StatusBadRequest, "Invalid max_staleness. Must be a positive duration (e.g. 30s)")
+			return
+		}
+		maxStaleness = ms
+		consistency = "stale"
 	}
 
 	// Validate consistency level
-	if consistency != "strong" && consistency != "eventual" {
-		respondError(w, http.StatusBadRequest, "Invalid consistency level. Must be 'strong' or 'eventual'")
+	switch consistency {
+	case "strong", "eventual", "stale":
+	case "stale-while-revalidate":
+		if maxStaleness > 0 {
+			respondError(w, http.StatusBadRequest, "max_staleness cannot be combined with stale-while-revalidate")
+			return
+		}
+	default:
+		respondError(w, http.StatusBadRequest, "Invalid consistency level. Must be 'strong', 'eventual', 'stale' or 'stale-while-revalidate'")
 		return
 	}
 
+	// Optional JSONPath selecting part of a JSON document, evaluated on the node
+	query := ""
+	if path := r.URL.Query().Get("path"); path != "" {
+		if tenantKey(r) != nil {
+			respondError(w, http.StatusBadRequest, "Path reads are not supported for encrypted values")
+			return
+		}
+		query = url.Values{"path": {path}}.Encode()
+	}
+
 	// Get user ID from context
-	userID := r.Context().Value("user_id").(int64)
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 
-	// Use hash ring to determine which node should handle this key
-	nodeURL := h.ring.GetNode(key)
-	log.Printf("GET key=%s routed to node=%s (user=%d, consistency=%s)\n", key, nodeURL, userID, consistency)
+	// The session's own write of the key, which the read must reflect
+	session, ok := readSession(w, r)
+	if !ok {
+		return
+	}
+	required := session.Require(key)
 
-	// Forward request to DHT node
-	reqURL := fmt.Sprintf("%s/store/%s", nodeURL, key)
-	req, err := http.NewRequestWithContext(r.Context(), "GET", reqURL, nil)
-	if err != nil {
-		log.Printf("Error creating request: %v\n", err)
-		respondError(w, http.StatusInternalServerError, "Failed to create request")
+	if consistency == "stale" || consistency == "stale-while-revalidate" {
+		h.getStale(w, r, key, query, userID, maxStaleness, consistency == "stale-while-revalidate", required)
 		return
 	}
 
-	// Forward headers
-	req.Header.Set("X-Consistency", consistency)
-	req.Header.Set("X-User-ID", fmt.Sprintf("%d", userID))
+	// Eventual reads may be answered from the negative cache; strong reads
+	// always go to the node, and so do reads of keys the session wrote
+	useNegativeCache := consistency == "eventual" && (required == nil || required.Deleted)
+	if useNegativeCache && h.negativeCache.IsMissing(key) {
+		w.Header().Set("X-Cache", "HIT")
+		respondError(w, http.StatusNotFound, "Key not found")
+		return
+	}
 
-	// Send request to DHT node
-	resp, err := h.httpClient.Do(req)
+	// Use hash ring to determine which node should handle this key
+	nodes := h.locateKey(r.Context(), key)
+	if len(nodes) == 0 {
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
+		return
+	}
+	nodeURL := nodes[0]
+
+	// Eventual reads fail over to a replica while the primary is suspected
+	// down; strong reads need the primary and fail fast instead
+	failover := false
+	if consistency == "eventual" && len(nodes) > 1 && !h.nodeAvailable(nodeURL) {
+		nodeURL = h.preferAvailable(nodes[1:])[0]
+		failover = true
+	} else if h.rejectIfSuspected(w, nodeURL) {
+		return
+	}
+	log.Printf("GET key=%s routed to node=%s (user=%d, consistency=%s, failover=%t)\n", key, nodeURL, userID, consistency, failover)
+
+	// Forward request to DHT node
+	lookupStart := time.Now()
+	resp, err := h.fetchFromNode(r.Context(), nodeURL, key, query, userID, consistency)
 	if err != nil {
 		log.Printf("Error forwarding request to DHT node: %v\n", err)
-		respondError(w, http.StatusServiceUnavailable, "DHT node unavailable")
+		respondNodeError(w, err, "DHT node unavailable")
 		return
 	}
+
+	// A replica that has not caught up with the session's write cannot
+	// answer; the primary has it
+	if failover && required != nil && !required.SatisfiedBy(nodeURL, resp) {
+		resp.Body.Close()
+		log.Printf("GET key=%s: replica %s is behind the session's write, reading from the primary\n", key, nodeURL)
+		nodeURL = nodes[0]
+		failover = false
+		resp, err = h.fetchFromNode(r.Context(), nodeURL, key, query, userID, consistency)
+		if err != nil {
+			log.Printf("Error forwarding request to DHT node: %v\n", err)
+			respondNodeError(w, err, "DHT node unavailable")
+			return
+		}
+	}
 	defer resp.Body.Close()
 
 	// Read response from DHT node
@@ -201,12 +422,192 @@ func (h *Handler) GetKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Forward DHT node response to client
+	// Remember missing keys (with a path, a 404 may mean only the path is missing;
+	// a replica may simply not have caught up)
+	if resp.StatusCode == http.StatusNotFound && query == "" && !failover {
+		h.negativeCache.AddMissing(key, lookupStart)
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		responseBody, err = openValue(tenantKey(r), key, responseBody)
+		if err != nil {
+			log.Printf("Error decrypting key=%s: %v\n", key, err)
+			respondError(w, http.StatusInternalServerError, "Failed to decrypt value")
+			return
+		}
+	}
+
+	// Forward DHT node response to client (the primary's version can guard transactions)
 	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	if failover {
+		w.Header().Set("X-Served-By", nodeURL)
+	} else if version := resp.Header.Get("X-Version"); version != "" {
+		w.Header().Set("X-Version", version)
+	}
 	w.WriteHeader(resp.StatusCode)
 	w.Write(responseBody)
 }
 
+// getStale serves a read from any replica of the key without touching the
+// primary. Replicas are tried in random order; the age of the returned copy
+// is reported in the X-Data-Age header. When maxStaleness is set, copies
+// older than that are skipped and the primary is used as a last resort.
+// With revalidate, the primary is the last resort too, and a read served by a
+// replica refreshes the replicas it saw from the primary in the background.
+// A session's own write (required, may be nil) skips replicas that have not
+// caught up with it, falling back to the primary.
+func (h *Handler) getStale(w http.ResponseWriter, r *http.Request, key, query string, userID int64, maxStaleness time.Duration, revalidate bool, required *sessionWrite) {
+	nodes := h.locateKey(r.Context(), key)
+	if len(nodes) == 0 {
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
+		return
+	}
+
+	// Single-node clusters have no replicas, so the primary is the only copy
+	candidates := nodes
+	if len(nodes) > 1 {
+		candidates = append([]string(nil), nodes[1:]...)
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	candidates = h.preferAvailable(candidates)
+	if (maxStaleness > 0 || revalidate || required != nil) && len(nodes) > 1 {
+		candidates = append(candidates, nodes[0])
+	}
+
+	// The primary's copy of the key tells how far a replica trails it. Only
+	// its metadata is read, alongside the replica read, and not while the
+	// primary is suspected.
+	var primaryCopy chan replicaStatus
+	if len(nodes) > 1 && h.nodeAvailable(nodes[0]) {
+		primaryCopy = make(chan replicaStatus, 1)
+		go func() { primaryCopy <- h.readKeyCopy(r.Context(), nodes[0], key, userID) }()
+	}
+	var primary *replicaStatus
+	primaryStatus := func() *replicaStatus {
+		if primary == nil && primaryCopy != nil {
+			status := <-primaryCopy
+			primary = &status
+		}
+		return primary
+	}
+
+	notFound := false
+	var missing []replicaCopy // replicas that do not have the key
+	for _, nodeURL := range candidates {
+		log.Printf("GET key=%s stale read from node=%s (user=%d, max_staleness=%v)\n", key, nodeURL, userID, maxStaleness)
+
+		resp, err := h.fetchFromNode(r.Context(), nodeURL, key, query, userID, "stale")
+		if err != nil {
+			log.Printf("Stale read from %s failed: %v\n", nodeURL, err)
+			continue
+		}
+
+		responseBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("Error reading response from %s: %v\n", nodeURL, err)
+			continue
+		}
+
+		isPrimary := nodeURL == nodes[0]
+		if required != nil && !isPrimary && !required.SatisfiedBy(nodeURL, resp) {
+			log.Printf("GET key=%s: replica %s is behind the session's write\n", key, nodeURL)
+			continue
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			notFound = true
+			if nodeURL != nodes[0] {
+				missing = append(missing, replicaCopy{node: nodeURL})
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		updatedAt, _ := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Updated-At"))
+		age := time.Duration(0)
+		if !isPrimary {
+			sourceVersion, _ := strconv.ParseUint(resp.Header.Get("X-Source-Version"), 10, 64)
+			age = replicationLag(primaryStatus(), sourceVersion, updatedAt, time.Now())
+		}
+
+		if maxStaleness > 0 && age > maxStaleness && !isPrimary {
+			log.Printf("GET key=%s: replica %s trails the primary by %v\n", key, nodeURL, age)
+			continue
+		}
+
+		responseBody, err = openValue(tenantKey(r), key, responseBody)
+		if err != nil {
+			log.Printf("Error decrypting key=%s from %s: %v\n", key, nodeURL, err)
+			respondError(w, http.StatusInternalServerError, "Failed to decrypt value")
+			return
+		}
+
+		if revalidate && !isPrimary {
+			copies := append(missing, replicaCopy{node: nodeURL, exists: true, updatedAt: updatedAt})
+			h.startRevalidation(w, r, nodes[0], key, userID, copies)
+		}
+
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.Header().Set("X-Data-Age", age.Round(time.Millisecond).String())
+		w.Header().Set("X-Served-By", nodeURL)
+		w.WriteHeader(http.StatusOK)
+		w.Write(responseBody)
+		return
+	}
+
+	if notFound {
+		respondError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+	respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No replica available for stale read", nil)
+}
+
+// replicationLag is how long a replica's copy of a key has trailed the
+// primary's: zero while it holds the primary's latest write, otherwise the
+// time since that write. Without the primary's copy (it is suspected,
+// unreachable or no longer has the key) the lag cannot be measured, and the
+// age of the replica's copy, which bounds it from above, is used instead.
+func replicationLag(primary *replicaStatus, sourceVersion uint64, updatedAt, now time.Time) time.Duration {
+	var lag time.Duration
+	switch {
+	case primary == nil || primary.Copy == nil:
+		lag = now.Sub(updatedAt)
+	case sourceVersion > 0 && sourceVersion >= primary.Copy.Version,
+		sourceVersion == 0 && !updatedAt.Before(primary.Copy.UpdatedAt):
+		return 0
+	default:
+		lag = now.Sub(primary.Copy.UpdatedAt)
+	}
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
+// fetchFromNode issues a GET for key against a single DHT node
+// query is an optional encoded query string forwarded to the node
+func (h *Handler) fetchFromNode(ctx context.Context, nodeURL, key, query string, userID int64, consistency string) (*http.Response, error) {
+	reqURL := fmt.Sprintf("%s/store/%s", nodeURL, key)
+	if query != "" {
+		reqURL += "?" + query
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Forward headers
+	req.Header.Set("X-Consistency", consistency)
+	req.Header.Set("X-User-ID", fmt.Sprintf("%d", userID))
+
+	return h.httpClient.Do(req)
+}
+
 // DeleteKey handles DELETE /v1/kv/:key
 func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
@@ -215,12 +616,12 @@ func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get consistency level from header (default: eventual)
-	consistency := r.Header.Get("X-Consistency")
-	if consistency == "" {
-		consistency = "eventual"
+	if h.rejectIfFrozen(w) {
+		return
 	}
 
+	consistency := requestConsistency(r, key)
+
 	// Validate consistency level
 	if consistency != "strong" && consistency != "eventual" {
 		respondError(w, http.StatusBadRequest, "Invalid consistency level. Must be 'strong' or 'eventual'")
@@ -228,21 +629,39 @@ func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user ID from context
-	userID := r.Context().Value("user_id").(int64)
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	session, ok := readSession(w, r)
+	if !ok {
+		return
+	}
 
 	// Use hash ring to determine primary and replica nodes
-	nodes := h.ring.LocateKey(key, 3)
+	nodes := h.locateKey(r.Context(), key)
 	if len(nodes) == 0 {
-		respondError(w, http.StatusServiceUnavailable, "No nodes available")
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
 		return
 	}
 
 	primaryNode := nodes[0]
 	replicaNodes := nodes[1:]
 
+	if h.rejectIfSuspected(w, primaryNode) {
+		return
+	}
+
+	if isDryRun(r) {
+		respondDryRun(w, "DELETE", key, primaryNode, replicaNodes, consistency, nil)
+		return
+	}
+
 	log.Printf("DELETE key=%s primary=%s replicas=%v (user=%d, consistency=%s)\n",
 		key, primaryNode, replicaNodes, userID, consistency)
 
+	h.negativeCache.Invalidate(key)
+
 	// Delete from primary node
 	reqURL := fmt.Sprintf("%s/store/%s", primaryNode, key)
 	req, err := http.NewRequestWithContext(r.Context(), "DELETE", reqURL, nil)
@@ -253,12 +672,16 @@ func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	req.Header.Set("X-User-ID", fmt.Sprintf("%d", userID))
+	// The primary checks If-Match against the version it is deleting
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
 
 	// Send request to primary DHT node
 	resp, err := h.httpClient.Do(req)
 	if err != nil {
 		log.Printf("Error forwarding request to primary node: %v\n", err)
-		respondError(w, http.StatusServiceUnavailable, "Primary node unavailable")
+		respondNodeError(w, err, "Primary node unavailable")
 		return
 	}
 	defer resp.Body.Close()
@@ -271,8 +694,11 @@ func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The deleted version; 0 if the primary did not have the key
+	version, _ := strconv.ParseUint(resp.Header.Get("X-Version"), 10, 64)
+
 	// Trigger replication if there are replica nodes
-	if len(replicaNodes) > 0 {
+	if len(replicaNodes) > 0 || h.rollouts.Active() {
 		replReq := models.ReplicationRequest{
 			Key:          key,
 			Operation:    "DELETE",
@@ -280,24 +706,34 @@ func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request) {
 			PrimaryNode:  primaryNode,
 			ReplicaNodes: replicaNodes,
 			UserID:       userID,
+			RequestID:    requestid.FromContext(r.Context()),
+			Version:      version,
 		}
 
-		h.triggerReplication(&replReq, consistency)
+		h.triggerReplication(r.Context(), &replReq, consistency)
 	}
 
+	// Later reads of the session must not see the deleted version
+	session.Record(key, primaryNode, version, true)
+	session.Set(w)
+
 	// Return success response
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"success":      true,
 		"key":          key,
 		"primary_node": primaryNode,
 		"replicas":     len(replicaNodes),
+		"version":      version,
 	})
 }
 
 // ListKeys handles GET /v1/kv (list all keys)
 func (h *Handler) ListKeys(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context
-	userID := r.Context().Value("user_id").(int64)
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 
 	// Get all nodes
 	nodes := h.ring.GetAllNodes()
@@ -356,9 +792,28 @@ func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 		"status":  "healthy",
 		"service": "gateway",
 		"nodes":   h.ring.GetAllNodes(),
+		"build":   buildinfo.Get("gateway", h.configFingerprint),
 	})
 }
 
+// Metrics returns gateway metrics
+func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	frozen, _, _ := h.freeze.Status()
+	metrics := map[string]interface{}{
+		"service":        "gateway",
+		"writes_frozen":  frozen,
+		"nodes":          h.detector.Snapshot(),
+		"negative_cache": h.negativeCache.Stats(),
+		"revalidation":   h.revalidator.Stats(),
+		"backends":       h.backends.Snapshot(),
+		"timestamp":      time.Now().Unix(),
+	}
+	if canary := h.canary.Stats(); canary.Passes > 0 {
+		metrics["canary"] = canary
+	}
+	respondJSON(w, http.StatusOK, metrics)
+}
+
 // Helper functions
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -366,31 +821,147 @@ func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// respondError writes the standard error body with the default code for status
 func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, map[string]string{"error": message})
+	respondErrorCode(w, status, models.CodeForStatus(status), message, nil)
 }
 
-// triggerReplication sends replication request to replicator service
-func (h *Handler) triggerReplication(replReq *models.ReplicationRequest, consistency string) {
+// requireUser returns the authenticated user of r, answering 401 if the
+// request reached a tenant route without passing authentication
+func requireUser(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	userID, ok := middleware.UserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Authentication required")
+	}
+	return userID, ok
+}
+
+// requestConsistency returns the consistency level a request asks for: the
+// X-Consistency header, else the consistency query parameter (for clients
+// that cannot set headers), else the default of the key's namespace, else
+// eventual
+func requestConsistency(r *http.Request, key string) string {
+	if consistency := r.Header.Get("X-Consistency"); consistency != "" {
+		return consistency
+	}
+	if consistency := r.URL.Query().Get("consistency"); consistency != "" {
+		return consistency
+	}
+	if consistency := middleware.NamespacePolicies(r.Context()).For(key).Consistency; consistency != "" {
+		return consistency
+	}
+	return "eventual"
+}
+
+// locateKey returns the nodes holding key, primary first: as many as the
+// replication factor of its namespace, with node rollouts applied
+func (h *Handler) locateKey(ctx context.Context, key string) []string {
+	nodes, _ := h.rollouts.Route(key, h.ring.LocateKey(key, middleware.NamespacePolicies(ctx).For(key).Replicas()))
+	return nodes
+}
+
+// replicationFactor returns the replication factor set by key's namespace,
+// 0 for the default
+func replicationFactor(ctx context.Context, key string) int {
+	return middleware.NamespacePolicies(ctx).For(key).ReplicationFactor
+}
+
+// setReplicationFactor records a namespace's replication factor on a write
+// to the primary, so the node keeps the key on that many nodes when
+// rebalancing
+func setReplicationFactor(req *http.Request, key string) {
+	if rf := replicationFactor(req.Context(), key); rf > 0 {
+		req.Header.Set("X-Replication-Factor", strconv.Itoa(rf))
+	}
+}
+
+// replicationRequest builds the request asking the replicator to copy a
+// write, adding the nodes being rolled out; it is nil if no other node needs
+// the write
+func (h *Handler) replicationRequest(ctx context.Context, replReq *models.ReplicationRequest) (*http.Request, error) {
+	// Nodes being rolled out get every write of the keys they share
+	if h.rollouts.Active() {
+		replReq.ShadowNodes = h.shadowNodes(replReq.Key, append([]string{replReq.PrimaryNode}, replReq.ReplicaNodes...))
+	}
+	if len(replReq.ReplicaNodes) == 0 && len(replReq.ShadowNodes) == 0 {
+		return nil, nil
+	}
+
 	replicatorURL := fmt.Sprintf("http://localhost:%s/replicate", h.config.ReplicatorPort)
 
-	jsonData, err := json.Marshal(replReq)
+	req, err := proto.NewRequest(ctx, "POST", replicatorURL, replReq, useProto(h.config))
 	if err != nil {
-		log.Printf("Failed to marshal replication request: %v\n", err)
+		return nil, err
+	}
+	if replReq.RequestID != "" {
+		req.Header.Set(requestid.Header, replReq.RequestID)
+	}
+	return req, nil
+}
+
+// isDryRun reports whether a write asks to be checked and routed without
+// being applied (?dry_run=true)
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return dryRun
+}
+
+// respondDryRun answers a dry-run write with where it would have gone; the
+// write passed authentication, quota and validation to get here
+func respondDryRun(w http.ResponseWriter, operation, key, primaryNode string, replicaNodes []string, consistency string, details map[string]interface{}) {
+	response := map[string]interface{}{
+		"dry_run":       true,
+		"operation":     operation,
+		"key":           key,
+		"primary_node":  primaryNode,
+		"replica_nodes": replicaNodes,
+		"consistency":   consistency,
+	}
+	for name, value := range details {
+		response[name] = value
+	}
+	w.Header().Set("X-Dry-Run", "true")
+	respondJSON(w, http.StatusOK, response)
+}
+
+// respondNodeError reports a failed call to a DHT node: 504 if the request's
+// deadline ran out, 503 otherwise
+func respondNodeError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		respondErrorCode(w, http.StatusGatewayTimeout, models.ErrCodeTimeout, "Request deadline exceeded", nil)
 		return
 	}
+	respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, message, nil)
+}
 
-	req, err := http.NewRequest("POST", replicatorURL, bytes.NewReader(jsonData))
+// respondErrorCode writes the standard error body, tagged with the request ID
+// the middleware set on the response
+func respondErrorCode(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	apiErr := models.NewAPIError(code, message, details)
+	apiErr.RequestID = w.Header().Get(requestid.Header)
+	respondJSON(w, status, models.ErrorResponse{Error: apiErr})
+}
+
+// triggerReplication sends replication request to replicator service
+// Strong replication runs within ctx's deadline; eventual replication outlives
+// the request and gets its own.
+func (h *Handler) triggerReplication(ctx context.Context, replReq *models.ReplicationRequest, consistency string) {
+	req, err := h.replicationRequest(ctx, replReq)
 	if err != nil {
 		log.Printf("Failed to create replication request: %v\n", err)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if req == nil {
+		return
+	}
 
 	// For eventual consistency, fire and forget
 	if consistency == "eventual" {
 		go func() {
-			resp, err := h.httpClient.Do(req)
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), h.config.WriteTimeout)
+			defer cancel()
+
+			resp, err := h.httpClient.Do(req.WithContext(ctx))
 			if err != nil {
 				log.Printf("Failed to trigger replication: %v\n", err)
 				return
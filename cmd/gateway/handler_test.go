@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"dht/internal/config"
+	"dht/internal/envelope"
+	"dht/internal/hashring"
+	"dht/internal/middleware"
+)
+
+// newTestHandler returns a gateway routing to nodes, with background
+// heartbeats slowed down so tests control every call to the nodes
+func newTestHandler(t *testing.T, nodes ...string) *Handler {
+	t.Helper()
+	return NewHandler(&config.Config{
+		HeartbeatInterval: time.Hour,
+		PhiThreshold:      8,
+		WriteTimeout:      10 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		TxnIntentTimeout:  30 * time.Second,
+		InternalEncoding:  "json",
+	}, hashring.NewHashRing(nodes), nil)
+}
+
+// userRequest returns a request authenticated as user 1, with dek as the
+// tenant key if set
+func userRequest(method, target string, body []byte, dek []byte) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	ctx := middleware.WithUserID(r.Context(), 1)
+	if dek != nil {
+		ctx = middleware.WithTenantKey(ctx, dek)
+	}
+	return r.WithContext(ctx)
+}
+
+func TestPutKeyDryRun(t *testing.T) {
+	value := []byte(`{"total": 99}`)
+	tests := []struct {
+		name      string
+		dek       []byte
+		encrypted bool
+	}{
+		{name: "plaintext tenant"},
+		{name: "encrypted tenant", dek: bytes.Repeat([]byte{1}, envelope.KeySize), encrypted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, "http://node-1", "http://node-2", "http://node-3")
+			r := userRequest("PUT", "/v1/kv/orders:42?dry_run=true", value, tt.dek)
+			r.SetPathValue("key", "orders:42")
+			w := httptest.NewRecorder()
+			h.PutKey(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			var got struct {
+				ValueBytes  int  `json:"value_bytes"`
+				StoredBytes int  `json:"stored_bytes"`
+				Encrypted   bool `json:"encrypted"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ValueBytes != len(value) {
+				t.Fatalf("value_bytes %d, want %d", got.ValueBytes, len(value))
+			}
+			if got.Encrypted != tt.encrypted || (got.StoredBytes > got.ValueBytes) != tt.encrypted {
+				t.Fatalf("encrypted %t with stored_bytes %d, want encrypted %t", got.Encrypted, got.StoredBytes, tt.encrypted)
+			}
+		})
+	}
+}
+
+// fakeCopy is what a fake node holds of a key
+type fakeCopy struct {
+	version, sourceVersion uint64
+	updatedAt              time.Time
+	metaFails              bool // GET /store/{key}/meta answers 500
+}
+
+// newFakeNode serves GET /store/{key} and its metadata from c
+func newFakeNode(t *testing.T, name string, c *fakeCopy) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /store/{key}/meta", func(w http.ResponseWriter, r *http.Request) {
+		if c.metaFails {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":        c.version,
+			"source_version": c.sourceVersion,
+			"updated_at":     c.updatedAt,
+		})
+	})
+	mux.HandleFunc("GET /store/{key}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Updated-At", c.updatedAt.UTC().Format(time.RFC3339Nano))
+		w.Header().Set("X-Version", strconv.FormatUint(c.version, 10))
+		if c.sourceVersion > 0 {
+			w.Header().Set("X-Source-Version", strconv.FormatUint(c.sourceVersion, 10))
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": name})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStaleReadLag(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name         string
+		primary      fakeCopy
+		replica      fakeCopy
+		maxStaleness string
+		servedBy     string // "primary" or "replica"
+		minAge       time.Duration
+		maxAge       time.Duration
+	}{
+		{
+			name:         "old copy in sync",
+			primary:      fakeCopy{version: 40, updatedAt: now.Add(-time.Hour)},
+			replica:      fakeCopy{version: 7, sourceVersion: 40, updatedAt: now.Add(-time.Hour)},
+			maxStaleness: "1s",
+			servedBy:     "replica",
+		},
+		{
+			name:         "behind by more than the bound",
+			primary:      fakeCopy{version: 41, updatedAt: now.Add(-5 * time.Second)},
+			replica:      fakeCopy{version: 7, sourceVersion: 40, updatedAt: now.Add(-time.Hour)},
+			maxStaleness: "1s",
+			servedBy:     "primary",
+		},
+		{
+			name:         "behind within the bound",
+			primary:      fakeCopy{version: 41, updatedAt: now.Add(-5 * time.Second)},
+			replica:      fakeCopy{version: 7, sourceVersion: 40, updatedAt: now.Add(-time.Hour)},
+			maxStaleness: "1m",
+			servedBy:     "replica",
+			minAge:       5 * time.Second,
+			maxAge:       6 * time.Second,
+		},
+		{
+			name:     "unbounded read reports the lag",
+			primary:  fakeCopy{version: 41, updatedAt: now.Add(-5 * time.Second)},
+			replica:  fakeCopy{version: 7, sourceVersion: 40, updatedAt: now.Add(-time.Hour)},
+			servedBy: "replica",
+			minAge:   5 * time.Second,
+			maxAge:   6 * time.Second,
+		},
+		{
+			name:         "copy written directly, newer than the primary's",
+			primary:      fakeCopy{version: 41, updatedAt: now.Add(-time.Hour)},
+			replica:      fakeCopy{version: 7, updatedAt: now.Add(-time.Minute)},
+			maxStaleness: "1s",
+			servedBy:     "replica",
+		},
+		{
+			name:         "primary unknown, copy older than the bound",
+			primary:      fakeCopy{version: 41, updatedAt: now.Add(-time.Hour), metaFails: true},
+			replica:      fakeCopy{version: 7, sourceVersion: 40, updatedAt: now.Add(-time.Hour)},
+			maxStaleness: "1m",
+			servedBy:     "primary",
+		},
+		{
+			name:     "primary unknown, copy age bounds the lag",
+			primary:  fakeCopy{version: 41, updatedAt: now.Add(-time.Hour), metaFails: true},
+			replica:  fakeCopy{version: 7, sourceVersion: 40, updatedAt: now.Add(-2 * time.Second)},
+			servedBy: "replica",
+			minAge:   2 * time.Second,
+			maxAge:   3 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			copies := map[string]*fakeCopy{"a": {}, "b": {}}
+			a := newFakeNode(t, "a", copies["a"])
+			b := newFakeNode(t, "b", copies["b"])
+			h := newTestHandler(t, a.URL, b.URL)
+
+			nodes := h.locateKey(t.Context(), "users:42")
+			roles := map[string]string{nodes[0]: "primary", nodes[1]: "replica"}
+			names := map[string]string{a.URL: "a", b.URL: "b"}
+			*copies[names[nodes[0]]] = tt.primary
+			*copies[names[nodes[1]]] = tt.replica
+
+			target := "/v1/kv/users:42"
+			if tt.maxStaleness != "" {
+				target += "?max_staleness=" + tt.maxStaleness
+			}
+			r := userRequest("GET", target, nil, nil)
+			r.Header.Set("X-Consistency", "stale")
+			r.SetPathValue("key", "users:42")
+			w := httptest.NewRecorder()
+			h.GetKey(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			if got := roles[w.Header().Get("X-Served-By")]; got != tt.servedBy {
+				t.Fatalf("served by the %s, want the %s", got, tt.servedBy)
+			}
+			age, err := time.ParseDuration(w.Header().Get("X-Data-Age"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if age < tt.minAge || age > tt.maxAge {
+				t.Fatalf("X-Data-Age %v, want between %v and %v", age, tt.minAge, tt.maxAge)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"dht/internal/httpx"
+	"dht/internal/models"
+)
+
+// observeCall records every call to a backend and feeds the failure
+// detector from regular traffic: every response from a ring node that is not
+// a server error counts as a heartbeat
+func (h *Handler) observeCall(attempt httpx.Attempt) {
+	h.backends.Observe(attempt)
+	if !attempt.Failed() && h.ring.HasNode(attempt.Target) {
+		h.detector.Heartbeat(attempt.Target)
+	}
+}
+
+// monitorNodes probes every ring node's /health each interval so the
+// failure detector keeps receiving heartbeats from idle nodes, then evicts
+// nodes that have been down for too long
+func (h *Handler) monitorNodes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Nodes being rolled out are watched before they join the ring
+		nodes := append(h.ring.GetAllNodes(), h.rollouts.NewNodes()...)
+
+		var wg sync.WaitGroup
+		for _, nodeURL := range nodes {
+			// Nodes that never answer must still accrue suspicion
+			h.detector.Watch(nodeURL)
+
+			wg.Add(1)
+			go func(nodeURL string) {
+				defer wg.Done()
+
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				defer cancel()
+
+				req, err := http.NewRequestWithContext(ctx, "GET", nodeURL+"/health", nil)
+				if err != nil {
+					return
+				}
+				// The transport records the heartbeat
+				if resp, err := h.httpClient.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			}(nodeURL)
+		}
+		wg.Wait()
+
+		h.checkEvictions()
+
+		// Forget nodes that have left the ring
+		for _, status := range h.detector.Snapshot() {
+			if !h.ring.HasNode(status.Node) && !h.rollouts.Involves(status.Node) {
+				h.detector.Remove(status.Node)
+			}
+		}
+	}
+}
+
+// nodeAvailable reports whether the failure detector considers node up
+func (h *Handler) nodeAvailable(node string) bool {
+	return h.detector.IsAvailable(node)
+}
+
+// preferAvailable reorders nodes so suspected ones are tried last,
+// keeping the relative order otherwise
+func (h *Handler) preferAvailable(nodes []string) []string {
+	ordered := make([]string, 0, len(nodes))
+	var suspected []string
+	for _, node := range nodes {
+		if h.nodeAvailable(node) {
+			ordered = append(ordered, node)
+		} else {
+			suspected = append(suspected, node)
+		}
+	}
+	return append(ordered, suspected...)
+}
+
+// rejectIfSuspected fails fast with 503 instead of sending a request to a
+// node the failure detector considers down (open circuit); the node is
+// retried once its heartbeats resume
+func (h *Handler) rejectIfSuspected(w http.ResponseWriter, node string) bool {
+	phi := h.detector.Phi(node)
+	if phi < h.detector.Threshold() {
+		return false
+	}
+
+	respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "Primary node is suspected down", map[string]interface{}{
+		"node": node,
+		"phi":  math.Round(phi*100) / 100,
+	})
+	return true
+}
+
+// Nodes handles GET /admin/nodes, reporting the suspicion level of each node
+func (h *Handler) Nodes(w http.ResponseWriter, r *http.Request) {
+	nodes := h.detector.Snapshot()
+	available := 0
+	for _, node := range nodes {
+		if node.Available {
+			available++
+		}
+	}
+
+	h.ringMu.Lock()
+	suspectedSince := make(map[string]time.Time, len(h.suspectedSince))
+	for node, since := range h.suspectedSince {
+		suspectedSince[node] = since
+	}
+	h.ringMu.Unlock()
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"nodes":           nodes,
+		"available":       available,
+		"total":           len(nodes),
+		"phi_threshold":   h.detector.Threshold(),
+		"suspected_since": suspectedSince,
+		"eviction_grace":  h.config.NodeEvictionGrace.String(),
+	})
+}
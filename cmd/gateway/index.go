@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"dht/internal/models"
+	"dht/internal/proto"
+)
+
+// nodeResult is the outcome of a request sent to a single DHT node
+type nodeResult struct {
+	node   string
+	status int
+	body   []byte
+	proto  bool // body is protobuf rather than JSON
+	err    error
+}
+
+// broadcast sends the same request to every node in the ring concurrently
+func (h *Handler) broadcast(ctx context.Context, method, path string, userID int64, payload interface{}) []nodeResult {
+	nodes := h.ring.GetAllNodes()
+	results := make([]nodeResult, len(nodes))
+
+	var wg sync.WaitGroup
+	for i, nodeURL := range nodes {
+		wg.Add(1)
+		go func(i int, nodeURL string) {
+			defer wg.Done()
+			results[i] = h.sendToNode(ctx, method, nodeURL+path, userID, payload)
+			results[i].node = nodeURL
+		}(i, nodeURL)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// sendToNode issues a request against a node and reads the response
+// payload, if not nil, is sent as the request body: protobuf if it has a
+// protobuf message and INTERNAL_ENCODING allows it, JSON otherwise. Only a
+// protobuf request gets a protobuf response; errors are always JSON.
+func (h *Handler) sendToNode(ctx context.Context, method, reqURL string, userID int64, payload interface{}) nodeResult {
+	var req *http.Request
+	var err error
+	if payload != nil {
+		req, err = proto.NewRequest(ctx, method, reqURL, payload, useProto(h.config))
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, reqURL, nil)
+	}
+	if err != nil {
+		return nodeResult{err: err}
+	}
+	req.Header.Set("X-User-ID", fmt.Sprintf("%d", userID))
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nodeResult{err: err}
+	}
+	defer resp.Body.Close()
+
+	if proto.Is(resp.Header.Get("Content-Type")) {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nodeResult{status: resp.StatusCode, err: err}
+		}
+		return nodeResult{status: resp.StatusCode, body: respBody, proto: true}
+	}
+
+	var respBody json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return nodeResult{status: resp.StatusCode, err: err}
+	}
+	return nodeResult{status: resp.StatusCode, body: respBody}
+}
+
+// decode decodes the response body into v
+func (res *nodeResult) decode(v interface{}) error {
+	if res.proto {
+		return proto.Unmarshal(res.body, v)
+	}
+	return json.Unmarshal(res.body, v)
+}
+
+// CreateIndex handles POST /v1/indexes
+// The index is declared on every node, each of which backfills it from its own keys.
+func (h *Handler) CreateIndex(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Field string `json:"field"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Field == "" {
+		respondError(w, http.StatusBadRequest, "Request body must be {\"field\": \"...\"}")
+		return
+	}
+
+	// Nodes cannot read fields out of encrypted values
+	if tenantKey(r) != nil {
+		respondError(w, http.StatusBadRequest, "Indexes are not supported for encrypted values")
+		return
+	}
+
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("CREATE INDEX field=%s (user=%d)\n", req.Field, userID)
+
+	results := h.broadcast(r.Context(), "PUT", "/admin/indexes/"+url.PathEscape(req.Field), userID, nil)
+
+	failed := make([]string, 0)
+	for _, res := range results {
+		if res.status == http.StatusBadRequest {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(res.body)
+			return
+		}
+		if res.err != nil || res.status != http.StatusOK {
+			log.Printf("Failed to create index on %s: status=%d err=%v\n", res.node, res.status, res.err)
+			failed = append(failed, res.node)
+		}
+	}
+
+	// Creating an index is idempotent, so callers can simply retry
+	if len(failed) > 0 {
+		respondErrorCode(w, http.StatusBadGateway, models.ErrCodeUpstream, "Index was not created on all nodes", map[string]interface{}{
+			"failed_nodes": failed,
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"success": true,
+		"field":   req.Field,
+		"nodes":   len(results),
+	})
+}
+
+// ListIndexes handles GET /v1/indexes
+func (h *Handler) ListIndexes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	fields := make(map[string]struct{})
+	for _, res := range h.broadcast(r.Context(), "GET", "/admin/indexes", userID, nil) {
+		if res.err != nil || res.status != http.StatusOK {
+			continue
+		}
+
+		var nodeData struct {
+			Indexes []string `json:"indexes"`
+		}
+		if err := json.Unmarshal(res.body, &nodeData); err != nil {
+			continue
+		}
+		for _, field := range nodeData.Indexes {
+			fields[field] = struct{}{}
+		}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"indexes": sortedKeys(fields),
+		"count":   len(fields),
+	})
+}
+
+// DropIndex handles DELETE /v1/indexes/:field
+func (h *Handler) DropIndex(w http.ResponseWriter, r *http.Request) {
+	field := r.PathValue("field")
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("DROP INDEX field=%s (user=%d)\n", field, userID)
+
+	found := false
+	failed := make([]string, 0)
+	for _, res := range h.broadcast(r.Context(), "DELETE", "/admin/indexes/"+url.PathEscape(field), userID, nil) {
+		switch {
+		case res.err == nil && res.status == http.StatusOK:
+			found = true
+		case res.err == nil && res.status == http.StatusNotFound:
+		default:
+			failed = append(failed, res.node)
+		}
+	}
+
+	if len(failed) > 0 {
+		respondErrorCode(w, http.StatusBadGateway, models.ErrCodeUpstream, "Index was not dropped on all nodes", map[string]interface{}{
+			"failed_nodes": failed,
+		})
+		return
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, "Index not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"field":   field,
+	})
+}
+
+// Query handles GET /v1/query?index=field&value=x
+// Every node is queried since each holds primary and replica copies of
+// different keys; results are merged and de-duplicated.
+func (h *Handler) Query(w http.ResponseWriter, r *http.Request) {
+	field := r.URL.Query().Get("index")
+	if field == "" {
+		respondError(w, http.StatusBadRequest, "index query parameter is required")
+		return
+	}
+	value := r.URL.Query().Get("value")
+
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("QUERY index=%s value=%q (user=%d)\n", field, value, userID)
+
+	path := fmt.Sprintf("/index/%s?%s", url.PathEscape(field), url.Values{"value": {value}}.Encode())
+
+	keys := make(map[string]struct{})
+	indexFound := false
+	queried := 0
+	for _, res := range h.broadcast(r.Context(), "GET", path, userID, nil) {
+		if res.err != nil {
+			log.Printf("Error querying node %s: %v\n", res.node, res.err)
+			continue
+		}
+		if res.status != http.StatusOK {
+			continue
+		}
+		queried++
+
+		var nodeData struct {
+			Keys []string `json:"keys"`
+		}
+		if err := json.Unmarshal(res.body, &nodeData); err != nil {
+			continue
+		}
+		indexFound = true
+		for _, key := range nodeData.Keys {
+			keys[key] = struct{}{}
+		}
+	}
+
+	if !indexFound {
+		respondError(w, http.StatusNotFound, "Index not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"index":         field,
+		"value":         value,
+		"keys":          sortedKeys(keys),
+		"count":         len(keys),
+		"nodes_queried": queried,
+		"nodes_total":   len(h.ring.GetAllNodes()),
+	})
+}
+
+// sortedKeys returns the members of a set in sorted order
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"dht/internal/storage"
+)
+
+// Keyspace handles GET /admin/keyspace
+// Adds up every node's keyspace analysis: value size and TTL histograms, the
+// largest keys and the keys and bytes per prefix. Each node only counts the
+// keys it is primary for, so replicas are not counted twice. Prefix counts
+// are exact unless a node had more prefixes than it was asked to list.
+func (h *Handler) Keyspace(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := url.Values{}
+	if owner := params.Get("user_id"); owner != "" {
+		if _, err := strconv.ParseInt(owner, 10, 64); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid user_id")
+			return
+		}
+		query.Set("owner", owner)
+	}
+
+	top, maxPrefixes := 10, 50
+	for _, p := range []struct {
+		name string
+		dst  *int
+		max  int
+	}{
+		{"top", &top, 1000},
+		{"prefixes", &maxPrefixes, 1000},
+		{"depth", nil, 8},
+	} {
+		str := params.Get(p.name)
+		if str == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(str)
+		if err != nil || parsed < 1 || parsed > p.max {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s. Must be between 1 and %d", p.name, p.max))
+			return
+		}
+		if p.dst != nil {
+			*p.dst = parsed
+		}
+		query.Set(p.name, str)
+	}
+	if params.Has("delimiter") {
+		query.Set("delimiter", params.Get("delimiter"))
+	}
+
+	ring := h.ring.GetAllNodes()
+	results := make([]nodeResult, len(ring))
+
+	var wg sync.WaitGroup
+	for i, nodeURL := range ring {
+		wg.Add(1)
+		go func(i int, nodeURL string) {
+			defer wg.Done()
+
+			nodeQuery := url.Values{"self": {nodeURL}, "ring": ring}
+			for name, values := range query {
+				nodeQuery[name] = values
+			}
+			results[i] = h.sendToNode(r.Context(), "GET", nodeURL+"/admin/keyspace?"+nodeQuery.Encode(), 0, nil)
+			results[i].node = nodeURL
+		}(i, nodeURL)
+	}
+	wg.Wait()
+
+	total := storage.KeyspaceStats{
+		SizeHistogram: storage.NewSizeHistogram(),
+		TTLHistogram:  storage.NewTTLHistogram(),
+	}
+	var largest []storage.KeySize
+	prefixes := make(map[string]*storage.PrefixCount)
+	truncated := false
+
+	nodes := make([]map[string]interface{}, len(results))
+	complete := len(ring) > 0
+	for i, res := range results {
+		nodes[i] = map[string]interface{}{"node": res.node}
+
+		var nodeData struct {
+			Keyspace storage.KeyspaceStats `json:"keyspace"`
+		}
+		switch {
+		case res.err != nil:
+			nodes[i]["error"] = res.err.Error()
+		case res.status != http.StatusOK:
+			nodes[i]["error"] = fmt.Sprintf("status %d", res.status)
+		case json.Unmarshal(res.body, &nodeData) != nil:
+			nodes[i]["error"] = "invalid response"
+		case len(nodeData.Keyspace.SizeHistogram) != len(total.SizeHistogram),
+			len(nodeData.Keyspace.TTLHistogram) != len(total.TTLHistogram):
+			nodes[i]["error"] = "histogram buckets differ"
+		}
+		if nodes[i]["error"] != nil {
+			complete = false
+			continue
+		}
+		ks := nodeData.Keyspace
+		nodes[i]["keys"] = ks.Keys
+		nodes[i]["bytes"] = ks.Bytes
+
+		total.Keys += ks.Keys
+		total.Bytes += ks.Bytes
+		for j, b := range ks.SizeHistogram {
+			total.SizeHistogram[j].Keys += b.Keys
+			total.SizeHistogram[j].Bytes += b.Bytes
+		}
+		for j, b := range ks.TTLHistogram {
+			total.TTLHistogram[j].Keys += b.Keys
+			total.TTLHistogram[j].Bytes += b.Bytes
+		}
+		largest = append(largest, ks.Largest...)
+		for _, p := range ks.Prefixes {
+			merged, exists := prefixes[p.Prefix]
+			if !exists {
+				merged = &storage.PrefixCount{Prefix: p.Prefix}
+				prefixes[p.Prefix] = merged
+			}
+			merged.Keys += p.Keys
+			merged.Bytes += p.Bytes
+		}
+		if ks.PrefixesTotal > len(ks.Prefixes) {
+			truncated = true
+		}
+	}
+
+	total.Largest = storage.LargestKeys(largest, top)
+	total.PrefixesTotal = len(prefixes)
+	total.Prefixes = make([]storage.PrefixCount, 0, len(prefixes))
+	for _, p := range prefixes {
+		total.Prefixes = append(total.Prefixes, *p)
+	}
+	total.Prefixes = storage.TopPrefixes(total.Prefixes, maxPrefixes)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"complete":         complete,
+		"keyspace":         total,
+		"prefixes_partial": truncated,
+		"nodes":            nodes,
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"dht/internal/models"
+	"dht/internal/namespace"
+)
+
+// Locate handles GET /admin/locate/{key}, reporting where the gateway
+// routes a key: its hash, the nodes holding it with node rollouts applied,
+// and the ring epoch the placement was computed at. ?replicas= sets the
+// replication factor for keys whose namespace has its own.
+func (h *Handler) Locate(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		respondError(w, http.StatusBadRequest, "Key is required")
+		return
+	}
+
+	replicas := namespace.DefaultReplicationFactor
+	if str := r.URL.Query().Get("replicas"); str != "" {
+		parsed, err := strconv.Atoi(str)
+		if err != nil || parsed < 1 || parsed > namespace.MaxReplicationFactor {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid replicas. Must be between 1 and %d", namespace.MaxReplicationFactor))
+			return
+		}
+		replicas = parsed
+	}
+
+	placement, hash, epoch := h.ring.Locate(key, replicas)
+	if len(placement) == 0 {
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
+		return
+	}
+	nodes, shadows := h.rollouts.Route(key, placement)
+
+	var suspected []string
+	for _, node := range nodes {
+		if !h.nodeAvailable(node) {
+			suspected = append(suspected, node)
+		}
+	}
+
+	response := map[string]interface{}{
+		"key":           key,
+		"hash":          fmt.Sprintf("%016x", hash),
+		"ring_epoch":    epoch,
+		"ring_size":     h.ring.NodeCount(),
+		"replicas":      replicas,
+		"primary_node":  nodes[0],
+		"replica_nodes": nodes[1:],
+	}
+	if ns := namespace.Of(key); ns != "" {
+		response["namespace"] = ns
+	}
+	if len(shadows) > 0 {
+		// A rollout moved some of the key's nodes
+		response["ring_nodes"] = placement
+		response["shadow_nodes"] = shadows
+	}
+	if len(suspected) > 0 {
+		response["suspected_nodes"] = suspected
+	}
+	respondJSON(w, http.StatusOK, response)
+}
@@ -10,58 +10,156 @@ import (
 	"syscall"
 	"time"
 
+	"dht/internal/buildinfo"
 	"dht/internal/config"
+	"dht/internal/deadline"
+	"dht/internal/discovery"
+	"dht/internal/envelope"
 	"dht/internal/hashring"
+	"dht/internal/httpx"
+	"dht/internal/middleware"
+	"dht/internal/requestid"
 )
 
 func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
+	if err := cfg.Check("gateway"); err != nil {
+		log.Fatalf("%v\n", err)
+	}
 
 	// Initialize hash ring with DHT nodes
-	// In production, this would come from service discovery for now we use localhosts
+	// Without service discovery the local development nodes are used
 	nodes := []string{
 		"http://localhost:8082", // dhtnode-1
 		"http://localhost:8083", // dhtnode-2
 		"http://localhost:8084", // dhtnode-3
 	}
 
+	var provider *discovery.Kubernetes
+	var discovered map[string]discovery.State
+	switch cfg.NodeDiscovery {
+	case "static":
+	case "kubernetes":
+		var err error
+		provider, err = discovery.NewKubernetes(discovery.KubernetesConfig{
+			Namespace: cfg.DiscoveryK8sNamespace,
+			Service:   cfg.DiscoveryK8sService,
+			PortName:  cfg.DiscoveryK8sPortName,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up Kubernetes discovery: %v\n", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		discovered, err = provider.List(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("Failed to discover DHT nodes: %v\n", err)
+		}
+		nodes = discovery.ReadyNodes(discovered)
+		log.Printf("Discovered %d ready DHT nodes behind service %s\n", len(nodes), cfg.DiscoveryK8sService)
+	default:
+		log.Fatalf("Unknown NODE_DISCOVERY %q (use static or kubernetes)\n", cfg.NodeDiscovery)
+	}
+
 	ring := hashring.NewHashRing(nodes)
 	log.Printf("Hash ring initialized with %d nodes\n", len(nodes))
 
 	// Initialize rate limiter store
 	rateLimiterStore := NewRateLimiterStore()
 
+	// Initialize tenant key resolver (the KEK unwraps tenant keys registered with the usermanager;
+	// KMS references are only resolved within the operator's allowlist)
+	var kek []byte
+	if cfg.DataKEK != "" {
+		var err error
+		kek, err = envelope.ParseKey(cfg.DataKEK)
+		if err != nil {
+			log.Fatalf("Invalid DATA_KEY_ENCRYPTION_KEY: %v\n", err)
+		}
+	}
+	tenantKeys := NewTenantKeyResolver(kek, envelope.KMSPolicy{
+		EnvPrefix: cfg.TenantKMSEnvPrefix,
+		KeyDir:    cfg.TenantKMSKeyDir,
+	})
+
 	// Initialize handlers
 	handler := NewHandler(cfg, ring, rateLimiterStore)
+	if provider != nil {
+		handler.startDiscovery(provider, discovered)
+	}
 
 	// Setup router
 	mux := http.NewServeMux()
 
-	// KV routes
-	mux.HandleFunc("PUT /v1/kv/{key}", handler.PutKey)
-	mux.HandleFunc("GET /v1/kv/{key}", handler.GetKey)
-	mux.HandleFunc("DELETE /v1/kv/{key}", handler.DeleteKey)
-	mux.HandleFunc("GET /v1/kv", handler.ListKeys)
+	// Client requests get a deadline covering all the backend calls they make
+	read := func(next http.HandlerFunc) http.HandlerFunc { return WithDeadline(cfg.ReadTimeout, next) }
+	write := func(next http.HandlerFunc) http.HandlerFunc { return WithDeadline(cfg.WriteTimeout, next) }
 
-	// Health check
+	// KV routes
+	mux.HandleFunc("PUT /v1/kv/{key}", write(handler.PutKey))
+	mux.HandleFunc("GET /v1/kv/{key}", read(handler.GetKey))
+	mux.HandleFunc("PATCH /v1/kv/{key}", write(handler.PatchKey))
+	mux.HandleFunc("DELETE /v1/kv/{key}", write(handler.DeleteKey))
+	mux.HandleFunc("GET /v1/kv", read(handler.ListKeys))
+	mux.HandleFunc("GET /v1/kv/_search", read(handler.SearchKeys))
+	mux.HandleFunc("GET /v1/kv/{key}/stats", read(handler.KeyStats))
+	mux.HandleFunc("GET /v1/kv/{key}/replicas", read(handler.KeyReplicas))
+	mux.HandleFunc("GET /v1/hotkeys", read(handler.HotKeys))
+
+	// Secondary index routes
+	mux.HandleFunc("POST /v1/indexes", write(handler.CreateIndex))
+	mux.HandleFunc("GET /v1/indexes", read(handler.ListIndexes))
+	mux.HandleFunc("DELETE /v1/indexes/{field}", write(handler.DropIndex))
+	mux.HandleFunc("GET /v1/query", read(handler.Query))
+	mux.HandleFunc("POST /v1/txn", write(handler.Txn))
+	mux.HandleFunc("POST /v1/tokens", handler.MintToken)
+
+	// Admin routes (X-Admin-Token)
+	mux.HandleFunc("GET /admin/freeze", read(handler.FreezeStatus))
+	mux.HandleFunc("POST /admin/freeze", write(handler.FreezeWrites))
+	mux.HandleFunc("POST /admin/unfreeze", write(handler.UnfreezeWrites))
+	mux.HandleFunc("GET /admin/nodes", handler.Nodes)
+	mux.HandleFunc("POST /admin/nodes", handler.AddNode)
+	mux.HandleFunc("GET /admin/ring/events", handler.RingHistory)
+	mux.HandleFunc("GET /admin/locate/{key}", handler.Locate)
+	mux.HandleFunc("GET /admin/rollouts", handler.Rollouts)
+	mux.HandleFunc("POST /admin/rollouts", handler.StartRollout)
+	mux.HandleFunc("POST /admin/rollouts/weight", handler.SetRolloutWeight)
+	mux.HandleFunc("POST /admin/rollouts/complete", handler.CompleteRollout)
+	mux.HandleFunc("POST /admin/rollouts/abort", handler.AbortRollout)
+	mux.HandleFunc("GET /admin/usage", handler.StorageUsage)
+	mux.HandleFunc("POST /admin/usage", handler.RunMetering)
+	mux.HandleFunc("GET /admin/canary", handler.CanaryStatus)
+	mux.HandleFunc("POST /admin/canary", handler.RunCanary)
+	mux.HandleFunc("GET /admin/namespaces", read(handler.NamespaceUsage))
+	mux.HandleFunc("GET /admin/keyspace", read(handler.Keyspace))
+
+	// Health check and metrics
 	mux.HandleFunc("GET /health", handler.Health)
-
-	// Wrap with middleware (order matters: logging -> CORS -> auth -> rate limit -> handler)
-	wrappedMux := LoggingMiddleware(
-		CORSMiddleware(
-			AuthMiddleware(cfg, rateLimiterStore)(mux),
+	mux.HandleFunc("GET /version", buildinfo.Handler("gateway", handler.configFingerprint))
+	mux.HandleFunc("GET /metrics", handler.Metrics)
+	mux.HandleFunc("GET /metrics/cluster", handler.ClusterMetrics)
+
+	// Wrap with middleware (order matters: request ID -> deadline -> logging -> CORS -> auth -> rate limit -> handler)
+	cors := middleware.CORS("GET, POST, PUT, PATCH, DELETE, OPTIONS",
+		"Content-Type, X-API-Key, X-Consistency, X-Request-ID, X-Request-Timeout, X-Session-Token")
+	wrappedMux := requestid.Middleware(deadline.Middleware(middleware.Logging(
+		cors(
+			AuthMiddleware(cfg, handler.httpClient, rateLimiterStore, tenantKeys)(mux),
 		),
-	)
+	)))
 
 	// Create server
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%s", cfg.GatewayPort),
 		Handler:      wrappedMux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  cfg.ServerReadTimeout,
+		WriteTimeout: cfg.ServerWriteTimeout,
+		IdleTimeout:  cfg.ServerIdleTimeout,
 	}
+	httpx.AcceptH2C(srv, cfg.HTTP2MaxConcurrentStreams)
 
 	// Start server in goroutine
 	go func() {
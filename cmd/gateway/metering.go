@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"dht/internal/models"
+)
+
+// UsageSnapshot is the outcome of one storage metering pass
+type UsageSnapshot struct {
+	TakenAt    time.Time                `json:"taken_at"`
+	DurationMs int64                    `json:"duration_ms"`
+	Complete   bool                     `json:"complete"` // every ring node reported
+	Recorded   bool                     `json:"recorded"` // stored with the usermanager
+	Tenants    []models.StorageUsage    `json:"tenants"`
+	Nodes      []map[string]interface{} `json:"nodes"`
+}
+
+// StorageMeter keeps the latest metering pass; passes never overlap
+type StorageMeter struct {
+	running sync.Mutex
+	mu      sync.RWMutex
+	last    *UsageSnapshot
+}
+
+// Last returns the most recent pass, nil if none has run yet
+func (m *StorageMeter) Last() *UsageSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.last
+}
+
+func (m *StorageMeter) set(snapshot *UsageSnapshot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = snapshot
+}
+
+// meterStorage runs a metering pass every interval
+func (h *Handler) meterStorage(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// A pass walks every node's keyspace; give it most of the interval
+		ctx, cancel := context.WithTimeout(context.Background(), interval*9/10)
+		h.runMetering(ctx)
+		cancel()
+	}
+}
+
+// runMetering asks every ring node for the storage of the keys it is primary
+// for and adds the reports up per tenant. Only complete passes are recorded
+// with the usermanager: a missing node would under-bill its tenants and let
+// them write past their quota.
+func (h *Handler) runMetering(ctx context.Context) *UsageSnapshot {
+	h.meter.running.Lock()
+	defer h.meter.running.Unlock()
+
+	start := time.Now()
+	ring := h.ring.GetAllNodes()
+
+	type nodeReport struct {
+		Owners map[int64]models.StorageUsage `json:"owners"`
+	}
+	reports := make([]*nodeReport, len(ring))
+	nodes := make([]map[string]interface{}, len(ring))
+
+	var wg sync.WaitGroup
+	for i, nodeURL := range ring {
+		wg.Add(1)
+		go func(i int, nodeURL string) {
+			defer wg.Done()
+
+			result := map[string]interface{}{"node": nodeURL}
+			nodes[i] = result
+
+			payload, _ := json.Marshal(map[string]interface{}{
+				"self": nodeURL,
+				"ring": ring,
+			})
+			req, err := http.NewRequestWithContext(ctx, "POST", nodeURL+"/admin/usage", bytes.NewReader(payload))
+			if err != nil {
+				result["error"] = err.Error()
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := h.httpClient.Do(req)
+			if err != nil {
+				result["error"] = err.Error()
+				return
+			}
+			defer resp.Body.Close()
+
+			var report nodeReport
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&report) != nil {
+				result["error"] = "metering failed with status " + resp.Status
+				return
+			}
+			reports[i] = &report
+			result["tenants"] = len(report.Owners)
+		}(i, nodeURL)
+	}
+	wg.Wait()
+
+	totals := make(map[int64]*models.StorageUsage)
+	complete := len(ring) > 0
+	for _, report := range reports {
+		if report == nil {
+			complete = false
+			continue
+		}
+		for owner, usage := range report.Owners {
+			total, exists := totals[owner]
+			if !exists {
+				total = &models.StorageUsage{UserID: owner}
+				totals[owner] = total
+			}
+			total.Keys += usage.Keys
+			total.Bytes += usage.Bytes
+		}
+	}
+
+	snapshot := &UsageSnapshot{
+		TakenAt:  start,
+		Complete: complete,
+		Tenants:  make([]models.StorageUsage, 0, len(totals)),
+		Nodes:    nodes,
+	}
+	for _, total := range totals {
+		snapshot.Tenants = append(snapshot.Tenants, *total)
+	}
+	sort.Slice(snapshot.Tenants, func(i, j int) bool {
+		return snapshot.Tenants[i].UserID < snapshot.Tenants[j].UserID
+	})
+
+	if complete {
+		if err := h.recordUsage(ctx, snapshot); err != nil {
+			log.Printf("Metering: recording snapshot failed: %v\n", err)
+		} else {
+			snapshot.Recorded = true
+		}
+	}
+	snapshot.DurationMs = time.Since(start).Milliseconds()
+
+	log.Printf("Metering: %d tenants on %d nodes (complete=%t, recorded=%t) in %v\n",
+		len(snapshot.Tenants), len(ring), snapshot.Complete, snapshot.Recorded, time.Since(start))
+	h.meter.set(snapshot)
+	return snapshot
+}
+
+// recordUsage stores a snapshot with the usermanager, where it feeds storage
+// quotas and billing exports
+func (h *Handler) recordUsage(ctx context.Context, snapshot *UsageSnapshot) error {
+	url := fmt.Sprintf("http://localhost:%s/storage-usage", h.config.UserManagerPort)
+
+	payload, err := json.Marshal(models.StorageSnapshot{
+		TakenAt: snapshot.TakenAt,
+		Tenants: snapshot.Tenants,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Admin-Token", h.config.AdminToken)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("usermanager responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// StorageUsage handles GET /admin/usage
+// Returns the latest metering pass, optionally for a single user_id.
+func (h *Handler) StorageUsage(w http.ResponseWriter, r *http.Request) {
+	snapshot := h.meter.Last()
+	if snapshot == nil {
+		respondError(w, http.StatusNotFound, "No metering pass has run yet")
+		return
+	}
+
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, err := strconv.ParseInt(userIDStr, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid user_id")
+			return
+		}
+		filtered := *snapshot
+		filtered.Tenants = []models.StorageUsage{}
+		for _, tenant := range snapshot.Tenants {
+			if tenant.UserID == userID {
+				filtered.Tenants = append(filtered.Tenants, tenant)
+			}
+		}
+		snapshot = &filtered
+	}
+
+	respondJSON(w, http.StatusOK, snapshot)
+}
+
+// RunMetering handles POST /admin/usage, running a metering pass now
+func (h *Handler) RunMetering(w http.ResponseWriter, r *http.Request) {
+	// Walking every keyspace can take much longer than a normal request
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	respondJSON(w, http.StatusOK, h.runMetering(ctx))
+}
@@ -2,7 +2,8 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,14 +12,33 @@ import (
 	"time"
 
 	"dht/internal/config"
+	"dht/internal/httpx"
+	"dht/internal/middleware"
+	"dht/internal/models"
+	"dht/internal/proto"
 )
 
 // AuthMiddleware validates API keys against the usermanager service
-func AuthMiddleware(cfg *config.Config, rls *RateLimiterStore) func(http.Handler) http.Handler {
+func AuthMiddleware(cfg *config.Config, client *httpx.Client, rls *RateLimiterStore, keys *TenantKeyResolver) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Skip auth for health check
-			if r.URL.Path == "/health" {
+			// Skip auth for health check and metrics
+			if r.URL.Path == "/health" || r.URL.Path == "/version" || r.URL.Path == "/metrics" || r.URL.Path == "/metrics/cluster" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The admin API uses its own shared token instead of tenant API keys
+			if strings.HasPrefix(r.URL.Path, "/admin/") {
+				if cfg.AdminToken == "" {
+					respondError(w, http.StatusForbidden, "Admin API is disabled")
+					return
+				}
+				token := r.Header.Get("X-Admin-Token")
+				if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+					respondError(w, http.StatusUnauthorized, "Invalid admin token")
+					return
+				}
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -30,105 +50,145 @@ func AuthMiddleware(cfg *config.Config, rls *RateLimiterStore) func(http.Handler
 				return
 			}
 
-			// Validate API key with usermanager service
-			userID, err := validateAPIKey(cfg, apiKey)
+			// A scoped token is checked here first so a request outside its
+			// scope does not use up a single-use token
+			var token *scopedClaims
+			if strings.HasPrefix(apiKey, scopedTokenPrefix) {
+				claims, err := parseScopedToken(cfg.ScopedTokenSecret, apiKey)
+				if err != nil {
+					log.Printf("Scoped token rejected: %v\n", err)
+					respondError(w, http.StatusUnauthorized, "Invalid or expired token")
+					return
+				}
+				if !claims.allows(r) {
+					respondError(w, http.StatusForbidden, "Token does not allow this request")
+					return
+				}
+				token = claims
+			}
+
+			// Validate API key (or the key behind the token) with usermanager service
+			var key *models.KeyValidation
+			var err error
+			if token != nil {
+				key, err = validateScopedToken(r.Context(), cfg, client, token)
+			} else {
+				key, err = validateAPIKey(r.Context(), cfg, client, apiKey)
+			}
 			if err != nil {
 				log.Printf("API key validation failed: %v\n", err)
+				if errors.Is(err, context.DeadlineExceeded) {
+					respondErrorCode(w, http.StatusGatewayTimeout, models.ErrCodeTimeout, "API key validation timed out", nil)
+					return
+				}
+				var apiErr *models.APIError
+				if errors.As(err, &apiErr) {
+					respondError(w, http.StatusUnauthorized, apiErr.Message)
+					return
+				}
 				respondError(w, http.StatusUnauthorized, "Invalid API key")
 				return
 			}
 
 			// Check rate limit for this user
-			if !rls.AllowRequest(userID) {
+			if !rls.AllowRequest(key.UserID) {
 				respondError(w, http.StatusTooManyRequests, "Rate limit exceeded")
 				return
 			}
 
-			// Add user ID to context
-			ctx := context.WithValue(r.Context(), "user_id", userID)
+			// Refuse writes that add data once the tenant's metered storage
+			// has reached its quota; reads and deletes stay allowed
+			if key.StorageQuotaBytes > 0 && key.StorageUsedBytes >= key.StorageQuotaBytes && addsData(r) {
+				respondErrorCode(w, http.StatusForbidden, models.ErrCodeQuotaExceeded, "Storage quota exceeded",
+					map[string]interface{}{
+						"storage_quota_bytes": key.StorageQuotaBytes,
+						"storage_used_bytes":  key.StorageUsedBytes,
+					})
+				return
+			}
+
+			// Add the caller's identity to context
+			ctx := middleware.WithUserID(r.Context(), key.UserID)
+			ctx = middleware.WithScopes(ctx, key.Scopes)
+			ctx = middleware.WithNamespacePolicies(ctx, key.Namespaces)
+			ctx = middleware.WithAPIKeyID(ctx, key.KeyID)
+			if token != nil {
+				ctx = middleware.WithScopedTokenID(ctx, token.ID)
+			}
+
+			// Resolve the tenant's encryption key; never fall back to plaintext
+			if key.Encryption != nil {
+				dek, err := keys.Resolve(key.Encryption)
+				if err != nil {
+					log.Printf("Failed to resolve encryption key for user %d: %v\n", key.UserID, err)
+					respondError(w, http.StatusInternalServerError, "Failed to load tenant encryption key")
+					return
+				}
+				ctx = middleware.WithTenantKey(ctx, dek)
+			}
+
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// addsData reports whether r is a write that can grow a tenant's storage
+func addsData(r *http.Request) bool {
+	switch {
+	case r.Method == "PUT" || r.Method == "PATCH":
+		return strings.HasPrefix(r.URL.Path, "/v1/kv/")
+	case r.Method == "POST":
+		return r.URL.Path == "/v1/txn"
+	}
+	return false
+}
+
 // validateAPIKey validates an API key against the usermanager service
-func validateAPIKey(cfg *config.Config, apiKey string) (int64, error) {
+func validateAPIKey(ctx context.Context, cfg *config.Config, client *httpx.Client, apiKey string) (*models.KeyValidation, error) {
 	// Create request to usermanager
 	url := fmt.Sprintf("http://localhost:%s/validate-key", cfg.UserManagerPort)
 
-	reqBody := map[string]string{"api_key": apiKey}
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return 0, err
-	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.AuthTimeout)
+	defer cancel()
 
-	req, err := http.NewRequest("POST", url, strings.NewReader(string(jsonData)))
+	req, err := proto.NewRequest(ctx, "POST", url, &models.ValidateKeyRequest{APIKey: apiKey}, useProto(cfg))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 5 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("API key validation failed with status %d", resp.StatusCode)
-	}
-
-	var result struct {
-		UserID int64 `json:"user_id"`
-		Valid  bool  `json:"valid"`
+		return nil, fmt.Errorf("API key validation failed with status %d", resp.StatusCode)
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return 0, err
+	var result models.KeyValidation
+	if err := proto.DecodeResponse(resp, &result); err != nil {
+		return nil, err
 	}
 
 	if !result.Valid {
-		return 0, fmt.Errorf("invalid API key")
+		return nil, fmt.Errorf("invalid API key")
 	}
 
-	return result.UserID, nil
+	return &result, nil
 }
 
-// LoggingMiddleware logs HTTP requests
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(wrapped, r)
-		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapped.statusCode, duration)
-	})
+// useProto reports whether messages to other services are sent as protobuf
+func useProto(cfg *config.Config) bool {
+	return cfg.InternalEncoding == "protobuf"
 }
 
-// CORSMiddleware handles CORS headers
-func CORSMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Consistency")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-// responseWriter wraps http.ResponseWriter to capture status code
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+// WithDeadline bounds the handling of a route, including every backend call
+// it makes, to d (or less if the client sent a shorter X-Request-Timeout)
+func WithDeadline(d time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
 }
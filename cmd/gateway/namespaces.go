@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// namespaceUsage is the storage one tenant holds in one namespace
+type namespaceUsage struct {
+	Owner     int64  `json:"owner"`
+	Namespace string `json:"namespace"`
+	Keys      int64  `json:"keys"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// NamespaceUsage handles GET /admin/namespaces
+// Adds up the per-tenant, per-namespace key counts and bytes of every node.
+// Each node only counts the keys it is primary for, so replicas are not
+// counted twice. ?user_id= limits the report to one tenant.
+func (h *Handler) NamespaceUsage(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("user_id")
+	if owner != "" {
+		if _, err := strconv.ParseInt(owner, 10, 64); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid user_id")
+			return
+		}
+	}
+
+	ring := h.ring.GetAllNodes()
+	results := make([]nodeResult, len(ring))
+
+	var wg sync.WaitGroup
+	for i, nodeURL := range ring {
+		wg.Add(1)
+		go func(i int, nodeURL string) {
+			defer wg.Done()
+
+			query := url.Values{"self": {nodeURL}, "ring": ring}
+			if owner != "" {
+				query.Set("owner", owner)
+			}
+			results[i] = h.sendToNode(r.Context(), "GET", nodeURL+"/admin/namespaces?"+query.Encode(), 0, nil)
+			results[i].node = nodeURL
+		}(i, nodeURL)
+	}
+	wg.Wait()
+
+	type group struct {
+		owner     int64
+		namespace string
+	}
+	totals := make(map[group]*namespaceUsage)
+	nodes := make([]map[string]interface{}, len(results))
+	complete := len(ring) > 0
+	for i, res := range results {
+		nodes[i] = map[string]interface{}{"node": res.node}
+
+		var nodeData struct {
+			Namespaces []namespaceUsage `json:"namespaces"`
+		}
+		switch {
+		case res.err != nil:
+			nodes[i]["error"] = res.err.Error()
+		case res.status != http.StatusOK:
+			nodes[i]["error"] = fmt.Sprintf("status %d", res.status)
+		case json.Unmarshal(res.body, &nodeData) != nil:
+			nodes[i]["error"] = "invalid response"
+		}
+		if nodes[i]["error"] != nil {
+			complete = false
+			continue
+		}
+		nodes[i]["namespaces"] = len(nodeData.Namespaces)
+
+		for _, u := range nodeData.Namespaces {
+			g := group{owner: u.Owner, namespace: u.Namespace}
+			total, exists := totals[g]
+			if !exists {
+				total = &namespaceUsage{Owner: u.Owner, Namespace: u.Namespace}
+				totals[g] = total
+			}
+			total.Keys += u.Keys
+			total.Bytes += u.Bytes
+		}
+	}
+
+	usage := make([]namespaceUsage, 0, len(totals))
+	for _, total := range totals {
+		usage = append(usage, *total)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Owner != usage[j].Owner {
+			return usage[i].Owner < usage[j].Owner
+		}
+		return usage[i].Namespace < usage[j].Namespace
+	})
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"complete":   complete,
+		"namespaces": usage,
+		"count":      len(usage),
+		"nodes":      nodes,
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// negativeEntry tracks cache state for one key
+type negativeEntry struct {
+	expiresAt     time.Time // when the cached "not found" lapses (zero if none)
+	invalidatedAt time.Time // last write seen for the key
+}
+
+// NegativeCache remembers keys recently found missing so repeated lookups
+// for nonexistent keys don't reach the DHT nodes. Writes through the
+// gateway invalidate entries.
+type NegativeCache struct {
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*negativeEntry
+	mu         sync.Mutex
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	stores        atomic.Int64
+	invalidations atomic.Int64
+}
+
+// NegativeCacheStats is a snapshot of cache metrics
+type NegativeCacheStats struct {
+	Enabled       bool    `json:"enabled"`
+	TTLMs         int64   `json:"ttl_ms"`
+	Entries       int     `json:"entries"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRate       float64 `json:"hit_rate"`
+	Stores        int64   `json:"stores"`
+	Invalidations int64   `json:"invalidations"`
+}
+
+// NewNegativeCache creates a negative cache; a ttl of 0 disables it
+func NewNegativeCache(ttl time.Duration, maxEntries int) *NegativeCache {
+	nc := &NegativeCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*negativeEntry),
+	}
+
+	if nc.Enabled() {
+		go nc.cleanup()
+	}
+
+	return nc
+}
+
+// Enabled reports whether negative caching is on
+func (nc *NegativeCache) Enabled() bool {
+	return nc.ttl > 0 && nc.maxEntries > 0
+}
+
+// IsMissing reports whether key is cached as not found
+func (nc *NegativeCache) IsMissing(key string) bool {
+	if !nc.Enabled() {
+		return false
+	}
+
+	nc.mu.Lock()
+	entry, exists := nc.entries[key]
+	hit := exists && time.Now().Before(entry.expiresAt)
+	nc.mu.Unlock()
+
+	if hit {
+		nc.hits.Add(1)
+	} else {
+		nc.misses.Add(1)
+	}
+	return hit
+}
+
+// AddMissing caches key as not found. lookupStart is when the lookup that
+// found it missing began; the result is dropped if a write invalidated the
+// key since then, so a slow lookup can't cache over a newer write.
+func (nc *NegativeCache) AddMissing(key string, lookupStart time.Time) {
+	if !nc.Enabled() {
+		return
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	entry, exists := nc.entries[key]
+	if exists && !entry.invalidatedAt.Before(lookupStart) {
+		return
+	}
+
+	if !exists {
+		if len(nc.entries) >= nc.maxEntries {
+			nc.evictOne()
+		}
+		entry = &negativeEntry{}
+		nc.entries[key] = entry
+	}
+	entry.expiresAt = time.Now().Add(nc.ttl)
+	nc.stores.Add(1)
+}
+
+// Invalidate drops the cached "not found" for key (called on writes)
+func (nc *NegativeCache) Invalidate(key string) {
+	if !nc.Enabled() {
+		return
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	entry, exists := nc.entries[key]
+	if !exists {
+		if len(nc.entries) >= nc.maxEntries {
+			nc.evictOne()
+		}
+		entry = &negativeEntry{}
+		nc.entries[key] = entry
+	} else if time.Now().Before(entry.expiresAt) {
+		nc.invalidations.Add(1)
+	}
+	entry.expiresAt = time.Time{}
+	entry.invalidatedAt = time.Now()
+}
+
+// Stats returns the current cache metrics
+func (nc *NegativeCache) Stats() NegativeCacheStats {
+	nc.mu.Lock()
+	entries := len(nc.entries)
+	nc.mu.Unlock()
+
+	stats := NegativeCacheStats{
+		Enabled:       nc.Enabled(),
+		TTLMs:         nc.ttl.Milliseconds(),
+		Entries:       entries,
+		Hits:          nc.hits.Load(),
+		Misses:        nc.misses.Load(),
+		Stores:        nc.stores.Load(),
+		Invalidations: nc.invalidations.Load(),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// evictOne removes an arbitrary entry; caller must hold nc.mu
+func (nc *NegativeCache) evictOne() {
+	for key := range nc.entries {
+		delete(nc.entries, key)
+		return
+	}
+}
+
+// cleanup removes lapsed entries periodically. Invalidation markers are
+// kept for a while so in-flight lookups that started before a write are
+// still recognized.
+func (nc *NegativeCache) cleanup() {
+	ticker := time.NewTicker(nc.ttl)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		nc.mu.Lock()
+		now := time.Now()
+		for key, entry := range nc.entries {
+			if now.After(entry.expiresAt) && now.Sub(entry.invalidatedAt) > time.Minute {
+				delete(nc.entries, key)
+			}
+		}
+		nc.mu.Unlock()
+	}
+}
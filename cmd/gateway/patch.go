@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dht/internal/delta"
+	"dht/internal/envelope"
+	"dht/internal/jsondoc"
+	"dht/internal/models"
+	"dht/internal/requestid"
+)
+
+// maxPatchAttempts bounds how often a patch is re-applied after the key was
+// changed between reading and writing it back
+const maxPatchAttempts = 5
+
+// patchBase is the stored document a patch is applied to, as read from the
+// primary
+type patchBase struct {
+	exists    bool
+	value     []byte
+	version   uint64
+	ttl       time.Duration // remaining (or sliding) TTL, 0 if the key does not expire
+	sliding   bool
+	updatedAt time.Time
+}
+
+// PatchKey handles PATCH /v1/kv/:key
+// The gateway reads the document from the primary, applies a JSON merge
+// patch (RFC 7386) or JSON patch (RFC 6902) to it and writes the result back
+// guarded by If-Match, so a concurrent write is never overwritten. Without a
+// client If-Match the patch is re-applied to the newer document instead.
+// Binary deltas are handled by patchDelta.
+func (h *Handler) PatchKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		respondError(w, http.StatusBadRequest, "Key is required")
+		return
+	}
+
+	if h.rejectIfFrozen(w) {
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == delta.ContentType {
+		h.patchDelta(w, r, key)
+		return
+	}
+	if contentType != jsondoc.MergePatchContentType && contentType != jsondoc.JSONPatchContentType {
+		respondError(w, http.StatusUnsupportedMediaType,
+			"Content-Type must be "+jsondoc.MergePatchContentType+", "+jsondoc.JSONPatchContentType+" or "+delta.ContentType)
+		return
+	}
+
+	// Read the patch document
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	consistency := requestConsistency(r, key)
+
+	// Validate consistency level
+	if consistency != "strong" && consistency != "eventual" {
+		respondError(w, http.StatusBadRequest, "Invalid consistency level. Must be 'strong' or 'eventual'")
+		return
+	}
+
+	// A client If-Match pins the version the patch was written against
+	var expected *uint64
+	if ifMatch := strings.TrimSpace(r.Header.Get("If-Match")); ifMatch != "" {
+		version, err := strconv.ParseUint(strings.Trim(ifMatch, `"`), 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "If-Match must be a version number")
+			return
+		}
+		expected = &version
+	}
+
+	// Get user ID from context
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	session, ok := readSession(w, r)
+	if !ok {
+		return
+	}
+
+	// Use hash ring to determine primary and replica nodes
+	nodes := h.locateKey(r.Context(), key)
+	if len(nodes) == 0 {
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
+		return
+	}
+
+	primaryNode := nodes[0]
+	replicaNodes := nodes[1:]
+
+	if h.rejectIfSuspected(w, primaryNode) {
+		return
+	}
+
+	log.Printf("PATCH key=%s primary=%s replicas=%v (user=%d, consistency=%s)\n",
+		key, primaryNode, replicaNodes, userID, consistency)
+
+	// A merge patch can create the key
+	h.negativeCache.Invalidate(key)
+
+	dek := tenantKey(r)
+	for attempt := 1; ; attempt++ {
+		base, resp, err := h.readPatchBase(r.Context(), primaryNode, key, userID)
+		if err != nil {
+			log.Printf("Error reading key from primary node: %v\n", err)
+			respondNodeError(w, err, "Primary node unavailable")
+			return
+		}
+		if resp != nil {
+			forwardResponse(w, resp)
+			return
+		}
+
+		if expected != nil && (!base.exists || base.version != *expected) {
+			respondErrorCode(w, http.StatusPreconditionFailed, models.ErrCodeConditionFailed,
+				"Precondition failed: the key's version does not match",
+				map[string]interface{}{"exists": base.exists, "current_version": base.version})
+			return
+		}
+		if !base.exists && contentType == jsondoc.JSONPatchContentType {
+			// A merge patch may create a document, a JSON patch needs one to operate on
+			respondError(w, http.StatusNotFound, "Key not found")
+			return
+		}
+
+		current, err := openValue(dek, key, base.value)
+		if err != nil {
+			log.Printf("Error decrypting value for key=%s: %v\n", key, err)
+			respondError(w, http.StatusInternalServerError, "Failed to decrypt value")
+			return
+		}
+
+		var patched []byte
+		if contentType == jsondoc.MergePatchContentType {
+			patched, err = jsondoc.MergePatch(current, patch)
+		} else {
+			patched, err = jsondoc.ApplyPatch(current, patch)
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, jsondoc.ErrNotJSON):
+				respondError(w, http.StatusUnprocessableEntity, "Value is not a JSON document")
+			case errors.Is(err, jsondoc.ErrTestFailed):
+				respondErrorCode(w, http.StatusConflict, models.ErrCodeConditionFailed, err.Error(), nil)
+			default:
+				respondError(w, http.StatusUnprocessableEntity, err.Error())
+			}
+			return
+		}
+
+		stored := patched
+		if dek != nil {
+			stored, err = envelope.Seal(dek, []byte(key), patched)
+			if err != nil {
+				log.Printf("Error encrypting value: %v\n", err)
+				respondError(w, http.StatusInternalServerError, "Failed to encrypt value")
+				return
+			}
+		}
+
+		resp, err = h.writePatched(r.Context(), primaryNode, key, userID, stored, base)
+		if err != nil {
+			log.Printf("Error forwarding request to primary node: %v\n", err)
+			respondNodeError(w, err, "Primary node unavailable")
+			return
+		}
+
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			resp.Body.Close()
+			if expected != nil {
+				respondErrorCode(w, http.StatusPreconditionFailed, models.ErrCodeConditionFailed,
+					"Precondition failed: the key's version does not match", nil)
+				return
+			}
+			if attempt < maxPatchAttempts {
+				// Someone wrote the key since it was read; patch the newer
+				// document after a short pause so contending writers spread out
+				select {
+				case <-time.After(time.Duration(rand.Intn(10*attempt)+1) * time.Millisecond):
+					continue
+				case <-r.Context().Done():
+					respondNodeError(w, r.Context().Err(), "Request cancelled")
+					return
+				}
+			}
+			respondErrorCode(w, http.StatusConflict, models.ErrCodeWriteConflict,
+				"Key is being modified concurrently", map[string]interface{}{"attempts": attempt})
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			forwardResponse(w, resp)
+			return
+		}
+		version, _ := strconv.ParseUint(resp.Header.Get("X-Version"), 10, 64)
+		resp.Body.Close()
+
+		// Replicate the patched document, keeping the key's remaining TTL
+		if len(replicaNodes) > 0 || h.rollouts.Active() {
+			replReq := models.ReplicationRequest{
+				Key:          key,
+				Value:        stored,
+				Operation:    "SET",
+				TTL:          base.ttl,
+				Sliding:      base.sliding,
+				Consistency:  consistency,
+				PrimaryNode:  primaryNode,
+				ReplicaNodes: replicaNodes,
+				UserID:       userID,
+				RequestID:    requestid.FromContext(r.Context()),
+				Version:      version,
+
+				ReplicationFactor: replicationFactor(r.Context(), key),
+			}
+
+			h.triggerReplication(r.Context(), &replReq, consistency)
+		}
+
+		// Return the patched document
+		session.Record(key, primaryNode, version, false)
+		session.Set(w)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Primary-Node", primaryNode)
+		w.Header().Set("X-Version", strconv.FormatUint(version, 10))
+		w.WriteHeader(http.StatusOK)
+		w.Write(patched)
+		return
+	}
+}
+
+// readPatchBase reads key with its version and expiry from the primary. A
+// missing key is a valid base; any other failure is returned as the node's
+// response for the caller to forward (and close).
+func (h *Handler) readPatchBase(ctx context.Context, primaryNode, key string, userID int64) (*patchBase, *http.Response, error) {
+	resp, err := h.fetchFromNode(ctx, primaryNode, key, "", userID, "strong")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return &patchBase{}, nil, nil
+	default:
+		return nil, resp, nil
+	}
+	defer resp.Body.Close()
+
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := &patchBase{exists: true, value: value}
+	base.version, _ = strconv.ParseUint(resp.Header.Get("X-Version"), 10, 64)
+	base.updatedAt, _ = time.Parse(time.RFC3339Nano, resp.Header.Get("X-Updated-At"))
+	if slidingTTL, err := time.ParseDuration(resp.Header.Get("X-Sliding-TTL")); err == nil {
+		base.ttl = slidingTTL
+		base.sliding = true
+	} else if expiresAt, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Expires-At")); err == nil {
+		// Keep the key's original expiry
+		base.ttl = time.Until(expiresAt)
+		if base.ttl <= 0 {
+			base.ttl = time.Millisecond
+		}
+	}
+	return base, nil, nil
+}
+
+// writePatched writes a patched value to the primary, only if the key is
+// still at the version (or still absent) that the patch was applied to
+func (h *Handler) writePatched(ctx context.Context, primaryNode, key string, userID int64, value []byte, base *patchBase) (*http.Response, error) {
+	reqURL := fmt.Sprintf("%s/store/%s", primaryNode, key)
+	if base.ttl > 0 {
+		// The remaining TTL was settled when the key was written
+		reqURL = fmt.Sprintf("%s?ttl=%s&jitter=false", reqURL, base.ttl.String())
+		if base.sliding {
+			reqURL += "&sliding=true"
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", fmt.Sprintf("%d", userID))
+	setReplicationFactor(req, key)
+	if base.exists {
+		req.Header.Set("If-Match", strconv.FormatUint(base.version, 10))
+	} else {
+		req.Header.Set("If-None-Match", "*")
+	}
+	return h.httpClient.Do(req)
+}
+
+// forwardResponse relays a node's (error) response to the client and
+// closes it
+func forwardResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"dht/internal/models"
+)
+
+// keyCopy is one node's copy of a key, as reported by GET /store/{key}/meta
+type keyCopy struct {
+	Version       uint64     `json:"version"`
+	SourceVersion uint64     `json:"source_version"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	Size          int        `json:"size"`
+	Checksum      string     `json:"checksum"`
+	Replicas      int        `json:"replicas"` // the key's own replication factor, 0 for the default
+}
+
+// replicaStatus is the state of a key on one of its nodes
+type replicaStatus struct {
+	Node      string   `json:"node"`
+	Role      string   `json:"role"` // "primary" or "replica"
+	Suspected bool     `json:"suspected,omitempty"`
+	Reachable bool     `json:"reachable"`
+	Exists    bool     `json:"exists"`
+	Copy      *keyCopy `json:"copy,omitempty"`
+	Error     string   `json:"error,omitempty"`
+
+	// InSync is nil when it cannot be decided (this node or the primary is
+	// unreachable); State explains a false
+	InSync *bool  `json:"in_sync,omitempty"`
+	State  string `json:"state"`
+}
+
+// KeyReplicas handles GET /v1/kv/{key}/replicas
+// Every node holding the key is asked for its copy's version, timestamp and
+// checksum; replicas are in sync when they match the primary's copy.
+func (h *Handler) KeyReplicas(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	nodes := h.locateKey(r.Context(), key)
+	if len(nodes) == 0 {
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
+		return
+	}
+
+	statuses := make([]replicaStatus, len(nodes))
+	var wg sync.WaitGroup
+	for i, nodeURL := range nodes {
+		wg.Add(1)
+		go func(i int, nodeURL string) {
+			defer wg.Done()
+			statuses[i] = h.readKeyCopy(r.Context(), nodeURL, key, userID)
+		}(i, nodeURL)
+	}
+	wg.Wait()
+	statuses[0].Role = "primary"
+
+	primary := statuses[0]
+	allInSync := primary.Reachable
+	for i := range statuses {
+		status := &statuses[i]
+		if !status.Reachable {
+			status.State = "unreachable"
+			allInSync = false
+			continue
+		}
+		if i == 0 {
+			status.State = "primary"
+			continue
+		}
+		if !primary.Reachable {
+			status.State = "unknown"
+			continue
+		}
+
+		status.State = compareCopies(primary.Copy, status.Copy)
+		inSync := status.State == "in_sync"
+		status.InSync = &inSync
+		allInSync = allInSync && inSync
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"key":          key,
+		"primary_node": nodes[0],
+		"exists":       primary.Exists,
+		"in_sync":      allInSync,
+		"nodes":        statuses,
+	})
+}
+
+// readKeyCopy asks one node for its copy of key
+func (h *Handler) readKeyCopy(ctx context.Context, nodeURL, key string, userID int64) replicaStatus {
+	status := replicaStatus{Node: nodeURL, Role: "replica", Suspected: !h.nodeAvailable(nodeURL)}
+
+	res := h.sendToNode(ctx, "GET", fmt.Sprintf("%s/store/%s/meta", nodeURL, url.PathEscape(key)), userID, nil)
+	switch {
+	case res.err != nil:
+		status.Error = res.err.Error()
+	case res.status == http.StatusNotFound:
+		status.Reachable = true
+	case res.status != http.StatusOK:
+		status.Error = fmt.Sprintf("node returned status %d", res.status)
+	default:
+		var c keyCopy
+		if err := json.Unmarshal(res.body, &c); err != nil {
+			status.Error = "invalid response from node"
+			break
+		}
+		status.Reachable = true
+		status.Exists = true
+		status.Copy = &c
+	}
+	return status
+}
+
+// compareCopies describes a replica's copy relative to the primary's; either
+// is nil when the node does not have the key
+func compareCopies(primary, replica *keyCopy) string {
+	switch {
+	case primary == nil && replica == nil:
+		return "in_sync"
+	case primary == nil:
+		return "not_deleted"
+	case replica == nil:
+		return "missing"
+	case primary.Checksum == replica.Checksum:
+		return "in_sync"
+	case replica.SourceVersion > 0 && replica.SourceVersion < primary.Version,
+		replica.SourceVersion == 0 && replica.UpdatedAt.Before(primary.UpdatedAt):
+		return "stale"
+	default:
+		return "diverged"
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dht/internal/models"
+	"dht/internal/requestid"
+)
+
+// replicaCopy is what a stale read found on one replica
+type replicaCopy struct {
+	node      string
+	exists    bool
+	updatedAt time.Time
+}
+
+// Revalidator runs the background refreshes of stale-while-revalidate reads,
+// at most one per key at a time
+type Revalidator struct {
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+
+	started  atomic.Int64
+	skipped  atomic.Int64 // a refresh of the key was already running
+	repaired atomic.Int64 // replicas rewritten from the primary
+	upToDate atomic.Int64 // refreshes that found every copy current
+	failures atomic.Int64
+}
+
+// RevalidatorStats is a snapshot of refresh metrics
+type RevalidatorStats struct {
+	InFlight int   `json:"in_flight"`
+	Started  int64 `json:"started"`
+	Skipped  int64 `json:"skipped"`
+	Repaired int64 `json:"repaired"`
+	UpToDate int64 `json:"up_to_date"`
+	Failures int64 `json:"failures"`
+}
+
+func NewRevalidator() *Revalidator {
+	return &Revalidator{inFlight: make(map[string]struct{})}
+}
+
+// begin claims the refresh of key, false if one is already running
+func (rv *Revalidator) begin(key string) bool {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+
+	if _, running := rv.inFlight[key]; running {
+		rv.skipped.Add(1)
+		return false
+	}
+	rv.inFlight[key] = struct{}{}
+	rv.started.Add(1)
+	return true
+}
+
+func (rv *Revalidator) done(key string) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	delete(rv.inFlight, key)
+}
+
+// Stats returns a snapshot of refresh metrics
+func (rv *Revalidator) Stats() RevalidatorStats {
+	rv.mu.Lock()
+	inFlight := len(rv.inFlight)
+	rv.mu.Unlock()
+
+	return RevalidatorStats{
+		InFlight: inFlight,
+		Started:  rv.started.Load(),
+		Skipped:  rv.skipped.Load(),
+		Repaired: rv.repaired.Load(),
+		UpToDate: rv.upToDate.Load(),
+		Failures: rv.failures.Load(),
+	}
+}
+
+// revalidate reads key from the primary and rewrites the replica copies a
+// stale-while-revalidate read found missing or older than the primary's,
+// through the replicator. It runs after the client has been answered; ctx
+// only carries the request's values.
+func (h *Handler) revalidate(ctx context.Context, primaryNode, key string, userID int64, copies []replicaCopy) {
+	defer h.revalidator.done(key)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), h.config.ReadTimeout)
+	defer cancel()
+
+	primary, errResp, err := h.readPatchBase(ctx, primaryNode, key, userID)
+	if err != nil || errResp != nil {
+		if errResp != nil {
+			errResp.Body.Close()
+		}
+		h.revalidator.failures.Add(1)
+		log.Printf("Revalidate key=%s: reading primary %s failed (err=%v)\n", key, primaryNode, err)
+		return
+	}
+
+	var stale []string
+	for _, replica := range copies {
+		switch {
+		case !primary.exists && replica.exists:
+			stale = append(stale, replica.node)
+		case primary.exists && (!replica.exists || replica.updatedAt.Before(primary.updatedAt)):
+			stale = append(stale, replica.node)
+		}
+	}
+	if len(stale) == 0 {
+		h.revalidator.upToDate.Add(1)
+		return
+	}
+
+	replReq := models.ReplicationRequest{
+		Key:          key,
+		Operation:    "DELETE",
+		Consistency:  "eventual",
+		PrimaryNode:  primaryNode,
+		ReplicaNodes: stale,
+		UserID:       userID,
+		RequestID:    requestid.FromContext(ctx),
+
+		ReplicationFactor: replicationFactor(ctx, key),
+	}
+	if primary.exists {
+		replReq.Operation = "SET"
+		replReq.Value = primary.value
+		replReq.TTL = primary.ttl
+		replReq.Sliding = primary.sliding
+	}
+
+	h.revalidator.repaired.Add(int64(len(stale)))
+	log.Printf("Revalidate key=%s: refreshing %d replica(s) from %s (%s)\n", key, len(stale), primaryNode, replReq.Operation)
+	h.triggerReplication(ctx, &replReq, "eventual")
+}
+
+// startRevalidation kicks off the background refresh of a key served from a
+// replica, marking the response; at most one refresh per key runs at a time
+func (h *Handler) startRevalidation(w http.ResponseWriter, r *http.Request, primaryNode, key string, userID int64, copies []replicaCopy) {
+	if !h.nodeAvailable(primaryNode) || !h.revalidator.begin(key) {
+		return
+	}
+	w.Header().Set("X-Revalidating", "true")
+	go h.revalidate(r.Context(), primaryNode, key, userID, copies)
+}
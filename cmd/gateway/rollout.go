@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backfill states of a rollout
+const (
+	backfillRunning = "running"
+	backfillDone    = "done"
+	backfillFailed  = "failed"
+)
+
+// Rollout replaces a ring node with a new one gradually. The new node
+// serves Weight percent of the old node's keys, chosen by key hash; every
+// write to the old node's keys reaches both nodes, so the weight can go up
+// and down freely until the rollout completes.
+type Rollout struct {
+	Old       string                 `json:"old"`
+	New       string                 `json:"new"`
+	Weight    int                    `json:"weight"`
+	StartedAt time.Time              `json:"started_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+	Backfill  string                 `json:"backfill"`
+	Copy      map[string]interface{} `json:"copy,omitempty"` // outcome of the backfill
+}
+
+// Rollouts are the node rollouts in progress, by old node
+type Rollouts struct {
+	rollouts map[string]*Rollout
+	mu       sync.RWMutex
+}
+
+// NewRollouts returns an empty set of rollouts
+func NewRollouts() *Rollouts {
+	return &Rollouts{rollouts: make(map[string]*Rollout)}
+}
+
+// Start registers a rollout of newNode replacing old, at weight 0
+func (rs *Rollouts) Start(old, newNode string) *Rollout {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	now := time.Now()
+	rollout := &Rollout{Old: old, New: newNode, StartedAt: now, UpdatedAt: now, Backfill: backfillRunning}
+	rs.rollouts[old] = rollout
+	return rollout
+}
+
+// Get returns a copy of the rollout replacing old
+func (rs *Rollouts) Get(old string) (Rollout, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	rollout, exists := rs.rollouts[old]
+	if !exists {
+		return Rollout{}, false
+	}
+	return *rollout, true
+}
+
+// Involves reports whether node is the old or new node of a rollout
+func (rs *Rollouts) Involves(node string) bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, rollout := range rs.rollouts {
+		if rollout.Old == node || rollout.New == node {
+			return true
+		}
+	}
+	return false
+}
+
+// SetWeight changes the share of old's keys served by its replacement
+func (rs *Rollouts) SetWeight(old string, weight int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rollout, exists := rs.rollouts[old]; exists {
+		rollout.Weight = weight
+		rollout.UpdatedAt = time.Now()
+	}
+}
+
+// SetBackfill records the outcome of a rollout's backfill
+func (rs *Rollouts) SetBackfill(old, state string, result map[string]interface{}) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rollout, exists := rs.rollouts[old]; exists {
+		rollout.Backfill = state
+		rollout.Copy = result
+		rollout.UpdatedAt = time.Now()
+	}
+}
+
+// Remove ends the rollout replacing old
+func (rs *Rollouts) Remove(old string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.rollouts, old)
+}
+
+// List returns copies of all rollouts, by old node
+func (rs *Rollouts) List() []Rollout {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	list := make([]Rollout, 0, len(rs.rollouts))
+	for _, rollout := range rs.rollouts {
+		list = append(list, *rollout)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Old < list[j].Old })
+	return list
+}
+
+// Active reports whether any rollout is in progress
+func (rs *Rollouts) Active() bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return len(rs.rollouts) > 0
+}
+
+// NewNodes returns the replacement nodes, which are not in the ring yet
+func (rs *Rollouts) NewNodes() []string {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	nodes := make([]string, 0, len(rs.rollouts))
+	for _, rollout := range rs.rollouts {
+		nodes = append(nodes, rollout.New)
+	}
+	return nodes
+}
+
+// Route returns the placement of key with rollouts applied: an old node is
+// replaced by its new one for the key's share of the weight. shadows are the
+// nodes of the pairs that were not chosen, which must still get its writes.
+func (rs *Rollouts) Route(key string, nodes []string) (routed, shadows []string) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	if len(rs.rollouts) == 0 {
+		return nodes, nil
+	}
+
+	routed = make([]string, len(nodes))
+	copy(routed, nodes)
+	for i, node := range nodes {
+		rollout, exists := rs.rollouts[node]
+		if !exists {
+			continue
+		}
+		if rolloutBucket(key) < rollout.Weight {
+			routed[i] = rollout.New
+			shadows = append(shadows, rollout.Old)
+		} else {
+			shadows = append(shadows, rollout.New)
+		}
+	}
+	return routed, shadows
+}
+
+// rolloutBucket places key in one of 100 buckets; a rollout at weight w
+// sends the keys of buckets below w to the new node
+func rolloutBucket(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % 100)
+}
+
+// shadowNodes returns the rollout nodes that must also receive a write
+// placed on nodes
+func (h *Handler) shadowNodes(key string, nodes []string) []string {
+	_, shadows := h.rollouts.Route(key, nodes)
+	return shadows
+}
+
+// Rollouts handles GET /admin/rollouts
+func (h *Handler) Rollouts(w http.ResponseWriter, r *http.Request) {
+	rollouts := h.rollouts.List()
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"rollouts": rollouts,
+		"count":    len(rollouts),
+	})
+}
+
+// rolloutRequest is the body of the rollout admin calls
+type rolloutRequest struct {
+	Old    string `json:"old"`
+	New    string `json:"new"`
+	Weight *int   `json:"weight"`
+}
+
+// decodeRolloutRequest reads a rolloutRequest, requiring old
+func decodeRolloutRequest(w http.ResponseWriter, r *http.Request) (rolloutRequest, bool) {
+	var req rolloutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Old == "" {
+		respondError(w, http.StatusBadRequest, "old is required")
+		return req, false
+	}
+	req.Old = strings.TrimRight(req.Old, "/")
+	req.New = strings.TrimRight(req.New, "/")
+	return req, true
+}
+
+// StartRollout handles POST /admin/rollouts
+// Registers new as the replacement of the ring node old at weight 0: writes
+// to old's keys start reaching new, and old copies the keys it holds to new
+// in the background. Reads move once the weight is raised.
+func (h *Handler) StartRollout(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeRolloutRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.New == "" || req.New == req.Old {
+		respondError(w, http.StatusBadRequest, "new is required and must differ from old")
+		return
+	}
+
+	h.ringMu.Lock()
+	defer h.ringMu.Unlock()
+
+	switch {
+	case !h.ring.HasNode(req.Old):
+		respondError(w, http.StatusNotFound, "Node is not in the ring")
+		return
+	case h.ring.HasNode(req.New):
+		respondError(w, http.StatusConflict, "Replacement node is already in the ring")
+		return
+	case h.rollouts.Involves(req.Old), h.rollouts.Involves(req.New):
+		respondError(w, http.StatusConflict, "Node is already part of a rollout")
+		return
+	}
+
+	rollout := *h.rollouts.Start(req.Old, req.New)
+	h.detector.Watch(req.New)
+	go h.backfill(req.Old, req.New)
+
+	log.Printf("Rollout started: %s replacing %s\n", req.New, req.Old)
+	respondJSON(w, http.StatusOK, rollout)
+}
+
+// backfill asks old to copy the keys it holds to new
+func (h *Handler) backfill(old, newNode string) {
+	// Copying a node's worth of keys can take much longer than a normal request
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	res := h.sendToNode(ctx, "POST", old+"/admin/copy", 0, map[string]string{"target": newNode})
+
+	var result map[string]interface{}
+	switch {
+	case res.err != nil:
+		result = map[string]interface{}{"error": res.err.Error()}
+	case res.status != http.StatusOK || json.Unmarshal(res.body, &result) != nil:
+		result = map[string]interface{}{"error": fmt.Sprintf("copy failed with status %d", res.status)}
+	}
+
+	state := backfillDone
+	if failed, _ := result["failed"].(float64); result["error"] != nil || failed > 0 {
+		state = backfillFailed
+	}
+	h.rollouts.SetBackfill(old, state, result)
+	log.Printf("Rollout of %s: backfill from %s %s\n", newNode, old, state)
+}
+
+// SetRolloutWeight handles POST /admin/rollouts/weight
+// Sets the percentage (0-100) of the old node's keys served by the new one.
+// Reads only move to the new node once its backfill is done.
+func (h *Handler) SetRolloutWeight(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeRolloutRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Weight == nil || *req.Weight < 0 || *req.Weight > 100 {
+		respondError(w, http.StatusBadRequest, "weight must be between 0 and 100")
+		return
+	}
+
+	rollout, exists := h.rollouts.Get(req.Old)
+	if !exists {
+		respondError(w, http.StatusNotFound, "No rollout for this node")
+		return
+	}
+	if *req.Weight > 0 && rollout.Backfill != backfillDone {
+		respondError(w, http.StatusConflict, "The replacement's backfill is "+rollout.Backfill+"; abort and restart the rollout if it failed")
+		return
+	}
+
+	h.rollouts.SetWeight(req.Old, *req.Weight)
+	rollout, _ = h.rollouts.Get(req.Old)
+
+	log.Printf("Rollout of %s: weight %d%%\n", rollout.New, rollout.Weight)
+	respondJSON(w, http.StatusOK, rollout)
+}
+
+// CompleteRollout handles POST /admin/rollouts/complete
+// Swaps the old node for the new one in the ring once the new node serves
+// all of its keys. The new node takes its own ring positions, so keys move
+// as when adding a node; the rebalance treats the new node as holding every
+// key the old one had.
+func (h *Handler) CompleteRollout(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeRolloutRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.ringMu.Lock()
+	defer h.ringMu.Unlock()
+
+	rollout, exists := h.rollouts.Get(req.Old)
+	switch {
+	case !exists:
+		respondError(w, http.StatusNotFound, "No rollout for this node")
+		return
+	case rollout.Weight < 100:
+		respondError(w, http.StatusConflict, "Raise the weight to 100 before completing the rollout")
+		return
+	case !h.ring.HasNode(rollout.Old):
+		respondError(w, http.StatusConflict, "The old node has left the ring; abort the rollout")
+		return
+	}
+
+	previous := h.ring.GetAllNodes()
+	h.ring.RemoveNode(rollout.Old)
+	h.ring.AddNode(rollout.New)
+	h.detector.Remove(rollout.Old)
+	delete(h.suspectedSince, rollout.Old)
+	h.rollouts.Remove(rollout.Old)
+
+	event := &RingEvent{
+		Time:   time.Now(),
+		Type:   "replaced",
+		Node:   rollout.New,
+		Reason: "rollout replacing " + rollout.Old + " completed",
+		Ring:   h.ring.GetAllNodes(),
+		Epoch:  h.ring.Epoch(),
+	}
+	h.ringEvents.Record(event)
+	completed := *event
+	go h.rebalance(event, previous, event.Ring, map[string]string{rollout.Old: rollout.New})
+
+	log.Printf("Rollout completed: %s replaced %s\n", rollout.New, rollout.Old)
+	respondJSON(w, http.StatusOK, completed)
+}
+
+// AbortRollout handles POST /admin/rollouts/abort
+// Sends all traffic back to the old node, which kept receiving every write.
+func (h *Handler) AbortRollout(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeRolloutRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.ringMu.Lock()
+	defer h.ringMu.Unlock()
+
+	rollout, exists := h.rollouts.Get(req.Old)
+	if !exists {
+		respondError(w, http.StatusNotFound, "No rollout for this node")
+		return
+	}
+	h.rollouts.Remove(req.Old)
+	if !h.ring.HasNode(rollout.New) {
+		h.detector.Remove(rollout.New)
+	}
+
+	log.Printf("Rollout aborted: %s no longer replacing %s\n", rollout.New, rollout.Old)
+	respondJSON(w, http.StatusOK, rollout)
+}
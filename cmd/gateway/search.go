@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"dht/internal/models"
+)
+
+// SearchKeys handles GET /v1/kv/_search?glob=users:*:profile (or ?regex=)
+// Each node matches its own keys; results are merged, de-duplicated and
+// paginated with an opaque cursor (the last key of the previous page).
+func (h *Handler) SearchKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	glob, expr := query.Get("glob"), query.Get("regex")
+	if (glob == "") == (expr == "") {
+		respondError(w, http.StatusBadRequest, "Exactly one of glob or regex is required")
+		return
+	}
+
+	limit := 100
+	if limitStr := query.Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 || l > 1000 {
+			respondError(w, http.StatusBadRequest, "Invalid limit. Must be between 1 and 1000")
+			return
+		}
+		limit = l
+	}
+	cursor := query.Get("cursor")
+
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("SEARCH glob=%q regex=%q cursor=%q limit=%d (user=%d)\n", glob, expr, cursor, limit, userID)
+
+	nodeQuery := url.Values{"limit": {strconv.Itoa(limit)}}
+	if glob != "" {
+		nodeQuery.Set("glob", glob)
+	} else {
+		nodeQuery.Set("regex", expr)
+	}
+	if cursor != "" {
+		nodeQuery.Set("after", cursor)
+	}
+
+	matches := make(map[string]struct{})
+	hasMore := false
+	queried := 0
+	for _, res := range h.broadcast(r.Context(), "GET", "/scan?"+nodeQuery.Encode(), userID, nil) {
+		if res.err != nil {
+			log.Printf("Error scanning node %s: %v\n", res.node, res.err)
+			continue
+		}
+		if res.status == http.StatusBadRequest {
+			// Invalid pattern; every node would reject it the same way
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(res.body)
+			return
+		}
+		if res.status != http.StatusOK {
+			continue
+		}
+
+		var nodeData struct {
+			Keys    []string `json:"keys"`
+			HasMore bool     `json:"has_more"`
+		}
+		if err := json.Unmarshal(res.body, &nodeData); err != nil {
+			continue
+		}
+		queried++
+		hasMore = hasMore || nodeData.HasMore
+		for _, key := range nodeData.Keys {
+			matches[key] = struct{}{}
+		}
+	}
+
+	if queried == 0 {
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
+		return
+	}
+
+	// Each node returned its first `limit` matches after the cursor, so the
+	// first `limit` keys of the union are the global first page
+	keys := make([]string, 0, len(matches))
+	for key := range matches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+		hasMore = true
+	}
+
+	response := map[string]interface{}{
+		"keys":          keys,
+		"count":         len(keys),
+		"has_more":      hasMore,
+		"nodes_queried": queried,
+		"nodes_total":   len(h.ring.GetAllNodes()),
+	}
+	if hasMore && len(keys) > 0 {
+		response["next_cursor"] = keys[len(keys)-1]
+	}
+
+	respondJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+)
+
+// sessionHeader carries a client's session token: the gateway returns an
+// updated token with every write, and clients send the latest one back on
+// their reads to be sure to see their own writes
+const sessionHeader = "X-Session-Token"
+
+// maxSessionWrites is how many of its most recent writes a session token
+// remembers; older writes have long been replicated in practice
+const maxSessionWrites = 32
+
+// sessionWrite is a write a session must be able to read back: the primary
+// that applied it and the version it got there
+type sessionWrite struct {
+	Key     uint64 `json:"k"` // FNV-64a of the key
+	Node    string `json:"n"`
+	Version uint64 `json:"v"`
+	Deleted bool   `json:"d,omitempty"`
+}
+
+// Session is the decoded session token, oldest write first
+type Session struct {
+	Writes []sessionWrite `json:"w"`
+}
+
+// readSession decodes the X-Session-Token of r, answering 400 if it is
+// malformed. Requests without a token get an empty session.
+func readSession(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	session := &Session{}
+	token := r.Header.Get(sessionHeader)
+	if token == "" {
+		return session, true
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(raw, session) != nil {
+		respondError(w, http.StatusBadRequest, "Invalid "+sessionHeader)
+		return nil, false
+	}
+	return session, true
+}
+
+func sessionKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// Require returns the session's latest write of key, nil if it has none
+func (s *Session) Require(key string) *sessionWrite {
+	hash := sessionKey(key)
+	for i := len(s.Writes) - 1; i >= 0; i-- {
+		if s.Writes[i].Key == hash {
+			return &s.Writes[i]
+		}
+	}
+	return nil
+}
+
+// Record adds a write the primary node applied at version, replacing any
+// earlier write of the same key
+func (s *Session) Record(key, node string, version uint64, deleted bool) {
+	hash := sessionKey(key)
+	writes := s.Writes[:0]
+	for _, write := range s.Writes {
+		if write.Key != hash {
+			writes = append(writes, write)
+		}
+	}
+	writes = append(writes, sessionWrite{Key: hash, Node: node, Version: version, Deleted: deleted})
+	if len(writes) > maxSessionWrites {
+		writes = writes[len(writes)-maxSessionWrites:]
+	}
+	s.Writes = writes
+}
+
+// Set returns the updated token to the client
+func (s *Session) Set(w http.ResponseWriter) {
+	raw, _ := json.Marshal(s)
+	w.Header().Set(sessionHeader, base64.RawURLEncoding.EncodeToString(raw))
+}
+
+// SatisfiedBy reports whether a node's answer to a read of the key reflects
+// the write. The primary that applied the write compares its own version;
+// other nodes compare the primary's version their copy was replicated from.
+// A key written again after a deleting write is at a newer version.
+func (sw *sessionWrite) SatisfiedBy(nodeURL string, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return sw.Deleted
+	case http.StatusOK:
+		header := "X-Source-Version"
+		if nodeURL == sw.Node {
+			header = "X-Version"
+		}
+		version, err := strconv.ParseUint(resp.Header.Get(header), 10, 64)
+		if err != nil {
+			return false
+		}
+		if sw.Deleted {
+			return version > sw.Version
+		}
+		return version >= sw.Version
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"dht/internal/models"
+)
+
+// KeyStats handles GET /v1/kv/{key}/stats, served by the key's primary
+func (h *Handler) KeyStats(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	nodes := h.locateKey(r.Context(), key)
+	if len(nodes) == 0 {
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
+		return
+	}
+	nodeURL := nodes[0]
+	res := h.sendToNode(r.Context(), "GET", fmt.Sprintf("%s/store/%s/stats", nodeURL, url.PathEscape(key)), userID, nil)
+	if res.err != nil {
+		log.Printf("Error fetching stats for key=%s from %s: %v\n", key, nodeURL, res.err)
+		respondNodeError(w, res.err, "DHT node unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.status)
+	w.Write(res.body)
+}
+
+// hotKey is a key's access statistics merged across nodes
+type hotKey struct {
+	Key       string     `json:"key"`
+	Reads     uint64     `json:"reads"`
+	Writes    uint64     `json:"writes"`
+	LastRead  *time.Time `json:"last_read,omitempty"`
+	LastWrite *time.Time `json:"last_write,omitempty"`
+}
+
+// HotKeys handles GET /v1/hotkeys
+// Reads are summed across nodes (each read is served by one node); writes
+// reach every replica, so the highest per-node count is used.
+func (h *Handler) HotKeys(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			respondError(w, http.StatusBadRequest, "Invalid limit. Must be between 1 and 1000")
+			return
+		}
+		limit = parsed
+	}
+
+	by := r.URL.Query().Get("by")
+	switch by {
+	case "":
+		by = "total"
+	case "reads", "writes", "total":
+	default:
+		respondError(w, http.StatusBadRequest, "Invalid by. Must be 'reads', 'writes' or 'total'")
+		return
+	}
+
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Each node returns its own top list, so ask for the full limit
+	query := url.Values{"limit": {strconv.Itoa(limit)}, "by": {by}}.Encode()
+	results := h.broadcast(r.Context(), "GET", "/admin/hotkeys?"+query, userID, nil)
+
+	merged := make(map[string]*hotKey)
+	queried := 0
+	sampleRate := 0
+	for _, res := range results {
+		if res.err != nil || res.status != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Keys       []hotKey `json:"keys"`
+			SampleRate int      `json:"sample_rate"`
+		}
+		if err := json.Unmarshal(res.body, &body); err != nil {
+			continue
+		}
+		queried++
+		sampleRate = body.SampleRate
+
+		for _, k := range body.Keys {
+			m, exists := merged[k.Key]
+			if !exists {
+				m = &hotKey{Key: k.Key}
+				merged[k.Key] = m
+			}
+			m.Reads += k.Reads
+			if k.Writes > m.Writes {
+				m.Writes = k.Writes
+			}
+			if k.LastRead != nil && (m.LastRead == nil || k.LastRead.After(*m.LastRead)) {
+				m.LastRead = k.LastRead
+			}
+			if k.LastWrite != nil && (m.LastWrite == nil || k.LastWrite.After(*m.LastWrite)) {
+				m.LastWrite = k.LastWrite
+			}
+		}
+	}
+
+	if queried == 0 {
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No node returned access statistics", nil)
+		return
+	}
+
+	score := func(k *hotKey) uint64 {
+		switch by {
+		case "reads":
+			return k.Reads
+		case "writes":
+			return k.Writes
+		default:
+			return k.Reads + k.Writes
+		}
+	}
+
+	keys := make([]*hotKey, 0, len(merged))
+	for _, k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if score(keys[i]) != score(keys[j]) {
+			return score(keys[i]) > score(keys[j])
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"keys":          keys,
+		"count":         len(keys),
+		"by":            by,
+		"sample_rate":   sampleRate,
+		"nodes_queried": queried,
+		"nodes_total":   len(results),
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"dht/internal/config"
+	"dht/internal/httpx"
+	"dht/internal/middleware"
+	"dht/internal/models"
+	"dht/internal/proto"
+)
+
+// Scoped tokens are short-lived credentials for specific keys, minted with
+// an API key to hand to jobs that should not hold the key itself. They are
+// sent in X-API-Key like a key and told apart by their prefix.
+const (
+	scopedTokenPrefix     = "ydst_"
+	scopedTokenAudience   = "dht-scoped-token"
+	defaultScopedTokenTTL = 15 * time.Minute
+	maxScopedTokenScopes  = 100
+)
+
+// scopedClaims are the claims of a scoped token. The gateway signs and
+// checks them itself; the usermanager only checks that the API key that
+// minted the token is still active and redeems single-use tokens.
+type scopedClaims struct {
+	KeyID     int64    `json:"key_id"`
+	Keys      []string `json:"keys,omitempty"`
+	Prefixes  []string `json:"prefixes,omitempty"`
+	ReadOnly  bool     `json:"read_only,omitempty"`
+	SingleUse bool     `json:"single_use,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// covers reports whether the token grants access to key
+func (c *scopedClaims) covers(key string) bool {
+	for _, k := range c.Keys {
+		if k == key {
+			return true
+		}
+	}
+	for _, prefix := range c.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the token may be used for r. Tokens only reach
+// single keys: listing, search, queries and transactions could touch keys
+// outside the token's scope, so they are refused.
+func (c *scopedClaims) allows(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT", "PATCH", "DELETE":
+		if c.ReadOnly {
+			return false
+		}
+	default:
+		return false
+	}
+
+	// Match the key the way the router does: one path segment, unescaped
+	escaped, ok := strings.CutPrefix(r.URL.EscapedPath(), "/v1/kv/")
+	if !ok || escaped == "" || strings.Contains(escaped, "/") {
+		return false
+	}
+	key, err := url.PathUnescape(escaped)
+	if err != nil || key == "_search" {
+		return false
+	}
+	return c.covers(key)
+}
+
+// MintToken handles POST /v1/tokens, minting a scoped token with the
+// caller's API key. The token is limited to the listed keys and key
+// prefixes, optionally to reads, and expires after ttl (at most
+// SCOPED_TOKEN_MAX_TTL). A single-use token is accepted for one request.
+func (h *Handler) MintToken(w http.ResponseWriter, r *http.Request) {
+	if h.config.ScopedTokenSecret == "" {
+		respondError(w, http.StatusForbidden, "Scoped tokens are disabled")
+		return
+	}
+	if middleware.ScopedTokenID(r.Context()) != "" {
+		respondError(w, http.StatusForbidden, "Scoped tokens cannot mint tokens; use an API key")
+		return
+	}
+
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	keyID := middleware.APIKeyID(r.Context())
+	if keyID == 0 {
+		respondError(w, http.StatusInternalServerError, "API key ID unavailable")
+		return
+	}
+
+	var req struct {
+		Keys      []string `json:"keys"`
+		Prefixes  []string `json:"prefixes"`
+		ReadOnly  bool     `json:"read_only"`
+		TTL       string   `json:"ttl"`
+		SingleUse bool     `json:"single_use"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if len(req.Keys)+len(req.Prefixes) == 0 {
+		respondError(w, http.StatusBadRequest, "At least one key or prefix is required")
+		return
+	}
+	if len(req.Keys)+len(req.Prefixes) > maxScopedTokenScopes {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("A token may list at most %d keys and prefixes", maxScopedTokenScopes))
+		return
+	}
+	for _, key := range req.Keys {
+		if key == "" {
+			respondError(w, http.StatusBadRequest, "Keys must not be empty")
+			return
+		}
+	}
+	for _, prefix := range req.Prefixes {
+		// An empty prefix would cover every key
+		if prefix == "" {
+			respondError(w, http.StatusBadRequest, "Prefixes must not be empty")
+			return
+		}
+	}
+
+	ttl := defaultScopedTokenTTL
+	if req.TTL != "" {
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil || parsed <= 0 {
+			respondError(w, http.StatusBadRequest, "Invalid ttl. Must be a positive duration like 10m")
+			return
+		}
+		ttl = parsed
+	}
+	if ttl > h.config.ScopedTokenMaxTTL {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("ttl must not exceed %v", h.config.ScopedTokenMaxTTL))
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	now := time.Now()
+	claims := scopedClaims{
+		KeyID:     keyID,
+		Keys:      req.Keys,
+		Prefixes:  req.Prefixes,
+		ReadOnly:  req.ReadOnly,
+		SingleUse: req.SingleUse,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
+			Subject:   strconv.FormatInt(userID, 10),
+			Audience:  jwt.ClaimStrings{scopedTokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			Issuer:    "yourdht",
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(h.config.ScopedTokenSecret))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to sign token")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"token":      scopedTokenPrefix + signed,
+		"token_id":   claims.ID,
+		"keys":       req.Keys,
+		"prefixes":   req.Prefixes,
+		"read_only":  req.ReadOnly,
+		"single_use": req.SingleUse,
+		"expires_at": claims.ExpiresAt.Time.UTC(),
+	})
+}
+
+// parseScopedToken checks the signature and expiry of a scoped token
+func parseScopedToken(secret, token string) (*scopedClaims, error) {
+	if secret == "" {
+		return nil, errors.New("scoped tokens are disabled")
+	}
+
+	claims := &scopedClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(token, scopedTokenPrefix), claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithAudience(scopedTokenAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" || claims.KeyID == 0 {
+		return nil, errors.New("scoped token is missing its ID or API key")
+	}
+	return claims, nil
+}
+
+// validateScopedToken asks the usermanager for the tenant context of a
+// scoped token whose signature and scope have been checked. The usermanager
+// refuses tokens whose API key is no longer active and single-use tokens
+// already used; those refusals are returned as *models.APIError.
+func validateScopedToken(ctx context.Context, cfg *config.Config, client *httpx.Client, claims *scopedClaims) (*models.KeyValidation, error) {
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token subject %q", claims.Subject)
+	}
+
+	url := fmt.Sprintf("http://localhost:%s/validate-token", cfg.UserManagerPort)
+	body := &models.ValidateTokenRequest{
+		UserID:    userID,
+		KeyID:     claims.KeyID,
+		TokenID:   claims.ID,
+		SingleUse: claims.SingleUse,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.AuthTimeout)
+	defer cancel()
+
+	req, err := proto.NewRequest(ctx, "POST", url, body, useProto(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		var body models.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.Error != nil {
+			return nil, body.Error
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token validation failed with status %d", resp.StatusCode)
+	}
+
+	var result models.KeyValidation
+	if err := proto.DecodeResponse(resp, &result); err != nil {
+		return nil, err
+	}
+	if !result.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	// A read-only token carries no more than the read scope of its key
+	if claims.ReadOnly {
+		var scopes []string
+		for _, scope := range result.Scopes {
+			if scope == "read" {
+				scopes = append(scopes, scope)
+			}
+		}
+		result.Scopes = scopes
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signScoped signs claims as MintToken does, with method and secret
+func signScoped(t *testing.T, method jwt.SigningMethod, secret string, claims scopedClaims) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(method, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scopedTokenPrefix + signed
+}
+
+func TestParseScopedToken(t *testing.T) {
+	const secret = "scoped-token-secret"
+	now := time.Now()
+	valid := func() scopedClaims {
+		return scopedClaims{
+			KeyID: 7,
+			Keys:  []string{"report"},
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        "0123456789abcdef",
+				Subject:   "42",
+				Audience:  jwt.ClaimStrings{scopedTokenAudience},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		secret   string // gateway's secret, the signing secret if empty
+		disabled bool   // the gateway has no secret
+		method   jwt.SigningMethod
+		change   func(c *scopedClaims)
+		token    string // used instead of signing claims if set
+		bare     bool   // sent without the token prefix
+		valid    bool
+	}{
+		{name: "valid", valid: true},
+		{name: "without prefix", bare: true, valid: true},
+		{name: "other secret", secret: "another-secret"},
+		{name: "disabled", disabled: true},
+		{name: "expired", change: func(c *scopedClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute)) }},
+		{name: "no expiry", change: func(c *scopedClaims) { c.ExpiresAt = nil }},
+		{name: "session token audience", change: func(c *scopedClaims) { c.Audience = jwt.ClaimStrings{"dht-session"} }},
+		{name: "no audience", change: func(c *scopedClaims) { c.Audience = nil }},
+		{name: "no token ID", change: func(c *scopedClaims) { c.ID = "" }},
+		{name: "no API key", change: func(c *scopedClaims) { c.KeyID = 0 }},
+		{name: "other HMAC", method: jwt.SigningMethodHS512},
+		{name: "unsigned", method: jwt.SigningMethodNone},
+		{name: "garbage", token: scopedTokenPrefix + "not.a.token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			if tt.change != nil {
+				tt.change(&claims)
+			}
+			token := tt.token
+			switch {
+			case token != "":
+			case tt.method == jwt.SigningMethodNone:
+				signed, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				token = scopedTokenPrefix + signed
+			case tt.method != nil:
+				token = signScoped(t, tt.method, secret, claims)
+			default:
+				token = signScoped(t, jwt.SigningMethodHS256, secret, claims)
+			}
+			if tt.bare {
+				token = token[len(scopedTokenPrefix):]
+			}
+
+			gatewaySecret := secret
+			if tt.secret != "" {
+				gatewaySecret = tt.secret
+			}
+			if tt.disabled {
+				gatewaySecret = ""
+			}
+
+			got, err := parseScopedToken(gatewaySecret, token)
+			if !tt.valid {
+				if err == nil {
+					t.Fatal("token accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("token rejected: %v", err)
+			}
+			if got.KeyID != 7 || got.Subject != "42" || got.ID != claims.ID || len(got.Keys) != 1 {
+				t.Fatalf("claims %+v", got)
+			}
+		})
+	}
+}
+
+func TestScopedClaimsAllows(t *testing.T) {
+	claims := &scopedClaims{Keys: []string{"report", "a/b", "space key"}, Prefixes: []string{"jobs:"}}
+	readOnly := &scopedClaims{Keys: []string{"report"}, ReadOnly: true}
+
+	tests := []struct {
+		name   string
+		claims *scopedClaims
+		method string
+		path   string
+		want   bool
+	}{
+		{name: "read listed key", claims: claims, method: "GET", path: "/v1/kv/report", want: true},
+		{name: "head listed key", claims: claims, method: "HEAD", path: "/v1/kv/report", want: true},
+		{name: "write listed key", claims: claims, method: "PUT", path: "/v1/kv/report", want: true},
+		{name: "patch listed key", claims: claims, method: "PATCH", path: "/v1/kv/report", want: true},
+		{name: "delete listed key", claims: claims, method: "DELETE", path: "/v1/kv/report", want: true},
+		{name: "key under prefix", claims: claims, method: "PUT", path: "/v1/kv/jobs:42", want: true},
+		{name: "escaped key", claims: claims, method: "GET", path: "/v1/kv/space%20key", want: true},
+		{name: "escaped slash", claims: claims, method: "GET", path: "/v1/kv/a%2Fb", want: true},
+		{name: "other key", claims: claims, method: "GET", path: "/v1/kv/reports", want: false},
+		{name: "key extending a listed key", claims: claims, method: "GET", path: "/v1/kv/report2", want: false},
+		{name: "prefix itself not under it", claims: claims, method: "GET", path: "/v1/kv/jobs", want: false},
+		{name: "nested path", claims: claims, method: "GET", path: "/v1/kv/a/b", want: false},
+		{name: "empty key", claims: claims, method: "GET", path: "/v1/kv/", want: false},
+		{name: "search", claims: &scopedClaims{Prefixes: []string{"_"}}, method: "GET", path: "/v1/kv/_search", want: false},
+		{name: "listing", claims: claims, method: "GET", path: "/v1/kv", want: false},
+		{name: "transaction", claims: claims, method: "POST", path: "/v1/txn", want: false},
+		{name: "minting", claims: claims, method: "POST", path: "/v1/tokens", want: false},
+		{name: "other API", claims: claims, method: "GET", path: "/v1/namespaces/report", want: false},
+		{name: "read-only read", claims: readOnly, method: "GET", path: "/v1/kv/report", want: true},
+		{name: "read-only write", claims: readOnly, method: "PUT", path: "/v1/kv/report", want: false},
+		{name: "read-only delete", claims: readOnly, method: "DELETE", path: "/v1/kv/report", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if got := tt.claims.allows(r); got != tt.want {
+				t.Fatalf("allows(%s %s) = %t, want %t", tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
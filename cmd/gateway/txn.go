@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"dht/internal/envelope"
+	"dht/internal/models"
+	"dht/internal/proto"
+	"dht/internal/requestid"
+	"dht/internal/storage"
+)
+
+// maxTxnOps bounds a transaction; 2PC is meant for small cross-key updates
+const maxTxnOps = 64
+
+// maxTxnCommitAttempts bounds how often a commit is sent to a participant
+// while the client waits
+const maxTxnCommitAttempts = 5
+
+// maxTxnCommitBackoff caps the wait between commit attempts
+const maxTxnCommitBackoff = 5 * time.Second
+
+// txnRequestOp is one operation of a POST /v1/txn request
+type txnRequestOp struct {
+	Op        string  `json:"op"` // "get", "put", "delete" or "check"
+	Key       string  `json:"key"`
+	Value     *string `json:"value,omitempty"`
+	TTL       string  `json:"ttl,omitempty"`
+	IfVersion *uint64 `json:"if_version,omitempty"` // 0 = key must not exist
+	IfExists  *bool   `json:"if_exists,omitempty"`
+}
+
+// Txn handles POST /v1/txn
+// Operations are grouped by the primary node owning each key. Every node
+// first prepares its share (checking conditions and locking the keys); only
+// if all succeed is the transaction committed everywhere, otherwise it is
+// aborted everywhere. The commit on one participant, the decision node,
+// decides the transaction; the others ask it how the transaction ended
+// before giving up on their share, so none aborts a committed transaction.
+func (h *Handler) Txn(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ops []txnRequestOp `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.Ops) == 0 || len(req.Ops) > maxTxnOps {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("A transaction needs between 1 and %d operations", maxTxnOps))
+		return
+	}
+
+	// Read-only transactions are allowed while writes are frozen
+	for _, op := range req.Ops {
+		if (op.Op == "put" || op.Op == "delete") && h.rejectIfFrozen(w) {
+			return
+		}
+	}
+
+	userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	session, ok := readSession(w, r)
+	if !ok {
+		return
+	}
+	dek := tenantKey(r)
+
+	// Build each node's share of the transaction
+	shares := make(map[string][]storage.TxnOp)
+	placement := make([][]string, len(req.Ops))
+	nodeOps := make([]storage.TxnOp, len(req.Ops))
+	seen := make(map[string]bool)
+
+	for i, op := range req.Ops {
+		switch op.Op {
+		case "get", "put", "delete", "check":
+		default:
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid op %q. Must be 'get', 'put', 'delete' or 'check'", op.Op))
+			return
+		}
+		if op.Key == "" || seen[op.Key] {
+			respondError(w, http.StatusBadRequest, "Every operation needs a distinct key")
+			return
+		}
+		seen[op.Key] = true
+
+		nodeOp := storage.TxnOp{Op: op.Op, Key: op.Key, IfVersion: op.IfVersion, IfExists: op.IfExists}
+		if op.Op == "put" {
+			nodeOp.Replicas = replicationFactor(r.Context(), op.Key)
+			if op.Value == nil {
+				respondError(w, http.StatusBadRequest, fmt.Sprintf("put %q needs a value", op.Key))
+				return
+			}
+			nodeOp.Value = []byte(*op.Value)
+			if dek != nil {
+				sealed, err := envelope.Seal(dek, []byte(op.Key), nodeOp.Value)
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, "Failed to encrypt value")
+					return
+				}
+				nodeOp.Value = sealed
+			}
+			if op.TTL != "" {
+				ttl, err := time.ParseDuration(op.TTL)
+				if err != nil || ttl < 0 {
+					respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ttl for %q", op.Key))
+					return
+				}
+				nodeOp.TTL = ttl
+			}
+		}
+
+		nodes := h.locateKey(r.Context(), op.Key)
+		if len(nodes) == 0 {
+			respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "No nodes available", nil)
+			return
+		}
+		placement[i] = nodes
+		nodeOps[i] = nodeOp
+		shares[nodes[0]] = append(shares[nodes[0]], nodeOp)
+
+		// The key may have been cached as missing
+		if nodeOp.Op == "put" || nodeOp.Op == "delete" {
+			h.negativeCache.Invalidate(op.Key)
+		}
+	}
+
+	// Don't lock keys on the other participants if one is suspected down
+	for node := range shares {
+		if h.rejectIfSuspected(w, node) {
+			return
+		}
+	}
+
+	txnID := newTxnID()
+	log.Printf("TXN %s: %d ops across %d nodes (user=%d)\n", txnID, len(req.Ops), len(shares), userID)
+
+	// Nodes start their intent timeout when they prepare, after this; the
+	// commit must reach the decision node before it expires, with a tenth
+	// to spare
+	commitBy := time.Now().Add(h.config.TxnIntentTimeout * 9 / 10)
+	decider := txnDecisionNode(shares)
+
+	// Phase 1: prepare on every participant
+	prepared := h.txnPhase(r.Context(), txnID, "prepare", shares, userID)
+
+	reads := make(map[string]storage.TxnRead)
+	var failure *nodeResult
+	for _, res := range prepared {
+		if res.err != nil || res.status != http.StatusOK {
+			if failure == nil || failure.status != http.StatusConflict {
+				failed := res
+				failure = &failed
+			}
+			continue
+		}
+		var body proto.TxnPrepared
+		res.decode(&body)
+		for _, read := range body.Reads {
+			reads[read.Key] = read
+		}
+	}
+
+	if failure != nil {
+		// Abort everywhere, including nodes whose prepare response was lost
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), h.config.WriteTimeout)
+		h.txnPhase(ctx, txnID, "abort", shares, userID)
+		cancel()
+
+		switch {
+		case failure.status == http.StatusConflict || failure.status == http.StatusBadRequest:
+			var nodeErr models.ErrorResponse
+			json.Unmarshal(failure.body, &nodeErr)
+			if nodeErr.Error == nil {
+				nodeErr.Error = models.NewAPIError(models.CodeForStatus(failure.status), "Transaction rejected", nil)
+			}
+			details := nodeErr.Error.Details
+			if details == nil {
+				details = make(map[string]interface{})
+			}
+			details["txn_id"] = txnID
+			details["committed"] = false
+			respondErrorCode(w, failure.status, nodeErr.Error.Code, nodeErr.Error.Message, details)
+		default:
+			log.Printf("TXN %s: prepare failed on %s: status=%d err=%v\n", txnID, failure.node, failure.status, failure.err)
+			respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "Transaction participant unavailable; transaction aborted", nil)
+		}
+		return
+	}
+
+	// Phase 2: commit on the decision node. Its COMMIT entry is the
+	// transaction's durable decision
+	decision := h.txnCommit(r.Context(), txnID, map[string][]storage.TxnOp{decider: shares[decider]}, userID, commitBy, maxTxnCommitAttempts)[0]
+	committed, decided := txnDecided(decision)
+	if !decided {
+		// Settle an unknown outcome by aborting, which the node refuses if
+		// the commit got through
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), h.config.WriteTimeout)
+		settled := h.txnPhase(ctx, txnID, "abort", map[string][]storage.TxnOp{decider: shares[decider]}, userID)[0]
+		cancel()
+		if settled.err == nil && (settled.status == http.StatusOK || settled.status == http.StatusConflict) {
+			committed, decided = settled.status == http.StatusConflict, true
+		}
+	}
+
+	if !decided {
+		// The participants keep their keys locked until the decision node
+		// answers them, then all apply the same outcome
+		log.Printf("TXN %s: in doubt, decision node %s did not answer: status=%d err=%v\n", txnID, decider, decision.status, decision.err)
+		respondErrorCode(w, http.StatusGatewayTimeout, models.ErrCodeTxnInDoubt, "Transaction outcome unknown; it is either applied or aborted everywhere once the decision node answers", map[string]interface{}{
+			"txn_id":        txnID,
+			"decision_node": decider,
+		})
+		return
+	}
+
+	if !committed {
+		// The decision node gave up on the transaction before the commit
+		// reached it, so nothing was written anywhere
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), h.config.WriteTimeout)
+		h.txnPhase(ctx, txnID, "abort", shares, userID)
+		cancel()
+
+		log.Printf("TXN %s: aborted by decision node %s before the commit: status=%d\n", txnID, decider, decision.status)
+		respondErrorCode(w, http.StatusServiceUnavailable, models.ErrCodeNodeUnavailable, "Transaction participant unavailable; transaction aborted", map[string]interface{}{
+			"txn_id":    txnID,
+			"committed": false,
+		})
+		return
+	}
+
+	// Committed: deliver the commit to the other participants
+	versions := make(map[string]uint64)
+	rest := make(map[string][]storage.TxnOp)
+	for node, ops := range shares {
+		if node == decider && decision.err == nil && decision.status == http.StatusOK {
+			versions[node] = commitVersion(decision)
+			continue
+		}
+		rest[node] = ops
+	}
+	pending := make(map[string][]storage.TxnOp)
+	for _, res := range h.txnCommit(r.Context(), txnID, rest, userID, time.Now().Add(h.config.WriteTimeout), maxTxnCommitAttempts) {
+		if res.err != nil || res.status != http.StatusOK {
+			log.Printf("TXN %s: commit not acknowledged by %s: status=%d err=%v\n", txnID, res.node, res.status, res.err)
+			pending[res.node] = rest[res.node]
+			continue
+		}
+		versions[res.node] = commitVersion(res)
+	}
+
+	// Replicate the writes of each participant that applied the commit
+	replicate := func(ctx context.Context, node string, version uint64) {
+		for i := range nodeOps {
+			if placement[i][0] == node && nodeOps[i].IsWrite() {
+				h.replicateTxnWrite(ctx, &nodeOps[i], placement[i], version, userID)
+			}
+		}
+	}
+	for node, version := range versions {
+		replicate(r.Context(), node, version)
+	}
+	if len(pending) > 0 {
+		go h.finishTxn(context.WithoutCancel(r.Context()), txnID, pending, userID, replicate)
+	}
+
+	// Build the per-operation results
+	results := make([]map[string]interface{}, len(nodeOps))
+	for i, op := range nodeOps {
+		nodes := placement[i]
+		result := map[string]interface{}{"op": op.Op, "key": op.Key}
+
+		switch op.Op {
+		case "put", "delete":
+			if _, applying := pending[nodes[0]]; applying {
+				result["pending"] = true
+				break
+			}
+			result["version"] = versions[nodes[0]]
+			session.Record(op.Key, nodes[0], versions[nodes[0]], op.Op == "delete")
+		default:
+			read := reads[op.Key]
+			result["exists"] = read.Exists
+			if read.Exists {
+				result["version"] = read.Version
+			}
+			if op.Op == "get" && read.Exists {
+				value, err := openValue(dek, op.Key, read.Value)
+				if err != nil {
+					log.Printf("TXN %s: error decrypting key=%s: %v\n", txnID, op.Key, err)
+					respondError(w, http.StatusInternalServerError, "Failed to decrypt value")
+					return
+				}
+				result["value"] = string(value)
+			}
+		}
+		results[i] = result
+	}
+
+	resp := map[string]interface{}{
+		"txn_id":    txnID,
+		"committed": true,
+		"results":   results,
+	}
+	status := http.StatusOK
+	if len(pending) > 0 {
+		pendingNodes := make([]string, 0, len(pending))
+		for node := range pending {
+			pendingNodes = append(pendingNodes, node)
+		}
+		sort.Strings(pendingNodes)
+		resp["pending_nodes"] = pendingNodes
+		status = http.StatusAccepted
+	}
+
+	session.Set(w)
+	respondJSON(w, status, resp)
+}
+
+// txnDecisionNode returns the participant whose commit decides a
+// transaction: the lowest URL, so every phase given all shares agrees
+func txnDecisionNode(shares map[string][]storage.TxnOp) string {
+	decider := ""
+	for node := range shares {
+		if decider == "" || node < decider {
+			decider = node
+		}
+	}
+	return decider
+}
+
+// txnDecided reads the decision node's answer to a commit: committed, or
+// aborted (refused because it gave up on the transaction), or not known
+func txnDecided(res nodeResult) (committed, decided bool) {
+	switch {
+	case res.err != nil:
+		return false, false
+	case res.status == http.StatusOK:
+		return true, true
+	case res.status == http.StatusConflict || res.status == http.StatusNotFound:
+		return false, true
+	}
+	return false, false
+}
+
+// commitVersion returns the version a participant committed the writes at
+func commitVersion(res nodeResult) uint64 {
+	var body struct {
+		Version uint64 `json:"version"`
+	}
+	json.Unmarshal(res.body, &body)
+	return body.Version
+}
+
+// replicateTxnWrite replicates a committed write of a transaction
+// asynchronously, like an eventual PUT or DELETE
+func (h *Handler) replicateTxnWrite(ctx context.Context, op *storage.TxnOp, nodes []string, version uint64, userID int64) {
+	if len(nodes) <= 1 && !h.rollouts.Active() {
+		return
+	}
+	replReq := models.ReplicationRequest{
+		Key:          op.Key,
+		Operation:    "SET",
+		Value:        op.Value,
+		TTL:          op.TTL,
+		Consistency:  "eventual",
+		PrimaryNode:  nodes[0],
+		ReplicaNodes: nodes[1:],
+		UserID:       userID,
+		RequestID:    requestid.FromContext(ctx),
+		Version:      version,
+
+		ReplicationFactor: replicationFactor(ctx, op.Key),
+	}
+	if op.Op == "delete" {
+		replReq.Operation = "DELETE"
+		replReq.Value = nil
+	}
+	h.triggerReplication(ctx, &replReq, "eventual")
+}
+
+// finishTxn keeps delivering a committed transaction to participants that
+// did not acknowledge it and replicates their writes once they do. They
+// also apply it on their own from the decision node when their intent
+// times out, after which a commit is answered with the version it got.
+func (h *Handler) finishTxn(ctx context.Context, txnID string, shares map[string][]storage.TxnOp, userID int64,
+	replicate func(ctx context.Context, node string, version uint64)) {
+	deadline := time.Now().Add(2 * h.config.TxnIntentTimeout)
+	for _, res := range h.txnCommit(ctx, txnID, shares, userID, deadline, 0) {
+		if res.err != nil || res.status != http.StatusOK {
+			log.Printf("TXN %s: %s never acknowledged the commit: status=%d err=%v\n", txnID, res.node, res.status, res.err)
+			continue
+		}
+		log.Printf("TXN %s: commit acknowledged by %s\n", txnID, res.node)
+		replicate(ctx, res.node, commitVersion(res))
+	}
+}
+
+// txnPhase sends one phase of the protocol to every participant
+// concurrently. A prepare, sent to all of them, names the decision node.
+func (h *Handler) txnPhase(ctx context.Context, txnID, phase string, shares map[string][]storage.TxnOp, userID int64) []nodeResult {
+	results := make([]nodeResult, 0, len(shares))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	decider := txnDecisionNode(shares)
+
+	for nodeURL, ops := range shares {
+		wg.Add(1)
+		go func(nodeURL string, ops []storage.TxnOp) {
+			defer wg.Done()
+
+			var payload interface{}
+			if phase == "prepare" {
+				prepare := &proto.TxnPrepare{Ops: ops}
+				if nodeURL != decider {
+					prepare.DecisionNode = decider
+				}
+				payload = prepare
+			}
+			res := h.sendToNode(ctx, "POST", fmt.Sprintf("%s/txn/%s/%s", nodeURL, txnID, phase), userID, payload)
+			res.node = nodeURL
+
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}(nodeURL, ops)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// txnCommit commits on every participant, retrying transient failures up to
+// attempts times (any number if attempts is 0). The decision node aborts a
+// transaction left undecided for TXN_INTENT_TIMEOUT, so no attempt runs past
+// deadline, which the caller derives from it; the participants still failing
+// then are returned with their last error. Once started, the commit must be
+// delivered even if the client gives up, so only ctx's values are kept and
+// each attempt gets its own deadline.
+func (h *Handler) txnCommit(ctx context.Context, txnID string, shares map[string][]storage.TxnOp, userID int64, deadline time.Time, attempts int) []nodeResult {
+	ctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	defer cancel()
+	pending := shares
+	var done []nodeResult
+
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, h.config.WriteTimeout)
+		results := h.txnPhase(attemptCtx, txnID, "commit", pending, userID)
+		cancelAttempt()
+
+		// Another attempt needs time left after the backoff
+		last := (attempts > 0 && attempt >= attempts) || time.Until(deadline) <= backoff
+
+		retry := make(map[string][]storage.TxnOp)
+		for _, res := range results {
+			if (res.err != nil || res.status >= http.StatusInternalServerError) && !last {
+				retry[res.node] = pending[res.node]
+				continue
+			}
+			done = append(done, res)
+		}
+
+		if len(retry) == 0 {
+			return done
+		}
+		pending = retry
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxTxnCommitBackoff)
+	}
+}
+
+// newTxnID returns a random transaction identifier
+func newTxnID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "txn_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dht/internal/config"
+	"dht/internal/httpx"
+	"dht/internal/models"
+	"dht/internal/proto"
+	"dht/internal/storage"
+)
+
+func TestTxnCommitRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     int           // commits answered with failStatus before succeeding
+		status   int           // failStatus
+		hang     time.Duration // how long the node takes to answer
+		deadline time.Duration
+		attempts int32
+		want     int // final status, 0 for a transport error
+	}{
+		{name: "committed", deadline: 10 * time.Second, attempts: 1, want: http.StatusOK},
+		{name: "transient failure", fail: 2, status: http.StatusServiceUnavailable, deadline: 10 * time.Second, attempts: 3, want: http.StatusOK},
+		{name: "attempts exhausted", fail: 100, status: http.StatusInternalServerError, deadline: 10 * time.Second, attempts: maxTxnCommitAttempts, want: http.StatusInternalServerError},
+		{name: "conflict not retried", fail: 100, status: http.StatusConflict, deadline: 10 * time.Second, attempts: 1, want: http.StatusConflict},
+		{name: "deadline stops retries", fail: 100, status: http.StatusInternalServerError, deadline: 250 * time.Millisecond, attempts: 2, want: http.StatusInternalServerError},
+		{name: "deadline cuts an attempt", hang: time.Second, deadline: 200 * time.Millisecond, attempts: 1, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				if tt.hang > 0 {
+					select {
+					case <-time.After(tt.hang):
+					case <-r.Context().Done():
+						return
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if int(n) <= tt.fail {
+					w.WriteHeader(tt.status)
+					w.Write([]byte(`{"error":{"code":"internal","message":"failed"}}`))
+					return
+				}
+				w.Write([]byte(`{"success":true,"version":7}`))
+			}))
+			defer node.Close()
+
+			h := &Handler{
+				config:     &config.Config{WriteTimeout: 10 * time.Second, InternalEncoding: "json"},
+				httpClient: httpx.New(httpx.Config{}),
+			}
+			shares := map[string][]storage.TxnOp{node.URL: {{Op: "put", Key: "k", Value: []byte("v")}}}
+
+			start := time.Now()
+			deadline := start.Add(tt.deadline)
+			results := h.txnCommit(t.Context(), "txn_test", shares, 1, deadline, maxTxnCommitAttempts)
+			elapsed := time.Since(start)
+
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			res := results[0]
+			if tt.want == 0 {
+				if res.err == nil {
+					t.Fatalf("status %d, want a transport error", res.status)
+				}
+			} else if res.err != nil || res.status != tt.want {
+				t.Fatalf("status %d err %v, want status %d", res.status, res.err, tt.want)
+			}
+			if got := calls.Load(); got != tt.attempts {
+				t.Fatalf("node got %d commits, want %d", got, tt.attempts)
+			}
+			if elapsed > tt.deadline+100*time.Millisecond {
+				t.Fatalf("took %v, past the %v deadline", elapsed, tt.deadline)
+			}
+		})
+	}
+}
+
+// participantScript is how a fake participant answers: commits with the
+// given statuses in turn, then with 200
+type participantScript struct {
+	commits []int
+	abort   int // status of an abort, 0 for 200
+}
+
+// fakeParticipant is a transaction participant
+type fakeParticipant struct {
+	participantScript
+
+	mu           sync.Mutex
+	decisionNode string // as sent with the prepare
+	commitCalls  int
+	abortCalls   int
+}
+
+func (p *fakeParticipant) serve(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /txn/{id}/prepare", func(w http.ResponseWriter, r *http.Request) {
+		var req proto.TxnPrepare
+		if err := proto.DecodeRequest(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		p.decisionNode = req.DecisionNode
+		p.mu.Unlock()
+		json.NewEncoder(w).Encode(&proto.TxnPrepared{Success: true, TxnID: r.PathValue("id")})
+	})
+	mux.HandleFunc("POST /txn/{id}/commit", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.commitCalls++
+		status := http.StatusOK
+		if p.commitCalls <= len(p.commits) {
+			status = p.commits[p.commitCalls-1]
+		}
+		p.mu.Unlock()
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": status == http.StatusOK, "version": 7})
+	})
+	mux.HandleFunc("POST /txn/{id}/abort", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.abortCalls++
+		status := p.abort
+		p.mu.Unlock()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": status == http.StatusOK})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (p *fakeParticipant) calls() (commits, aborts int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.commitCalls, p.abortCalls
+}
+
+// TestTxnDecision runs a transaction across two participants: the one with
+// the lower URL decides it, and whatever it decides, no participant is left
+// applying a different outcome
+func TestTxnDecision(t *testing.T) {
+	failures := func(n, status int) []int {
+		statuses := make([]int, n)
+		for i := range statuses {
+			statuses[i] = status
+		}
+		return statuses
+	}
+
+	tests := []struct {
+		name          string
+		decider       participantScript
+		other         participantScript
+		status        int
+		code          string
+		pending       bool // the other participant had not applied the commit
+		otherCommits  bool // the commit was sent to the other participant
+		otherAborted  bool
+		replicated    bool // both writes reach the replicator
+		deciderAborts int
+	}{
+		{name: "committed", status: http.StatusOK, otherCommits: true, replicated: true},
+		{
+			name:         "participant applies the commit late",
+			other:        participantScript{commits: failures(maxTxnCommitAttempts, http.StatusInternalServerError)},
+			status:       http.StatusAccepted,
+			pending:      true,
+			otherCommits: true,
+			replicated:   true,
+		},
+		{
+			name:          "decision node gave up first",
+			decider:       participantScript{commits: []int{http.StatusConflict}},
+			status:        http.StatusServiceUnavailable,
+			code:          models.ErrCodeNodeUnavailable,
+			otherAborted:  true,
+			deciderAborts: 1,
+		},
+		{
+			name:          "lost commit answer settled by a refused abort",
+			decider:       participantScript{commits: failures(maxTxnCommitAttempts, http.StatusInternalServerError), abort: http.StatusConflict},
+			status:        http.StatusOK,
+			otherCommits:  true,
+			replicated:    true,
+			deciderAborts: 1,
+		},
+		{
+			name:          "lost commit answer settled by an abort",
+			decider:       participantScript{commits: failures(maxTxnCommitAttempts, http.StatusInternalServerError)},
+			status:        http.StatusServiceUnavailable,
+			code:          models.ErrCodeNodeUnavailable,
+			otherAborted:  true,
+			deciderAborts: 2,
+		},
+		{
+			name:          "in doubt",
+			decider:       participantScript{commits: failures(100, http.StatusInternalServerError), abort: http.StatusInternalServerError},
+			status:        http.StatusGatewayTimeout,
+			code:          models.ErrCodeTxnInDoubt,
+			deciderAborts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			replicated := make(map[string]uint64)
+			replicator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req models.ReplicationRequest
+				proto.DecodeRequest(r, &req)
+				mu.Lock()
+				replicated[req.Key] = req.Version
+				mu.Unlock()
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer replicator.Close()
+
+			// The lower URL decides
+			decider, other := &fakeParticipant{}, &fakeParticipant{}
+			firstURL, secondURL := decider.serve(t).URL, other.serve(t).URL
+			if secondURL < firstURL {
+				decider, other = other, decider
+				firstURL, secondURL = secondURL, firstURL
+			}
+			decider.participantScript = tt.decider
+			other.participantScript = tt.other
+
+			h := newTestHandler(t, firstURL, secondURL)
+			target, _ := url.Parse(replicator.URL)
+			h.config.ReplicatorPort = target.Port()
+
+			// One key on each participant
+			keys := make(map[string]string)
+			for i := 0; len(keys) < 2; i++ {
+				key := fmt.Sprintf("k%d", i)
+				if primary := h.locateKey(t.Context(), key)[0]; keys[primary] == "" {
+					keys[primary] = key
+				}
+			}
+			body, _ := json.Marshal(map[string]interface{}{"ops": []map[string]string{
+				{"op": "put", "key": keys[firstURL], "value": "1"},
+				{"op": "put", "key": keys[secondURL], "value": "2"},
+			}})
+
+			w := httptest.NewRecorder()
+			h.Txn(w, userRequest("POST", "/v1/txn", body, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			if tt.code != "" {
+				var resp models.ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error == nil {
+					t.Fatalf("invalid error body %s", w.Body)
+				}
+				if resp.Error.Code != tt.code || resp.Error.Details["txn_id"] == nil {
+					t.Fatalf("error %+v, want code %s with the txn_id", resp.Error, tt.code)
+				}
+			} else {
+				var resp struct {
+					Committed    bool                     `json:"committed"`
+					PendingNodes []string                 `json:"pending_nodes"`
+					Results      []map[string]interface{} `json:"results"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				var wantPending []string
+				if tt.pending {
+					wantPending = []string{secondURL}
+				}
+				if !resp.Committed || !reflect.DeepEqual(resp.PendingNodes, wantPending) {
+					t.Fatalf("committed %t with pending nodes %v, want committed with %v", resp.Committed, resp.PendingNodes, wantPending)
+				}
+				if _, ok := resp.Results[0]["version"]; !ok {
+					t.Fatalf("the decision node's write has no version: %v", resp.Results[0])
+				}
+				if pending, _ := resp.Results[1]["pending"].(bool); pending != tt.pending {
+					t.Fatalf("other write %v, want pending %t", resp.Results[1], tt.pending)
+				}
+			}
+
+			decider.mu.Lock()
+			other.mu.Lock()
+			if decider.decisionNode != "" || other.decisionNode != firstURL {
+				t.Fatalf("prepares named decision nodes %q and %q, want none and %q", decider.decisionNode, other.decisionNode, firstURL)
+			}
+			decider.mu.Unlock()
+			other.mu.Unlock()
+
+			otherCommits, otherAborts := other.calls()
+			if (otherCommits > 0) != tt.otherCommits || (otherAborts > 0) != tt.otherAborted {
+				t.Fatalf("other participant got %d commits and %d aborts", otherCommits, otherAborts)
+			}
+			if _, aborts := decider.calls(); aborts != tt.deciderAborts {
+				t.Fatalf("decision node got %d aborts, want %d", aborts, tt.deciderAborts)
+			}
+
+			// Replication runs in the background, a late commit's included
+			var want []string
+			if tt.replicated {
+				want = []string{keys[firstURL], keys[secondURL]}
+				sort.Strings(want)
+			}
+			var got []string
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				mu.Lock()
+				got = got[:0]
+				for key, version := range replicated {
+					if version == 7 {
+						got = append(got, key)
+					}
+				}
+				mu.Unlock()
+				sort.Strings(got)
+				if len(got) >= len(want) || time.Now().After(deadline) {
+					break
+				}
+			}
+			if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Fatalf("replicated %v, want %v", got, want)
+			}
+		})
+	}
+}
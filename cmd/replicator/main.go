@@ -11,12 +11,21 @@ import (
 	"syscall"
 	"time"
 
+	"dht/internal/buildinfo"
 	"dht/internal/config"
+	"dht/internal/deadline"
+	"dht/internal/httpx"
+	"dht/internal/middleware"
+	"dht/internal/models"
+	"dht/internal/requestid"
 )
 
 func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
+	if err := cfg.Check("replicator"); err != nil {
+		log.Fatalf("%v\n", err)
+	}
 
 	// Initialize replicator
 	replicator := NewReplicator(cfg)
@@ -29,14 +38,16 @@ func main() {
 	mux.HandleFunc("POST /replicate", replicator.HandleReplicate)
 	mux.HandleFunc("GET /metrics", replicator.HandleMetrics)
 	mux.HandleFunc("GET /health", replicator.HandleHealth)
+	mux.HandleFunc("GET /version", buildinfo.Handler("replicator", cfg.Fingerprint()))
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%s", cfg.ReplicatorPort),
-		Handler:      LoggingMiddleware(mux),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Handler:      requestid.Middleware(deadline.Middleware(middleware.Logging(mux))),
+		ReadTimeout:  cfg.ServerReadTimeout,
+		WriteTimeout: cfg.ServerWriteTimeout,
+		IdleTimeout:  cfg.ServerIdleTimeout,
 	}
+	httpx.AcceptH2C(srv, cfg.HTTP2MaxConcurrentStreams)
 
 	// Start server
 	go func() {
@@ -64,33 +75,16 @@ func main() {
 	log.Println("Replicator exited gracefully")
 }
 
-// LoggingMiddleware logs HTTP requests
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(wrapped, r)
-		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapped.statusCode, duration)
-	})
-}
-
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
-}
-
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(data)
 }
 
+// respondError writes the standard error body with the default code for status,
+// tagged with the request ID the middleware set on the response
 func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, map[string]string{"error": message})
+	apiErr := models.NewAPIError(models.CodeForStatus(status), message, nil)
+	apiErr.RequestID = w.Header().Get(requestid.Header)
+	respondJSON(w, status, models.ErrorResponse{Error: apiErr})
 }
@@ -3,17 +3,22 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"dht/internal/buildinfo"
 	"dht/internal/config"
+	"dht/internal/httpx"
 	"dht/internal/models"
+	"dht/internal/proto"
+	"dht/internal/requestid"
 )
 
 // ReplicationTask represents a replication task in the queue
@@ -23,17 +28,34 @@ type ReplicationTask struct {
 	MaxRetries  int
 	EnqueuedAt  time.Time
 	LastAttempt time.Time
+
+	// superseded is set once a newer write for the key has been accepted;
+	// guarded by Replicator.tasksMu
+	superseded bool
+}
+
+// coalesceKey identifies the tasks that replace each other: writes of the
+// same key to the same replicas
+func coalesceKey(req *models.ReplicationRequest) string {
+	return req.Key + "\x00" + strings.Join(req.ReplicaNodes, ",")
 }
 
 // Replicator handles data replication across nodes
 type Replicator struct {
 	config     *config.Config
-	httpClient *http.Client
+	httpClient *httpx.Client
 
 	// Async replication queue
 	eventualQueue chan *ReplicationTask
 	retryQueue    chan *ReplicationTask
 
+	// Eventual tasks not yet picked up by a worker, and tasks waiting out a
+	// retry backoff, by coalesceKey. A newer write for the key replaces the
+	// queued value and cancels the retry, so bursts send only the last value.
+	tasksMu  sync.Mutex
+	queued   map[string]*ReplicationTask
+	retrying map[string]*ReplicationTask
+
 	// Metrics
 	metrics struct {
 		totalReplications  atomic.Int64
@@ -43,6 +65,7 @@ type Replicator struct {
 		ackTimesMu         sync.Mutex
 		maxLag             atomic.Int64 // in milliseconds
 		retriesInProgress  atomic.Int32
+		coalescedTasks     atomic.Int64
 	}
 
 	// Control
@@ -54,11 +77,17 @@ type Replicator struct {
 func NewReplicator(cfg *config.Config) *Replicator {
 	return &Replicator{
 		config: cfg,
-		httpClient: &http.Client{
-			Timeout: 5 * time.Second,
-		},
+		// Replica writes carry the whole value, so sending one twice is harmless
+		httpClient: httpx.New(httpx.Config{
+			MaxRetries:        cfg.HTTPMaxRetries,
+			RetryBackoff:      cfg.HTTPRetryBackoff,
+			IdempotentMethods: []string{"GET", "PUT", "DELETE"},
+			H2C:               cfg.H2C,
+		}),
 		eventualQueue: make(chan *ReplicationTask, 1000),
 		retryQueue:    make(chan *ReplicationTask, 500),
+		queued:        make(map[string]*ReplicationTask),
+		retrying:      make(map[string]*ReplicationTask),
 		stopCh:        make(chan struct{}),
 	}
 }
@@ -88,7 +117,7 @@ func (r *Replicator) Stop() {
 // HandleReplicate handles replication requests
 func (r *Replicator) HandleReplicate(w http.ResponseWriter, req *http.Request) {
 	var replReq models.ReplicationRequest
-	if err := json.NewDecoder(req.Body).Decode(&replReq); err != nil {
+	if err := proto.DecodeRequest(req, &replReq); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
@@ -105,19 +134,57 @@ func (r *Replicator) HandleReplicate(w http.ResponseWriter, req *http.Request) {
 
 	r.metrics.totalReplications.Add(1)
 
+	// Shadow copies are sent like an eventual write whatever the consistency,
+	// so they never hold up a quorum
+	if len(replReq.ShadowNodes) > 0 {
+		shadow := replReq
+		shadow.ReplicaNodes, shadow.ShadowNodes = replReq.ShadowNodes, nil
+		if !r.enqueue(&shadow) {
+			log.Printf("Replication queue is full, dropped shadow write of key=%s to %v\n", replReq.Key, shadow.ReplicaNodes)
+		}
+	}
+
 	// Handle based on consistency level
 	switch replReq.Consistency {
 	case "eventual":
-		r.handleEventualReplication(&replReq, w)
+		r.handleEventualReplication(&replReq, w, req)
 	case "strong":
-		r.handleStrongReplication(&replReq, w)
+		// Pending eventual writes of the key are older; sending them after
+		// this one would roll the replicas back
+		r.supersede(coalesceKey(&replReq))
+		r.handleStrongReplication(req.Context(), &replReq, w, req)
 	default:
 		respondError(w, http.StatusBadRequest, "Invalid consistency level")
 	}
 }
 
 // handleEventualReplication handles eventual consistency replication
-func (r *Replicator) handleEventualReplication(replReq *models.ReplicationRequest, w http.ResponseWriter) {
+// The response is encoded as the request asked for.
+func (r *Replicator) handleEventualReplication(replReq *models.ReplicationRequest, w http.ResponseWriter, req *http.Request) {
+	if !r.enqueue(replReq) {
+		respondError(w, http.StatusServiceUnavailable, "Replication queue is full")
+		return
+	}
+	proto.Respond(w, req, http.StatusAccepted, &models.ReplicationResponse{
+		Success: true,
+		NodeID:  "replicator",
+	})
+}
+
+// enqueue queues an eventual write, returning false if the queue is full
+func (r *Replicator) enqueue(replReq *models.ReplicationRequest) bool {
+	key := coalesceKey(replReq)
+
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	// A task for the key is still queued: send this value in its place
+	if queued, exists := r.queued[key]; exists {
+		queued.Request = replReq
+		r.metrics.coalescedTasks.Add(1)
+		return true
+	}
+
 	// Queue the replication task
 	task := &ReplicationTask{
 		Request:    replReq,
@@ -127,24 +194,68 @@ func (r *Replicator) handleEventualReplication(replReq *models.ReplicationReques
 
 	select {
 	case r.eventualQueue <- task:
-		// Successfully queued
-		respondJSON(w, http.StatusAccepted, models.ReplicationResponse{
-			Success: true,
-			NodeID:  "replicator",
-		})
+		// Successfully queued; a retry of an older value is now pointless
+		r.queued[key] = task
+		if retry, exists := r.retrying[key]; exists {
+			retry.superseded = true
+			delete(r.retrying, key)
+			r.metrics.coalescedTasks.Add(1)
+		}
+		return true
 	default:
 		// Queue is full
-		respondError(w, http.StatusServiceUnavailable, "Replication queue is full")
+		return false
 	}
 }
 
+// supersede drops the queued task and pending retry of a key
+func (r *Replicator) supersede(key string) {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	for _, tasks := range []map[string]*ReplicationTask{r.queued, r.retrying} {
+		if task, exists := tasks[key]; exists {
+			task.superseded = true
+			delete(tasks, key)
+			r.metrics.coalescedTasks.Add(1)
+		}
+	}
+}
+
+// claim takes a task off the coalescing maps before a worker sends it,
+// returning false if a newer write superseded it
+func (r *Replicator) claim(task *ReplicationTask) bool {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	if task.superseded {
+		return false
+	}
+	key := coalesceKey(task.Request)
+	for _, tasks := range []map[string]*ReplicationTask{r.queued, r.retrying} {
+		if tasks[key] == task {
+			delete(tasks, key)
+		}
+	}
+	return true
+}
+
 // handleStrongReplication handles strong consistency replication
-func (r *Replicator) handleStrongReplication(replReq *models.ReplicationRequest, w http.ResponseWriter) {
+// It waits for a majority until the caller's deadline in ctx; each replica
+// write is also bounded by ReplicationTimeout. The response is encoded as the
+// request asked for.
+func (r *Replicator) handleStrongReplication(ctx context.Context, replReq *models.ReplicationRequest, w http.ResponseWriter, req *http.Request) {
 	startTime := time.Now()
 
-	// Calculate majority
+	// A majority of the key's nodes must hold the write. The primary already
+	// does, so one fewer replica ack is needed; with a replication factor of
+	// 3 that is 1 of the 2 replicas, with 5 it is 2 of 4.
 	totalNodes := len(replReq.ReplicaNodes)
-	majorityRequired := (totalNodes / 2) + 1
+	majorityRequired := (totalNodes + 1) / 2
+	if majorityRequired == 0 {
+		proto.Respond(w, req, http.StatusOK, &models.ReplicationResponse{Success: true, NodeID: "replicator"})
+		return
+	}
 
 	// Replicate to all replica nodes concurrently
 	results := make(chan bool, totalNodes)
@@ -152,7 +263,7 @@ func (r *Replicator) handleStrongReplication(replReq *models.ReplicationRequest,
 	var failedNodes []string
 	var mu sync.Mutex
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	for _, node := range replReq.ReplicaNodes {
@@ -182,7 +293,7 @@ func (r *Replicator) handleStrongReplication(replReq *models.ReplicationRequest,
 					ackTime := time.Since(startTime).Milliseconds()
 					r.recordAckTime(float64(ackTime))
 
-					respondJSON(w, http.StatusOK, models.ReplicationResponse{
+					proto.Respond(w, req, http.StatusOK, &models.ReplicationResponse{
 						Success:    true,
 						NodeID:     "replicator",
 						AckedNodes: ackedNodes,
@@ -191,8 +302,8 @@ func (r *Replicator) handleStrongReplication(replReq *models.ReplicationRequest,
 				}
 			}
 		case <-ctx.Done():
-			// Timeout
-			respondError(w, http.StatusRequestTimeout, "Replication timeout - majority not reached")
+			// The caller's deadline ran out
+			respondError(w, http.StatusGatewayTimeout, "Replication timeout - majority not reached")
 			return
 		}
 	}
@@ -211,7 +322,9 @@ func (r *Replicator) eventualWorker() {
 	for {
 		select {
 		case task := <-r.eventualQueue:
-			r.processEventualTask(task)
+			if r.claim(task) {
+				r.processEventualTask(task)
+			}
 		case <-r.stopCh:
 			return
 		}
@@ -223,9 +336,7 @@ func (r *Replicator) processEventualTask(task *ReplicationTask) {
 	startTime := time.Now()
 	task.LastAttempt = startTime
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
+	ctx := context.Background()
 	successCount := 0
 	for _, node := range task.Request.ReplicaNodes {
 		if r.replicateToNode(ctx, node, task.Request) {
@@ -245,6 +356,9 @@ func (r *Replicator) processEventualTask(task *ReplicationTask) {
 
 	// If not all replicas succeeded and retries remaining, queue for retry
 	if successCount < len(task.Request.ReplicaNodes) && task.Retries < task.MaxRetries {
+		if !r.awaitRetry(task) {
+			return
+		}
 		task.Retries++
 		r.metrics.retriesInProgress.Add(1)
 
@@ -263,6 +377,21 @@ func (r *Replicator) processEventualTask(task *ReplicationTask) {
 	}
 }
 
+// awaitRetry registers a task for retry, unless a newer write of its key is
+// already queued and will bring the replicas up to date
+func (r *Replicator) awaitRetry(task *ReplicationTask) bool {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	key := coalesceKey(task.Request)
+	if _, exists := r.queued[key]; exists {
+		r.metrics.coalescedTasks.Add(1)
+		return false
+	}
+	r.retrying[key] = task
+	return true
+}
+
 // retryWorker processes retry tasks
 func (r *Replicator) retryWorker() {
 	defer r.wg.Done()
@@ -271,8 +400,11 @@ func (r *Replicator) retryWorker() {
 		select {
 		case task := <-r.retryQueue:
 			r.metrics.retriesInProgress.Add(-1)
-			log.Printf("Retrying replication for key=%s (attempt %d/%d)\n",
-				task.Request.Key, task.Retries, task.MaxRetries)
+			if !r.claim(task) {
+				continue
+			}
+			log.Printf("Retrying replication for key=%s (attempt %d/%d, request_id=%s)\n",
+				task.Request.Key, task.Retries, task.MaxRetries, task.Request.RequestID)
 			r.processEventualTask(task)
 		case <-r.stopCh:
 			return
@@ -280,8 +412,11 @@ func (r *Replicator) retryWorker() {
 	}
 }
 
-// replicateToNode replicates data to a specific node
+// replicateToNode replicates data to a specific node within ReplicationTimeout
 func (r *Replicator) replicateToNode(ctx context.Context, nodeURL string, replReq *models.ReplicationRequest) bool {
+	ctx, cancel := context.WithTimeout(ctx, r.config.ReplicationTimeout)
+	defer cancel()
+
 	var reqURL string
 	var method string
 	var body io.Reader
@@ -303,6 +438,9 @@ func (r *Replicator) replicateToNode(ctx context.Context, nodeURL string, replRe
 	// Add TTL if provided
 	if replReq.TTL > 0 {
 		reqURL = fmt.Sprintf("%s?ttl=%s", reqURL, replReq.TTL.String())
+		if replReq.Sliding {
+			reqURL += "&sliding=true"
+		}
 	}
 
 	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
@@ -315,10 +453,20 @@ func (r *Replicator) replicateToNode(ctx context.Context, nodeURL string, replRe
 		req.Header.Set("Content-Type", "application/octet-stream")
 	}
 	req.Header.Set("X-Replication", "true")
+	req.Header.Set("X-User-ID", fmt.Sprintf("%d", replReq.UserID))
+	if replReq.Version > 0 {
+		req.Header.Set("X-Source-Version", strconv.FormatUint(replReq.Version, 10))
+	}
+	if replReq.ReplicationFactor > 0 && replReq.Operation == "SET" {
+		req.Header.Set("X-Replication-Factor", strconv.Itoa(replReq.ReplicationFactor))
+	}
+	if replReq.RequestID != "" {
+		req.Header.Set(requestid.Header, replReq.RequestID)
+	}
 
 	resp, err := r.httpClient.Do(req)
 	if err != nil {
-		log.Printf("Failed to replicate to %s: %v\n", nodeURL, err)
+		log.Printf("Failed to replicate to %s: %v (request_id=%s)\n", nodeURL, err, replReq.RequestID)
 		return false
 	}
 	defer resp.Body.Close()
@@ -327,7 +475,14 @@ func (r *Replicator) replicateToNode(ctx context.Context, nodeURL string, replRe
 		return true
 	}
 
-	log.Printf("Replication to %s failed with status %d\n", nodeURL, resp.StatusCode)
+	// The replica already holds a newer write than the one deleted; keeping
+	// it is the outcome the primary would have had, so there is nothing to retry
+	if replReq.Operation == "DELETE" && resp.StatusCode == http.StatusPreconditionFailed {
+		log.Printf("Replica %s kept a newer write of key=%s (request_id=%s)\n", nodeURL, replReq.Key, replReq.RequestID)
+		return true
+	}
+
+	log.Printf("Replication to %s failed with status %d (request_id=%s)\n", nodeURL, resp.StatusCode, replReq.RequestID)
 	return false
 }
 
@@ -365,6 +520,7 @@ func (r *Replicator) HandleMetrics(w http.ResponseWriter, req *http.Request) {
 		AverageAckTime:     avgAckTime,
 		MaxReplicationLag:  float64(r.metrics.maxLag.Load()),
 		RetriesInProgress:  int(r.metrics.retriesInProgress.Load()),
+		CoalescedTasks:     r.metrics.coalescedTasks.Load(),
 	}
 
 	respondJSON(w, http.StatusOK, metrics)
@@ -384,5 +540,6 @@ func (r *Replicator) HandleHealth(w http.ResponseWriter, req *http.Request) {
 		"status":     status,
 		"service":    "replicator",
 		"queue_size": queueSize,
+		"build":      buildinfo.Get("replicator", r.config.Fingerprint()),
 	})
 }
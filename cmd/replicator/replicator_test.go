@@ -0,0 +1,128 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"dht/internal/config"
+	"dht/internal/models"
+)
+
+// step is one event in the life of a key's replication, played against the
+// coalescing maps without starting any workers
+type step struct {
+	op    string // put, strong, send, fail or retry
+	value string // put: the value written
+	nodes string // put: the replicas, "n1" if empty
+}
+
+func TestCoalescing(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     []step
+		sent      []string // values workers went on to send, in order
+		coalesced int64
+	}{
+		{
+			name:  "single write",
+			steps: []step{{op: "put", value: "a"}, {op: "send"}},
+			sent:  []string{"a"},
+		},
+		{
+			name:      "burst sends the last value",
+			steps:     []step{{op: "put", value: "a"}, {op: "put", value: "b"}, {op: "put", value: "c"}, {op: "send"}},
+			sent:      []string{"c"},
+			coalesced: 2,
+		},
+		{
+			name:  "write after a send is queued again",
+			steps: []step{{op: "put", value: "a"}, {op: "send"}, {op: "put", value: "b"}, {op: "send"}},
+			sent:  []string{"a", "b"},
+		},
+		{
+			name:  "failed send is retried",
+			steps: []step{{op: "put", value: "a"}, {op: "send"}, {op: "fail"}, {op: "retry"}},
+			sent:  []string{"a", "a"},
+		},
+		{
+			name:      "newer write cancels the retry",
+			steps:     []step{{op: "put", value: "a"}, {op: "send"}, {op: "fail"}, {op: "put", value: "b"}, {op: "retry"}, {op: "send"}},
+			sent:      []string{"a", "b"},
+			coalesced: 1,
+		},
+		{
+			name:      "queued write skips the retry",
+			steps:     []step{{op: "put", value: "a"}, {op: "send"}, {op: "put", value: "b"}, {op: "fail"}, {op: "send"}},
+			sent:      []string{"a", "b"},
+			coalesced: 1,
+		},
+		{
+			name:      "strong write drops the queued task",
+			steps:     []step{{op: "put", value: "a"}, {op: "strong"}, {op: "send"}},
+			coalesced: 1,
+		},
+		{
+			name:      "strong write drops the retry",
+			steps:     []step{{op: "put", value: "a"}, {op: "send"}, {op: "fail"}, {op: "strong"}, {op: "retry"}},
+			sent:      []string{"a"},
+			coalesced: 1,
+		},
+		{
+			name:  "other replicas are not coalesced",
+			steps: []step{{op: "put", value: "a"}, {op: "put", value: "b", nodes: "n2"}, {op: "send"}, {op: "send"}},
+			sent:  []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReplicator(&config.Config{})
+			var (
+				sent     []string
+				sending  *ReplicationTask // claimed by the last send
+				retrying *ReplicationTask // waiting out its backoff
+			)
+			for _, s := range tt.steps {
+				switch s.op {
+				case "put":
+					nodes := s.nodes
+					if nodes == "" {
+						nodes = "n1"
+					}
+					req := &models.ReplicationRequest{Key: "k", Value: []byte(s.value), Operation: "SET", ReplicaNodes: []string{nodes}}
+					if !r.enqueue(req) {
+						t.Fatal("queue is full")
+					}
+				case "strong":
+					r.supersede(coalesceKey(&models.ReplicationRequest{Key: "k", ReplicaNodes: []string{"n1"}}))
+				case "send":
+					sending = <-r.eventualQueue
+					if r.claim(sending) {
+						sent = append(sent, string(sending.Request.Value))
+					}
+				case "fail":
+					if r.awaitRetry(sending) {
+						retrying = sending
+					}
+				case "retry":
+					if retrying == nil {
+						t.Fatal("no task is waiting to retry")
+					}
+					if r.claim(retrying) {
+						sent = append(sent, string(retrying.Request.Value))
+					}
+					retrying = nil
+				}
+			}
+
+			if !slices.Equal(sent, tt.sent) {
+				t.Fatalf("sent %q, want %q", sent, tt.sent)
+			}
+			if got := r.metrics.coalescedTasks.Load(); got != tt.coalesced {
+				t.Fatalf("coalesced %d tasks, want %d", got, tt.coalesced)
+			}
+			if len(r.eventualQueue) != 0 || len(r.queued) != 0 || len(r.retrying) != 0 {
+				t.Fatalf("left %d queued tasks, %d in the map and %d retrying", len(r.eventualQueue), len(r.queued), len(r.retrying))
+			}
+		})
+	}
+}
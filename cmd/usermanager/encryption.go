@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"dht/internal/envelope"
+	"dht/internal/models"
+)
+
+// SetEncryptionKey handles PUT /encryption-key
+// Registers the caller's data-encryption key ({"key": "<base64>"}) or a KMS
+// reference ({"kms_uri": "env://VAR"}). Replacing an existing key requires
+// "replace": true, since values encrypted with the old key become unreadable.
+func (h *Handler) SetEncryptionKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.extractUserIDFromToken(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		Key     string `json:"key"`
+		KMSURI  string `json:"kms_uri"`
+		Replace bool   `json:"replace"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if (req.Key == "") == (req.KMSURI == "") {
+		respondError(w, http.StatusBadRequest, "Exactly one of key or kms_uri is required")
+		return
+	}
+
+	var key *models.EncryptionKey
+	if req.Key != "" {
+		raw, parseErr := envelope.ParseKey(req.Key)
+		if parseErr != nil {
+			respondError(w, http.StatusBadRequest, parseErr.Error())
+			return
+		}
+		key, err = h.encryptionKeyService.SetKey(r.Context(), userID, raw, req.Replace)
+	} else {
+		if validateErr := h.encryptionKeyService.ValidateKMSURI(req.KMSURI); validateErr != nil {
+			respondError(w, http.StatusBadRequest, validateErr.Error())
+			return
+		}
+		key, err = h.encryptionKeyService.SetKMS(r.Context(), userID, req.KMSURI, req.Replace)
+	}
+
+	switch {
+	case errors.Is(err, models.ErrEncryptionKeyExists):
+		respondError(w, http.StatusConflict, "Encryption key already registered; set replace to true to overwrite it")
+		return
+	case errors.Is(err, models.ErrNoKEK):
+		respondError(w, http.StatusNotImplemented, "Raw keys are not accepted on this deployment; register a kms_uri instead")
+		return
+	case err != nil:
+		log.Printf("Error storing encryption key: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to store encryption key")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, key)
+}
+
+// GetEncryptionKey handles GET /encryption-key (metadata only, never key material)
+func (h *Handler) GetEncryptionKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.extractUserIDFromToken(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	key, err := h.encryptionKeyService.GetKey(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoEncryptionKey) {
+			respondError(w, http.StatusNotFound, "No encryption key registered")
+			return
+		}
+		log.Printf("Error loading encryption key: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to load encryption key")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, key)
+}
+
+// DeleteEncryptionKey handles DELETE /encryption-key
+// New writes are stored unencrypted; values encrypted with the key become unreadable.
+func (h *Handler) DeleteEncryptionKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.extractUserIDFromToken(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := h.encryptionKeyService.DeleteKey(r.Context(), userID); err != nil {
+		if errors.Is(err, models.ErrNoEncryptionKey) {
+			respondError(w, http.StatusNotFound, "No encryption key registered")
+			return
+		}
+		log.Printf("Error deleting encryption key: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to delete encryption key")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -11,23 +11,43 @@ import (
 	"time"
 
 	"dht/internal/auth"
+	"dht/internal/buildinfo"
 	"dht/internal/models"
+	"dht/internal/proto"
+	"dht/internal/requestid"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Handler struct {
-	userService   *models.UserService
-	apiKeyService *models.APIKeyService
-	authService   *auth.AuthService
-	db            *pgxpool.Pool
+	userService          *models.UserService
+	apiKeyService        *models.APIKeyService
+	encryptionKeyService *models.EncryptionKeyService
+	storageUsageService  *models.StorageUsageService
+	namespaceService     *models.NamespaceService
+	invitationService    *models.InvitationService
+	scopedTokenService   *models.ScopedTokenService
+	purgeService         *models.PurgeService
+	authService          *auth.AuthService
+	db                   *pgxpool.Pool
+	adminToken           string // shared with the gateway for internal routes, empty disables them
+	configFingerprint    string // reported with the build in /health and /version
+	openSignup           bool   // false requires an invitation code to sign up
+	signupURL            string // web signup page invitation links point to, empty for codes only
 }
 
-func NewHandler(userService *models.UserService, apiKeyService *models.APIKeyService, authService *auth.AuthService, db *pgxpool.Pool) *Handler {
+func NewHandler(userService *models.UserService, apiKeyService *models.APIKeyService, encryptionKeyService *models.EncryptionKeyService, storageUsageService *models.StorageUsageService, namespaceService *models.NamespaceService, invitationService *models.InvitationService, scopedTokenService *models.ScopedTokenService, purgeService *models.PurgeService, authService *auth.AuthService, db *pgxpool.Pool, adminToken string) *Handler {
 	return &Handler{
-		userService:   userService,
-		apiKeyService: apiKeyService,
-		authService:   authService,
-		db:            db,
+		userService:          userService,
+		apiKeyService:        apiKeyService,
+		encryptionKeyService: encryptionKeyService,
+		storageUsageService:  storageUsageService,
+		namespaceService:     namespaceService,
+		invitationService:    invitationService,
+		scopedTokenService:   scopedTokenService,
+		purgeService:         purgeService,
+		authService:          authService,
+		db:                   db,
+		adminToken:           adminToken,
 	}
 }
 
@@ -57,9 +77,23 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create user
-	user, err := h.userService.CreateUser(r.Context(), req.Email, req.Username, req.Password)
+	// Create user, redeeming the invitation if there is one
+	var user *models.User
+	var err error
+	switch {
+	case req.InviteCode != "":
+		user, err = h.userService.CreateInvitedUser(r.Context(), req.Email, req.Username, req.Password, req.InviteCode)
+	case !h.openSignup:
+		respondError(w, http.StatusForbidden, "Signup is by invitation only")
+		return
+	default:
+		user, err = h.userService.CreateUser(r.Context(), req.Email, req.Username, req.Password)
+	}
 	if err != nil {
+		if msg, ok := invitationErrorMessage(err); ok {
+			respondError(w, http.StatusForbidden, msg)
+			return
+		}
 		if strings.Contains(err.Error(), "duplicate") || strings.Contains(err.Error(), "already exists") {
 			respondError(w, http.StatusConflict, "Email or username already exists")
 			return
@@ -225,11 +259,8 @@ func (h *Handler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
 
 // ValidateAPIKey validates an API key and returns user ID
 func (h *Handler) ValidateAPIKey(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		APIKey string `json:"api_key"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	var req models.ValidateKeyRequest
+	if err := proto.DecodeRequest(r, &req); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
@@ -240,23 +271,116 @@ func (h *Handler) ValidateAPIKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify API key
-	userID, err := h.apiKeyService.VerifyAPIKey(r.Context(), req.APIKey)
+	userID, keyID, scopes, err := h.apiKeyService.VerifyAPIKey(r.Context(), req.APIKey)
 	if err != nil {
 		respondError(w, http.StatusUnauthorized, "Invalid API key")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"valid":   true,
-		"user_id": userID,
+	h.respondValidated(w, r, &models.KeyValidation{
+		Valid:  true,
+		UserID: userID,
+		KeyID:  keyID,
+		Scopes: scopes,
+	})
+}
+
+// ValidateScopedToken is called by the gateway for a scoped token whose
+// signature, expiry and scope it has already checked. It makes sure the API
+// key that minted the token is still active, redeems single-use tokens and
+// returns the same tenant context as ValidateAPIKey.
+func (h *Handler) ValidateScopedToken(w http.ResponseWriter, r *http.Request) {
+	var req models.ValidateTokenRequest
+	if err := proto.DecodeRequest(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.UserID == 0 || req.KeyID == 0 || req.TokenID == "" {
+		respondError(w, http.StatusBadRequest, "user_id, key_id and token_id are required")
+		return
+	}
+
+	// Revoking the key revokes every token minted with it
+	scopes, err := h.apiKeyService.ActiveKeyScopes(r.Context(), req.KeyID, req.UserID)
+	if errors.Is(err, models.ErrAPIKeyInactive) {
+		respondError(w, http.StatusUnauthorized, "The API key that minted the token is no longer active")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading API key %d: %v\n", req.KeyID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to validate token")
+		return
+	}
+
+	if req.SingleUse {
+		if err := h.scopedTokenService.Redeem(r.Context(), req.TokenID, req.UserID, req.KeyID, req.ExpiresAt); err != nil {
+			if errors.Is(err, models.ErrScopedTokenUsed) {
+				respondError(w, http.StatusUnauthorized, "Token has already been used")
+				return
+			}
+			log.Printf("Error redeeming token %s: %v\n", req.TokenID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to validate token")
+			return
+		}
+	}
+
+	h.respondValidated(w, r, &models.KeyValidation{
+		Valid:  true,
+		UserID: req.UserID,
+		KeyID:  req.KeyID,
+		Scopes: scopes,
 	})
 }
 
+// respondValidated completes the response to a validated key or token with
+// the tenant context the gateway needs for the user's requests, in the
+// encoding the gateway asked for
+func (h *Handler) respondValidated(w http.ResponseWriter, r *http.Request, response *models.KeyValidation) {
+	userID := response.UserID
+
+	// Include the tenant's encryption key so the gateway encrypts values.
+	// Fail closed: if the lookup fails the gateway must not write plaintext.
+	key, err := h.encryptionKeyService.GetKey(r.Context(), userID)
+	switch {
+	case err == nil:
+		response.Encryption = key.TenantEncryption()
+	case !errors.Is(err, models.ErrNoEncryptionKey):
+		log.Printf("Error loading encryption key for user %d: %v\n", userID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to load encryption key")
+		return
+	}
+
+	// Include the namespace defaults the gateway applies to the user's keys
+	policies, err := h.namespaceService.Policies(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading namespace settings for user %d: %v\n", userID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to load namespace settings")
+		return
+	}
+	if len(policies) > 0 {
+		response.Namespaces = policies
+	}
+
+	// Include the storage quota so the gateway can refuse writes over it.
+	// Fail open: metering is advisory and must not take writes down with it.
+	quota, err := h.storageUsageService.Quota(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading storage quota for user %d: %v\n", userID, err)
+	} else {
+		response.StorageQuotaBytes = quota.QuotaBytes
+		response.StorageUsedBytes = quota.UsedBytes
+	}
+
+	proto.Respond(w, r, http.StatusOK, response)
+}
+
 // Health check endpoint
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
-	respondJSON(w, http.StatusOK, map[string]string{
+	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"status":  "healthy",
 		"service": "usermanager",
+		"build":   buildinfo.Get("usermanager", h.configFingerprint),
 	})
 }
 
@@ -306,17 +430,20 @@ func (h *Handler) ListUsageRecords(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Optional filter to follow a single operation
+	requestID := r.URL.Query().Get("request_id")
+
 	query := `
 		SELECT id, user_id, api_key_id, operation, key_accessed, 
 		       request_size_bytes, response_size_bytes, status_code, 
-		       duration_ms, ip_address, user_agent, error_message, created_at
+		       duration_ms, ip_address, user_agent, error_message, request_id, created_at
 		FROM usage_records
-		WHERE user_id = $1
+		WHERE user_id = $1 AND ($3 = '' OR request_id = $3)
 		ORDER BY created_at DESC
 		LIMIT $2
 	`
 
-	rows, err := h.db.Query(context.Background(), query, userID, limit)
+	rows, err := h.db.Query(r.Context(), query, userID, limit, requestID)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch usage records")
 		return
@@ -338,6 +465,7 @@ func (h *Handler) ListUsageRecords(w http.ResponseWriter, r *http.Request) {
 			IPAddress         *string
 			UserAgent         *string
 			ErrorMessage      *string
+			RequestID         *string
 			CreatedAt         time.Time
 		}
 
@@ -345,7 +473,7 @@ func (h *Handler) ListUsageRecords(w http.ResponseWriter, r *http.Request) {
 			&record.ID, &record.UserID, &record.APIKeyID, &record.Operation,
 			&record.KeyAccessed, &record.RequestSizeBytes, &record.ResponseSizeBytes,
 			&record.StatusCode, &record.DurationMs, &record.IPAddress,
-			&record.UserAgent, &record.ErrorMessage, &record.CreatedAt,
+			&record.UserAgent, &record.ErrorMessage, &record.RequestID, &record.CreatedAt,
 		)
 		if err != nil {
 			continue
@@ -364,6 +492,7 @@ func (h *Handler) ListUsageRecords(w http.ResponseWriter, r *http.Request) {
 			"ip_address":          record.IPAddress,
 			"user_agent":          record.UserAgent,
 			"error_message":       record.ErrorMessage,
+			"request_id":          record.RequestID,
 			"created_at":          record.CreatedAt,
 		})
 	}
@@ -398,7 +527,7 @@ func (h *Handler) GetUsageStats(w http.ResponseWriter, r *http.Request) {
 		AverageLatencyMs      float64
 	}
 
-	err = h.db.QueryRow(context.Background(), query, userID).Scan(
+	err = h.db.QueryRow(r.Context(), query, userID).Scan(
 		&stats.TotalRequests,
 		&stats.SuccessfulRequests,
 		&stats.FailedRequests,
@@ -418,7 +547,7 @@ func (h *Handler) GetUsageStats(w http.ResponseWriter, r *http.Request) {
 		GROUP BY operation
 	`
 
-	rows, err := h.db.Query(context.Background(), operationQuery, userID)
+	rows, err := h.db.Query(r.Context(), operationQuery, userID)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch operation stats")
 		return
@@ -451,8 +580,12 @@ func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// respondError writes the standard error body with the default code for status,
+// tagged with the request ID the middleware set on the response
 func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, map[string]string{"error": message})
+	apiErr := models.NewAPIError(models.CodeForStatus(status), message, nil)
+	apiErr.RequestID = w.Header().Get(requestid.Header)
+	respondJSON(w, status, models.ErrorResponse{Error: apiErr})
 }
 
 func isValidEmail(email string) bool {
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"dht/internal/models"
+)
+
+// CreateInvitation handles POST /invitations (internal)
+// {"email": "...", "note": "...", "max_uses": 1, "expires_in_days": 7} issues
+// an invitation code; all fields are optional. The code is only returned
+// here, with a signup link when SIGNUP_URL is set.
+func (h *Handler) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	var req struct {
+		Email         string `json:"email"`
+		Note          string `json:"note"`
+		MaxUses       int    `json:"max_uses"`
+		ExpiresInDays int    `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Email != "" && !isValidEmail(req.Email) {
+		respondError(w, http.StatusBadRequest, "Invalid email format")
+		return
+	}
+	if len(req.Note) > 255 {
+		respondError(w, http.StatusBadRequest, "note must be at most 255 characters")
+		return
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.MaxUses < 1 || req.MaxUses > 10000 {
+		respondError(w, http.StatusBadRequest, "max_uses must be between 1 and 10000")
+		return
+	}
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = 7
+	}
+	if req.ExpiresInDays < 1 || req.ExpiresInDays > 365 {
+		respondError(w, http.StatusBadRequest, "expires_in_days must be between 1 and 365")
+		return
+	}
+
+	inv, code, err := h.invitationService.Create(r.Context(), req.Email, req.Note, req.MaxUses, time.Duration(req.ExpiresInDays)*24*time.Hour)
+	if err != nil {
+		log.Printf("Error creating invitation: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"invitation": inv,
+		"code":       code,
+	}
+	if link := h.invitationLink(code); link != "" {
+		resp["url"] = link
+	}
+	respondJSON(w, http.StatusCreated, resp)
+}
+
+// ListInvitations handles GET /invitations (internal)
+func (h *Handler) ListInvitations(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
+			limit = l
+		}
+	}
+
+	list, err := h.invitationService.List(r.Context(), limit)
+	if err != nil {
+		log.Printf("Error listing invitations: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to fetch invitations")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"invitations": list,
+		"count":       len(list),
+		"open_signup": h.openSignup,
+	})
+}
+
+// GetInvitation handles GET /invitations/{id} (internal), listing the
+// accounts created with the invitation
+func (h *Handler) GetInvitation(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid invitation ID")
+		return
+	}
+
+	inv, err := h.invitationService.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrInvitationNotFound) {
+			respondError(w, http.StatusNotFound, "Invitation not found")
+			return
+		}
+		log.Printf("Error loading invitation: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to fetch invitation")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, inv)
+}
+
+// RevokeInvitation handles DELETE /invitations/{id} (internal). Accounts
+// already created with the invitation are kept.
+func (h *Handler) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid invitation ID")
+		return
+	}
+
+	inv, err := h.invitationService.Revoke(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrInvitationNotFound) {
+			respondError(w, http.StatusNotFound, "Invitation not found")
+			return
+		}
+		log.Printf("Error revoking invitation: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to revoke invitation")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, inv)
+}
+
+// invitationLink is the signup page URL with code filled in, or "" without
+// a SIGNUP_URL
+func (h *Handler) invitationLink(code string) string {
+	if h.signupURL == "" {
+		return ""
+	}
+	u, err := url.Parse(h.signupURL)
+	if err != nil {
+		return ""
+	}
+	query := u.Query()
+	query.Set("invite", code)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// invitationErrorMessage explains why an invitation code was refused, if err
+// is one of the redemption errors
+func invitationErrorMessage(err error) (string, bool) {
+	switch {
+	case errors.Is(err, models.ErrInvitationNotFound):
+		return "Invalid invitation code", true
+	case errors.Is(err, models.ErrInvitationExpired):
+		return "Invitation has expired", true
+	case errors.Is(err, models.ErrInvitationUsedUp):
+		return "Invitation has already been used", true
+	case errors.Is(err, models.ErrInvitationRevoked):
+		return "Invitation has been revoked", true
+	case errors.Is(err, models.ErrInvitationEmailMismatch):
+		return "Invitation is for a different email address", true
+	}
+	return "", false
+}
@@ -11,8 +11,14 @@ import (
 	"time"
 
 	"dht/internal/auth"
+	"dht/internal/buildinfo"
 	"dht/internal/config"
+	"dht/internal/deadline"
+	"dht/internal/envelope"
+	"dht/internal/httpx"
+	"dht/internal/middleware"
 	"dht/internal/models"
+	"dht/internal/requestid"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -20,6 +26,9 @@ import (
 func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
+	if err := cfg.Check("usermanager"); err != nil {
+		log.Fatalf("%v\n", err)
+	}
 
 	// Initialize database connection pool
 	dbPool, err := pgxpool.New(context.Background(), cfg.DatabaseURL)
@@ -43,8 +52,50 @@ func main() {
 	// Initialize API key service
 	apiKeyService := models.NewAPIKeyService(dbPool)
 
+	// Initialize tenant encryption key service (raw keys require a KEK)
+	var kek []byte
+	if cfg.DataKEK != "" {
+		kek, err = envelope.ParseKey(cfg.DataKEK)
+		if err != nil {
+			log.Fatalf("Invalid DATA_KEY_ENCRYPTION_KEY: %v\n", err)
+		}
+	}
+	encryptionKeyService := models.NewEncryptionKeyService(dbPool, kek, envelope.KMSPolicy{
+		EnvPrefix: cfg.TenantKMSEnvPrefix,
+		KeyDir:    cfg.TenantKMSKeyDir,
+	})
+
+	// Initialize storage metering service
+	storageUsageService := models.NewStorageUsageService(dbPool, cfg.DefaultStorageQuota)
+
+	// Initialize namespace settings service
+	namespaceService := models.NewNamespaceService(dbPool)
+
+	// Initialize invitation service
+	invitationService := models.NewInvitationService(dbPool)
+	if !cfg.OpenSignup {
+		log.Println("Signup is by invitation only")
+	}
+
+	// Initialize scoped token redemption
+	scopedTokenService := models.NewScopedTokenService(dbPool)
+
+	// Initialize the purge of soft-deleted users
+	purgeService := models.NewPurgeService(dbPool, cfg.PurgeMode, models.PurgeRetention{
+		Users:    cfg.PurgeUserRetention,
+		Sessions: cfg.PurgeSessionRetention,
+		UsagePII: cfg.PurgeUsagePIIRetention,
+	})
+
 	// Initialize handlers
-	handler := NewHandler(userService, apiKeyService, authService, dbPool)
+	handler := NewHandler(userService, apiKeyService, encryptionKeyService, storageUsageService, namespaceService, invitationService, scopedTokenService, purgeService, authService, dbPool, cfg.AdminToken)
+	handler.configFingerprint = cfg.Fingerprint()
+	handler.openSignup = cfg.OpenSignup
+	handler.signupURL = cfg.SignupURL
+	if cfg.PurgeInterval > 0 {
+		go handler.purgeDeletedUsers(cfg.PurgeInterval)
+		log.Printf("Soft-deleted users are %sd %v after deletion\n", cfg.PurgeMode, cfg.PurgeUserRetention)
+	}
 
 	// Setup router
 	mux := http.NewServeMux()
@@ -52,22 +103,43 @@ func main() {
 	mux.HandleFunc("POST /login", handler.Login)
 	mux.HandleFunc("POST /apikeys", handler.CreateAPIKey)
 	mux.HandleFunc("GET /apikeys", handler.ListAPIKeys)
+	mux.HandleFunc("PUT /encryption-key", handler.SetEncryptionKey)
+	mux.HandleFunc("GET /encryption-key", handler.GetEncryptionKey)
+	mux.HandleFunc("DELETE /encryption-key", handler.DeleteEncryptionKey)
+	mux.HandleFunc("GET /namespaces", handler.ListNamespaces)
+	mux.HandleFunc("PUT /namespaces/{namespace}", handler.SetNamespace)
+	mux.HandleFunc("DELETE /namespaces/{namespace}", handler.DeleteNamespace)
 	mux.HandleFunc("GET /health", handler.Health)
+	mux.HandleFunc("GET /version", buildinfo.Handler("usermanager", handler.configFingerprint))
 	mux.HandleFunc("POST /validate-key", handler.ValidateAPIKey)
+	mux.HandleFunc("POST /validate-token", handler.ValidateScopedToken)
 	mux.HandleFunc("GET /usage", handler.ListUsageRecords)
 	mux.HandleFunc("GET /usage/stats", handler.GetUsageStats)
+	mux.HandleFunc("GET /storage-usage", handler.GetStorageUsage)
+
+	// Internal routes (X-Admin-Token)
+	mux.HandleFunc("POST /storage-usage", handler.RecordStorageUsage)
+	mux.HandleFunc("GET /storage-usage/export", handler.ExportStorageUsage)
+	mux.HandleFunc("PUT /users/{id}/storage-quota", handler.SetStorageQuota)
+	mux.HandleFunc("POST /invitations", handler.CreateInvitation)
+	mux.HandleFunc("GET /invitations", handler.ListInvitations)
+	mux.HandleFunc("GET /invitations/{id}", handler.GetInvitation)
+	mux.HandleFunc("DELETE /invitations/{id}", handler.RevokeInvitation)
+	mux.HandleFunc("POST /deleted-users/purge", handler.PurgeDeletedUsers)
 
 	// Wrap with middleware
-	wrappedMux := LoggingMiddleware(CORSMiddleware(mux))
+	cors := middleware.CORS("GET, POST, PUT, DELETE, OPTIONS", "Content-Type, Authorization, X-Admin-Token, X-Request-ID, X-Request-Timeout")
+	wrappedMux := requestid.Middleware(deadline.Middleware(middleware.Logging(cors(mux))))
 
 	// Create server
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%s", cfg.UserManagerPort),
 		Handler:      wrappedMux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  cfg.ServerReadTimeout,
+		WriteTimeout: cfg.ServerWriteTimeout,
+		IdleTimeout:  cfg.ServerIdleTimeout,
 	}
+	httpx.AcceptH2C(srv, cfg.HTTP2MaxConcurrentStreams)
 
 	// Start server in goroutine
 	go func() {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"dht/internal/models"
+	"dht/internal/namespace"
+)
+
+// ListNamespaces handles GET /namespaces
+func (h *Handler) ListNamespaces(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.extractUserIDFromToken(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	list, err := h.namespaceService.List(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing namespace settings: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to fetch namespace settings")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, list)
+}
+
+// SetNamespace handles PUT /namespaces/{namespace}
+// Sets the defaults applied to the caller's keys in the namespace, e.g.
+// {"consistency": "strong", "replication_factor": 5} for every "orders:*" key.
+func (h *Handler) SetNamespace(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.extractUserIDFromToken(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	name := r.PathValue("namespace")
+	if !namespace.Valid(name) {
+		respondError(w, http.StatusBadRequest, "Invalid namespace. Use 1-64 letters, digits, '_', '-' or '.'")
+		return
+	}
+
+	var policy namespace.Policy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if policy.Consistency != "" && policy.Consistency != "strong" && policy.Consistency != "eventual" {
+		respondError(w, http.StatusBadRequest, "Invalid consistency level. Must be 'strong' or 'eventual'")
+		return
+	}
+	if policy.ReplicationFactor < 0 || policy.ReplicationFactor > namespace.MaxReplicationFactor {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid replication_factor. Must be between 1 and %d", namespace.MaxReplicationFactor))
+		return
+	}
+
+	settings, err := h.namespaceService.Set(r.Context(), userID, name, policy)
+	if err != nil {
+		log.Printf("Error storing namespace settings: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to store namespace settings")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, settings)
+}
+
+// DeleteNamespace handles DELETE /namespaces/{namespace}, reverting the
+// namespace's keys to the service defaults
+func (h *Handler) DeleteNamespace(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.extractUserIDFromToken(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := h.namespaceService.Delete(r.Context(), userID, r.PathValue("namespace")); err != nil {
+		if errors.Is(err, models.ErrNamespaceNotFound) {
+			respondError(w, http.StatusNotFound, "Namespace has no settings")
+			return
+		}
+		log.Printf("Error deleting namespace settings: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to delete namespace settings")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
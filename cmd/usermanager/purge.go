@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// purgeDeletedUsers runs a purge pass every interval
+func (h *Handler) purgeDeletedUsers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Unfinished work is picked up by the next pass
+		ctx, cancel := context.WithTimeout(context.Background(), interval*9/10)
+		result, err := h.purgeService.Purge(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Purge of deleted users failed: %v\n", err)
+			continue
+		}
+		if result.SessionsDeleted+result.UsageScrubbed+result.UsersAnonymized+result.UsersDeleted > 0 {
+			log.Printf("Purged deleted users: %d sessions deleted, %d usage records scrubbed, %d users anonymized, %d users deleted (%dms)\n",
+				result.SessionsDeleted, result.UsageScrubbed, result.UsersAnonymized, result.UsersDeleted, result.DurationMs)
+		}
+	}
+}
+
+// PurgeDeletedUsers handles POST /deleted-users/purge (internal), running a
+// purge pass now instead of waiting for the next scheduled one
+func (h *Handler) PurgeDeletedUsers(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	result, err := h.purgeService.Purge(r.Context())
+	if err != nil {
+		log.Printf("Purge of deleted users failed: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Purge failed; it resumes on the next pass")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dht/internal/models"
+)
+
+// GetStorageUsage handles GET /storage-usage
+// Returns the caller's quota, latest metered usage and snapshot history.
+func (h *Handler) GetStorageUsage(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.extractUserIDFromToken(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	limit := 24
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
+			limit = l
+		}
+	}
+
+	quota, err := h.storageUsageService.Quota(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading storage quota: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to fetch storage usage")
+		return
+	}
+
+	history, err := h.storageUsageService.History(r.Context(), userID, limit)
+	if err != nil {
+		log.Printf("Error loading storage usage: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to fetch storage usage")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"storage_quota_bytes": quota.QuotaBytes,
+		"storage_used_bytes":  quota.UsedBytes,
+		"snapshots":           history,
+	})
+}
+
+// RecordStorageUsage handles POST /storage-usage (internal)
+// The gateway's metering job posts a snapshot of every tenant's storage.
+func (h *Handler) RecordStorageUsage(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	var snapshot models.StorageSnapshot
+	if err := json.NewDecoder(r.Body).Decode(&snapshot); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if snapshot.TakenAt.IsZero() {
+		snapshot.TakenAt = time.Now()
+	}
+
+	stored, err := h.storageUsageService.RecordSnapshot(r.Context(), &snapshot)
+	if err != nil {
+		log.Printf("Error storing storage snapshot: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to store storage usage")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"taken_at": snapshot.TakenAt,
+		"stored":   stored,
+	})
+}
+
+// ExportStorageUsage handles GET /storage-usage/export?from=&to= (internal)
+// Summarises every tenant's snapshots in the period as CSV for billing; the
+// period defaults to the previous calendar month (UTC).
+func (h *Handler) ExportStorageUsage(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	thisMonth := time.Now().UTC()
+	thisMonth = time.Date(thisMonth.Year(), thisMonth.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from, to := thisMonth.AddDate(0, -1, 0), thisMonth
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid "+param+". Must be an RFC 3339 time")
+			return
+		}
+		*t = parsed
+	}
+	if !from.Before(to) {
+		respondError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	lines, err := h.storageUsageService.BillingExport(r.Context(), from, to)
+	if err != nil {
+		log.Printf("Error exporting storage usage: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to export storage usage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="storage-usage-%s.csv"`, from.Format("2006-01-02")))
+	w.WriteHeader(http.StatusOK)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"user_id", "email", "period_start", "period_end", "snapshots", "avg_bytes", "peak_bytes", "peak_keys"})
+	for _, line := range lines {
+		out.Write([]string{
+			strconv.FormatInt(line.UserID, 10),
+			line.Email,
+			from.Format(time.RFC3339),
+			to.Format(time.RFC3339),
+			strconv.FormatInt(line.Snapshots, 10),
+			strconv.FormatFloat(line.AvgBytes, 'f', 0, 64),
+			strconv.FormatInt(line.PeakBytes, 10),
+			strconv.FormatInt(line.PeakKeys, 10),
+		})
+	}
+	out.Flush()
+}
+
+// SetStorageQuota handles PUT /users/{id}/storage-quota (internal)
+// {"quota_bytes": n} sets the user's quota (0 = unlimited); null reverts it
+// to the deployment default.
+func (h *Handler) SetStorageQuota(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req struct {
+		QuotaBytes *int64 `json:"quota_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.QuotaBytes != nil && *req.QuotaBytes < 0 {
+		respondError(w, http.StatusBadRequest, "quota_bytes must not be negative")
+		return
+	}
+
+	if err := h.storageUsageService.SetQuota(r.Context(), userID, req.QuotaBytes); err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			respondError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		log.Printf("Error setting storage quota: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to set storage quota")
+		return
+	}
+
+	quota, err := h.storageUsageService.Quota(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading storage quota: %v\n", err)
+		respondError(w, http.StatusInternalServerError, "Failed to fetch storage quota")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"user_id":             userID,
+		"storage_quota_bytes": quota.QuotaBytes,
+		"storage_used_bytes":  quota.UsedBytes,
+	})
+}
+
+// requireAdmin checks the X-Admin-Token of an internal route, writing the
+// error response if it is missing or wrong
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if h.adminToken == "" {
+		respondError(w, http.StatusForbidden, "Internal API is disabled")
+		return false
+	}
+	token := r.Header.Get("X-Admin-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		respondError(w, http.StatusUnauthorized, "Invalid admin token")
+		return false
+	}
+	return true
+}
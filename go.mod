@@ -6,6 +6,7 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/jackc/pgx/v5 v5.7.6
 	golang.org/x/crypto v0.44.0
+	google.golang.org/protobuf v1.36.10
 )
 
 require (
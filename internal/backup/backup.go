@@ -0,0 +1,273 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"dht/internal/storage"
+)
+
+const (
+	manifestName = "manifest.json"
+	snapshotName = "snapshot.gob"
+	walName      = "wal.log"
+	catalogName  = "index.json"
+)
+
+// Manifest describes a single node backup
+type Manifest struct {
+	BackupID     string    `json:"backup_id"`
+	NodeID       string    `json:"node_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Entries      int       `json:"entries"`
+	SnapshotFile string    `json:"snapshot_file"`
+	SnapshotSize int64     `json:"snapshot_size"`
+	SHA256       string    `json:"sha256"`
+
+	// Last WAL sequence number the snapshot holds; a node restoring it
+	// continues its WAL from there
+	WALSeq uint64 `json:"wal_seq"`
+
+	// Archived WAL segment (optional), used for point-in-time recovery
+	WALFile   string `json:"wal_file,omitempty"`
+	WALSize   int64  `json:"wal_size,omitempty"`
+	WALSHA256 string `json:"wal_sha256,omitempty"`
+}
+
+// CatalogEntry is one backup in a node's catalog (<dest>/<nodeID>/index.json)
+type CatalogEntry struct {
+	BackupID  string    `json:"backup_id"`
+	CreatedAt time.Time `json:"created_at"`
+	HasWAL    bool      `json:"has_wal"`
+}
+
+// ClusterManifest records a full-cluster backup orchestrated by dhtctl
+type ClusterManifest struct {
+	BackupID  string       `json:"backup_id"`
+	CreatedAt time.Time    `json:"created_at"`
+	Nodes     []NodeBackup `json:"nodes"`
+}
+
+// NodeBackup is one node's entry in a ClusterManifest
+type NodeBackup struct {
+	NodeURL  string    `json:"node_url"`
+	NodeID   string    `json:"node_id,omitempty"`
+	Location string    `json:"location,omitempty"`
+	Manifest *Manifest `json:"manifest,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// NewBackupID returns a sortable, timestamp-based backup ID
+func NewBackupID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// Upload copies a local snapshot (and optionally an archived WAL segment) plus
+// a manifest to <dest>/<nodeID>/<backupID>/ and records it in the node catalog
+// Returns the manifest and the URI of the backup directory
+func Upload(ctx context.Context, dest, nodeID, backupID string, info *storage.SnapshotInfo, walPath string) (*Manifest, string, error) {
+	store, err := Open(dest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return upload(ctx, store, nodeID, backupID, info, walPath, true)
+}
+
+// upload writes a backup to store; catalog controls whether it is recorded
+// in the node catalog (and so becomes a candidate base for recoveries)
+func upload(ctx context.Context, store ObjectStore, nodeID, backupID string, info *storage.SnapshotInfo, walPath string, catalog bool) (*Manifest, string, error) {
+	prefix := path.Join(nodeID, backupID)
+
+	if err := putFile(ctx, store, path.Join(prefix, snapshotName), info.Path); err != nil {
+		return nil, "", err
+	}
+
+	manifest := &Manifest{
+		BackupID:     backupID,
+		NodeID:       nodeID,
+		CreatedAt:    info.CreatedAt,
+		Entries:      info.Entries,
+		SnapshotFile: snapshotName,
+		SnapshotSize: info.Size,
+		SHA256:       info.SHA256,
+		WALSeq:       info.WALSeq,
+	}
+
+	if walPath != "" {
+		walInfo, err := os.Stat(walPath)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to stat WAL archive: %w", err)
+		}
+		walSum, err := storage.FileSHA256(walPath)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to checksum WAL archive: %w", err)
+		}
+		if err := putFile(ctx, store, path.Join(prefix, walName), walPath); err != nil {
+			return nil, "", err
+		}
+		manifest.WALFile = walName
+		manifest.WALSize = walInfo.Size()
+		manifest.WALSHA256 = walSum
+	}
+
+	// Manifest is written last so a backup without one is known to be incomplete
+	if err := putJSON(ctx, store, path.Join(prefix, manifestName), manifest); err != nil {
+		return nil, "", err
+	}
+
+	if catalog {
+		if err := addToCatalog(ctx, store, nodeID, manifest); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return manifest, store.URI(prefix), nil
+}
+
+// Download fetches the backup at uri into dir and verifies its checksum
+// Returns the manifest and the path of the verified local snapshot
+func Download(ctx context.Context, uri, dir string) (*Manifest, string, error) {
+	store, err := Open(uri)
+	if err != nil {
+		return nil, "", err
+	}
+
+	manifest, err := ReadManifest(ctx, store)
+	if err != nil {
+		return nil, "", err
+	}
+
+	localPath := filepath.Join(dir, fmt.Sprintf("%s-%s-restore.gob", manifest.NodeID, manifest.BackupID))
+	if err := fetchVerified(ctx, store, manifest.SnapshotFile, manifest.SHA256, localPath); err != nil {
+		return nil, "", fmt.Errorf("snapshot: %w", err)
+	}
+
+	return manifest, localPath, nil
+}
+
+// ReadManifest reads manifest.json from the root of store
+func ReadManifest(ctx context.Context, store ObjectStore) (*Manifest, error) {
+	var manifest Manifest
+	if err := getJSON(ctx, store, manifestName, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// ReadCatalog returns a node's backups ordered by creation time
+func ReadCatalog(ctx context.Context, store ObjectStore, nodeID string) ([]CatalogEntry, error) {
+	var catalog []CatalogEntry
+	err := getJSON(ctx, store, path.Join(nodeID, catalogName), &catalog)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+
+	sort.Slice(catalog, func(i, j int) bool {
+		return catalog[i].CreatedAt.Before(catalog[j].CreatedAt)
+	})
+	return catalog, nil
+}
+
+// WriteClusterManifest stores a cluster manifest at <dest>/cluster/<backupID>.json
+func WriteClusterManifest(ctx context.Context, dest string, cm *ClusterManifest) (string, error) {
+	store, err := Open(dest)
+	if err != nil {
+		return "", err
+	}
+
+	name := path.Join("cluster", cm.BackupID+".json")
+	if err := putJSON(ctx, store, name, cm); err != nil {
+		return "", err
+	}
+	return store.URI(name), nil
+}
+
+// addToCatalog appends a backup to the node catalog, replacing any entry with the same ID
+func addToCatalog(ctx context.Context, store ObjectStore, nodeID string, manifest *Manifest) error {
+	catalog, err := ReadCatalog(ctx, store, nodeID)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]CatalogEntry, 0, len(catalog)+1)
+	for _, entry := range catalog {
+		if entry.BackupID != manifest.BackupID {
+			entries = append(entries, entry)
+		}
+	}
+	entries = append(entries, CatalogEntry{
+		BackupID:  manifest.BackupID,
+		CreatedAt: manifest.CreatedAt,
+		HasWAL:    manifest.WALFile != "",
+	})
+
+	return putJSON(ctx, store, path.Join(nodeID, catalogName), entries)
+}
+
+// fetchVerified downloads an object to localPath and checks its SHA-256
+func fetchVerified(ctx context.Context, store ObjectStore, name, wantSHA256, localPath string) error {
+	rc, err := store.Get(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", name, err)
+	}
+	defer rc.Close()
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", localPath, err)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hasher), rc); err != nil {
+		file.Close()
+		os.Remove(localPath)
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	file.Close()
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != wantSHA256 {
+		os.Remove(localPath)
+		return fmt.Errorf("checksum mismatch for %s: manifest=%s actual=%s", name, wantSHA256, sum)
+	}
+	return nil
+}
+
+func putFile(ctx context.Context, store ObjectStore, name, localPath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", localPath, err)
+	}
+	defer file.Close()
+
+	return store.Put(ctx, name, file)
+}
+
+func putJSON(ctx context.Context, store ObjectStore, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, name, bytes.NewReader(data))
+}
+
+func getJSON(ctx context.Context, store ObjectStore, name string, v interface{}) error {
+	rc, err := store.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return json.NewDecoder(rc).Decode(v)
+}
@@ -0,0 +1,253 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dht/internal/storage"
+)
+
+// walOverlap is how far before the base snapshot WAL replay starts
+// Replaying a suffix of the WAL in order is idempotent, so starting slightly
+// early covers writes that were in flight while the snapshot was taken.
+const walOverlap = time.Second
+
+// PITRPlan describes how a point-in-time recovery will be performed
+type PITRPlan struct {
+	NodeID string
+	Target time.Time
+	Base   CatalogEntry // snapshot the recovery starts from
+	WAL    CatalogEntry // backup whose archived WAL covers (Base, Target]
+}
+
+// PITRResult summarizes a completed point-in-time recovery
+type PITRResult struct {
+	Plan        *PITRPlan
+	Manifest    *Manifest
+	Location    string
+	Replayed    int
+	Skipped     int
+	LastApplied time.Time
+	Warnings    []string
+}
+
+// PlanPointInTime selects the base snapshot (latest backup taken at or before
+// target) and the WAL archive (earliest backup with a WAL taken at or after target)
+func PlanPointInTime(ctx context.Context, store ObjectStore, nodeID string, target time.Time) (*PITRPlan, error) {
+	catalog, err := ReadCatalog(ctx, store, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(catalog) == 0 {
+		return nil, fmt.Errorf("no backups found for node %s", nodeID)
+	}
+
+	plan := &PITRPlan{NodeID: nodeID, Target: target}
+
+	foundBase := false
+	for _, entry := range catalog {
+		if !entry.CreatedAt.After(target) {
+			plan.Base = entry
+			foundBase = true
+		}
+	}
+	if !foundBase {
+		return nil, fmt.Errorf("no snapshot taken at or before %s (oldest is %s)",
+			target.Format(time.RFC3339), catalog[0].CreatedAt.Format(time.RFC3339))
+	}
+
+	foundWAL := false
+	for _, entry := range catalog {
+		if entry.HasWAL && !entry.CreatedAt.Before(target) {
+			plan.WAL = entry
+			foundWAL = true
+			break
+		}
+	}
+	if !foundWAL {
+		return nil, fmt.Errorf("no archived WAL covers %s; take a backup after that time first",
+			target.Format(time.RFC3339))
+	}
+
+	return plan, nil
+}
+
+// RecoverToPointInTime rebuilds a node's state as of target (optionally only
+// keys under prefix) from archived snapshots and WAL, verifying checksums of
+// everything it downloads. The result is uploaded as a new backup under
+// <dest>/<nodeID>/pitr-<target>/ that dhtnode can restore with -restore-from.
+func RecoverToPointInTime(ctx context.Context, dest, nodeID string, target time.Time, prefix, workDir string) (*PITRResult, error) {
+	store, err := Open(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := PlanPointInTime(ctx, store, nodeID, target)
+	if err != nil {
+		return nil, err
+	}
+	result := &PITRResult{Plan: plan}
+
+	// Fetch and verify the base snapshot
+	var base Manifest
+	if err := getJSON(ctx, store, path.Join(nodeID, plan.Base.BackupID, manifestName), &base); err != nil {
+		return nil, fmt.Errorf("failed to read base manifest: %w", err)
+	}
+	snapPath := filepath.Join(workDir, fmt.Sprintf("%s-%s-base.gob", nodeID, base.BackupID))
+	if err := fetchVerified(ctx, store, path.Join(nodeID, base.BackupID, base.SnapshotFile), base.SHA256, snapPath); err != nil {
+		return nil, fmt.Errorf("base snapshot: %w", err)
+	}
+	defer os.Remove(snapPath)
+
+	// Fetch and verify the WAL archive
+	var walManifest Manifest
+	if err := getJSON(ctx, store, path.Join(nodeID, plan.WAL.BackupID, manifestName), &walManifest); err != nil {
+		return nil, fmt.Errorf("failed to read WAL manifest: %w", err)
+	}
+	walPath := filepath.Join(workDir, fmt.Sprintf("%s-%s-wal.log", nodeID, walManifest.BackupID))
+	if err := fetchVerified(ctx, store, path.Join(nodeID, walManifest.BackupID, walManifest.WALFile), walManifest.WALSHA256, walPath); err != nil {
+		return nil, fmt.Errorf("WAL archive: %w", err)
+	}
+	defer os.Remove(walPath)
+
+	// Build the recovered state
+	full := storage.NewStorage()
+	if _, err := storage.LoadSnapshot(snapPath, full); err != nil {
+		return nil, fmt.Errorf("failed to load base snapshot: %w", err)
+	}
+
+	recovered := full
+	if prefix != "" {
+		recovered = storage.NewStorage()
+		for key, entry := range full.GetAll() {
+			if strings.HasPrefix(key, prefix) {
+				recovered.SetEntry(entry)
+			}
+		}
+	}
+
+	replayFrom := base.CreatedAt.Add(-walOverlap)
+	firstSeen := time.Time{}
+	lastSeq := base.WALSeq // of the last entry up to target
+	now := time.Now()
+
+	walFile, err := os.Open(walPath)
+	if err != nil {
+		return nil, err
+	}
+	// replay applies a single SET/TOUCH/DELETE, returning false if it was skipped
+	replay := func(entry *storage.WALEntry) bool {
+		switch entry.Operation {
+		case "SET":
+			rec := &storage.Entry{
+				Key:        entry.Key,
+				Value:      entry.Value,
+				Owner:      entry.Owner,
+				Version:    entry.Seq,
+				CreatedAt:  entry.Timestamp,
+				UpdatedAt:  entry.Timestamp,
+				SlidingTTL: entry.WriteOptions().SlidingTTL,
+			}
+			if existing, err := recovered.GetEntry(entry.Key); err == nil {
+				rec.CreatedAt = existing.CreatedAt
+			}
+			if entry.TTL > 0 {
+				expiresAt := entry.Timestamp.Add(entry.TTL)
+				// Expired sliding keys are kept, a later TOUCH may extend them
+				if expiresAt.Before(now) && rec.SlidingTTL == 0 {
+					recovered.Delete(entry.Key)
+					return false
+				}
+				rec.ExpiresAt = &expiresAt
+			}
+			recovered.SetEntry(rec)
+		case "TOUCH":
+			recovered.SetExpiry(entry.Key, entry.Timestamp.Add(entry.TTL))
+		case "DELETE":
+			recovered.Delete(entry.Key)
+		}
+		return true
+	}
+
+	err = storage.ReadWAL(walFile, func(entry *storage.WALEntry) error {
+		// A compaction after the base snapshot dropped history replay needs
+		if entry.Operation == "COMPACT" {
+			if entry.Timestamp.After(base.CreatedAt) {
+				result.Warnings = append(result.Warnings, fmt.Sprintf(
+					"WAL was compacted at %s, after base snapshot %s; overwritten values and deletes before then may be missing",
+					entry.Timestamp.Format(time.RFC3339), base.CreatedAt.Format(time.RFC3339)))
+			}
+			return nil
+		}
+		if firstSeen.IsZero() {
+			firstSeen = entry.Timestamp
+		}
+		if entry.Timestamp.Before(replayFrom) || entry.Timestamp.After(target) {
+			return nil
+		}
+		lastSeq = max(lastSeq, entry.Seq)
+
+		// Committed transactions are replayed as their individual writes;
+		// prepared or aborted ones never changed a key
+		writes := []*storage.WALEntry{entry}
+		switch entry.Operation {
+		case "COMMIT":
+			var err error
+			if writes, err = entry.TxnWrites(); err != nil {
+				result.Warnings = append(result.Warnings, err.Error())
+			}
+		case "PREPARE", "ABORT":
+			return nil
+		}
+
+		for _, write := range writes {
+			if prefix != "" && !strings.HasPrefix(write.Key, prefix) {
+				continue
+			}
+			if !replay(write) {
+				result.Skipped++
+				continue
+			}
+			result.Replayed++
+			result.LastApplied = entry.Timestamp
+		}
+		return nil
+	})
+	walFile.Close()
+	if err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("WAL archive ends with a corrupted entry: %v", err))
+	}
+
+	// A WAL that starts after the base snapshot means writes may be missing
+	if !firstSeen.IsZero() && firstSeen.After(base.CreatedAt) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf(
+			"WAL archive starts at %s, after base snapshot %s; writes in between may be missing",
+			firstSeen.Format(time.RFC3339), base.CreatedAt.Format(time.RFC3339)))
+	}
+
+	// Write the recovered state as a new, restorable backup. It is kept out
+	// of the catalog so later recoveries never pick it (or a partial keyspace
+	// recovery) as their base.
+	outPath := filepath.Join(workDir, fmt.Sprintf("%s-pitr.gob", nodeID))
+	info, err := storage.WriteSnapshot(recovered, outPath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(outPath)
+	info.CreatedAt = target
+	info.WALSeq = lastSeq
+
+	manifest, location, err := upload(ctx, store, nodeID, "pitr-"+NewBackupID(target), info, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Manifest = manifest
+	result.Location = location
+	return result, nil
+}
@@ -0,0 +1,248 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by ObjectStore.Get when an object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// ObjectStore is the minimal blob interface backups are written to
+type ObjectStore interface {
+	Put(ctx context.Context, name string, r io.Reader) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	URI(name string) string
+}
+
+// Open returns an ObjectStore for the given URI
+// Supported schemes:
+//   - file:///path/to/dir (local disk or a mounted bucket)
+//   - http(s)://host/bucket/prefix (S3-compatible endpoints accepting plain PUT/GET)
+func Open(uri string) (ObjectStore, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup URI: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		root := u.Path
+		if root == "" {
+			return nil, fmt.Errorf("file URI must include a path")
+		}
+		return &FileStore{root: root}, nil
+	case "http", "https":
+		return &HTTPStore{
+			baseURL: strings.TrimRight(uri, "/"),
+			client:  &http.Client{Timeout: 5 * time.Minute},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported backup URI scheme %q", u.Scheme)
+	}
+}
+
+// DestinationPolicy limits the destinations a node may be asked to write
+// backups to to the ones the operator configured. The zero policy accepts no
+// destinations at all.
+type DestinationPolicy struct {
+	// file:// destinations must lie inside Root
+	Root string
+	// http(s):// destinations must lie under one of these base URLs
+	URLs []string
+}
+
+// Validate checks that a destination uses a supported scheme and lies where
+// the policy allows
+func (p DestinationPolicy) Validate(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid backup URI: %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return fmt.Errorf("file URI must include a path")
+		}
+		if p.Root == "" {
+			return fmt.Errorf("file backup destinations are not enabled on this node")
+		}
+		if !within(p.Root, u.Path) {
+			return fmt.Errorf("file backup destination must be inside %s", p.Root)
+		}
+		// A symlink inside the root must not lead out of it
+		root, err := filepath.EvalSymlinks(p.Root)
+		if err != nil {
+			return fmt.Errorf("failed to read backup root: %w", err)
+		}
+		if resolved, err := resolveExisting(u.Path); err != nil || !within(root, resolved) {
+			return fmt.Errorf("file backup destination must be inside %s", p.Root)
+		}
+	case "http", "https":
+		if len(p.URLs) == 0 {
+			return fmt.Errorf("http backup destinations are not enabled on this node")
+		}
+		for _, allowed := range p.URLs {
+			if under(allowed, u) {
+				return nil
+			}
+		}
+		return fmt.Errorf("http backup destination must be under one of %s", strings.Join(p.URLs, ", "))
+	default:
+		return fmt.Errorf("unsupported backup URI scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// within reports whether path is dir or lies inside it
+func within(dir, path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveExisting resolves the symlinks in the part of path that exists; the
+// rest is created by the backup
+func resolveExisting(path string) (string, error) {
+	path = filepath.Clean(path)
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(path)}, missing...)
+		path = parent
+	}
+}
+
+// under reports whether u is base or lies below it, on a path segment boundary
+func under(base string, u *url.URL) bool {
+	b, err := url.Parse(strings.TrimRight(base, "/"))
+	if err != nil || b.Scheme != u.Scheme || !strings.EqualFold(b.Host, u.Host) {
+		return false
+	}
+	dest := path.Clean("/" + u.Path)
+	prefix := path.Clean("/" + b.Path)
+	return prefix == "/" || dest == prefix || strings.HasPrefix(dest, prefix+"/")
+}
+
+// FileStore stores objects as files under a root directory
+type FileStore struct {
+	root string
+}
+
+// Put writes an object atomically (temp file + rename)
+func (f *FileStore) Put(ctx context.Context, name string, r io.Reader) error {
+	path := filepath.Join(f.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create object: %w", err)
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync object: %w", err)
+	}
+	file.Close()
+
+	return os.Rename(tmpPath, path)
+}
+
+// Get opens an object for reading
+func (f *FileStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(f.root, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// URI returns the URI of an object
+func (f *FileStore) URI(name string) string {
+	return "file://" + filepath.ToSlash(filepath.Join(f.root, filepath.FromSlash(name)))
+}
+
+// HTTPStore stores objects with plain HTTP PUT/GET requests
+type HTTPStore struct {
+	baseURL string
+	client  *http.Client
+}
+
+// Put uploads an object
+func (h *HTTPStore) Put(ctx context.Context, name string, r io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", h.URI(name), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload object: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("upload of %s failed with status %d", name, resp.StatusCode)
+	}
+	return nil
+}
+
+// Get downloads an object
+func (h *HTTPStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", h.URI(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download of %s failed with status %d", name, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// URI returns the URI of an object
+func (h *HTTPStore) URI(name string) string {
+	return h.baseURL + "/" + strings.TrimLeft(name, "/")
+}
@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDestinationPolicy(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	policy := DestinationPolicy{Root: root, URLs: []string{"https://s3.example.com/dht-backups/"}}
+
+	tests := []struct {
+		name   string
+		policy DestinationPolicy
+		uri    string
+		ok     bool
+	}{
+		{name: "root", policy: policy, uri: "file://" + root, ok: true},
+		{name: "inside root", policy: policy, uri: "file://" + root + "/cluster-a", ok: true},
+		{name: "outside root", policy: policy, uri: "file://" + outside},
+		{name: "dot dot out of root", policy: policy, uri: "file://" + root + "/../etc"},
+		{name: "symlink out of root", policy: policy, uri: "file://" + root + "/escape/cluster-a"},
+		{name: "sibling with root as prefix", policy: policy, uri: "file://" + root + "-other"},
+		{name: "file disabled", policy: DestinationPolicy{URLs: policy.URLs}, uri: "file://" + root},
+		{name: "base url", policy: policy, uri: "https://s3.example.com/dht-backups", ok: true},
+		{name: "below base url", policy: policy, uri: "https://s3.example.com/dht-backups/cluster-a", ok: true},
+		{name: "other bucket", policy: policy, uri: "https://s3.example.com/other"},
+		{name: "bucket with base as prefix", policy: policy, uri: "https://s3.example.com/dht-backups-evil"},
+		{name: "dot dot out of base url", policy: policy, uri: "https://s3.example.com/dht-backups/../other"},
+		{name: "other host", policy: policy, uri: "https://attacker.example.com/dht-backups"},
+		{name: "plain http", policy: policy, uri: "http://s3.example.com/dht-backups"},
+		{name: "http disabled", policy: DestinationPolicy{Root: root}, uri: "https://s3.example.com/dht-backups"},
+		{name: "unsupported scheme", policy: policy, uri: "ftp://s3.example.com/dht-backups"},
+		{name: "zero policy", uri: "file://" + root},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate(tt.uri)
+			if tt.ok && err != nil {
+				t.Fatalf("Validate(%q) = %v, want accepted", tt.uri, err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("Validate(%q) accepted, want rejected", tt.uri)
+			}
+		})
+	}
+}
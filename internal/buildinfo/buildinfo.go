@@ -0,0 +1,103 @@
+package buildinfo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// Set at build time with
+//
+//	go build -ldflags "-X dht/internal/buildinfo.Version=v1.4.0 \
+//	  -X dht/internal/buildinfo.GitSHA=$(git rev-parse HEAD) \
+//	  -X dht/internal/buildinfo.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without ldflags the VCS details the go command stamps into the binary are
+// used where available.
+var (
+	Version   = "dev"
+	GitSHA    = ""
+	BuildTime = ""
+)
+
+// started is when the process started serving, near enough
+var started = time.Now()
+
+// Info describes the running build of a service
+type Info struct {
+	Service           string    `json:"service"`
+	Version           string    `json:"version"`
+	GitSHA            string    `json:"git_sha"`
+	BuildTime         string    `json:"build_time"`
+	GoVersion         string    `json:"go_version"`
+	StartedAt         time.Time `json:"started_at"`
+	Uptime            string    `json:"uptime"`
+	UptimeSeconds     int64     `json:"uptime_seconds"`
+	ConfigFingerprint string    `json:"config_fingerprint"`
+}
+
+// Get returns the build and uptime of service; fingerprint identifies the
+// configuration it runs with (see Fingerprint)
+func Get(service, fingerprint string) Info {
+	sha, builtAt := GitSHA, BuildTime
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && sha == "":
+				sha = setting.Value
+			case setting.Key == "vcs.time" && builtAt == "":
+				builtAt = setting.Value
+			}
+		}
+	}
+	if sha == "" {
+		sha = "unknown"
+	}
+	if builtAt == "" {
+		builtAt = "unknown"
+	}
+
+	uptime := time.Since(started)
+	return Info{
+		Service:           service,
+		Version:           Version,
+		GitSHA:            sha,
+		BuildTime:         builtAt,
+		GoVersion:         runtime.Version(),
+		StartedAt:         started.UTC(),
+		Uptime:            uptime.Round(time.Second).String(),
+		UptimeSeconds:     int64(uptime.Seconds()),
+		ConfigFingerprint: fingerprint,
+	}
+}
+
+// Fingerprint returns a short hash of a service's settings, so operators can
+// tell whether two instances run with the same configuration. Secrets must
+// be left out of settings by the caller.
+func Fingerprint(settings map[string]string) string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%q\n", key, settings[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// Handler serves GET /version
+func Handler(service, fingerprint string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Get(service, fingerprint))
+	}
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Problem is a setting Validate found invalid or unsafe
+type Problem struct {
+	Setting string
+	Message string
+
+	// Unsafe settings work, so they are only warned about outside production;
+	// anything else is always an error
+	Unsafe bool
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Setting, p.Message)
+}
+
+// Production reports whether ENV=production, where unsafe settings are errors
+func (c *Config) Production() bool {
+	return strings.EqualFold(c.Env, "production")
+}
+
+// Validate returns the problems with the settings service ("gateway",
+// "usermanager" or "replicator") uses
+func (c *Config) Validate(service string) []Problem {
+	var problems []Problem
+	invalid := func(setting, format string, args ...interface{}) {
+		problems = append(problems, Problem{Setting: setting, Message: fmt.Sprintf(format, args...)})
+	}
+	unsafe := func(setting, format string, args ...interface{}) {
+		problems = append(problems, Problem{Setting: setting, Message: fmt.Sprintf(format, args...), Unsafe: true})
+	}
+
+	for _, setting := range c.malformed {
+		unsafe(setting, "value could not be parsed, using the default")
+	}
+
+	// Every service makes backend calls with these
+	if c.HTTPMaxRetries < 0 {
+		invalid("HTTP_MAX_RETRIES", "must not be negative")
+	}
+	if c.HTTPRetryBackoff < 0 {
+		invalid("HTTP_RETRY_BACKOFF", "must not be negative")
+	}
+	if c.ServerReadTimeout <= 0 || c.ServerWriteTimeout <= 0 || c.ServerIdleTimeout <= 0 {
+		unsafe("SERVER_*_TIMEOUT", "a timeout of 0 lets slow clients hold connections forever")
+	}
+	if c.HTTP2MaxConcurrentStreams < 1 {
+		invalid("HTTP2_MAX_CONCURRENT_STREAMS", "must be at least 1")
+	}
+
+	// The usermanager accepts tenant KMS references and the gateway resolves them
+	if (service == "usermanager" || service == "gateway") && c.TenantKMSKeyDir != "" {
+		if !filepath.IsAbs(c.TenantKMSKeyDir) {
+			invalid("TENANT_KMS_KEY_DIR", "must be an absolute path")
+		} else if filepath.Clean(c.TenantKMSKeyDir) == "/" {
+			unsafe("TENANT_KMS_KEY_DIR", "lets tenants use any file on the host as their key")
+		}
+	}
+
+	switch service {
+	case "usermanager":
+		if c.DatabaseURL == DefaultDatabaseURL {
+			unsafe("DATABASE_URL", "not set, using the local development database")
+		}
+		if c.JWTSecret == DefaultJWTSecret {
+			unsafe("JWT_SECRET", "not set, using the insecure default secret")
+		} else if len(c.JWTSecret) < 32 {
+			unsafe("JWT_SECRET", "shorter than 32 bytes")
+		}
+		if c.JWTExpiration <= 0 {
+			invalid("JWT_EXPIRATION", "must be positive")
+		}
+		if !c.OpenSignup && c.AdminToken == "" {
+			unsafe("OPEN_SIGNUP", "signup is invitation-only but ADMIN_TOKEN is not set, so no invitations can be created")
+		}
+		if c.SignupURL != "" {
+			if u, err := url.Parse(c.SignupURL); err != nil || u.Scheme == "" || u.Host == "" {
+				invalid("SIGNUP_URL", "must be an absolute URL")
+			}
+		}
+		if c.PurgeInterval < 0 {
+			invalid("PURGE_INTERVAL", "must not be negative (0 disables the purge)")
+		}
+		if c.PurgeMode != "anonymize" && c.PurgeMode != "delete" {
+			invalid("PURGE_MODE", "unknown mode %q (use anonymize or delete)", c.PurgeMode)
+		}
+		if c.PurgeUserRetention < 0 {
+			invalid("PURGE_USER_RETENTION", "must not be negative")
+		}
+		if c.PurgeSessionRetention < 0 {
+			invalid("PURGE_SESSION_RETENTION", "must not be negative")
+		}
+		if c.PurgeUsagePIIRetention < 0 {
+			invalid("PURGE_USAGE_PII_RETENTION", "must not be negative")
+		}
+		if c.PurgeMode == "delete" && c.PurgeUserRetention < 24*time.Hour {
+			unsafe("PURGE_USER_RETENTION", "%v leaves under a day to restore an account deleted by mistake", c.PurgeUserRetention)
+		}
+
+	case "gateway":
+		if c.NodeDiscovery != "static" && c.NodeDiscovery != "kubernetes" {
+			invalid("NODE_DISCOVERY", "unknown discovery %q (use static or kubernetes)", c.NodeDiscovery)
+		}
+		if c.InternalEncoding != "protobuf" && c.InternalEncoding != "json" {
+			invalid("INTERNAL_ENCODING", "unknown encoding %q (use protobuf or json)", c.InternalEncoding)
+		}
+		if c.ReadTimeout <= 0 {
+			invalid("READ_TIMEOUT", "must be positive")
+		}
+		if c.WriteTimeout <= 0 {
+			invalid("WRITE_TIMEOUT", "must be positive")
+		}
+		if c.AuthTimeout <= 0 {
+			invalid("AUTH_TIMEOUT", "must be positive")
+		} else if c.ReadTimeout > 0 && c.AuthTimeout >= c.ReadTimeout {
+			unsafe("AUTH_TIMEOUT", "%v leaves no time of READ_TIMEOUT (%v) for the read itself", c.AuthTimeout, c.ReadTimeout)
+		}
+		if c.ServerWriteTimeout > 0 && c.ServerWriteTimeout < c.WriteTimeout {
+			unsafe("SERVER_WRITE_TIMEOUT", "%v closes connections before WRITE_TIMEOUT (%v) expires", c.ServerWriteTimeout, c.WriteTimeout)
+		}
+		if c.ReplicationTimeout > 0 && c.WriteTimeout > 0 && c.ReplicationTimeout >= c.WriteTimeout {
+			unsafe("REPLICATION_TIMEOUT", "%v is not below WRITE_TIMEOUT (%v), so strong writes time out before their replicas answer", c.ReplicationTimeout, c.WriteTimeout)
+		}
+		if c.TxnIntentTimeout <= 0 {
+			invalid("TXN_INTENT_TIMEOUT", "must be positive")
+		} else if c.WriteTimeout > 0 && c.WriteTimeout >= c.TxnIntentTimeout {
+			unsafe("TXN_INTENT_TIMEOUT", "%v leaves no time after WRITE_TIMEOUT (%v) to retry a failed commit before the decision node aborts the transaction", c.TxnIntentTimeout, c.WriteTimeout)
+		}
+		if c.HeartbeatInterval <= 0 {
+			invalid("HEARTBEAT_INTERVAL", "must be positive")
+		}
+		if c.PhiThreshold <= 0 {
+			invalid("PHI_THRESHOLD", "must be positive")
+		}
+		if c.NodeEvictionGrace < 0 {
+			invalid("NODE_EVICTION_GRACE", "must not be negative (0 disables eviction)")
+		} else if c.NodeEvictionGrace > 0 && c.NodeEvictionGrace < 10*c.HeartbeatInterval {
+			unsafe("NODE_EVICTION_GRACE", "%v is under 10 heartbeats (%v each); a briefly slow node would be evicted", c.NodeEvictionGrace, c.HeartbeatInterval)
+		}
+		if c.NegativeCacheSize < 0 {
+			invalid("NEGATIVE_CACHE_SIZE", "must not be negative")
+		}
+		if c.DefaultStorageQuota < 0 {
+			invalid("DEFAULT_STORAGE_QUOTA", "must not be negative (0 = unlimited)")
+		}
+		if c.CanaryInterval < 0 {
+			invalid("CANARY_INTERVAL", "must not be negative (0 disables the canary)")
+		}
+		if c.CanarySampleKeys < 0 || c.CanarySampleKeys > 1000 {
+			invalid("CANARY_SAMPLE_KEYS", "must be between 0 and 1000")
+		}
+		if c.CanaryMaxStaleness <= 0 {
+			invalid("CANARY_MAX_STALENESS", "must be positive")
+		} else if c.CanaryInterval > 0 && 2*c.CanaryMaxStaleness >= c.CanaryInterval {
+			unsafe("CANARY_MAX_STALENESS", "%v leaves no time between canary passes every %v (a pass can wait twice this long)", c.CanaryMaxStaleness, c.CanaryInterval)
+		}
+		if c.CanaryAlertWebhook != "" {
+			if u, err := url.Parse(c.CanaryAlertWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				invalid("CANARY_ALERT_WEBHOOK", "must be an http or https URL")
+			}
+		}
+		if c.AdminToken != "" && len(c.AdminToken) < 16 {
+			unsafe("ADMIN_TOKEN", "shorter than 16 bytes")
+		}
+		if c.ScopedTokenSecret != "" {
+			if len(c.ScopedTokenSecret) < 32 {
+				unsafe("SCOPED_TOKEN_SECRET", "shorter than 32 bytes")
+			}
+			if c.ScopedTokenSecret == c.JWTSecret {
+				unsafe("SCOPED_TOKEN_SECRET", "same as JWT_SECRET")
+			}
+		}
+		if c.ScopedTokenMaxTTL <= 0 {
+			invalid("SCOPED_TOKEN_MAX_TTL", "must be positive")
+		} else if c.ScopedTokenMaxTTL > 24*time.Hour {
+			unsafe("SCOPED_TOKEN_MAX_TTL", "%v lets tokens meant for short jobs live for over a day", c.ScopedTokenMaxTTL)
+		}
+
+	case "replicator":
+		if c.ReplicationTimeout <= 0 {
+			invalid("REPLICATION_TIMEOUT", "must be positive")
+		}
+	}
+
+	return problems
+}
+
+// Check validates the settings of service at startup. Unsafe settings are
+// logged as warnings, except in production where they fail like invalid
+// ones; the returned error lists every failing setting.
+func (c *Config) Check(service string) error {
+	var failed []string
+	for _, p := range c.Validate(service) {
+		if p.Unsafe && !c.Production() {
+			log.Printf("WARNING: unsafe configuration: %s (fails with ENV=production)\n", p)
+			continue
+		}
+		failed = append(failed, p.String())
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("invalid configuration for %s: %s", service, strings.Join(failed, "; "))
+	}
+	return nil
+}
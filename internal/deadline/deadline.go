@@ -0,0 +1,53 @@
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header carries the caller's remaining time budget in milliseconds. A
+// relative budget, unlike an absolute deadline, is immune to clock skew
+// between hosts.
+const Header = "X-Request-Timeout"
+
+// Middleware applies the budget sent by the caller to the request context,
+// so the request and every call it makes give up when the caller does
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, err := strconv.ParseInt(r.Header.Get(Header), 10, 64)
+		if err != nil || ms <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Transport sends the time left until the deadline of each outgoing
+// request's context as the X-Request-Timeout header
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if deadline, ok := req.Context().Deadline(); ok {
+		remaining := time.Until(deadline).Milliseconds()
+		if remaining < 1 {
+			remaining = 1
+		}
+		// RoundTrippers must not modify the caller's request
+		req = req.Clone(req.Context())
+		req.Header.Set(Header, strconv.FormatInt(remaining, 10))
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,218 @@
+// Package delta implements the binary delta format used to update part of a
+// large value without sending all of it again.
+//
+// A delta is the magic "DHTD", a format version byte (1) and a list of
+// operations applied in order to the current value. Every operation starts
+// with a one-byte code; numbers are unsigned LEB128 varints (as written by
+// encoding/binary.PutUvarint) and offsets refer to the value as left by the
+// operations before:
+//
+//	'W' offset length data   overwrite from offset, extending the value past its end
+//	'I' offset length data   insert data at offset
+//	'D' offset length        remove length bytes at offset
+//	'T' length               truncate the value to length bytes
+//
+// An offset may be the value's length (its end) but not beyond.
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ContentType is the media type of a delta
+const ContentType = "application/vnd.dht.delta"
+
+// Version is the format version written after the magic
+const Version = 1
+
+const magic = "DHTD"
+
+// Operation codes
+const (
+	OpWrite    byte = 'W'
+	OpInsert   byte = 'I'
+	OpDelete   byte = 'D'
+	OpTruncate byte = 'T'
+)
+
+var (
+	// ErrInvalid is returned for a delta that cannot be decoded
+	ErrInvalid = errors.New("invalid delta")
+	// ErrOutOfRange is returned when an operation reaches past the value
+	ErrOutOfRange = errors.New("delta operation out of range")
+)
+
+// Delta builds a delta
+type Delta struct {
+	buf bytes.Buffer
+}
+
+// New starts an empty delta
+func New() *Delta {
+	d := &Delta{}
+	d.buf.WriteString(magic)
+	d.buf.WriteByte(Version)
+	return d
+}
+
+// Write overwrites the value from offset with data
+func (d *Delta) Write(offset int, data []byte) *Delta {
+	d.op(OpWrite, offset, len(data))
+	d.buf.Write(data)
+	return d
+}
+
+// Insert inserts data at offset
+func (d *Delta) Insert(offset int, data []byte) *Delta {
+	d.op(OpInsert, offset, len(data))
+	d.buf.Write(data)
+	return d
+}
+
+// Delete removes length bytes at offset
+func (d *Delta) Delete(offset, length int) *Delta {
+	d.op(OpDelete, offset, length)
+	return d
+}
+
+// Truncate cuts the value to length bytes
+func (d *Delta) Truncate(length int) *Delta {
+	d.buf.WriteByte(OpTruncate)
+	d.uvarint(length)
+	return d
+}
+
+// Bytes returns the encoded delta
+func (d *Delta) Bytes() []byte {
+	return d.buf.Bytes()
+}
+
+func (d *Delta) op(code byte, offset, length int) {
+	d.buf.WriteByte(code)
+	d.uvarint(offset)
+	d.uvarint(length)
+}
+
+func (d *Delta) uvarint(n int) {
+	var scratch [binary.MaxVarintLen64]byte
+	d.buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(n))])
+}
+
+// Stats summarizes an applied delta
+type Stats struct {
+	Operations int `json:"operations"`
+	// Bytes is how much new data the delta carried
+	Bytes int `json:"bytes"`
+}
+
+// Apply returns base with the delta applied; base is not modified
+func Apply(base, delta []byte) ([]byte, *Stats, error) {
+	if len(delta) < len(magic)+1 || string(delta[:len(magic)]) != magic {
+		return nil, nil, fmt.Errorf("%w: missing %q header", ErrInvalid, magic)
+	}
+	if delta[len(magic)] != Version {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalid, delta[len(magic)])
+	}
+
+	r := &reader{data: delta, pos: len(magic) + 1}
+	value := make([]byte, len(base), len(base)+len(delta))
+	copy(value, base)
+	stats := &Stats{}
+
+	for r.pos < len(r.data) {
+		code := r.data[r.pos]
+		r.pos++
+		stats.Operations++
+
+		switch code {
+		case OpWrite, OpInsert:
+			offset, data, err := r.span()
+			if err != nil {
+				return nil, nil, err
+			}
+			if offset > len(value) {
+				return nil, nil, fmt.Errorf("%w: operation %d writes at offset %d of a %d byte value", ErrOutOfRange, stats.Operations, offset, len(value))
+			}
+			stats.Bytes += len(data)
+			if code == OpInsert {
+				// data is part of the delta, so shift the tail in place
+				// rather than appending to it
+				tail := len(value) - offset
+				value = append(value, data...)
+				copy(value[offset+len(data):], value[offset:offset+tail])
+				copy(value[offset:], data)
+				continue
+			}
+			if end := offset + len(data); end > len(value) {
+				value = append(value, make([]byte, end-len(value))...)
+			}
+			copy(value[offset:], data)
+
+		case OpDelete:
+			offset, err := r.uvarint()
+			if err != nil {
+				return nil, nil, err
+			}
+			length, err := r.uvarint()
+			if err != nil {
+				return nil, nil, err
+			}
+			if offset > len(value) || length > len(value)-offset {
+				return nil, nil, fmt.Errorf("%w: operation %d deletes %d bytes at offset %d of a %d byte value", ErrOutOfRange, stats.Operations, length, offset, len(value))
+			}
+			value = append(value[:offset], value[offset+length:]...)
+
+		case OpTruncate:
+			length, err := r.uvarint()
+			if err != nil {
+				return nil, nil, err
+			}
+			if length > len(value) {
+				return nil, nil, fmt.Errorf("%w: operation %d truncates a %d byte value to %d bytes", ErrOutOfRange, stats.Operations, len(value), length)
+			}
+			value = value[:length]
+
+		default:
+			return nil, nil, fmt.Errorf("%w: unknown operation %q at byte %d", ErrInvalid, code, r.pos-1)
+		}
+	}
+
+	return value, stats, nil
+}
+
+// reader decodes the operands of a delta
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) uvarint() (int, error) {
+	n, size := binary.Uvarint(r.data[r.pos:])
+	if size <= 0 || n > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: bad number at byte %d", ErrInvalid, r.pos)
+	}
+	r.pos += size
+	return int(n), nil
+}
+
+// span reads an offset and the data following its length
+func (r *reader) span() (int, []byte, error) {
+	offset, err := r.uvarint()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := r.uvarint()
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > len(r.data)-r.pos {
+		return 0, nil, fmt.Errorf("%w: operation data runs past the end", ErrInvalid)
+	}
+	data := r.data[r.pos : r.pos+length]
+	r.pos += length
+	return offset, data, nil
+}
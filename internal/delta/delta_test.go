@@ -0,0 +1,114 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	base := []byte("hello, world")
+	tests := []struct {
+		name  string
+		base  []byte
+		delta []byte
+		want  []byte
+		ops   int
+		err   error
+	}{
+		{name: "no operations", base: base, delta: New().Bytes(), want: base},
+		{name: "no operations on an empty value", delta: New().Bytes(), want: []byte{}},
+		{name: "identical overwrite", base: base, delta: New().Write(0, base).Bytes(), want: base, ops: 1},
+		{name: "overwrite", base: base, delta: New().Write(7, []byte("there")).Bytes(), want: []byte("hello, there"), ops: 1},
+		{name: "overwrite past the end grows the value", base: base, delta: New().Write(7, []byte("everyone")).Bytes(), want: []byte("hello, everyone"), ops: 1},
+		{name: "write at the end appends", base: base, delta: New().Write(len(base), []byte("!")).Bytes(), want: []byte("hello, world!"), ops: 1},
+		{name: "insert", base: base, delta: New().Insert(5, []byte(" there")).Bytes(), want: []byte("hello there, world"), ops: 1},
+		{name: "insert at the start", base: base, delta: New().Insert(0, []byte(">> ")).Bytes(), want: []byte(">> hello, world"), ops: 1},
+		{name: "delete", base: base, delta: New().Delete(5, 7).Bytes(), want: []byte("hello"), ops: 1},
+		{name: "delete nothing at the end", base: base, delta: New().Delete(len(base), 0).Bytes(), want: base, ops: 1},
+		{name: "truncate", base: base, delta: New().Truncate(5).Bytes(), want: []byte("hello"), ops: 1},
+		{name: "fully different", base: base, delta: New().Truncate(0).Write(0, []byte("something else entirely")).Bytes(), want: []byte("something else entirely"), ops: 2},
+		{name: "build an empty value up", delta: New().Insert(0, []byte("world")).Insert(0, []byte("hello, ")).Bytes(), want: base, ops: 2},
+		{name: "offsets follow earlier operations", base: base, delta: New().Delete(0, 7).Insert(5, []byte("!")).Write(0, []byte("W")).Bytes(), want: []byte("World!"), ops: 3},
+
+		{name: "write past the end", base: base, delta: New().Write(len(base)+1, []byte("x")).Bytes(), err: ErrOutOfRange},
+		{name: "insert past the end", base: base, delta: New().Insert(len(base)+1, []byte("x")).Bytes(), err: ErrOutOfRange},
+		{name: "delete past the end", base: base, delta: New().Delete(10, 3).Bytes(), err: ErrOutOfRange},
+		{name: "truncate to more than the value", base: base, delta: New().Truncate(len(base) + 1).Bytes(), err: ErrOutOfRange},
+		{name: "later operation out of range", base: base, delta: New().Truncate(2).Delete(0, 3).Bytes(), err: ErrOutOfRange},
+
+		{name: "empty body", base: base, delta: nil, err: ErrInvalid},
+		{name: "magic only", base: base, delta: []byte("DHTD"), err: ErrInvalid},
+		{name: "wrong magic", base: base, delta: []byte("DHTX\x01"), err: ErrInvalid},
+		{name: "unsupported version", base: base, delta: []byte("DHTD\x02"), err: ErrInvalid},
+		{name: "unknown operation", base: base, delta: append(New().Bytes(), 'X'), err: ErrInvalid},
+		{name: "missing operands", base: base, delta: append(New().Bytes(), OpDelete, 1), err: ErrInvalid},
+		{name: "unterminated varint", base: base, delta: append(New().Bytes(), OpTruncate, 0x80), err: ErrInvalid},
+		{name: "length beyond int32", base: base, delta: append(New().Bytes(), OpTruncate, 0xff, 0xff, 0xff, 0xff, 0x0f), err: ErrInvalid},
+		{name: "data shorter than its length", base: base, delta: append(New().Bytes(), OpWrite, 0, 10, 'a', 'b'), err: ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := bytes.Clone(tt.base)
+			got, stats, err := Apply(tt.base, tt.delta)
+			if !bytes.Equal(tt.base, original) {
+				t.Fatalf("Apply modified the base value: %q", tt.base)
+			}
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Apply: %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("Apply = %q, want %q", got, tt.want)
+			}
+			if stats.Operations != tt.ops {
+				t.Fatalf("%d operations, want %d", stats.Operations, tt.ops)
+			}
+		})
+	}
+}
+
+// TestApplyTruncated cuts a valid delta at every length: each prefix is
+// either a shorter valid delta or rejected as invalid, never out of range or
+// a panic
+func TestApplyTruncated(t *testing.T) {
+	base := []byte("hello, world")
+	full := New().Write(7, []byte("there")).Insert(0, []byte(">> ")).Delete(2, 1).Truncate(8).Bytes()
+	want := []byte(">>hello,")
+	if got, _, err := Apply(base, full); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("Apply(full) = %q, %v; want %q", got, err, want)
+	}
+
+	for n := 0; n < len(full); n++ {
+		_, _, err := Apply(base, full[:n])
+		if err != nil && !errors.Is(err, ErrInvalid) {
+			t.Fatalf("Apply(first %d bytes): %v, want nil or %v", n, err, ErrInvalid)
+		}
+	}
+}
+
+// TestApplyCorrupt flips every byte of a valid delta: each result is applied
+// or rejected with one of the package's errors, never a panic
+func TestApplyCorrupt(t *testing.T) {
+	base := []byte("hello, world")
+	full := New().Write(7, []byte("there")).Insert(0, []byte(">> ")).Delete(2, 1).Truncate(8).Bytes()
+
+	for i := range full {
+		for _, flip := range []byte{0x01, 0x80, 0xff} {
+			corrupt := bytes.Clone(full)
+			corrupt[i] ^= flip
+			_, _, err := Apply(base, corrupt)
+			if err != nil && !errors.Is(err, ErrInvalid) && !errors.Is(err, ErrOutOfRange) {
+				t.Fatalf("byte %d ^ %#x: %v", i, flip, err)
+			}
+			if i < len(magic)+1 && err == nil {
+				t.Fatalf("byte %d ^ %#x: a corrupt header was accepted", i, flip)
+			}
+		}
+	}
+}
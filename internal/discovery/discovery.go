@@ -0,0 +1,37 @@
+package discovery
+
+import "sort"
+
+// State is the lifecycle state of a discovered node
+type State int
+
+const (
+	// NotReady nodes exist but must not receive traffic yet
+	NotReady State = iota
+	// Ready nodes pass their readiness checks
+	Ready
+	// Terminating nodes are shutting down and should leave the ring
+	Terminating
+)
+
+func (s State) String() string {
+	switch s {
+	case Ready:
+		return "ready"
+	case Terminating:
+		return "terminating"
+	}
+	return "not_ready"
+}
+
+// ReadyNodes returns the ready nodes of states, sorted
+func ReadyNodes(states map[string]State) []string {
+	nodes := make([]string, 0, len(states))
+	for node, state := range states {
+		if state == Ready {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
@@ -0,0 +1,343 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-cluster service account files
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultTokenFile  = serviceAccountDir + "/token"
+	defaultCAFile     = serviceAccountDir + "/ca.crt"
+	namespaceFile     = serviceAccountDir + "/namespace"
+)
+
+// watchTimeout makes the API server end each watch so it is re-established
+// regularly, even through proxies that drop idle connections silently
+const watchTimeout = 5 * time.Minute
+
+// errResourceExpired means the watch fell too far behind and must relist
+var errResourceExpired = errors.New("resource version expired")
+
+// KubernetesConfig selects the EndpointSlices of a (headless) Service
+type KubernetesConfig struct {
+	APIServer string // defaults to the in-cluster address
+	Namespace string // defaults to the gateway's own namespace
+	Service   string
+	PortName  string // endpoint port to use; empty picks the only port
+	Scheme    string // scheme of the node URLs, "http" by default
+	TokenFile string
+	CAFile    string
+}
+
+// Kubernetes discovers DHT nodes from the EndpointSlices of a Service
+type Kubernetes struct {
+	cfg    KubernetesConfig
+	client *http.Client
+
+	slices          map[string]map[string]State // slice name -> node URL -> state
+	resourceVersion string
+	mu              sync.Mutex
+}
+
+// NewKubernetes creates a provider using the pod's service account
+func NewKubernetes(cfg KubernetesConfig) (*Kubernetes, error) {
+	if cfg.Service == "" {
+		return nil, fmt.Errorf("service name is required")
+	}
+	if cfg.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a cluster (KUBERNETES_SERVICE_HOST is unset)")
+		}
+		cfg.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if cfg.Namespace == "" {
+		ns, err := os.ReadFile(namespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read namespace: %w", err)
+		}
+		cfg.Namespace = strings.TrimSpace(string(ns))
+	}
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = defaultTokenFile
+	}
+	if cfg.CAFile == "" {
+		cfg.CAFile = defaultCAFile
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if ca, err := os.ReadFile(cfg.CAFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+
+	return &Kubernetes{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport},
+		slices: make(map[string]map[string]State),
+	}, nil
+}
+
+// List fetches the current EndpointSlices and returns the state of every node
+func (k *Kubernetes) List(ctx context.Context) (map[string]State, error) {
+	resp, err := k.get(ctx, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing endpointslices failed with status %d", resp.StatusCode)
+	}
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointSlice `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid endpointslice list: %w", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.slices = make(map[string]map[string]State)
+	for _, slice := range list.Items {
+		k.slices[slice.Metadata.Name] = k.nodeStates(slice)
+	}
+	k.resourceVersion = list.Metadata.ResourceVersion
+	return k.merged(), nil
+}
+
+// Watch follows EndpointSlice changes until ctx is done, calling onChange
+// with the state of every node after each change. List must be called first.
+// Dropped watches are resumed, relisting when the API server no longer has
+// the last seen version.
+func (k *Kubernetes) Watch(ctx context.Context, onChange func(map[string]State)) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := k.watchOnce(ctx, onChange)
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if !errors.Is(err, errResourceExpired) {
+			log.Printf("Kubernetes discovery: watch failed: %v (retrying in %v)\n", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+
+		states, err := k.List(ctx)
+		if err != nil {
+			log.Printf("Kubernetes discovery: relist failed: %v\n", err)
+			continue
+		}
+		onChange(states)
+	}
+}
+
+// watchOnce runs a single watch request until the server ends it
+func (k *Kubernetes) watchOnce(ctx context.Context, onChange func(map[string]State)) error {
+	k.mu.Lock()
+	resourceVersion := k.resourceVersion
+	k.mu.Unlock()
+
+	resp, err := k.get(ctx, url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(watchTimeout.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return errResourceExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("watch failed with status %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// The server closes the stream when timeoutSeconds elapses
+			return nil
+		}
+
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return errResourceExpired
+			}
+			return fmt.Errorf("watch error %d: %s", status.Code, status.Message)
+		}
+
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return fmt.Errorf("invalid watch event: %w", err)
+		}
+
+		k.mu.Lock()
+		k.resourceVersion = slice.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			k.slices[slice.Metadata.Name] = k.nodeStates(slice)
+		case "DELETED":
+			delete(k.slices, slice.Metadata.Name)
+		default: // BOOKMARK only advances the resource version
+			k.mu.Unlock()
+			continue
+		}
+		states := k.merged()
+		k.mu.Unlock()
+
+		onChange(states)
+	}
+}
+
+// get requests the Service's EndpointSlices with extra query parameters
+func (k *Kubernetes) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	query.Set("labelSelector", "kubernetes.io/service-name="+k.cfg.Service)
+	reqURL := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		strings.TrimRight(k.cfg.APIServer, "/"), url.PathEscape(k.cfg.Namespace), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	// Projected tokens are rotated, so read it for every request
+	if token, err := os.ReadFile(k.cfg.TokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	return k.client.Do(req)
+}
+
+// nodeStates maps a slice's endpoints to node URLs; caller must hold k.mu
+func (k *Kubernetes) nodeStates(slice endpointSlice) map[string]State {
+	states := make(map[string]State)
+
+	port := 0
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
+		if name == k.cfg.PortName || (k.cfg.PortName == "" && len(slice.Ports) == 1) {
+			port = *p.Port
+			break
+		}
+	}
+	if port == 0 {
+		if len(slice.Endpoints) > 0 {
+			log.Printf("Kubernetes discovery: endpointslice %s has no port named %q\n", slice.Metadata.Name, k.cfg.PortName)
+		}
+		return states
+	}
+
+	for _, ep := range slice.Endpoints {
+		state := NotReady
+		switch {
+		case ep.Conditions.Terminating != nil && *ep.Conditions.Terminating:
+			state = Terminating
+		// An unknown readiness is to be treated as ready
+		case ep.Conditions.Ready == nil || *ep.Conditions.Ready:
+			state = Ready
+		}
+
+		// Every address of an endpoint belongs to the same pod
+		if len(ep.Addresses) > 0 {
+			node := k.cfg.Scheme + "://" + net.JoinHostPort(ep.Addresses[0], strconv.Itoa(port))
+			states[node] = state
+		}
+	}
+	return states
+}
+
+// merged combines the states from all slices; an endpoint briefly listed in
+// two slices takes the most advanced state. Caller must hold k.mu.
+func (k *Kubernetes) merged() map[string]State {
+	states := make(map[string]State)
+	for _, slice := range k.slices {
+		for node, state := range slice {
+			if current, exists := states[node]; !exists || state > current {
+				states[node] = state
+			}
+		}
+	}
+	return states
+}
+
+// endpointSlice holds the fields of a discovery.k8s.io/v1 EndpointSlice
+// that discovery needs
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
@@ -0,0 +1,272 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeySize is the size of data-encryption keys (AES-256)
+const KeySize = 32
+
+// magic prefixes every sealed value so encrypted and plaintext values can coexist
+var magic = []byte("ydenc1:")
+
+var (
+	// ErrWrongKey is returned when a value was sealed with a different key
+	ErrWrongKey = errors.New("value was encrypted with a different key")
+	// ErrCorrupt is returned when a sealed value fails authentication
+	ErrCorrupt = errors.New("encrypted value is corrupt or was tampered with")
+)
+
+// KeyID returns a short, non-secret fingerprint of a key
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// IsSealed reports whether data was produced by Seal
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Seal encrypts plaintext with AES-256-GCM. aad is authenticated but not
+// encrypted (the storage key, so a value can't be moved to another key).
+// Layout: magic | key id (8 bytes) | nonce | ciphertext+tag
+func Seal(key, aad, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	keyID := sha256.Sum256(key)
+	out := make([]byte, 0, len(magic)+8+len(nonce)+len(plaintext)+gcm.Overhead())
+	out = append(out, magic...)
+	out = append(out, keyID[:8]...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, aad), nil
+}
+
+// Open decrypts a value produced by Seal
+func Open(key, aad, sealed []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, ErrCorrupt
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	body := sealed[len(magic):]
+	if len(body) < 8+gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrCorrupt
+	}
+
+	keyID := sha256.Sum256(key)
+	if !bytes.Equal(body[:8], keyID[:8]) {
+		return nil, ErrWrongKey
+	}
+
+	nonce := body[8 : 8+gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, body[8+gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return plaintext, nil
+}
+
+// Wrap encrypts a data-encryption key with a key-encryption key for storage
+func Wrap(kek, dek []byte) (string, error) {
+	sealed, err := Seal(kek, []byte("dek"), dek)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Unwrap decrypts a key produced by Wrap
+func Unwrap(kek []byte, wrapped string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	return Open(kek, []byte("dek"), sealed)
+}
+
+// ParseKey decodes a base64 (or hex) encoded 256-bit key
+func ParseKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	// A hex key is also valid base64, decoding to the wrong size
+	if err != nil || len(key) != KeySize {
+		if decoded, hexErr := hex.DecodeString(encoded); hexErr == nil {
+			key, err = decoded, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key must be base64 or hex encoded")
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// maxKeyFileSize bounds how much of a key file is read; an encoded 32-byte
+// key with surrounding whitespace fits well within it
+const maxKeyFileSize = 1 << 10
+
+// reservedEnv are the variables holding the services' own secrets, which a
+// tenant must never be able to use (or fingerprint) as their key
+var reservedEnv = map[string]bool{
+	"ADMIN_TOKEN":             true,
+	"CANARY_ALERT_WEBHOOK":    true,
+	"DATABASE_URL":            true,
+	"DATA_KEY_ENCRYPTION_KEY": true,
+	"DHT_API_KEY":             true,
+	"JWT_SECRET":              true,
+	"SCOPED_TOKEN_SECRET":     true,
+}
+
+// KMSPolicy limits the keys tenants may reference to the ones the operator
+// provisioned for them. The zero policy accepts no references at all.
+type KMSPolicy struct {
+	// env:// references must name a variable starting with EnvPrefix
+	EnvPrefix string
+	// file:// references must name a file inside KeyDir
+	KeyDir string
+}
+
+// Validate checks that a KMS reference uses a supported scheme and points
+// at a key the policy allows
+func (p KMSPolicy) Validate(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid KMS URI: %w", err)
+	}
+	switch u.Scheme {
+	case "env":
+		if u.Host == "" {
+			return fmt.Errorf("env KMS URI must name a variable (env://VAR_NAME)")
+		}
+		if p.EnvPrefix == "" {
+			return fmt.Errorf("env KMS references are not enabled on this deployment")
+		}
+		if !strings.HasPrefix(u.Host, p.EnvPrefix) || reservedEnv[u.Host] {
+			return fmt.Errorf("env KMS URI must name a variable starting with %s", p.EnvPrefix)
+		}
+	case "file":
+		if u.Path == "" {
+			return fmt.Errorf("file KMS URI must include a path (file:///path/to/key)")
+		}
+		if p.KeyDir == "" {
+			return fmt.Errorf("file KMS references are not enabled on this deployment")
+		}
+		if !within(p.KeyDir, u.Path) {
+			return fmt.Errorf("file KMS URI must name a file in %s", p.KeyDir)
+		}
+	default:
+		return fmt.Errorf("unsupported KMS scheme %q (supported: env, file)", u.Scheme)
+	}
+	return nil
+}
+
+// Resolve loads the key a KMS reference points to. Key material stays
+// on the host resolving it (e.g. a secret mounted into the gateway) and is
+// never sent to the usermanager.
+//   - env://VAR_NAME      base64/hex key in an environment variable
+//   - file:///path/to/key base64/hex key in a file
+func (p KMSPolicy) Resolve(uri string) ([]byte, error) {
+	if err := p.Validate(uri); err != nil {
+		return nil, err
+	}
+
+	u, _ := url.Parse(uri)
+	var encoded string
+	switch u.Scheme {
+	case "env":
+		encoded = os.Getenv(u.Host)
+		if encoded == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", u.Host)
+		}
+	case "file":
+		data, err := p.readKeyFile(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+
+	return ParseKey(encoded)
+}
+
+// readKeyFile reads a regular file in the key directory, following symlinks
+// only as long as they stay inside it
+func (p KMSPolicy) readKeyFile(path string) ([]byte, error) {
+	dir, err := filepath.EvalSymlinks(p.KeyDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key directory: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if !within(dir, resolved) {
+		return nil, fmt.Errorf("key file %s is outside %s", path, p.KeyDir)
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("key file %s is not a regular file", path)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(f, maxKeyFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if len(data) > maxKeyFileSize {
+		return nil, fmt.Errorf("key file %s is larger than %d bytes", path, maxKeyFileSize)
+	}
+	return data, nil
+}
+
+// within reports whether path lies inside dir
+func within(dir, path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
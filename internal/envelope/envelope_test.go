@@ -0,0 +1,259 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	other := bytes.Repeat([]byte{2}, KeySize)
+	aad := []byte("user:1")
+
+	tests := []struct {
+		name      string
+		plaintext []byte
+		openKey   []byte
+		openAAD   []byte
+		tamper    func(sealed []byte) []byte
+		err       error // from Open, nil if the plaintext comes back
+	}{
+		{name: "round trip", plaintext: []byte("secret value"), openKey: key, openAAD: aad},
+		{name: "empty value", plaintext: []byte{}, openKey: key, openAAD: aad},
+		{name: "large value", plaintext: bytes.Repeat([]byte("x"), 1<<20), openKey: key, openAAD: aad},
+		{name: "other key", plaintext: []byte("secret value"), openKey: other, openAAD: aad, err: ErrWrongKey},
+		{name: "moved to another storage key", plaintext: []byte("secret value"), openKey: key, openAAD: []byte("user:2"), err: ErrCorrupt},
+		{
+			name: "ciphertext changed", plaintext: []byte("secret value"), openKey: key, openAAD: aad, err: ErrCorrupt,
+			tamper: func(sealed []byte) []byte { sealed[len(sealed)-1] ^= 1; return sealed },
+		},
+		{
+			name: "nonce changed", plaintext: []byte("secret value"), openKey: key, openAAD: aad, err: ErrCorrupt,
+			tamper: func(sealed []byte) []byte { sealed[len(magic)+8] ^= 1; return sealed },
+		},
+		{
+			name: "truncated", plaintext: []byte("secret value"), openKey: key, openAAD: aad, err: ErrCorrupt,
+			tamper: func(sealed []byte) []byte { return sealed[:len(magic)+8+4] },
+		},
+		{
+			name: "plaintext value", plaintext: []byte("secret value"), openKey: key, openAAD: aad, err: ErrCorrupt,
+			tamper: func([]byte) []byte { return []byte("stored before encryption") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := Seal(key, aad, tt.plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsSealed(sealed) {
+				t.Fatal("sealed value is not recognised as sealed")
+			}
+			if len(tt.plaintext) > 0 && bytes.Contains(sealed, tt.plaintext) {
+				t.Fatal("sealed value contains the plaintext")
+			}
+			if tt.tamper != nil {
+				sealed = tt.tamper(sealed)
+			}
+
+			got, err := Open(tt.openKey, tt.openAAD, sealed)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Open: %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if !bytes.Equal(got, tt.plaintext) {
+				t.Fatal("Open returned a different value")
+			}
+		})
+	}
+
+	// Every value gets its own nonce
+	a, _ := Seal(key, aad, []byte("v"))
+	b, _ := Seal(key, aad, []byte("v"))
+	if bytes.Equal(a, b) {
+		t.Fatal("sealing the same value twice gave the same output")
+	}
+	if _, err := Seal(key[:16], aad, []byte("v")); err == nil {
+		t.Fatal("sealed with a 16-byte key")
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	kek := bytes.Repeat([]byte{1}, KeySize)
+	dek := bytes.Repeat([]byte{9}, KeySize)
+	wrapped, err := Wrap(kek, dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		kek     []byte
+		wrapped string
+		err     error // nil if dek comes back; errAny for any error
+	}{
+		{name: "same KEK", kek: kek, wrapped: wrapped},
+		{name: "rotated KEK", kek: bytes.Repeat([]byte{2}, KeySize), wrapped: wrapped, err: ErrWrongKey},
+		{name: "not base64", kek: kek, wrapped: "not base64!", err: errAny},
+		{name: "a value sealed for storage", kek: kek, wrapped: sealedValue(t, kek), err: ErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Unwrap(tt.kek, tt.wrapped)
+			switch {
+			case tt.err == errAny:
+				if err == nil {
+					t.Fatal("Unwrap succeeded, want an error")
+				}
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Unwrap: %v, want %v", err, tt.err)
+				}
+			case err != nil:
+				t.Fatalf("Unwrap: %v", err)
+			case !bytes.Equal(got, dek):
+				t.Fatal("Unwrap returned a different key")
+			}
+		})
+	}
+}
+
+// errAny stands for any error in test tables
+var errAny = errors.New("any error")
+
+// sealedValue seals a value as it would be stored, which is bound to its
+// storage key rather than to the "dek" label of wrapped keys
+func sealedValue(t *testing.T, key []byte) string {
+	sealed, err := Seal(key, []byte("user:1"), bytes.Repeat([]byte{9}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+func TestParseKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, KeySize)
+
+	tests := []struct {
+		name    string
+		encoded string
+		err     string // empty if key is parsed
+	}{
+		{name: "base64", encoded: base64.StdEncoding.EncodeToString(key)},
+		{name: "hex", encoded: hex.EncodeToString(key)},
+		{name: "surrounding whitespace", encoded: "  " + base64.StdEncoding.EncodeToString(key) + "\n"},
+		{name: "16 bytes", encoded: base64.StdEncoding.EncodeToString(key[:16]), err: "must be 32 bytes, got 16"},
+		{name: "33 bytes", encoded: hex.EncodeToString(append(key, 0)), err: "must be 32 bytes, got 33"},
+		{name: "empty", encoded: "", err: "must be 32 bytes, got 0"},
+		{name: "not encoded", encoded: "correct horse battery staple", err: "base64 or hex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseKey(tt.encoded)
+			if tt.err == "" {
+				if err != nil || !bytes.Equal(got, key) {
+					t.Fatalf("ParseKey: %x %v", got, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("ParseKey: %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestKMSPolicy(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	dir := t.TempDir()
+	keyDir := filepath.Join(dir, "keys")
+	if err := os.Mkdir(keyDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(keyDir, "tenant.key"), encoded+"\n")
+	write(filepath.Join(keyDir, "short.key"), base64.StdEncoding.EncodeToString(key[:16]))
+	write(filepath.Join(keyDir, "large.key"), strings.Repeat("A", maxKeyFileSize+1))
+	write(filepath.Join(dir, "outside.key"), encoded)
+	if err := os.Symlink(filepath.Join(dir, "outside.key"), filepath.Join(keyDir, "escape.key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(keyDir, "sub"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TENANT_KEY_ACME", encoded)
+	t.Setenv("TENANT_KEY_EMPTY", "")
+	t.Setenv("OTHER_KEY", encoded)
+	t.Setenv("JWT_SECRET", encoded)
+
+	policy := KMSPolicy{EnvPrefix: "TENANT_KEY_", KeyDir: keyDir}
+
+	tests := []struct {
+		name    string
+		policy  KMSPolicy
+		uri     string
+		invalid bool   // rejected by Validate
+		err     string // Resolve error, empty if the key resolves
+	}{
+		{name: "env with prefix", policy: policy, uri: "env://TENANT_KEY_ACME"},
+		{name: "env without prefix", policy: policy, uri: "env://OTHER_KEY", invalid: true, err: "starting with TENANT_KEY_"},
+		{name: "env unset", policy: policy, uri: "env://TENANT_KEY_EMPTY", err: "is not set"},
+		{name: "env service secret", policy: policy, uri: "env://JWT_SECRET", invalid: true, err: "starting with"},
+		{name: "env service secret matching prefix", policy: KMSPolicy{EnvPrefix: "JWT_"}, uri: "env://JWT_SECRET", invalid: true, err: "starting with"},
+		{name: "env disabled", policy: KMSPolicy{KeyDir: keyDir}, uri: "env://TENANT_KEY_ACME", invalid: true, err: "not enabled"},
+		{name: "env without name", policy: policy, uri: "env://", invalid: true, err: "must name a variable"},
+		{name: "file in key dir", policy: policy, uri: "file://" + filepath.Join(keyDir, "tenant.key")},
+		{name: "file outside key dir", policy: policy, uri: "file://" + filepath.Join(dir, "outside.key"), invalid: true, err: "must name a file in"},
+		{name: "file traversal", policy: policy, uri: "file://" + keyDir + "/../outside.key", invalid: true, err: "must name a file in"},
+		{name: "file symlink out of key dir", policy: policy, uri: "file://" + filepath.Join(keyDir, "escape.key"), err: "is outside"},
+		{name: "file device", policy: policy, uri: "file:///dev/zero", invalid: true, err: "must name a file in"},
+		{name: "file device in key dir", policy: KMSPolicy{KeyDir: "/dev"}, uri: "file:///dev/zero", err: "not a regular file"},
+		{name: "file directory", policy: policy, uri: "file://" + filepath.Join(keyDir, "sub"), err: "not a regular file"},
+		{name: "file key dir itself", policy: policy, uri: "file://" + keyDir, invalid: true, err: "must name a file in"},
+		{name: "file too large", policy: policy, uri: "file://" + filepath.Join(keyDir, "large.key"), err: "larger than"},
+		{name: "file short key", policy: policy, uri: "file://" + filepath.Join(keyDir, "short.key"), err: "must be 32 bytes"},
+		{name: "file missing", policy: policy, uri: "file://" + filepath.Join(keyDir, "missing.key"), err: "failed to read key file"},
+		{name: "file disabled", policy: KMSPolicy{EnvPrefix: "TENANT_KEY_"}, uri: "file://" + filepath.Join(keyDir, "tenant.key"), invalid: true, err: "not enabled"},
+		{name: "zero policy", uri: "env://TENANT_KEY_ACME", invalid: true, err: "not enabled"},
+		{name: "unsupported scheme", policy: policy, uri: "https://kms.example.com/key", invalid: true, err: "unsupported KMS scheme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(tt.uri); (err != nil) != tt.invalid {
+				t.Fatalf("Validate(%q) = %v, want invalid %v", tt.uri, err, tt.invalid)
+			}
+
+			got, err := tt.policy.Resolve(tt.uri)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Resolve(%q): %v", tt.uri, err)
+				}
+				if !bytes.Equal(got, key) {
+					t.Fatalf("Resolve(%q) returned the wrong key", tt.uri)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Resolve(%q) = %v, want error containing %q", tt.uri, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package failure
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config tunes a phi-accrual failure detector
+type Config struct {
+	// Threshold is the phi above which a node is considered unavailable
+	// (phi 8 means roughly a 1 in 10^8 chance the node is actually fine)
+	Threshold float64
+
+	// WindowSize is how many heartbeat intervals are kept per node
+	WindowSize int
+
+	// MinStdDev keeps very regular heartbeats from making phi overly sensitive
+	MinStdDev time.Duration
+
+	// AcceptablePause is added to the expected interval to tolerate GC
+	// pauses and brief network hiccups
+	AcceptablePause time.Duration
+
+	// FirstHeartbeatEstimate seeds the interval history of a new node
+	FirstHeartbeatEstimate time.Duration
+}
+
+// DefaultConfig returns settings suited to heartbeats every interval
+func DefaultConfig(interval time.Duration) Config {
+	return Config{
+		Threshold:              8,
+		WindowSize:             100,
+		MinStdDev:              interval / 2,
+		AcceptablePause:        interval,
+		FirstHeartbeatEstimate: interval,
+	}
+}
+
+// history is the heartbeat record of one node
+type history struct {
+	intervals []time.Duration // ring buffer of the last WindowSize intervals
+	next      int
+	sum       float64
+	sumSq     float64
+	last      time.Time
+}
+
+// Detector implements the phi-accrual failure detector (Hayashibara et al.)
+// Instead of a binary up/down verdict it reports phi, the suspicion that a
+// node has failed given how long it has been since its last heartbeat
+// compared to the intervals observed so far. Any sign of life (a heartbeat
+// or a successful request) counts as a heartbeat.
+type Detector struct {
+	cfg   Config
+	nodes map[string]*history
+	mu    sync.Mutex
+
+	// now reads the clock; tests replace it to inject heartbeat times
+	now func() time.Time
+}
+
+// NodeStatus is a point-in-time view of one node's suspicion level
+type NodeStatus struct {
+	Node          string    `json:"node"`
+	Phi           float64   `json:"phi"`
+	Available     bool      `json:"available"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	MeanInterval  float64   `json:"mean_interval_ms"`
+	Samples       int       `json:"samples"`
+}
+
+// NewDetector creates a failure detector
+func NewDetector(cfg Config) *Detector {
+	if cfg.WindowSize < 2 {
+		cfg.WindowSize = 2
+	}
+	return &Detector{
+		cfg:   cfg,
+		nodes: make(map[string]*history),
+		now:   time.Now,
+	}
+}
+
+// Threshold returns the phi above which nodes are considered unavailable
+func (d *Detector) Threshold() float64 {
+	return d.cfg.Threshold
+}
+
+// Watch starts tracking node as if it had just sent a heartbeat, so a node
+// that never responds becomes suspected
+func (d *Detector) Watch(node string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.nodes[node]; !exists {
+		d.nodes[node] = d.newHistory(d.now())
+	}
+}
+
+// Heartbeat records a sign of life from node
+func (d *Detector) Heartbeat(node string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	h, exists := d.nodes[node]
+	if !exists {
+		d.nodes[node] = d.newHistory(now)
+		return
+	}
+
+	if interval := now.Sub(h.last); interval > 0 {
+		h.add(interval, d.cfg.WindowSize)
+	}
+	h.last = now
+}
+
+// newHistory seeds two samples around the first-heartbeat estimate so the
+// first real interval already has a meaningful mean and deviation
+func (d *Detector) newHistory(now time.Time) *history {
+	estimate := d.cfg.FirstHeartbeatEstimate
+	h := &history{intervals: make([]time.Duration, 0, d.cfg.WindowSize), last: now}
+	h.add(estimate-estimate/4, d.cfg.WindowSize)
+	h.add(estimate+estimate/4, d.cfg.WindowSize)
+	return h
+}
+
+// add appends an interval, dropping the oldest once the window is full
+func (h *history) add(interval time.Duration, window int) {
+	ms := float64(interval) / float64(time.Millisecond)
+	if len(h.intervals) < window {
+		h.intervals = append(h.intervals, interval)
+	} else {
+		old := float64(h.intervals[h.next]) / float64(time.Millisecond)
+		h.sum -= old
+		h.sumSq -= old * old
+		h.intervals[h.next] = interval
+		h.next = (h.next + 1) % window
+	}
+	h.sum += ms
+	h.sumSq += ms * ms
+}
+
+// Phi returns the current suspicion level of node; 0 for unknown nodes
+func (d *Detector) Phi(node string) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h, exists := d.nodes[node]
+	if !exists {
+		return 0
+	}
+	return d.phi(h, d.now())
+}
+
+// IsAvailable reports whether node's suspicion level is below the threshold
+func (d *Detector) IsAvailable(node string) bool {
+	return d.Phi(node) < d.cfg.Threshold
+}
+
+// Remove forgets node (e.g. when it leaves the ring)
+func (d *Detector) Remove(node string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.nodes, node)
+}
+
+// Snapshot returns the status of every tracked node, sorted by node
+func (d *Detector) Snapshot() []NodeStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	statuses := make([]NodeStatus, 0, len(d.nodes))
+	for node, h := range d.nodes {
+		phi := d.phi(h, now)
+		statuses = append(statuses, NodeStatus{
+			Node:          node,
+			Phi:           math.Round(phi*100) / 100,
+			Available:     phi < d.cfg.Threshold,
+			LastHeartbeat: h.last,
+			MeanInterval:  math.Round(h.sum/float64(len(h.intervals))*10) / 10,
+			Samples:       len(h.intervals),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Node < statuses[j].Node })
+	return statuses
+}
+
+// phi computes -log10(P(a heartbeat arrives later than now)) assuming
+// normally distributed intervals; caller must hold d.mu
+func (d *Detector) phi(h *history, now time.Time) float64 {
+	n := float64(len(h.intervals))
+	mean := h.sum / n
+	variance := h.sumSq/n - mean*mean
+	stdDev := math.Sqrt(math.Max(variance, 0))
+
+	minStdDev := float64(d.cfg.MinStdDev) / float64(time.Millisecond)
+	if stdDev < minStdDev {
+		stdDev = minStdDev
+	}
+	if stdDev <= 0 {
+		stdDev = 1
+	}
+	mean += float64(d.cfg.AcceptablePause) / float64(time.Millisecond)
+
+	elapsed := float64(now.Sub(h.last)) / float64(time.Millisecond)
+
+	// Logistic approximation of the normal CDF, accurate to ~1e-4
+	y := (elapsed - mean) / stdDev
+	exponent := -y * (1.5976 + 0.070566*y*y)
+	e := math.Exp(exponent)
+	if elapsed > mean {
+		// -log10(e/(1+e)) in log space, since e underflows for long silences
+		return (math.Log1p(e) - exponent) / math.Ln10
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
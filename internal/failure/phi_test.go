@@ -0,0 +1,184 @@
+package failure
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// fakeClock is a detector clock the test moves by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestDetector returns a detector reading c, with node sending beats
+// heartbeats every interval
+func newTestDetector(cfg Config, c *fakeClock, node string, beats int, interval time.Duration) *Detector {
+	d := NewDetector(cfg)
+	d.now = func() time.Time { return c.now }
+	for i := 0; i < beats; i++ {
+		if i > 0 {
+			c.advance(interval)
+		}
+		d.Heartbeat(node)
+	}
+	return d
+}
+
+func TestPhiRisesWithSilence(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	d := newTestDetector(DefaultConfig(time.Second), clock, "node-1", 30, time.Second)
+
+	previous := d.Phi("node-1")
+	if previous > 1 {
+		t.Fatalf("phi right after a heartbeat = %.2f, want below 1", previous)
+	}
+	last := clock.now
+	for silence := 250 * time.Millisecond; silence <= time.Hour; silence *= 2 {
+		clock.now = last.Add(silence)
+		phi := d.Phi("node-1")
+		if math.IsNaN(phi) || math.IsInf(phi, 0) {
+			t.Fatalf("phi after %v of silence = %v", silence, phi)
+		}
+		if phi <= previous {
+			t.Fatalf("phi fell from %.2f to %.2f as silence grew", previous, phi)
+		}
+		previous = phi
+	}
+
+	// A heartbeat clears the suspicion
+	d.Heartbeat("node-1")
+	if phi := d.Phi("node-1"); phi > 1 {
+		t.Fatalf("phi after a new heartbeat = %.2f, want below 1", phi)
+	}
+}
+
+func TestPhiThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		interval  time.Duration // between the 30 heartbeats
+		silence   time.Duration
+		available bool
+	}{
+		{name: "right after a heartbeat", interval: time.Second, available: true},
+		{name: "one interval late", interval: time.Second, silence: 2 * time.Second, available: true},
+		{name: "within the acceptable pause", interval: time.Second, silence: 3 * time.Second, available: true},
+		{name: "silent for five intervals", interval: time.Second, silence: 5 * time.Second},
+		{name: "silent for a minute", interval: time.Second, silence: time.Minute},
+		{name: "slow heartbeats are judged by their own rate", interval: 10 * time.Second, silence: 20 * time.Second, available: true},
+		{name: "slow heartbeats silent for five intervals", interval: 10 * time.Second, silence: 50 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1700000000, 0)}
+			d := newTestDetector(DefaultConfig(time.Second), clock, "node-1", 30, tt.interval)
+			clock.advance(tt.silence)
+
+			phi := d.Phi("node-1")
+			if got := d.IsAvailable("node-1"); got != tt.available {
+				t.Fatalf("available = %v at phi %.2f, want %v (threshold %v)", got, phi, tt.available, d.Threshold())
+			}
+			if got := phi < d.Threshold(); got != tt.available {
+				t.Fatalf("phi %.2f against threshold %v disagrees with IsAvailable", phi, d.Threshold())
+			}
+			statuses := d.Snapshot()
+			if len(statuses) != 1 || statuses[0].Available != tt.available {
+				t.Fatalf("snapshot %+v disagrees with IsAvailable", statuses)
+			}
+		})
+	}
+}
+
+func TestPhiFewSamples(t *testing.T) {
+	cfg := DefaultConfig(time.Second)
+	tests := []struct {
+		name      string
+		cfg       Config
+		watch     bool // only watched, no heartbeat yet
+		beats     int
+		silence   time.Duration
+		available bool
+		samples   int
+	}{
+		{name: "watched, just now", cfg: cfg, watch: true, available: true, samples: 2},
+		{name: "watched, silent within the estimate", cfg: cfg, watch: true, silence: 2 * time.Second, available: true, samples: 2},
+		{name: "watched, never answers", cfg: cfg, watch: true, silence: 10 * time.Second, samples: 2},
+		{name: "one heartbeat", cfg: cfg, beats: 1, silence: time.Second, available: true, samples: 2},
+		{name: "one heartbeat, then silence", cfg: cfg, beats: 1, silence: 10 * time.Second, samples: 2},
+		{name: "two heartbeats", cfg: cfg, beats: 2, silence: 2 * time.Second, available: true, samples: 3},
+		{name: "zero config suspects any delay", cfg: Config{Threshold: 8}, beats: 1, silence: time.Second, samples: 2},
+		{name: "zero config, just now", cfg: Config{Threshold: 8}, beats: 1, available: true, samples: 2},
+		{name: "window below two", cfg: Config{Threshold: 8, WindowSize: 1, FirstHeartbeatEstimate: time.Second}, beats: 5, silence: time.Second, available: true, samples: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1700000000, 0)}
+			d := newTestDetector(tt.cfg, clock, "node-1", tt.beats, time.Second)
+			if tt.watch {
+				d.Watch("node-1")
+			}
+			clock.advance(tt.silence)
+
+			phi := d.Phi("node-1")
+			if math.IsNaN(phi) || math.IsInf(phi, 0) || phi < 0 {
+				t.Fatalf("phi = %v", phi)
+			}
+			if got := d.IsAvailable("node-1"); got != tt.available {
+				t.Fatalf("available = %v at phi %.2f, want %v", got, phi, tt.available)
+			}
+			if statuses := d.Snapshot(); statuses[0].Samples != tt.samples {
+				t.Fatalf("%d samples, want %d", statuses[0].Samples, tt.samples)
+			}
+		})
+	}
+}
+
+func TestPhiUnknownNode(t *testing.T) {
+	d := NewDetector(DefaultConfig(time.Second))
+	if phi := d.Phi("node-1"); phi != 0 {
+		t.Fatalf("phi of an unknown node = %v, want 0", phi)
+	}
+	if !d.IsAvailable("node-1") {
+		t.Fatal("an unknown node is not available")
+	}
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	d = newTestDetector(DefaultConfig(time.Second), clock, "node-1", 5, time.Second)
+	clock.advance(time.Minute)
+	d.Remove("node-1")
+	if phi := d.Phi("node-1"); phi != 0 {
+		t.Fatalf("phi of a removed node = %v, want 0", phi)
+	}
+}
+
+// TestPhiWindow checks that old intervals leave the window, so a node whose
+// heartbeats slow down is judged by its recent rate
+func TestPhiWindow(t *testing.T) {
+	cfg := DefaultConfig(time.Second)
+	cfg.WindowSize = 10
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	d := newTestDetector(cfg, clock, "node-1", 30, time.Second)
+
+	for i := 0; i < cfg.WindowSize; i++ {
+		clock.advance(10 * time.Second)
+		d.Heartbeat("node-1")
+	}
+	status := d.Snapshot()[0]
+	if status.Samples != cfg.WindowSize || status.MeanInterval != 10000 {
+		t.Fatalf("window holds %d samples with mean %vms, want %d with mean 10000ms", status.Samples, status.MeanInterval, cfg.WindowSize)
+	}
+
+	// 11s would be far too long at the old 1s rate
+	clock.advance(11 * time.Second)
+	if !d.IsAvailable("node-1") {
+		t.Fatalf("phi %.2f after 11s at a 10s rate, want available", d.Phi("node-1"))
+	}
+	clock.advance(10 * time.Second)
+	if d.IsAvailable("node-1") {
+		t.Fatalf("phi %.2f after 21s at a 10s rate, want suspected", d.Phi("node-1"))
+	}
+}
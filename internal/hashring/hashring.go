@@ -13,6 +13,7 @@ type HashRing struct {
 	sortedHashes    []uint64          // Sorted hash values
 	virtualReplicas int               // Number of virtual nodes per physical node
 	replicationN    int               // Number of replicas for each key
+	epoch           uint64            // Bumped on every membership change
 	mu              sync.RWMutex
 }
 
@@ -25,6 +26,7 @@ func NewHashRing(nodes []string) *HashRing {
 		virtualNodes:    make(map[uint64]string),
 		virtualReplicas: 150, // 150 virtual nodes per physical node
 		replicationN:    3,   // Store each key on 3 nodes
+		epoch:           1,
 	}
 
 	ring.addNodes(nodes)
@@ -66,7 +68,11 @@ func (hr *HashRing) GetNode(key string) string {
 func (hr *HashRing) LocateKey(key string, n int) []string {
 	hr.mu.RLock()
 	defer hr.mu.RUnlock()
+	return hr.locateLocked(key, n)
+}
 
+// locateLocked is LocateKey for callers holding hr.mu
+func (hr *HashRing) locateLocked(key string, n int) []string {
 	if len(hr.sortedHashes) == 0 {
 		return nil
 	}
@@ -104,6 +110,22 @@ func (hr *HashRing) LocateKey(key string, n int) []string {
 	return result
 }
 
+// Locate is LocateKey that also returns the key's hash and the ring epoch
+// the placement was computed at
+func (hr *HashRing) Locate(key string, n int) (nodes []string, hash uint64, epoch uint64) {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	return hr.locateLocked(key, n), hr.hash(key), hr.epoch
+}
+
+// Epoch returns the ring's epoch: 1 when created, incremented by every node
+// added or removed since
+func (hr *HashRing) Epoch() uint64 {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	return hr.epoch
+}
+
 // GetAllNodes returns all physical nodes in the ring
 func (hr *HashRing) GetAllNodes() []string {
 	hr.mu.RLock()
@@ -128,6 +150,7 @@ func (hr *HashRing) AddNode(node string) {
 
 	// Add to physical nodes
 	hr.nodes = append(hr.nodes, node)
+	hr.epoch++
 
 	// Create virtual nodes
 	for i := 0; i < hr.virtualReplicas; i++ {
@@ -148,6 +171,11 @@ func (hr *HashRing) RemoveNode(node string) {
 	hr.mu.Lock()
 	defer hr.mu.Unlock()
 
+	if !hr.hasNodeLocked(node) {
+		return
+	}
+	hr.epoch++
+
 	// Remove virtual nodes
 	newSortedHashes := make([]uint64, 0)
 	for _, hash := range hr.sortedHashes {
@@ -176,6 +204,24 @@ func (hr *HashRing) hash(key string) uint64 {
 	return h.Sum64()
 }
 
+// HasNode reports whether node is a member of the ring
+func (hr *HashRing) HasNode(node string) bool {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	return hr.hasNodeLocked(node)
+}
+
+// hasNodeLocked is HasNode for callers holding hr.mu
+func (hr *HashRing) hasNodeLocked(node string) bool {
+	for _, n := range hr.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
 // NodeCount returns the number of physical nodes
 func (hr *HashRing) NodeCount() int {
 	hr.mu.RLock()
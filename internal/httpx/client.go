@@ -0,0 +1,243 @@
+package httpx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"dht/internal/deadline"
+	"dht/internal/requestid"
+)
+
+// Config tunes a Client. The zero value gives a pooled client without
+// retries or timeout.
+type Config struct {
+	// Timeout bounds a whole call, retries included, when the request's
+	// context has no deadline of its own. Zero means no limit.
+	Timeout time.Duration
+
+	// MaxRetries is how many times a failed call is sent again
+	MaxRetries int
+
+	// RetryBackoff is the wait before the first retry; it doubles with
+	// every further retry up to MaxBackoff
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+
+	// IdempotentMethods may be retried after they reached the server.
+	// Requests that failed to connect are retried whatever their method.
+	// Defaults to GET, HEAD and OPTIONS.
+	IdempotentMethods []string
+
+	// MaxIdleConnsPerHost sizes the connection pool kept for each service
+	MaxIdleConnsPerHost int
+
+	// H2C sends calls to http:// services as unencrypted HTTP/2 with prior
+	// knowledge, multiplexing concurrent calls over one connection per
+	// service instead of one connection per call in flight. Every service
+	// called must accept it (see AcceptH2C).
+	H2C bool
+
+	// Observer is called after every attempt, including retries
+	Observer func(Attempt)
+}
+
+// Health checks of idle HTTP/2 connections
+const (
+	h2cPingInterval = 10 * time.Second
+	h2cPingTimeout  = 5 * time.Second
+)
+
+// Attempt describes one round trip made by a Client
+type Attempt struct {
+	Method   string
+	Target   string // scheme://host of the called service
+	Path     string
+	Retry    int // 0 for the first attempt
+	Status   int // 0 if no response was received
+	Err      error
+	Duration time.Duration
+}
+
+// Failed reports whether the attempt got no response or a server error
+func (a Attempt) Failed() bool {
+	return a.Err != nil || a.Status >= http.StatusInternalServerError
+}
+
+// Client makes calls between services. Every call forwards the request ID
+// and remaining deadline of its context, and transient failures are retried
+// with exponential backoff.
+type Client struct {
+	cfg        Config
+	client     *http.Client
+	idempotent map[string]bool
+}
+
+// New creates a client with its own connection pool
+func New(cfg Config) *Client {
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 50 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 2 * time.Second
+	}
+	if cfg.MaxIdleConnsPerHost <= 0 {
+		cfg.MaxIdleConnsPerHost = 32
+	}
+	if cfg.IdempotentMethods == nil {
+		cfg.IdempotentMethods = []string{"GET", "HEAD", "OPTIONS"}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	if transport.MaxIdleConns < cfg.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.H2C {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		// A connection carries every call to its service, so one that stops
+		// answering is found by pings rather than left to request deadlines
+		transport.HTTP2 = &http.HTTP2Config{
+			SendPingTimeout: h2cPingInterval,
+			PingTimeout:     h2cPingTimeout,
+		}
+	}
+
+	idempotent := make(map[string]bool, len(cfg.IdempotentMethods))
+	for _, method := range cfg.IdempotentMethods {
+		idempotent[method] = true
+	}
+
+	return &Client{
+		cfg: cfg,
+		client: &http.Client{
+			Transport: &requestid.Transport{Base: &deadline.Transport{Base: transport}},
+		},
+		idempotent: idempotent,
+	}
+}
+
+// Do sends req, retrying transient failures. As with http.Client, the
+// caller must close the returned response's body.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Context().Deadline(); ok || c.cfg.Timeout <= 0 {
+		return c.do(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), c.cfg.Timeout)
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// Keep the deadline until the caller has read the response
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		attemptReq := req
+		if retry > 0 && req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		start := time.Now()
+		resp, err := c.client.Do(attemptReq)
+		attempt := Attempt{
+			Method:   req.Method,
+			Target:   req.URL.Scheme + "://" + req.URL.Host,
+			Path:     req.URL.Path,
+			Retry:    retry,
+			Err:      err,
+			Duration: time.Since(start),
+		}
+		if resp != nil {
+			attempt.Status = resp.StatusCode
+		}
+		if c.cfg.Observer != nil {
+			c.cfg.Observer(attempt)
+		}
+
+		if retry >= c.cfg.MaxRetries || !c.retryable(req, resp, err) {
+			return resp, err
+		}
+
+		wait := c.backoff(retry)
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+			// No time left for another attempt
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryable reports whether a failed attempt may be sent again
+func (c *Client) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	// A body that cannot be replayed allows a single attempt only
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	if err != nil {
+		// The server never saw a request that failed to connect
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return c.idempotent[req.Method]
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return c.idempotent[req.Method]
+	}
+	return false
+}
+
+// backoff returns the wait before a retry, with jitter so callers that
+// failed together do not retry in lockstep
+func (c *Client) backoff(retry int) time.Duration {
+	wait := c.cfg.RetryBackoff << retry
+	if wait <= 0 || wait > c.cfg.MaxBackoff {
+		wait = c.cfg.MaxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// cancelOnClose releases a call's timeout once its response is consumed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,188 @@
+package httpx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newServer starts a test server keeping PUT values in memory and counting
+// the connections opened to it
+func newServer(tb testing.TB, h2c bool) (*httptest.Server, *atomic.Int64) {
+	tb.Helper()
+	var (
+		mu     sync.RWMutex
+		values = make(map[string][]byte)
+		conns  atomic.Int64
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			value, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			values[r.URL.Path] = value
+			mu.Unlock()
+		default:
+			mu.RLock()
+			value := values[r.URL.Path]
+			mu.RUnlock()
+			w.Write(value)
+		}
+	}))
+	if h2c {
+		AcceptH2C(srv.Config, 0)
+	}
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	tb.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+// get makes one GET call and discards the response body
+func get(client *Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestH2C(t *testing.T) {
+	tests := []struct {
+		name      string
+		serverH2C bool
+		clientH2C bool
+		wantProto int // 0 if the call fails
+	}{
+		{name: "HTTP/1.1", wantProto: 1},
+		{name: "HTTP/1.1 to an h2c server", serverH2C: true, wantProto: 1},
+		{name: "h2c", serverH2C: true, clientH2C: true, wantProto: 2},
+		{name: "h2c to an HTTP/1.1 server", clientH2C: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, conns := newServer(t, tt.serverH2C)
+			client := New(Config{H2C: tt.clientH2C})
+
+			// Concurrent calls made before a connection is up may each dial
+			// one, so the first call opens it
+			if _, err := get(client, srv.URL+"/key"); err != nil {
+				if tt.wantProto == 0 {
+					return
+				}
+				t.Fatal(err)
+			}
+			if tt.wantProto == 0 {
+				t.Fatal("call succeeded, want it rejected")
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+			for i := 0; i < cap(errs); i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := get(client, srv.URL+"/key")
+					if err != nil {
+						errs <- err
+					} else if resp.ProtoMajor != tt.wantProto {
+						errs <- fmt.Errorf("response over HTTP/%d, want HTTP/%d", resp.ProtoMajor, tt.wantProto)
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			if tt.wantProto == 2 && conns.Load() != 1 {
+				t.Fatalf("h2c calls used %d connections, want 1", conns.Load())
+			}
+		})
+	}
+}
+
+// BenchmarkClient compares HTTP/1.1 and h2c under concurrent load: alternating
+// PUTs and GETs from many goroutines to one server, as the gateway calls a
+// node. Besides throughput it reports the connections the server accepted,
+// which for h2c stays at one until a connection's stream limit is reached.
+// Run with -cpu to vary GOMAXPROCS, which the goroutine counts multiply.
+func BenchmarkClient(b *testing.B) {
+	for _, bench := range []struct {
+		parallelism int // goroutines per GOMAXPROCS
+		size        int
+	}{
+		{16, 1 << 10},
+		{64, 1 << 10},
+		{256, 1 << 10},
+		{64, 64 << 10},
+	} {
+		for _, h2c := range []bool{false, true} {
+			proto := "HTTP1"
+			if h2c {
+				proto = "h2c"
+			}
+			b.Run(fmt.Sprintf("%s/%d/%dKiB", proto, bench.parallelism, bench.size>>10), func(b *testing.B) {
+				srv, conns := newServer(b, h2c)
+				client := New(Config{H2C: h2c, MaxIdleConnsPerHost: 1024})
+				value := bytes.Repeat([]byte("v"), bench.size)
+				if _, err := get(client, srv.URL+"/store/warmup"); err != nil {
+					b.Fatal(err)
+				}
+
+				var next atomic.Int64
+				b.SetBytes(int64(bench.size))
+				b.SetParallelism(bench.parallelism)
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						n := next.Add(1)
+						url := fmt.Sprintf("%s/store/key-%d", srv.URL, n/2%1024)
+						var req *http.Request
+						var err error
+						if n%2 == 0 {
+							req, err = http.NewRequest(http.MethodPut, url, bytes.NewReader(value))
+						} else {
+							req, err = http.NewRequest(http.MethodGet, url, nil)
+						}
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						resp, err := client.Do(req)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						io.Copy(io.Discard, resp.Body)
+						resp.Body.Close()
+					}
+				})
+				b.StopTimer()
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+				b.ReportMetric(float64(conns.Load()), "conns")
+			})
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package httpx
+
+import (
+	"sync"
+	"time"
+)
+
+// TargetStats summarises the calls made to one service
+type TargetStats struct {
+	Requests     int64   `json:"requests"`
+	Retries      int64   `json:"retries"`
+	Errors       int64   `json:"errors"` // no response or a 5xx
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// Metrics counts calls per target. Its Observe method is meant to be used
+// as (or from) Config.Observer.
+type Metrics struct {
+	mu      sync.Mutex
+	targets map[string]*targetCounters
+}
+
+type targetCounters struct {
+	requests, retries, errors int64
+	latency                   time.Duration
+}
+
+// NewMetrics creates an empty metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{targets: make(map[string]*targetCounters)}
+}
+
+// Observe records one attempt
+func (m *Metrics) Observe(a Attempt) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, exists := m.targets[a.Target]
+	if !exists {
+		t = &targetCounters{}
+		m.targets[a.Target] = t
+	}
+	t.requests++
+	if a.Retry > 0 {
+		t.retries++
+	}
+	if a.Failed() {
+		t.errors++
+	}
+	t.latency += a.Duration
+}
+
+// Snapshot returns the current stats keyed by target
+func (m *Metrics) Snapshot() map[string]TargetStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]TargetStats, len(m.targets))
+	for target, t := range m.targets {
+		snapshot[target] = TargetStats{
+			Requests:     t.requests,
+			Retries:      t.retries,
+			Errors:       t.errors,
+			AvgLatencyMs: float64(t.latency) / float64(time.Millisecond) / float64(t.requests),
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,14 @@
+package httpx
+
+import "net/http"
+
+// AcceptH2C lets srv serve unencrypted HTTP/2 (h2c with prior knowledge)
+// alongside HTTP/1.1, so clients created with Config.H2C can multiplex
+// their calls. maxStreams caps the concurrent requests on one connection
+// (0 uses Go's default of 250); a client past it opens another connection.
+func AcceptH2C(srv *http.Server, maxStreams int) {
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	srv.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: maxStreams}
+}
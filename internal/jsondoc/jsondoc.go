@@ -0,0 +1,214 @@
+package jsondoc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Content types for the supported patch formats
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+var (
+	// ErrNotJSON is returned when a stored value is not a JSON document
+	ErrNotJSON = errors.New("value is not a JSON document")
+	// ErrPathNotFound is returned when a path does not resolve in a document
+	ErrPathNotFound = errors.New("path not found")
+	// ErrTestFailed is returned when a JSON Patch "test" operation fails
+	ErrTestFailed = errors.New("test operation failed")
+)
+
+// Decode parses a JSON document, keeping numbers as json.Number so they
+// round-trip without precision loss
+func Decode(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON document")
+	}
+	return doc, nil
+}
+
+// Encode serializes a document
+func Encode(doc interface{}) ([]byte, error) {
+	return json.Marshal(doc)
+}
+
+// Get evaluates a JSONPath-style path ($.a.b, $.items[0], $['odd key'])
+// against a JSON document and returns the selected sub-document
+func Get(data []byte, path string) ([]byte, error) {
+	segments, err := ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := Decode(data)
+	if err != nil {
+		return nil, ErrNotJSON
+	}
+
+	current := doc
+	for _, seg := range segments {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if seg.isIndex {
+				return nil, ErrPathNotFound
+			}
+			child, ok := node[seg.name]
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			current = child
+		case []interface{}:
+			if !seg.isIndex {
+				return nil, ErrPathNotFound
+			}
+			idx := seg.index
+			if idx < 0 {
+				idx += len(node)
+			}
+			if idx < 0 || idx >= len(node) {
+				return nil, ErrPathNotFound
+			}
+			current = node[idx]
+		default:
+			return nil, ErrPathNotFound
+		}
+	}
+
+	return Encode(current)
+}
+
+// segment is one step of a parsed path
+type segment struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// ParsePath parses a JSONPath-style path into segments
+// Supported: $ root, .name, ['name'] / ["name"], [index] (negative counts from the end)
+func ParsePath(path string) ([]segment, error) {
+	path = strings.TrimSpace(path)
+	if path == "" || path == "$" {
+		return nil, nil
+	}
+	if path[0] != '$' {
+		return nil, fmt.Errorf("path must start with $")
+	}
+
+	var segments []segment
+	i := 1
+	for i < len(path) {
+		switch path[i] {
+		case '.':
+			i++
+			start := i
+			for i < len(path) && path[i] != '.' && path[i] != '[' {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("empty field name at position %d", start)
+			}
+			segments = append(segments, segment{name: path[start:i]})
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ at position %d", i)
+			}
+			inner := path[i+1 : i+end]
+			i += end + 1
+
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, segment{name: inner[1 : len(inner)-1]})
+				continue
+			}
+			idx, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q", inner)
+			}
+			segments = append(segments, segment{index: idx, isIndex: true})
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", path[i], i)
+		}
+	}
+
+	return segments, nil
+}
+
+// MergePatch applies an RFC 7386 JSON Merge Patch to a document
+// A nil or empty target is treated as null, so a patch can create a document.
+func MergePatch(target, patch []byte) ([]byte, error) {
+	patchDoc, err := Decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %w", err)
+	}
+
+	var targetDoc interface{}
+	if len(bytes.TrimSpace(target)) > 0 {
+		targetDoc, err = Decode(target)
+		if err != nil {
+			return nil, ErrNotJSON
+		}
+	}
+
+	return Encode(mergePatch(targetDoc, patchDoc))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+			continue
+		}
+		targetObj[name] = mergePatch(targetObj[name], value)
+	}
+	return targetObj
+}
+
+// Scalar returns the string form of the scalar (string, number or boolean)
+// at path, and false if the path does not resolve to a scalar
+func Scalar(data []byte, path string) (string, bool) {
+	raw, err := Get(data, path)
+	if err != nil {
+		return "", false
+	}
+
+	value, err := Decode(raw)
+	if err != nil {
+		return "", false
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
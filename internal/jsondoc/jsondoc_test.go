@@ -0,0 +1,215 @@
+package jsondoc
+
+import (
+	"errors"
+	"testing"
+)
+
+// errAny stands for any error in test tables
+var errAny = errors.New("any error")
+
+// checkResult compares a function's output with a table row's expectations
+func checkResult(t *testing.T, got []byte, err error, want string, wantErr error) {
+	t.Helper()
+	switch {
+	case wantErr == errAny:
+		if err == nil {
+			t.Fatalf("got %s, want an error", got)
+		}
+	case wantErr != nil:
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("error %v, want %v", err, wantErr)
+		}
+	case err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case string(got) != want:
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestGet(t *testing.T) {
+	doc := []byte(`{"name":"ada","tags":["a","b","c"],"address":{"city":"Berlin"},"odd.key":1,"big":12345678901234567890}`)
+	tests := []struct {
+		name string
+		doc  []byte
+		path string
+		want string
+		err  error
+	}{
+		{name: "root", doc: []byte(`{"a":1}`), path: "$", want: `{"a":1}`},
+		{name: "empty path is the root", doc: []byte(`[1]`), path: "", want: `[1]`},
+		{name: "field", doc: doc, path: "$.name", want: `"ada"`},
+		{name: "nested field", doc: doc, path: "$.address.city", want: `"Berlin"`},
+		{name: "index", doc: doc, path: "$.tags[1]", want: `"b"`},
+		{name: "negative index", doc: doc, path: "$.tags[-1]", want: `"c"`},
+		{name: "quoted name", doc: doc, path: "$['odd.key']", want: `1`},
+		{name: "double quoted name", doc: doc, path: `$["address"].city`, want: `"Berlin"`},
+		{name: "number keeps its precision", doc: doc, path: "$.big", want: `12345678901234567890`},
+		{name: "sub-document", doc: doc, path: "$.address", want: `{"city":"Berlin"}`},
+		{name: "missing field", doc: doc, path: "$.email", err: ErrPathNotFound},
+		{name: "index past the end", doc: doc, path: "$.tags[3]", err: ErrPathNotFound},
+		{name: "index into an object", doc: doc, path: "$.address[0]", err: ErrPathNotFound},
+		{name: "field of a scalar", doc: doc, path: "$.name.first", err: ErrPathNotFound},
+		{name: "not JSON", doc: []byte("plain text"), path: "$.a", err: ErrNotJSON},
+		{name: "trailing data", doc: []byte(`{"a":1} {}`), path: "$", err: ErrNotJSON},
+		{name: "no $", doc: doc, path: "name", err: errAny},
+		{name: "unterminated bracket", doc: doc, path: "$.tags[1", err: errAny},
+		{name: "bad index", doc: doc, path: "$.tags[x]", err: errAny},
+		{name: "empty field name", doc: doc, path: "$..name", err: errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Get(tt.doc, tt.path)
+			checkResult(t, got, err, tt.want, tt.err)
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		patch  string
+		want   string
+		err    error
+	}{
+		{name: "set a field", target: `{"a":1}`, patch: `{"b":2}`, want: `{"a":1,"b":2}`},
+		{name: "replace a field", target: `{"a":1}`, patch: `{"a":"x"}`, want: `{"a":"x"}`},
+		{name: "null removes a field", target: `{"a":1,"b":2}`, patch: `{"a":null}`, want: `{"b":2}`},
+		{name: "remove a missing field", target: `{"a":1}`, patch: `{"b":null}`, want: `{"a":1}`},
+		{name: "nested merge", target: `{"a":{"b":1,"c":2}}`, patch: `{"a":{"c":3,"d":4}}`, want: `{"a":{"b":1,"c":3,"d":4}}`},
+		{name: "arrays are replaced", target: `{"a":[1,2,3]}`, patch: `{"a":[4]}`, want: `{"a":[4]}`},
+		{name: "object replaces a scalar", target: `{"a":1}`, patch: `{"a":{"b":null,"c":1}}`, want: `{"a":{"c":1}}`},
+		{name: "non-object patch replaces the document", target: `{"a":1}`, patch: `[1,2]`, want: `[1,2]`},
+		{name: "creates a document", target: ``, patch: `{"a":1,"b":null}`, want: `{"a":1}`},
+		{name: "object over a non-object target", target: `"text"`, patch: `{"a":1}`, want: `{"a":1}`},
+		{name: "numbers keep their precision", target: `{"a":1}`, patch: `{"b":12345678901234567890}`, want: `{"a":1,"b":12345678901234567890}`},
+		{name: "target not JSON", target: `plain text`, patch: `{"a":1}`, err: ErrNotJSON},
+		{name: "patch not JSON", target: `{}`, patch: `{"a":`, err: errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergePatch([]byte(tt.target), []byte(tt.patch))
+			checkResult(t, got, err, tt.want, tt.err)
+		})
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	doc := `{"a":{"b":1},"list":[1,2,3],"a/b":"slash","m~n":"tilde"}`
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+		err   error
+	}{
+		// add
+		{name: "add a field", doc: `{"a":1}`, patch: `[{"op":"add","path":"/b","value":2}]`, want: `{"a":1,"b":2}`},
+		{name: "add replaces an existing field", doc: `{"a":1}`, patch: `[{"op":"add","path":"/a","value":[1]}]`, want: `{"a":[1]}`},
+		{name: "add a nested field", doc: doc, patch: `[{"op":"add","path":"/a/c","value":null}]`, want: `{"a":{"b":1,"c":null},"a/b":"slash","list":[1,2,3],"m~n":"tilde"}`},
+		{name: "add inserts into an array", doc: `[1,2,3]`, patch: `[{"op":"add","path":"/1","value":9}]`, want: `[1,9,2,3]`},
+		{name: "add at the array length", doc: `[1,2]`, patch: `[{"op":"add","path":"/2","value":9}]`, want: `[1,2,9]`},
+		{name: "add appends with -", doc: `{"list":[1]}`, patch: `[{"op":"add","path":"/list/-","value":2}]`, want: `{"list":[1,2]}`},
+		{name: "add replaces the root", doc: `{"a":1}`, patch: `[{"op":"add","path":"","value":[1]}]`, want: `[1]`},
+		{name: "add past the array end", doc: `[1,2]`, patch: `[{"op":"add","path":"/3","value":9}]`, err: errAny},
+		{name: "add with a leading zero index", doc: `[1,2]`, patch: `[{"op":"add","path":"/01","value":9}]`, err: errAny},
+		{name: "add under a missing parent", doc: `{}`, patch: `[{"op":"add","path":"/a/b","value":1}]`, err: ErrPathNotFound},
+		{name: "add without a value", doc: `{}`, patch: `[{"op":"add","path":"/a"}]`, err: errAny},
+
+		// remove
+		{name: "remove a field", doc: `{"a":1,"b":2}`, patch: `[{"op":"remove","path":"/a"}]`, want: `{"b":2}`},
+		{name: "remove from an array", doc: `{"list":[1,2,3]}`, patch: `[{"op":"remove","path":"/list/0"}]`, want: `{"list":[2,3]}`},
+		{name: "remove from a nested array", doc: `[[1,2],[3]]`, patch: `[{"op":"remove","path":"/0/1"}]`, want: `[[1],[3]]`},
+		{name: "remove a missing field", doc: `{"a":1}`, patch: `[{"op":"remove","path":"/b"}]`, err: ErrPathNotFound},
+		{name: "remove with -", doc: `[1]`, patch: `[{"op":"remove","path":"/-"}]`, err: errAny},
+		{name: "remove past the array end", doc: `[1]`, patch: `[{"op":"remove","path":"/1"}]`, err: errAny},
+
+		// replace
+		{name: "replace a field", doc: `{"a":1}`, patch: `[{"op":"replace","path":"/a","value":"x"}]`, want: `{"a":"x"}`},
+		{name: "replace an array element", doc: `[1,2,3]`, patch: `[{"op":"replace","path":"/1","value":9}]`, want: `[1,9,3]`},
+		{name: "replace a missing field", doc: `{}`, patch: `[{"op":"replace","path":"/a","value":1}]`, err: ErrPathNotFound},
+
+		// move
+		{name: "move a field", doc: `{"a":{"b":1},"c":{}}`, patch: `[{"op":"move","from":"/a/b","path":"/c/d"}]`, want: `{"a":{},"c":{"d":1}}`},
+		{name: "move within an array", doc: `[1,2,3]`, patch: `[{"op":"move","from":"/0","path":"/-"}]`, want: `[2,3,1]`},
+		{name: "move into its own child", doc: `{"a":{"b":{}}}`, patch: `[{"op":"move","from":"/a","path":"/a/b/c"}]`, err: errAny},
+		{name: "move a missing field", doc: `{}`, patch: `[{"op":"move","from":"/a","path":"/b"}]`, err: ErrPathNotFound},
+
+		// copy
+		{name: "copy a field", doc: `{"a":{"b":1}}`, patch: `[{"op":"copy","from":"/a","path":"/c"}]`, want: `{"a":{"b":1},"c":{"b":1}}`},
+		{name: "copy is deep", doc: `{"a":{"b":1}}`, patch: `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, want: `{"a":{"b":1},"c":{"b":2}}`},
+		{name: "copy into an array", doc: `{"a":1,"list":[]}`, patch: `[{"op":"copy","from":"/a","path":"/list/0"}]`, want: `{"a":1,"list":[1]}`},
+		{name: "copy a missing field", doc: `{}`, patch: `[{"op":"copy","from":"/a","path":"/b"}]`, err: ErrPathNotFound},
+
+		// test
+		{name: "test a scalar", doc: `{"a":"x"}`, patch: `[{"op":"test","path":"/a","value":"x"}]`, want: `{"a":"x"}`},
+		{name: "test numbers by value", doc: `{"a":1}`, patch: `[{"op":"test","path":"/a","value":1.0}]`, want: `{"a":1}`},
+		{name: "test nested numbers by value", doc: `{"a":{"b":[1,{"c":100}]}}`, patch: `[{"op":"test","path":"/a","value":{"b":[1.0,{"c":1e2}]}}]`, want: `{"a":{"b":[1,{"c":100}]}}`},
+		{name: "test large integers exactly", doc: `{"a":12345678901234567890}`, patch: `[{"op":"test","path":"/a","value":12345678901234567891}]`, err: ErrTestFailed},
+		{name: "test a different value", doc: `{"a":1}`, patch: `[{"op":"test","path":"/a","value":2}]`, err: ErrTestFailed},
+		{name: "test a number against a string", doc: `{"a":1}`, patch: `[{"op":"test","path":"/a","value":"1"}]`, err: ErrTestFailed},
+		{name: "test an object with an extra field", doc: `{"a":{"b":1}}`, patch: `[{"op":"test","path":"/a","value":{"b":1,"c":2}}]`, err: ErrTestFailed},
+		{name: "test arrays of different length", doc: `{"a":[1,2]}`, patch: `[{"op":"test","path":"/a","value":[1]}]`, err: ErrTestFailed},
+		{name: "test null", doc: `{"a":null}`, patch: `[{"op":"test","path":"/a","value":null}]`, want: `{"a":null}`},
+		{name: "test a missing field", doc: `{}`, patch: `[{"op":"test","path":"/a","value":1}]`, err: ErrPathNotFound},
+
+		// pointers
+		{name: "~1 escapes a slash", doc: doc, patch: `[{"op":"test","path":"/a~1b","value":"slash"}]`, want: `{"a":{"b":1},"a/b":"slash","list":[1,2,3],"m~n":"tilde"}`},
+		{name: "~0 escapes a tilde", doc: doc, patch: `[{"op":"remove","path":"/m~0n"}]`, want: `{"a":{"b":1},"a/b":"slash","list":[1,2,3]}`},
+		{name: "~01 is a tilde then 1", doc: `{"~1":true}`, patch: `[{"op":"test","path":"/~01","value":true}]`, want: `{"~1":true}`},
+		{name: "escaped key in from", doc: doc, patch: `[{"op":"move","from":"/a~1b","path":"/s"}]`, want: `{"a":{"b":1},"list":[1,2,3],"m~n":"tilde","s":"slash"}`},
+		{name: "pointer without a leading slash", doc: doc, patch: `[{"op":"remove","path":"a"}]`, err: errAny},
+
+		// the patch as a whole
+		{name: "operations apply in order", doc: `{}`, patch: `[{"op":"add","path":"/a","value":[]},{"op":"add","path":"/a/-","value":1},{"op":"test","path":"/a/0","value":1}]`, want: `{"a":[1]}`},
+		{name: "a failed operation fails the patch", doc: `{"a":1}`, patch: `[{"op":"add","path":"/b","value":2},{"op":"test","path":"/a","value":2}]`, err: ErrTestFailed},
+		{name: "unsupported op", doc: `{}`, patch: `[{"op":"merge","path":"/a","value":1}]`, err: errAny},
+		{name: "patch not an array", doc: `{}`, patch: `{"op":"add","path":"/a","value":1}`, err: errAny},
+		{name: "document not JSON", doc: `plain text`, patch: `[]`, err: ErrNotJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyPatch([]byte(tt.doc), []byte(tt.patch))
+			checkResult(t, got, err, tt.want, tt.err)
+		})
+	}
+}
+
+func TestJSONEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: `1`, b: `1.0`, want: true},
+		{a: `1`, b: `1e0`, want: true},
+		{a: `-0`, b: `0`, want: true},
+		{a: `0.1`, b: `1e-1`, want: true},
+		{a: `{"a":1.0}`, b: `{"a":1}`, want: true},
+		{a: `[{"a":[2.50]}]`, b: `[{"a":[2.5]}]`, want: true},
+		{a: `1e999999999999`, b: `1e999999999999`, want: true},
+		{a: `1e999999999999`, b: `2e999999999999`},
+		{a: `9007199254740993`, b: `9007199254740992`},
+		{a: `{"a":1}`, b: `{"b":1}`},
+		{a: `{"a":null}`, b: `{}`},
+		{a: `[1,2]`, b: `[2,1]`},
+		{a: `"1"`, b: `1`},
+		{a: `true`, b: `"true"`},
+		{a: `null`, b: `null`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, err := Decode([]byte(tt.a))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := Decode([]byte(tt.b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := jsonEqual(a, b); got != tt.want {
+				t.Fatalf("jsonEqual(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package jsondoc
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Operation is a single RFC 6902 JSON Patch operation
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// ApplyPatch applies an RFC 6902 JSON Patch to a document
+// Operations are applied in order and the whole patch fails atomically.
+func ApplyPatch(target, patch []byte) ([]byte, error) {
+	var ops []Operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("invalid JSON patch: %w", err)
+	}
+
+	doc, err := Decode(target)
+	if err != nil {
+		return nil, ErrNotJSON
+	}
+
+	for i, op := range ops {
+		doc, err = applyOperation(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+
+	return Encode(doc)
+}
+
+func applyOperation(doc interface{}, op Operation) (interface{}, error) {
+	switch op.Op {
+	case "add":
+		value, err := decodeValue(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, op.Path, value)
+	case "remove":
+		doc, _, err := remove(doc, op.Path)
+		return doc, err
+	case "replace":
+		value, err := decodeValue(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		doc, _, err = remove(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, op.Path, value)
+	case "move":
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("cannot move a value into one of its children")
+		}
+		doc, value, err := remove(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, op.Path, value)
+	case "copy":
+		value, err := get(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, op.Path, deepCopy(value))
+	case "test":
+		expected, err := decodeValue(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		actual, err := get(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(actual, expected) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unsupported op %q", op.Op)
+	}
+}
+
+func decodeValue(raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("missing value")
+	}
+	return Decode(raw)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.ReplaceAll(token, "~1", "/")
+		tokens[i] = strings.ReplaceAll(token, "~0", "~")
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if idx > max {
+		return 0, fmt.Errorf("array index %d out of range", idx)
+	}
+	return idx, nil
+}
+
+func get(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	current := doc
+	for _, token := range tokens {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			child, ok := node[token]
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			current = child
+		case []interface{}:
+			idx, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, ErrPathNotFound
+			}
+			current = node[idx]
+		default:
+			return nil, ErrPathNotFound
+		}
+	}
+	return current, nil
+}
+
+// add sets value at pointer, returning the (possibly new) root
+func add(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parent, err := get(doc, pointerOf(tokens[:len(tokens)-1]))
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[idx+1:], node[idx:])
+		node[idx] = value
+		return replaceParent(doc, tokens[:len(tokens)-1], node)
+	default:
+		return nil, ErrPathNotFound
+	}
+}
+
+// remove deletes the value at pointer, returning the new root and the removed value
+func remove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+
+	parent, err := get(doc, pointerOf(tokens[:len(tokens)-1]))
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, ErrPathNotFound
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[idx]
+		node = append(node[:idx], node[idx+1:]...)
+		root, err := replaceParent(doc, tokens[:len(tokens)-1], node)
+		return root, value, err
+	default:
+		return nil, nil, ErrPathNotFound
+	}
+}
+
+// replaceParent stores a resized array back into its parent container
+func replaceParent(doc interface{}, parentTokens []string, array []interface{}) (interface{}, error) {
+	if len(parentTokens) == 0 {
+		return array, nil
+	}
+
+	grandparent, err := get(doc, pointerOf(parentTokens[:len(parentTokens)-1]))
+	if err != nil {
+		return nil, err
+	}
+	last := parentTokens[len(parentTokens)-1]
+
+	switch node := grandparent.(type) {
+	case map[string]interface{}:
+		node[last] = array
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[idx] = array
+	}
+	return doc, nil
+}
+
+func pointerOf(tokens []string) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	escaped := make([]string, len(tokens))
+	for i, token := range tokens {
+		token = strings.ReplaceAll(token, "~", "~0")
+		escaped[i] = strings.ReplaceAll(token, "/", "~1")
+	}
+	return "/" + strings.Join(escaped, "/")
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			copied[k] = deepCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = deepCopy(child)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// jsonEqual compares documents, treating numbers by value at any depth, so
+// 1, 1.0 and 1e0 are equal
+func jsonEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		// 256 bits keep large integers exact, and unlike big.Rat a huge
+		// exponent does not have to be expanded; beyond big.Float's range
+		// only identical text is equal
+		af, aok := new(big.Float).SetPrec(256).SetString(string(av))
+		bf, bok := new(big.Float).SetPrec(256).SetString(string(bv))
+		if aok && bok && !af.IsInf() && !bf.IsInf() {
+			return af.Cmp(bf) == 0
+		}
+		return av == bv
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for name, value := range av {
+			other, exists := bv[name]
+			if !exists || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
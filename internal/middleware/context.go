@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+
+	"dht/internal/namespace"
+	"dht/internal/requestid"
+)
+
+// Context keys are unexported types so no other package can collide with them
+type (
+	userIDKey    struct{}
+	scopesKey    struct{}
+	tenantKeyKey struct{}
+	policiesKey  struct{}
+	keyIDKey     struct{}
+	tokenIDKey   struct{}
+)
+
+// WithUserID returns a copy of ctx carrying the authenticated user's ID
+func WithUserID(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// UserID returns the authenticated user's ID; ok is false if the request
+// was not authenticated
+func UserID(ctx context.Context) (userID int64, ok bool) {
+	userID, ok = ctx.Value(userIDKey{}).(int64)
+	return userID, ok
+}
+
+// WithScopes returns a copy of ctx carrying the scopes granted to the caller
+func WithScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesKey{}, scopes)
+}
+
+// Scopes returns the scopes granted to the caller, nil if none
+func Scopes(ctx context.Context) []string {
+	scopes, _ := ctx.Value(scopesKey{}).([]string)
+	return scopes
+}
+
+// HasScope reports whether the caller was granted scope
+func HasScope(ctx context.Context, scope string) bool {
+	for _, s := range Scopes(ctx) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// WithAPIKeyID returns a copy of ctx carrying the ID of the API key the
+// caller authenticated with, or that minted the caller's scoped token
+func WithAPIKeyID(ctx context.Context, keyID int64) context.Context {
+	return context.WithValue(ctx, keyIDKey{}, keyID)
+}
+
+// APIKeyID returns the ID of the caller's API key, 0 if unknown
+func APIKeyID(ctx context.Context) int64 {
+	keyID, _ := ctx.Value(keyIDKey{}).(int64)
+	return keyID
+}
+
+// WithScopedTokenID returns a copy of ctx marking the caller as
+// authenticated by the scoped token with ID tokenID
+func WithScopedTokenID(ctx context.Context, tokenID string) context.Context {
+	return context.WithValue(ctx, tokenIDKey{}, tokenID)
+}
+
+// ScopedTokenID returns the ID of the scoped token the caller authenticated
+// with, empty if it used an API key
+func ScopedTokenID(ctx context.Context) string {
+	tokenID, _ := ctx.Value(tokenIDKey{}).(string)
+	return tokenID
+}
+
+// WithTenantKey returns a copy of ctx carrying the tenant's data encryption key
+func WithTenantKey(ctx context.Context, key []byte) context.Context {
+	return context.WithValue(ctx, tenantKeyKey{}, key)
+}
+
+// TenantKey returns the tenant's data encryption key, nil if the tenant
+// stores plaintext
+func TenantKey(ctx context.Context) []byte {
+	key, _ := ctx.Value(tenantKeyKey{}).([]byte)
+	return key
+}
+
+// WithNamespacePolicies returns a copy of ctx carrying the tenant's
+// namespace policies
+func WithNamespacePolicies(ctx context.Context, policies namespace.Policies) context.Context {
+	return context.WithValue(ctx, policiesKey{}, policies)
+}
+
+// NamespacePolicies returns the tenant's namespace policies, nil if none
+func NamespacePolicies(ctx context.Context) namespace.Policies {
+	policies, _ := ctx.Value(policiesKey{}).(namespace.Policies)
+	return policies
+}
+
+// RequestID returns the correlation ID of the request, empty if none
+func RequestID(ctx context.Context) string {
+	return requestid.FromContext(ctx)
+}
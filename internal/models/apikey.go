@@ -4,13 +4,18 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrAPIKeyInactive is returned for an API key that can no longer be used
+var ErrAPIKeyInactive = errors.New("API key is no longer active")
+
 type APIKey struct {
 	ID         int64      `json:"id"`
 	UserID     int64      `json:"user_id"`
@@ -151,8 +156,9 @@ func (s *APIKeyService) ListAPIKeys(ctx context.Context, userID int64) ([]*APIKe
 	return apiKeys, nil
 }
 
-// VerifyAPIKey verifies an API key and returns the associated user ID
-func (s *APIKeyService) VerifyAPIKey(ctx context.Context, plainKey string) (int64, error) {
+// VerifyAPIKey verifies an API key and returns the associated user ID, the
+// key's ID and the scopes granted to the key
+func (s *APIKeyService) VerifyAPIKey(ctx context.Context, plainKey string) (int64, int64, []string, error) {
 	// Strip the "ydht_" prefix if present
 	if len(plainKey) > 5 && plainKey[:5] == "ydht_" {
 		plainKey = plainKey[5:]
@@ -163,14 +169,14 @@ func (s *APIKeyService) VerifyAPIKey(ctx context.Context, plainKey string) (int6
 
 	// Find all keys with this prefix
 	query := `
-		SELECT id, user_id, key_hash, is_active, expires_at
+		SELECT id, user_id, key_hash, scopes, is_active, expires_at
 		FROM api_keys
 		WHERE key_prefix = $1 AND is_active = true AND revoked_at IS NULL
 	`
 
 	rows, err := s.db.Query(ctx, query, keyPrefix)
 	if err != nil {
-		return 0, fmt.Errorf("failed to find API key: %w", err)
+		return 0, 0, nil, fmt.Errorf("failed to find API key: %w", err)
 	}
 	defer rows.Close()
 
@@ -178,10 +184,11 @@ func (s *APIKeyService) VerifyAPIKey(ctx context.Context, plainKey string) (int6
 	for rows.Next() {
 		var id, userID int64
 		var keyHash string
+		var scopes []string
 		var isActive bool
 		var expiresAt *time.Time
 
-		err := rows.Scan(&id, &userID, &keyHash, &isActive, &expiresAt)
+		err := rows.Scan(&id, &userID, &keyHash, &scopes, &isActive, &expiresAt)
 		if err != nil {
 			continue
 		}
@@ -197,9 +204,31 @@ func (s *APIKeyService) VerifyAPIKey(ctx context.Context, plainKey string) (int6
 			updateQuery := `UPDATE api_keys SET last_used_at = NOW() WHERE id = $1`
 			s.db.Exec(ctx, updateQuery, id)
 
-			return userID, nil
+			return userID, id, scopes, nil
 		}
 	}
 
-	return 0, fmt.Errorf("invalid API key")
+	return 0, 0, nil, fmt.Errorf("invalid API key")
+}
+
+// ActiveKeyScopes returns the scopes of the user's API key with the given
+// ID, or ErrAPIKeyInactive if it has since been deactivated, revoked or has
+// expired (or does not exist)
+func (s *APIKeyService) ActiveKeyScopes(ctx context.Context, keyID, userID int64) ([]string, error) {
+	query := `
+		SELECT scopes
+		FROM api_keys
+		WHERE id = $1 AND user_id = $2 AND is_active = true AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at > NOW())
+	`
+
+	var scopes []string
+	err := s.db.QueryRow(ctx, query, keyID, userID).Scan(&scopes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAPIKeyInactive
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return scopes, nil
 }
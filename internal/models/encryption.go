@@ -0,0 +1,170 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"dht/internal/envelope"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	// ErrNoEncryptionKey is returned when a user has not registered a key
+	ErrNoEncryptionKey = errors.New("no encryption key registered")
+	// ErrEncryptionKeyExists is returned when registering over an existing key without replace
+	ErrEncryptionKeyExists = errors.New("encryption key already registered")
+	// ErrNoKEK is returned when raw keys are registered but no key-encryption key is configured
+	ErrNoKEK = errors.New("key-encryption key is not configured")
+)
+
+// EncryptionKey is a tenant's registered data-encryption key
+// Raw keys are stored wrapped with the operator's key-encryption key;
+// KMS references are stored as-is and resolved by the gateway.
+type EncryptionKey struct {
+	UserID     int64     `json:"user_id"`
+	Source     string    `json:"source"` // "key" or "kms"
+	KeyID      string    `json:"key_id,omitempty"`
+	WrappedKey string    `json:"-"`
+	KMSURI     string    `json:"kms_uri,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TenantEncryption is what the gateway needs to encrypt a tenant's values
+// (returned with API key validation)
+type TenantEncryption struct {
+	Source     string `json:"source"`
+	KeyID      string `json:"key_id,omitempty"`
+	WrappedKey string `json:"wrapped_key,omitempty"`
+	KMSURI     string `json:"kms_uri,omitempty"`
+}
+
+type EncryptionKeyService struct {
+	db  *pgxpool.Pool
+	kek []byte
+	kms envelope.KMSPolicy
+}
+
+// NewEncryptionKeyService creates the service; kek may be nil, in which
+// case only KMS references can be registered, and kms limits the ones that can
+func NewEncryptionKeyService(db *pgxpool.Pool, kek []byte, kms envelope.KMSPolicy) *EncryptionKeyService {
+	return &EncryptionKeyService{db: db, kek: kek, kms: kms}
+}
+
+// ValidateKMSURI checks that a KMS reference is one tenants may register
+func (s *EncryptionKeyService) ValidateKMSURI(kmsURI string) error {
+	return s.kms.Validate(kmsURI)
+}
+
+// SetKey registers a raw data-encryption key, stored wrapped with the KEK
+func (s *EncryptionKeyService) SetKey(ctx context.Context, userID int64, key []byte, replace bool) (*EncryptionKey, error) {
+	if s.kek == nil {
+		return nil, ErrNoKEK
+	}
+
+	wrapped, err := envelope.Wrap(s.kek, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
+	}
+
+	return s.upsert(ctx, userID, "key", envelope.KeyID(key), wrapped, "", replace)
+}
+
+// SetKMS registers a KMS reference
+func (s *EncryptionKeyService) SetKMS(ctx context.Context, userID int64, kmsURI string, replace bool) (*EncryptionKey, error) {
+	if err := s.kms.Validate(kmsURI); err != nil {
+		return nil, err
+	}
+
+	return s.upsert(ctx, userID, "kms", "", "", kmsURI, replace)
+}
+
+func (s *EncryptionKeyService) upsert(ctx context.Context, userID int64, source, keyID, wrappedKey, kmsURI string, replace bool) (*EncryptionKey, error) {
+	query := `
+		INSERT INTO tenant_encryption_keys (user_id, source, key_id, wrapped_key, kms_uri)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''))
+		ON CONFLICT (user_id) DO NOTHING
+		RETURNING created_at, updated_at
+	`
+	if replace {
+		query = `
+			INSERT INTO tenant_encryption_keys (user_id, source, key_id, wrapped_key, kms_uri)
+			VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''))
+			ON CONFLICT (user_id) DO UPDATE
+			SET source = EXCLUDED.source, key_id = EXCLUDED.key_id,
+			    wrapped_key = EXCLUDED.wrapped_key, kms_uri = EXCLUDED.kms_uri
+			RETURNING created_at, updated_at
+		`
+	}
+
+	key := &EncryptionKey{
+		UserID:     userID,
+		Source:     source,
+		KeyID:      keyID,
+		WrappedKey: wrappedKey,
+		KMSURI:     kmsURI,
+	}
+	err := s.db.QueryRow(ctx, query, userID, source, keyID, wrappedKey, kmsURI).Scan(&key.CreatedAt, &key.UpdatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrEncryptionKeyExists
+		}
+		return nil, fmt.Errorf("failed to store encryption key: %w", err)
+	}
+
+	return key, nil
+}
+
+// GetKey returns a user's registered key
+func (s *EncryptionKeyService) GetKey(ctx context.Context, userID int64) (*EncryptionKey, error) {
+	query := `
+		SELECT user_id, source, COALESCE(key_id, ''), COALESCE(wrapped_key, ''), COALESCE(kms_uri, ''), created_at, updated_at
+		FROM tenant_encryption_keys
+		WHERE user_id = $1
+	`
+
+	var key EncryptionKey
+	err := s.db.QueryRow(ctx, query, userID).Scan(
+		&key.UserID,
+		&key.Source,
+		&key.KeyID,
+		&key.WrappedKey,
+		&key.KMSURI,
+		&key.CreatedAt,
+		&key.UpdatedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrNoEncryptionKey
+		}
+		return nil, fmt.Errorf("failed to get encryption key: %w", err)
+	}
+
+	return &key, nil
+}
+
+// DeleteKey removes a user's key; values encrypted with it become unreadable
+func (s *EncryptionKeyService) DeleteKey(ctx context.Context, userID int64) error {
+	tag, err := s.db.Exec(ctx, `DELETE FROM tenant_encryption_keys WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete encryption key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoEncryptionKey
+	}
+	return nil
+}
+
+// TenantEncryption returns the gateway-facing form of a key
+func (k *EncryptionKey) TenantEncryption() *TenantEncryption {
+	return &TenantEncryption{
+		Source:     k.Source,
+		KeyID:      k.KeyID,
+		WrappedKey: k.WrappedKey,
+		KMSURI:     k.KMSURI,
+	}
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Error codes carried in APIError.Code. Clients branch on these, so a code
+// must never change meaning once released; add a new one instead.
+const (
+	ErrCodeInvalidRequest  = "invalid_request"
+	ErrCodeUnauthorized    = "unauthorized"
+	ErrCodeForbidden       = "forbidden"
+	ErrCodeNotFound        = "not_found"
+	ErrCodeConflict        = "conflict"
+	ErrCodeKeyLocked       = "key_locked"
+	ErrCodeTxnConflict     = "txn_conflict"
+	ErrCodeConditionFailed = "condition_failed"
+	ErrCodeTxnInDoubt      = "txn_in_doubt"
+	ErrCodeWriteConflict   = "write_conflict"
+	ErrCodeRateLimited     = "rate_limited"
+	ErrCodeQuotaExceeded   = "quota_exceeded"
+	ErrCodeWritesFrozen    = "writes_frozen"
+	ErrCodeNodeUnavailable = "node_unavailable"
+	ErrCodeUnavailable     = "unavailable"
+	ErrCodeUpstream        = "upstream_error"
+	ErrCodeTimeout         = "timeout"
+	ErrCodeInternal        = "internal"
+)
+
+// APIError is the error body returned by every service
+type APIError struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Retryable bool                   `json:"retryable"`
+}
+
+// ErrorResponse wraps an APIError as {"error": {...}}
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+// NewAPIError creates an error for code, deriving whether it is retryable
+func NewAPIError(code, message string, details map[string]interface{}) *APIError {
+	return &APIError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		Retryable: IsRetryable(code),
+	}
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// CodeForStatus returns the default error code for an HTTP status
+func CodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeInvalidRequest
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusConflict:
+		return ErrCodeConflict
+	case http.StatusTooManyRequests:
+		return ErrCodeRateLimited
+	case http.StatusBadGateway:
+		return ErrCodeUpstream
+	case http.StatusServiceUnavailable:
+		return ErrCodeUnavailable
+	case http.StatusGatewayTimeout:
+		return ErrCodeTimeout
+	}
+	if status >= http.StatusInternalServerError {
+		return ErrCodeInternal
+	}
+	return ErrCodeInvalidRequest
+}
+
+// IsRetryable reports whether a request that failed with code may succeed
+// if sent again unchanged
+func IsRetryable(code string) bool {
+	switch code {
+	case ErrCodeKeyLocked, ErrCodeTxnConflict, ErrCodeWriteConflict, ErrCodeRateLimited, ErrCodeWritesFrozen,
+		ErrCodeNodeUnavailable, ErrCodeUnavailable, ErrCodeUpstream, ErrCodeTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Reasons an invitation code cannot be redeemed
+var (
+	ErrInvitationNotFound      = errors.New("invitation not found")
+	ErrInvitationExpired       = errors.New("invitation has expired")
+	ErrInvitationUsedUp        = errors.New("invitation has already been used")
+	ErrInvitationRevoked       = errors.New("invitation has been revoked")
+	ErrInvitationEmailMismatch = errors.New("invitation is for a different email address")
+)
+
+// Invitation is an admin-issued code that lets someone sign up while signup
+// is closed. The code itself is only known when it is created.
+type Invitation struct {
+	ID             int64                  `json:"id"`
+	CodePrefix     string                 `json:"code_prefix"`
+	Email          *string                `json:"email,omitempty"`
+	Note           string                 `json:"note,omitempty"`
+	MaxUses        int                    `json:"max_uses"`
+	Uses           int                    `json:"uses"`
+	Status         string                 `json:"status"` // "active", "expired", "used" or "revoked"
+	ExpiresAt      time.Time              `json:"expires_at"`
+	RevokedAt      *time.Time             `json:"revoked_at,omitempty"`
+	LastRedeemedAt *time.Time             `json:"last_redeemed_at,omitempty"`
+	CreatedAt      time.Time              `json:"created_at"`
+	UpdatedAt      time.Time              `json:"updated_at"`
+	Redemptions    []InvitationRedemption `json:"redemptions,omitempty"`
+}
+
+// InvitationRedemption is an account created with an invitation
+type InvitationRedemption struct {
+	UserID     int64     `json:"user_id"`
+	Email      string    `json:"email"`
+	Username   string    `json:"username"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+// check returns why the invitation cannot be redeemed now, if it cannot
+func (inv *Invitation) check(now time.Time) error {
+	switch {
+	case inv.RevokedAt != nil:
+		return ErrInvitationRevoked
+	case inv.Uses >= inv.MaxUses:
+		return ErrInvitationUsedUp
+	case !inv.ExpiresAt.After(now):
+		return ErrInvitationExpired
+	}
+	return nil
+}
+
+func (inv *Invitation) setStatus(now time.Time) {
+	switch inv.check(now) {
+	case nil:
+		inv.Status = "active"
+	case ErrInvitationRevoked:
+		inv.Status = "revoked"
+	case ErrInvitationUsedUp:
+		inv.Status = "used"
+	default:
+		inv.Status = "expired"
+	}
+}
+
+type InvitationService struct {
+	db *pgxpool.Pool
+}
+
+func NewInvitationService(db *pgxpool.Pool) *InvitationService {
+	return &InvitationService{db: db}
+}
+
+const invitationColumns = `id, code_prefix, email, note, max_uses, uses, expires_at, revoked_at, last_redeemed_at, created_at, updated_at`
+
+func scanInvitation(row pgx.Row) (*Invitation, error) {
+	var inv Invitation
+	err := row.Scan(
+		&inv.ID,
+		&inv.CodePrefix,
+		&inv.Email,
+		&inv.Note,
+		&inv.MaxUses,
+		&inv.Uses,
+		&inv.ExpiresAt,
+		&inv.RevokedAt,
+		&inv.LastRedeemedAt,
+		&inv.CreatedAt,
+		&inv.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	inv.setStatus(time.Now())
+	return &inv, nil
+}
+
+// generateInvitationCode returns a new random code. Codes carry 128 random
+// bits, so a plain SHA-256 is enough to store them and look them up.
+func generateInvitationCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "inv_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashInvitationCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create issues an invitation valid for expiresIn and maxUses signups,
+// optionally only for email. The plain code is returned once and never
+// stored.
+func (s *InvitationService) Create(ctx context.Context, email, note string, maxUses int, expiresIn time.Duration) (*Invitation, string, error) {
+	code, err := generateInvitationCode()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate invitation code: %w", err)
+	}
+
+	var boundEmail *string
+	if email != "" {
+		boundEmail = &email
+	}
+
+	query := `
+		INSERT INTO invitations (code_hash, code_prefix, email, note, max_uses, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + invitationColumns
+
+	inv, err := scanInvitation(s.db.QueryRow(ctx, query, hashInvitationCode(code), code[:12], boundEmail, note, maxUses, time.Now().Add(expiresIn)))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create invitation: %w", err)
+	}
+
+	return inv, code, nil
+}
+
+// List returns invitations newest first
+func (s *InvitationService) List(ctx context.Context, limit int) ([]Invitation, error) {
+	query := `SELECT ` + invitationColumns + ` FROM invitations ORDER BY created_at DESC, id DESC LIMIT $1`
+
+	rows, err := s.db.Query(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invitations: %w", err)
+	}
+	defer rows.Close()
+
+	list := []Invitation{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan invitation: %w", err)
+		}
+		list = append(list, *inv)
+	}
+	return list, rows.Err()
+}
+
+// Get returns an invitation with the accounts created with it
+func (s *InvitationService) Get(ctx context.Context, id int64) (*Invitation, error) {
+	inv, err := scanInvitation(s.db.QueryRow(ctx, `SELECT `+invitationColumns+` FROM invitations WHERE id = $1`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInvitationNotFound
+		}
+		return nil, fmt.Errorf("failed to get invitation: %w", err)
+	}
+
+	query := `
+		SELECT r.user_id, u.email, u.username, r.redeemed_at
+		FROM invitation_redemptions r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.invitation_id = $1
+		ORDER BY r.redeemed_at
+	`
+
+	rows, err := s.db.Query(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invitation redemptions: %w", err)
+	}
+	defer rows.Close()
+
+	inv.Redemptions = []InvitationRedemption{}
+	for rows.Next() {
+		var r InvitationRedemption
+		if err := rows.Scan(&r.UserID, &r.Email, &r.Username, &r.RedeemedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan invitation redemption: %w", err)
+		}
+		inv.Redemptions = append(inv.Redemptions, r)
+	}
+	return inv, rows.Err()
+}
+
+// Revoke stops an invitation from being redeemed; accounts already created
+// with it are kept. Revoking a revoked invitation is a no-op.
+func (s *InvitationService) Revoke(ctx context.Context, id int64) (*Invitation, error) {
+	query := `
+		UPDATE invitations SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE id = $1
+		RETURNING ` + invitationColumns
+
+	inv, err := scanInvitation(s.db.QueryRow(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInvitationNotFound
+		}
+		return nil, fmt.Errorf("failed to revoke invitation: %w", err)
+	}
+	return inv, nil
+}
+
+// CreateInvitedUser creates a user with an invitation code, redeeming it in
+// the same transaction so a code cannot be used more often than allowed
+func (s *UserService) CreateInvitedUser(ctx context.Context, email, username, password, code string) (*User, error) {
+	hashedPassword, err := s.authService.HashPassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the invitation until the redemption commits
+	inv, err := scanInvitation(tx.QueryRow(ctx, `SELECT `+invitationColumns+` FROM invitations WHERE code_hash = $1 FOR UPDATE`, hashInvitationCode(code)))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInvitationNotFound
+		}
+		return nil, fmt.Errorf("failed to find invitation: %w", err)
+	}
+	if err := inv.check(time.Now()); err != nil {
+		return nil, err
+	}
+	if inv.Email != nil && !strings.EqualFold(*inv.Email, email) {
+		return nil, ErrInvitationEmailMismatch
+	}
+
+	user, err := insertUser(ctx, tx, email, username, hashedPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE invitations SET uses = uses + 1, last_redeemed_at = NOW() WHERE id = $1`, inv.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem invitation: %w", err)
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO invitation_redemptions (invitation_id, user_id) VALUES ($1, $2)`, inv.ID, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record invitation redemption: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit signup: %w", err)
+	}
+	return user, nil
+}
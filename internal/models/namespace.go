@@ -0,0 +1,103 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"dht/internal/namespace"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrNamespaceNotFound is returned when a namespace has no settings
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+// NamespaceSettings is a tenant's policy for the keys of one namespace
+type NamespaceSettings struct {
+	Namespace string `json:"namespace"`
+	namespace.Policy
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type NamespaceService struct {
+	db *pgxpool.Pool
+}
+
+func NewNamespaceService(db *pgxpool.Pool) *NamespaceService {
+	return &NamespaceService{db: db}
+}
+
+// Set creates or replaces the policy of a user's namespace
+func (s *NamespaceService) Set(ctx context.Context, userID int64, name string, policy namespace.Policy) (*NamespaceSettings, error) {
+	query := `
+		INSERT INTO namespace_settings (user_id, namespace, consistency, replication_factor)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, 0))
+		ON CONFLICT (user_id, namespace) DO UPDATE
+		SET consistency = EXCLUDED.consistency, replication_factor = EXCLUDED.replication_factor
+		RETURNING created_at, updated_at
+	`
+
+	settings := &NamespaceSettings{Namespace: name, Policy: policy}
+	err := s.db.QueryRow(ctx, query, userID, name, policy.Consistency, policy.ReplicationFactor).Scan(&settings.CreatedAt, &settings.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store namespace settings: %w", err)
+	}
+
+	return settings, nil
+}
+
+// List returns a user's namespace settings ordered by namespace
+func (s *NamespaceService) List(ctx context.Context, userID int64) ([]NamespaceSettings, error) {
+	query := `
+		SELECT namespace, COALESCE(consistency, ''), COALESCE(replication_factor, 0), created_at, updated_at
+		FROM namespace_settings
+		WHERE user_id = $1
+		ORDER BY namespace
+	`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespace settings: %w", err)
+	}
+	defer rows.Close()
+
+	list := []NamespaceSettings{}
+	for rows.Next() {
+		var settings NamespaceSettings
+		if err := rows.Scan(&settings.Namespace, &settings.Consistency, &settings.ReplicationFactor, &settings.CreatedAt, &settings.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan namespace settings: %w", err)
+		}
+		list = append(list, settings)
+	}
+	return list, rows.Err()
+}
+
+// Policies returns a user's namespace policies keyed by namespace, in the
+// form the gateway applies them
+func (s *NamespaceService) Policies(ctx context.Context, userID int64) (namespace.Policies, error) {
+	list, err := s.List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make(namespace.Policies, len(list))
+	for _, settings := range list {
+		policies[settings.Namespace] = settings.Policy
+	}
+	return policies, nil
+}
+
+// Delete removes the settings of a user's namespace
+func (s *NamespaceService) Delete(ctx context.Context, userID int64, name string) error {
+	tag, err := s.db.Exec(ctx, `DELETE FROM namespace_settings WHERE user_id = $1 AND namespace = $2`, userID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete namespace settings: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNamespaceNotFound
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// How soft-deleted accounts are purged once their retention is over
+const (
+	PurgeAnonymize = "anonymize" // scrub the account, keep its usage and billing history
+	PurgeDelete    = "delete"    // delete the account and every row referencing it
+)
+
+// purgeBatchSize bounds the rows one statement of a purge touches, so a
+// backlog of deleted users never holds locks for long
+const purgeBatchSize = 1000
+
+// PurgeRetention is how long after a user is soft-deleted each kind of their
+// data is kept. Sessions and usage PII never outlive the account itself.
+type PurgeRetention struct {
+	Users    time.Duration // then the account is anonymized or deleted
+	Sessions time.Duration // then the user's sessions are deleted
+	UsagePII time.Duration // then IP addresses and user agents of usage records are cleared
+}
+
+// PurgeResult counts what one purge pass removed
+type PurgeResult struct {
+	StartedAt       time.Time `json:"started_at"`
+	DurationMs      int64     `json:"duration_ms"`
+	SessionsDeleted int64     `json:"sessions_deleted"`
+	UsageScrubbed   int64     `json:"usage_records_scrubbed"`
+	UsersAnonymized int64     `json:"users_anonymized"`
+	UsersDeleted    int64     `json:"users_deleted"`
+}
+
+// PurgeService removes the personal data of soft-deleted users once their
+// retention is over; passes never overlap
+type PurgeService struct {
+	db        *pgxpool.Pool
+	mode      string
+	retention PurgeRetention
+	running   sync.Mutex
+}
+
+// NewPurgeService creates the service; mode is PurgeAnonymize or PurgeDelete
+func NewPurgeService(db *pgxpool.Pool, mode string, retention PurgeRetention) *PurgeService {
+	return &PurgeService{db: db, mode: mode, retention: retention}
+}
+
+// Purge runs one pass over every soft-deleted user. Each step works in
+// batches and is safe to repeat, so a pass cut short by ctx or an error is
+// finished by the next one. Keys the users stored in the DHT are not touched.
+func (s *PurgeService) Purge(ctx context.Context) (*PurgeResult, error) {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	result := &PurgeResult{StartedAt: time.Now()}
+	defer func() { result.DurationMs = time.Since(result.StartedAt).Milliseconds() }()
+
+	cutoff := func(retention time.Duration) time.Time {
+		return result.StartedAt.Add(-min(retention, s.retention.Users))
+	}
+
+	var err error
+	result.SessionsDeleted, err = s.batched(ctx, `
+		DELETE FROM sessions
+		WHERE id IN (
+			SELECT sessions.id FROM sessions
+			JOIN users ON users.id = sessions.user_id
+			WHERE users.deleted_at < $1
+			LIMIT $2
+		)
+	`, cutoff(s.retention.Sessions))
+	if err != nil {
+		return result, fmt.Errorf("failed to delete sessions: %w", err)
+	}
+
+	result.UsageScrubbed, err = s.batched(ctx, `
+		UPDATE usage_records SET ip_address = NULL, user_agent = NULL
+		WHERE id IN (
+			SELECT usage_records.id FROM usage_records
+			JOIN users ON users.id = usage_records.user_id
+			WHERE users.deleted_at < $1
+			  AND (usage_records.ip_address IS NOT NULL OR usage_records.user_agent IS NOT NULL)
+			LIMIT $2
+		)
+	`, cutoff(s.retention.UsagePII))
+	if err != nil {
+		return result, fmt.Errorf("failed to scrub usage records: %w", err)
+	}
+
+	if s.mode == PurgeDelete {
+		result.UsersDeleted, err = s.purgeUsers(ctx, cutoff(s.retention.Users), false)
+	} else {
+		result.UsersAnonymized, err = s.purgeUsers(ctx, cutoff(s.retention.Users), true)
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to purge users: %w", err)
+	}
+	return result, nil
+}
+
+// batched runs query (taking the cutoff and a batch size) until it affects
+// fewer rows than a full batch, returning the rows affected in total
+func (s *PurgeService) batched(ctx context.Context, query string, cutoff time.Time) (int64, error) {
+	var total int64
+	for {
+		tag, err := s.db.Exec(ctx, query, cutoff, purgeBatchSize)
+		if err != nil {
+			return total, err
+		}
+		total += tag.RowsAffected()
+		if tag.RowsAffected() < purgeBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// purgeUsers anonymizes or deletes the users soft-deleted before cutoff, a
+// batch per transaction. Invitations they redeemed lose the email they were
+// bound to.
+func (s *PurgeService) purgeUsers(ctx context.Context, cutoff time.Time, anonymize bool) (int64, error) {
+	due := `SELECT id FROM users WHERE deleted_at < $1 ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED`
+	if anonymize {
+		due = `SELECT id FROM users WHERE deleted_at < $1 AND anonymized_at IS NULL ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED`
+	}
+
+	var total int64
+	for {
+		n, err := s.purgeUserBatch(ctx, due, cutoff, anonymize)
+		total += n
+		if err != nil || n < purgeBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (s *PurgeService) purgeUserBatch(ctx context.Context, due string, cutoff time.Time, anonymize bool) (int64, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, due, cutoff, purgeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE invitations SET email = NULL
+		FROM invitation_redemptions, users
+		WHERE invitation_redemptions.invitation_id = invitations.id
+		  AND users.id = invitation_redemptions.user_id
+		  AND users.id = ANY($1)
+		  AND LOWER(invitations.email) = LOWER(users.email)
+	`, ids)
+	if err != nil {
+		return 0, fmt.Errorf("failed to scrub invitations: %w", err)
+	}
+
+	if anonymize {
+		// The keys of a deleted account must stop working even though the
+		// row stays
+		_, err = tx.Exec(ctx, `
+			UPDATE api_keys SET is_active = false, revoked_at = COALESCE(revoked_at, NOW())
+			WHERE user_id = ANY($1) AND (is_active OR revoked_at IS NULL)
+		`, ids)
+		if err != nil {
+			return 0, fmt.Errorf("failed to revoke API keys: %w", err)
+		}
+
+		// Email and username stay unique; an empty password hash matches no password
+		_, err = tx.Exec(ctx, `
+			UPDATE users SET
+				email = 'deleted-' || id || '@anonymized.invalid',
+				username = 'deleted-' || id,
+				password_hash = '',
+				last_login_at = NULL,
+				is_active = false,
+				anonymized_at = NOW()
+			WHERE id = ANY($1)
+		`, ids)
+	} else {
+		// Everything referencing the users goes with them (ON DELETE CASCADE)
+		_, err = tx.Exec(ctx, `DELETE FROM users WHERE id = ANY($1)`, ids)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
@@ -8,10 +8,24 @@ type ReplicationRequest struct {
 	Value        []byte        `json:"value"`
 	Operation    string        `json:"operation"` // "SET" or "DELETE"
 	TTL          time.Duration `json:"ttl"`
-	Consistency  string        `json:"consistency"` // "strong" or "eventual"
+	Sliding      bool          `json:"sliding,omitempty"` // TTL is refreshed on every read
+	Consistency  string        `json:"consistency"`       // "strong" or "eventual"
 	PrimaryNode  string        `json:"primary_node"`
 	ReplicaNodes []string      `json:"replica_nodes"`
 	UserID       int64         `json:"user_id"`
+	RequestID    string        `json:"request_id,omitempty"` // Correlation ID of the client operation
+
+	// Version is the primary's version of the write (the version removed, for
+	// a DELETE); replicas use it to ignore a delete older than their value
+	Version uint64 `json:"version,omitempty"`
+
+	// ReplicationFactor is set by the key's namespace (0 = default); replicas
+	// record it so rebalancing keeps the key on that many nodes
+	ReplicationFactor int `json:"replication_factor,omitempty"`
+
+	// ShadowNodes also receive the write during a node rollout, without
+	// counting towards the quorum
+	ShadowNodes []string `json:"shadow_nodes,omitempty"`
 }
 
 // ReplicationResponse represents a replication response
@@ -32,4 +46,5 @@ type ReplicationMetrics struct {
 	AverageAckTime     float64 `json:"average_ack_time_ms"`
 	MaxReplicationLag  float64 `json:"max_replication_lag_ms"`
 	RetriesInProgress  int     `json:"retries_in_progress"`
+	CoalescedTasks     int64   `json:"coalesced_tasks"` // writes superseded by a newer one before being sent
 }
@@ -1,12 +1,18 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"dht/internal/namespace"
+)
 
 // Request models
 type SignupRequest struct {
 	Email    string `json:"email"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// InviteCode is required while signup is invitation-only
+	InviteCode string `json:"invite_code,omitempty"`
 }
 
 type LoginRequest struct {
@@ -48,3 +54,35 @@ type APIKeyResponse struct {
 	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
 	CreatedAt  time.Time  `json:"created_at"`
 }
+
+// Key validation between the gateway and the usermanager
+
+// ValidateKeyRequest asks the usermanager to validate an API key
+type ValidateKeyRequest struct {
+	APIKey string `json:"api_key"`
+}
+
+// ValidateTokenRequest asks the usermanager to validate a scoped token whose
+// signature, expiry and scope the gateway has already checked
+type ValidateTokenRequest struct {
+	UserID    int64     `json:"user_id"`
+	KeyID     int64     `json:"key_id"`
+	TokenID   string    `json:"token_id"`
+	SingleUse bool      `json:"single_use"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// KeyValidation is what the usermanager reports about a valid API key or
+// scoped token: who the caller is and the tenant settings the gateway applies
+type KeyValidation struct {
+	Valid      bool               `json:"valid"`
+	UserID     int64              `json:"user_id"`
+	KeyID      int64              `json:"key_id"`
+	Scopes     []string           `json:"scopes"`
+	Encryption *TenantEncryption  `json:"encryption,omitempty"` // nil if the tenant stores plaintext
+	Namespaces namespace.Policies `json:"namespaces,omitempty"`
+
+	// Storage quota (0 = unlimited) and usage as of the last metering pass
+	StorageQuotaBytes int64 `json:"storage_quota_bytes"`
+	StorageUsedBytes  int64 `json:"storage_used_bytes"`
+}
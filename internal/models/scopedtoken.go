@@ -0,0 +1,51 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrScopedTokenUsed is returned when a single-use scoped token is presented
+// a second time
+var ErrScopedTokenUsed = errors.New("scoped token has already been used")
+
+// ScopedTokenService records the redemption of single-use scoped tokens.
+// The tokens themselves are minted and verified by the gateway; only their
+// IDs are stored here, and only until they expire.
+type ScopedTokenService struct {
+	db *pgxpool.Pool
+}
+
+func NewScopedTokenService(db *pgxpool.Pool) *ScopedTokenService {
+	return &ScopedTokenService{db: db}
+}
+
+// Redeem marks the single-use token tokenID as used, or returns
+// ErrScopedTokenUsed if it already was. The insert is atomic, so of two
+// concurrent requests with the same token only one succeeds.
+func (s *ScopedTokenService) Redeem(ctx context.Context, tokenID string, userID, keyID int64, expiresAt time.Time) error {
+	// An expired token is refused before it gets here, so its row is no
+	// longer needed; the hour covers clock skew with the gateways
+	if _, err := s.db.Exec(ctx, `DELETE FROM used_scoped_tokens WHERE expires_at < NOW() - INTERVAL '1 hour'`); err != nil {
+		return fmt.Errorf("failed to remove expired tokens: %w", err)
+	}
+
+	query := `
+		INSERT INTO used_scoped_tokens (token_id, user_id, api_key_id, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (token_id) DO NOTHING
+	`
+
+	tag, err := s.db.Exec(ctx, query, tokenID, userID, keyID, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to redeem token: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrScopedTokenUsed
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrUserNotFound is returned when a storage quota is set for an unknown user
+var ErrUserNotFound = errors.New("user not found")
+
+// StorageUsage is the storage a tenant holds across the cluster, counting
+// each key once (on its primary) whatever the replication factor
+type StorageUsage struct {
+	UserID int64 `json:"user_id"`
+	Keys   int64 `json:"keys"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// StorageSnapshot is the result of one metering pass over every node
+type StorageSnapshot struct {
+	TakenAt time.Time      `json:"taken_at"`
+	Tenants []StorageUsage `json:"tenants"`
+}
+
+// StorageUsageRecord is a tenant's stored usage at one metering pass
+type StorageUsageRecord struct {
+	Keys    int64     `json:"keys"`
+	Bytes   int64     `json:"bytes"`
+	TakenAt time.Time `json:"taken_at"`
+}
+
+// StorageQuota is a tenant's quota and latest metered usage
+type StorageQuota struct {
+	QuotaBytes int64 `json:"storage_quota_bytes"` // 0 if unlimited
+	UsedBytes  int64 `json:"storage_used_bytes"`
+}
+
+// StorageBillingLine summarises a tenant's storage over a billing period
+type StorageBillingLine struct {
+	UserID    int64   `json:"user_id"`
+	Email     string  `json:"email"`
+	Snapshots int64   `json:"snapshots"`
+	AvgBytes  float64 `json:"avg_bytes"`
+	PeakBytes int64   `json:"peak_bytes"`
+	PeakKeys  int64   `json:"peak_keys"`
+}
+
+type StorageUsageService struct {
+	db           *pgxpool.Pool
+	defaultQuota int64
+}
+
+// NewStorageUsageService creates the service; defaultQuota applies to users
+// without a quota of their own (0 = unlimited)
+func NewStorageUsageService(db *pgxpool.Pool, defaultQuota int64) *StorageUsageService {
+	return &StorageUsageService{db: db, defaultQuota: defaultQuota}
+}
+
+// RecordSnapshot stores a metering pass. Every active user gets a row, so a
+// tenant missing from the snapshot is recorded as holding nothing; owners
+// that are not (or no longer) users are skipped. Returns the rows stored.
+func (s *StorageUsageService) RecordSnapshot(ctx context.Context, snapshot *StorageSnapshot) (int64, error) {
+	userIDs := make([]int64, len(snapshot.Tenants))
+	keys := make([]int64, len(snapshot.Tenants))
+	bytes := make([]int64, len(snapshot.Tenants))
+	for i, tenant := range snapshot.Tenants {
+		userIDs[i] = tenant.UserID
+		keys[i] = tenant.Keys
+		bytes[i] = tenant.Bytes
+	}
+
+	query := `
+		INSERT INTO storage_usage_snapshots (user_id, key_count, value_bytes, taken_at)
+		SELECT users.id, COALESCE(usage.key_count, 0), COALESCE(usage.value_bytes, 0), $4
+		FROM users
+		LEFT JOIN unnest($1::bigint[], $2::bigint[], $3::bigint[]) AS usage(user_id, key_count, value_bytes)
+		       ON usage.user_id = users.id
+		WHERE users.deleted_at IS NULL
+	`
+
+	tag, err := s.db.Exec(ctx, query, userIDs, keys, bytes, snapshot.TakenAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store storage snapshot: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// History returns a user's most recent snapshots, newest first
+func (s *StorageUsageService) History(ctx context.Context, userID int64, limit int) ([]StorageUsageRecord, error) {
+	query := `
+		SELECT key_count, value_bytes, taken_at
+		FROM storage_usage_snapshots
+		WHERE user_id = $1
+		ORDER BY taken_at DESC
+		LIMIT $2
+	`
+
+	rows, err := s.db.Query(ctx, query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage usage: %w", err)
+	}
+	defer rows.Close()
+
+	records := []StorageUsageRecord{}
+	for rows.Next() {
+		var record StorageUsageRecord
+		if err := rows.Scan(&record.Keys, &record.Bytes, &record.TakenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan storage usage: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Quota returns a user's effective quota and the bytes of their latest snapshot
+func (s *StorageUsageService) Quota(ctx context.Context, userID int64) (*StorageQuota, error) {
+	query := `
+		SELECT COALESCE(users.storage_quota_bytes, $2),
+		       COALESCE((SELECT value_bytes FROM storage_usage_snapshots
+		                 WHERE user_id = users.id
+		                 ORDER BY taken_at DESC LIMIT 1), 0)
+		FROM users
+		WHERE users.id = $1
+	`
+
+	var quota StorageQuota
+	err := s.db.QueryRow(ctx, query, userID, s.defaultQuota).Scan(&quota.QuotaBytes, &quota.UsedBytes)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get storage quota: %w", err)
+	}
+	return &quota, nil
+}
+
+// SetQuota sets a user's quota in bytes (0 = unlimited); nil reverts the
+// user to the default quota
+func (s *StorageUsageService) SetQuota(ctx context.Context, userID int64, quotaBytes *int64) error {
+	tag, err := s.db.Exec(ctx, `UPDATE users SET storage_quota_bytes = $2 WHERE id = $1 AND deleted_at IS NULL`, userID, quotaBytes)
+	if err != nil {
+		return fmt.Errorf("failed to set storage quota: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// BillingExport summarises every user's snapshots taken in [from, to)
+func (s *StorageUsageService) BillingExport(ctx context.Context, from, to time.Time) ([]StorageBillingLine, error) {
+	query := `
+		SELECT users.id, users.email, COUNT(*), AVG(snap.value_bytes)::float8,
+		       MAX(snap.value_bytes), MAX(snap.key_count)
+		FROM storage_usage_snapshots AS snap
+		JOIN users ON users.id = snap.user_id
+		WHERE snap.taken_at >= $1 AND snap.taken_at < $2
+		GROUP BY users.id, users.email
+		ORDER BY users.id
+	`
+
+	rows, err := s.db.Query(ctx, query, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export storage usage: %w", err)
+	}
+	defer rows.Close()
+
+	lines := []StorageBillingLine{}
+	for rows.Next() {
+		var line StorageBillingLine
+		if err := rows.Scan(&line.UserID, &line.Email, &line.Snapshots, &line.AvgBytes, &line.PeakBytes, &line.PeakKeys); err != nil {
+			return nil, fmt.Errorf("failed to scan storage usage: %w", err)
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
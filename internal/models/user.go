@@ -59,7 +59,16 @@ func (s *UserService) CreateUser(ctx context.Context, email, username, password
 		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	// Insert user
+	return insertUser(ctx, s.db, email, username, hashedPassword)
+}
+
+// rowQuerier is a pool or a transaction
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// insertUser inserts an active, unverified user with an already hashed password
+func insertUser(ctx context.Context, q rowQuerier, email, username, hashedPassword string) (*User, error) {
 	query := `
 		INSERT INTO users (email, username, password_hash, is_active, is_verified)
 		VALUES ($1, $2, $3, true, false)
@@ -67,7 +76,7 @@ func (s *UserService) CreateUser(ctx context.Context, email, username, password
 	`
 
 	var user User
-	err = s.db.QueryRow(ctx, query, email, username, hashedPassword).Scan(
+	err := q.QueryRow(ctx, query, email, username, hashedPassword).Scan(
 		&user.ID,
 		&user.Email,
 		&user.Username,
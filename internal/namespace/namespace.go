@@ -0,0 +1,71 @@
+// Package namespace groups a tenant's keys by prefix. A key's namespace is
+// the part before its first ":", so "sessions:abc" is in namespace
+// "sessions"; keys without a ":" are in no namespace.
+package namespace
+
+import "strings"
+
+// Separator ends a key's namespace
+const Separator = ":"
+
+// maxNameLength bounds namespace names
+const maxNameLength = 64
+
+// Number of nodes holding each key (primary included), unless its namespace
+// sets its own between 1 and MaxReplicationFactor
+const (
+	DefaultReplicationFactor = 3
+	MaxReplicationFactor     = 5
+)
+
+// Policy holds a tenant's settings for the keys of one namespace. Empty
+// fields fall back to the service defaults.
+type Policy struct {
+	Consistency       string `json:"consistency,omitempty"`        // "strong" or "eventual"
+	ReplicationFactor int    `json:"replication_factor,omitempty"` // Nodes holding each key, primary included
+}
+
+// Replicas returns the number of nodes that hold the policy's keys
+func (p Policy) Replicas() int {
+	if p.ReplicationFactor > 0 {
+		return p.ReplicationFactor
+	}
+	return DefaultReplicationFactor
+}
+
+// Policies maps namespace names to their policy
+type Policies map[string]Policy
+
+// For returns the policy that applies to key (the zero Policy if its
+// namespace has none)
+func (p Policies) For(key string) Policy {
+	if p == nil {
+		return Policy{}
+	}
+	return p[Of(key)]
+}
+
+// Of returns the namespace of key, empty if it has none
+func Of(key string) string {
+	name, _, found := strings.Cut(key, Separator)
+	if !found {
+		return ""
+	}
+	return name
+}
+
+// Valid reports whether name can be used as a namespace: 1 to 64 letters,
+// digits, '_', '-' or '.'
+func Valid(name string) bool {
+	if name == "" || len(name) > maxNameLength {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Is reports whether contentType is the protobuf media type
+func Is(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == ContentType
+}
+
+// Accepts reports whether the client asked for protobuf responses
+func Accepts(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			if Is(strings.TrimSpace(part)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewRequest creates a request carrying v as protobuf if useProto is set and
+// v has a protobuf message, and as JSON otherwise. A protobuf request also
+// asks for a protobuf response.
+func NewRequest(ctx context.Context, method, url string, v interface{}, useProto bool) (*http.Request, error) {
+	var body []byte
+	var err error
+	contentType := "application/json"
+	if useProto && Supports(v) {
+		body, err = Marshal(v)
+		contentType = ContentType
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentType == ContentType {
+		req.Header.Set("Accept", ContentType+", application/json")
+	}
+	return req, nil
+}
+
+// DecodeRequest decodes the body of r into v, as protobuf if r says it is
+// and as JSON otherwise
+func DecodeRequest(r *http.Request, v interface{}) error {
+	if !Is(r.Header.Get("Content-Type")) {
+		return json.NewDecoder(r.Body).Decode(v)
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return Unmarshal(data, v)
+}
+
+// DecodeResponse decodes the body of resp into v by its Content-Type
+func DecodeResponse(resp *http.Response, v interface{}) error {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return Decode(resp.Header.Get("Content-Type"), data, v)
+}
+
+// Decode decodes data of the given Content-Type into v
+func Decode(contentType string, data []byte, v interface{}) error {
+	if Is(contentType) {
+		return Unmarshal(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Respond writes v with status, as protobuf if the client accepts it and v
+// has a protobuf message, and as JSON otherwise
+func Respond(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if Accepts(r) && Supports(v) {
+		data, err := Marshal(v)
+		if err == nil {
+			w.Header().Set("Content-Type", ContentType)
+			w.WriteHeader(status)
+			w.Write(data)
+			return
+		}
+		// Fall back to JSON, which every caller understands
+		log.Printf("proto: encoding %T: %v\n", v, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,350 @@
+package proto
+
+import (
+	"sort"
+	"time"
+
+	"dht/internal/models"
+	"dht/internal/namespace"
+	"dht/internal/storage"
+)
+
+// Field numbers are those of dht.proto
+
+func appendReplicationRequest(b []byte, m *models.ReplicationRequest) []byte {
+	b = appendString(b, 1, m.Key)
+	b = appendBytes(b, 2, m.Value)
+	b = appendString(b, 3, m.Operation)
+	b = appendInt(b, 4, int64(m.TTL))
+	b = appendBool(b, 5, m.Sliding)
+	b = appendString(b, 6, m.Consistency)
+	b = appendString(b, 7, m.PrimaryNode)
+	b = appendStrings(b, 8, m.ReplicaNodes)
+	b = appendInt(b, 9, m.UserID)
+	b = appendString(b, 10, m.RequestID)
+	b = appendUint(b, 11, m.Version)
+	b = appendInt(b, 12, int64(m.ReplicationFactor))
+	b = appendStrings(b, 13, m.ShadowNodes)
+	return b
+}
+
+func decodeReplicationRequest(b []byte, m *models.ReplicationRequest) error {
+	return walk(b, func(f *field) (err error) {
+		switch f.num {
+		case 1:
+			m.Key, err = f.string()
+		case 2:
+			m.Value, err = f.bytes()
+		case 3:
+			m.Operation, err = f.string()
+		case 4:
+			var ttl int64
+			ttl, err = f.int64()
+			m.TTL = time.Duration(ttl)
+		case 5:
+			m.Sliding, err = f.bool()
+		case 6:
+			m.Consistency, err = f.string()
+		case 7:
+			m.PrimaryNode, err = f.string()
+		case 8:
+			var node string
+			node, err = f.string()
+			m.ReplicaNodes = append(m.ReplicaNodes, node)
+		case 9:
+			m.UserID, err = f.int64()
+		case 10:
+			m.RequestID, err = f.string()
+		case 11:
+			m.Version, err = f.uint()
+		case 12:
+			m.ReplicationFactor, err = f.int32()
+		case 13:
+			var node string
+			node, err = f.string()
+			m.ShadowNodes = append(m.ShadowNodes, node)
+		}
+		return err
+	})
+}
+
+func appendReplicationResponse(b []byte, m *models.ReplicationResponse) []byte {
+	b = appendBool(b, 1, m.Success)
+	b = appendString(b, 2, m.NodeID)
+	b = appendStrings(b, 3, m.AckedNodes)
+	b = appendStrings(b, 4, m.FailedNodes)
+	b = appendString(b, 5, m.Error)
+	return b
+}
+
+func decodeReplicationResponse(b []byte, m *models.ReplicationResponse) error {
+	return walk(b, func(f *field) (err error) {
+		switch f.num {
+		case 1:
+			m.Success, err = f.bool()
+		case 2:
+			m.NodeID, err = f.string()
+		case 3:
+			var node string
+			node, err = f.string()
+			m.AckedNodes = append(m.AckedNodes, node)
+		case 4:
+			var node string
+			node, err = f.string()
+			m.FailedNodes = append(m.FailedNodes, node)
+		case 5:
+			m.Error, err = f.string()
+		}
+		return err
+	})
+}
+
+func appendValidateTokenRequest(b []byte, m *models.ValidateTokenRequest) []byte {
+	b = appendInt(b, 1, m.UserID)
+	b = appendInt(b, 2, m.KeyID)
+	b = appendString(b, 3, m.TokenID)
+	b = appendBool(b, 4, m.SingleUse)
+	if !m.ExpiresAt.IsZero() {
+		b = appendInt(b, 5, m.ExpiresAt.UnixNano())
+	}
+	return b
+}
+
+func decodeValidateTokenRequest(b []byte, m *models.ValidateTokenRequest) error {
+	return walk(b, func(f *field) (err error) {
+		switch f.num {
+		case 1:
+			m.UserID, err = f.int64()
+		case 2:
+			m.KeyID, err = f.int64()
+		case 3:
+			m.TokenID, err = f.string()
+		case 4:
+			m.SingleUse, err = f.bool()
+		case 5:
+			var nanos int64
+			nanos, err = f.int64()
+			m.ExpiresAt = time.Unix(0, nanos).UTC()
+		}
+		return err
+	})
+}
+
+func appendKeyValidation(b []byte, m *models.KeyValidation) []byte {
+	b = appendBool(b, 1, m.Valid)
+	b = appendInt(b, 2, m.UserID)
+	b = appendInt(b, 3, m.KeyID)
+	b = appendStrings(b, 4, m.Scopes)
+	if e := m.Encryption; e != nil {
+		var enc []byte
+		enc = appendString(enc, 1, e.Source)
+		enc = appendString(enc, 2, e.KeyID)
+		enc = appendString(enc, 3, e.WrappedKey)
+		enc = appendString(enc, 4, e.KMSURI)
+		b = appendMessage(b, 5, enc)
+	}
+
+	// Map entries in a stable order, so equal messages encode the same
+	names := make([]string, 0, len(m.Namespaces))
+	for name := range m.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		policy := m.Namespaces[name]
+		var value []byte
+		value = appendString(value, 1, policy.Consistency)
+		value = appendInt(value, 2, int64(policy.ReplicationFactor))
+
+		var entry []byte
+		entry = appendString(entry, 1, name)
+		entry = appendMessage(entry, 2, value)
+		b = appendMessage(b, 6, entry)
+	}
+
+	b = appendInt(b, 7, m.StorageQuotaBytes)
+	b = appendInt(b, 8, m.StorageUsedBytes)
+	return b
+}
+
+func decodeKeyValidation(b []byte, m *models.KeyValidation) error {
+	return walk(b, func(f *field) (err error) {
+		switch f.num {
+		case 1:
+			m.Valid, err = f.bool()
+		case 2:
+			m.UserID, err = f.int64()
+		case 3:
+			m.KeyID, err = f.int64()
+		case 4:
+			var scope string
+			scope, err = f.string()
+			m.Scopes = append(m.Scopes, scope)
+		case 5:
+			var data []byte
+			if data, err = f.message(); err != nil {
+				return err
+			}
+			m.Encryption = &models.TenantEncryption{}
+			err = decodeTenantEncryption(data, m.Encryption)
+		case 6:
+			var data []byte
+			if data, err = f.message(); err != nil {
+				return err
+			}
+			if m.Namespaces == nil {
+				m.Namespaces = make(namespace.Policies)
+			}
+			err = decodeNamespaceEntry(data, m.Namespaces)
+		case 7:
+			m.StorageQuotaBytes, err = f.int64()
+		case 8:
+			m.StorageUsedBytes, err = f.int64()
+		}
+		return err
+	})
+}
+
+func decodeTenantEncryption(b []byte, m *models.TenantEncryption) error {
+	return walk(b, func(f *field) (err error) {
+		switch f.num {
+		case 1:
+			m.Source, err = f.string()
+		case 2:
+			m.KeyID, err = f.string()
+		case 3:
+			m.WrappedKey, err = f.string()
+		case 4:
+			m.KMSURI, err = f.string()
+		}
+		return err
+	})
+}
+
+func decodeNamespaceEntry(b []byte, policies namespace.Policies) error {
+	var name string
+	var policy namespace.Policy
+	err := walk(b, func(f *field) (err error) {
+		switch f.num {
+		case 1:
+			name, err = f.string()
+		case 2:
+			var data []byte
+			if data, err = f.message(); err != nil {
+				return err
+			}
+			err = walk(data, func(f *field) (err error) {
+				switch f.num {
+				case 1:
+					policy.Consistency, err = f.string()
+				case 2:
+					policy.ReplicationFactor, err = f.int32()
+				}
+				return err
+			})
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	policies[name] = policy
+	return nil
+}
+
+func appendTxnOp(b []byte, op *storage.TxnOp) []byte {
+	b = appendString(b, 1, op.Op)
+	b = appendString(b, 2, op.Key)
+	b = appendBytes(b, 3, op.Value)
+	b = appendInt(b, 4, int64(op.TTL))
+	// Conditions have explicit presence: if_version 0 means "must not exist"
+	if op.IfVersion != nil {
+		b = appendPresent(b, 5, *op.IfVersion)
+	}
+	if op.IfExists != nil {
+		v := uint64(0)
+		if *op.IfExists {
+			v = 1
+		}
+		b = appendPresent(b, 6, v)
+	}
+	b = appendInt(b, 7, int64(op.Replicas))
+	return b
+}
+
+func decodeTxnOp(b []byte, op *storage.TxnOp) error {
+	return walk(b, func(f *field) (err error) {
+		switch f.num {
+		case 1:
+			op.Op, err = f.string()
+		case 2:
+			op.Key, err = f.string()
+		case 3:
+			op.Value, err = f.bytes()
+		case 4:
+			var ttl int64
+			ttl, err = f.int64()
+			op.TTL = time.Duration(ttl)
+		case 5:
+			var version uint64
+			version, err = f.uint()
+			op.IfVersion = &version
+		case 6:
+			var exists bool
+			exists, err = f.bool()
+			op.IfExists = &exists
+		case 7:
+			op.Replicas, err = f.int32()
+		}
+		return err
+	})
+}
+
+func appendTxnPrepared(b []byte, m *TxnPrepared) []byte {
+	b = appendBool(b, 1, m.Success)
+	b = appendString(b, 2, m.TxnID)
+	b = appendString(b, 3, m.Node)
+	for _, read := range m.Reads {
+		var r []byte
+		r = appendString(r, 1, read.Key)
+		r = appendBool(r, 2, read.Exists)
+		r = appendBytes(r, 3, read.Value)
+		r = appendUint(r, 4, read.Version)
+		b = appendMessage(b, 4, r)
+	}
+	return b
+}
+
+func decodeTxnPrepared(b []byte, m *TxnPrepared) error {
+	return walk(b, func(f *field) (err error) {
+		switch f.num {
+		case 1:
+			m.Success, err = f.bool()
+		case 2:
+			m.TxnID, err = f.string()
+		case 3:
+			m.Node, err = f.string()
+		case 4:
+			var data []byte
+			if data, err = f.message(); err != nil {
+				return err
+			}
+			var read storage.TxnRead
+			err = walk(data, func(f *field) (err error) {
+				switch f.num {
+				case 1:
+					read.Key, err = f.string()
+				case 2:
+					read.Exists, err = f.bool()
+				case 3:
+					read.Value, err = f.bytes()
+				case 4:
+					read.Version, err = f.uint()
+				}
+				return err
+			})
+			m.Reads = append(m.Reads, read)
+		}
+		return err
+	})
+}
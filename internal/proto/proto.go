@@ -0,0 +1,283 @@
+// Package proto encodes the messages exchanged between services as protocol
+// buffers, following the schema in dht.proto.
+//
+// The encoding is written by hand with protowire rather than generated, so
+// building needs no protoc; any protobuf implementation given dht.proto can
+// read and write the same bytes. Every message is also a JSON body, which
+// services keep accepting so callers can be moved over one at a time.
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"dht/internal/models"
+	"dht/internal/storage"
+)
+
+// ContentType is the media type of a v1 protobuf message
+const ContentType = "application/vnd.dht.v1+protobuf"
+
+var (
+	// ErrUnsupported is returned for a value with no protobuf message
+	ErrUnsupported = errors.New("no protobuf message for type")
+	// ErrInvalid is returned for bytes that are not a valid message
+	ErrInvalid = errors.New("invalid protobuf message")
+)
+
+// TxnPrepare is the body of POST /txn/{id}/prepare
+type TxnPrepare struct {
+	Ops []storage.TxnOp `json:"ops"`
+
+	// DecisionNode is the participant whose outcome the node consults
+	// before giving up on the transaction; empty when sent to that node
+	DecisionNode string `json:"decision_node,omitempty"`
+}
+
+// TxnPrepared is a node's answer to a successful prepare
+type TxnPrepared struct {
+	Success bool              `json:"success"`
+	TxnID   string            `json:"txn_id"`
+	Node    string            `json:"node"`
+	Reads   []storage.TxnRead `json:"reads"`
+}
+
+// Supports reports whether v (a pointer to a message type) has a protobuf
+// encoding
+func Supports(v interface{}) bool {
+	switch v.(type) {
+	case *models.ReplicationRequest, *models.ReplicationResponse,
+		*models.ValidateKeyRequest, *models.ValidateTokenRequest, *models.KeyValidation,
+		*TxnPrepare, *TxnPrepared:
+		return true
+	}
+	return false
+}
+
+// Marshal encodes v, a pointer to a message type
+func Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case *models.ReplicationRequest:
+		return appendReplicationRequest(nil, m), nil
+	case *models.ReplicationResponse:
+		return appendReplicationResponse(nil, m), nil
+	case *models.ValidateKeyRequest:
+		return appendString(nil, 1, m.APIKey), nil
+	case *models.ValidateTokenRequest:
+		return appendValidateTokenRequest(nil, m), nil
+	case *models.KeyValidation:
+		return appendKeyValidation(nil, m), nil
+	case *TxnPrepare:
+		var b []byte
+		for i := range m.Ops {
+			b = appendMessage(b, 1, appendTxnOp(nil, &m.Ops[i]))
+		}
+		return appendString(b, 2, m.DecisionNode), nil
+	case *TxnPrepared:
+		return appendTxnPrepared(nil, m), nil
+	}
+	return nil, fmt.Errorf("%w %T", ErrUnsupported, v)
+}
+
+// Unmarshal decodes b into v, a pointer to a message type. Unknown fields
+// are skipped. Decoded byte fields share b's memory.
+func Unmarshal(b []byte, v interface{}) error {
+	switch m := v.(type) {
+	case *models.ReplicationRequest:
+		*m = models.ReplicationRequest{}
+		return decodeReplicationRequest(b, m)
+	case *models.ReplicationResponse:
+		*m = models.ReplicationResponse{}
+		return decodeReplicationResponse(b, m)
+	case *models.ValidateKeyRequest:
+		*m = models.ValidateKeyRequest{}
+		return walk(b, func(f *field) (err error) {
+			if f.num == 1 {
+				m.APIKey, err = f.string()
+			}
+			return err
+		})
+	case *models.ValidateTokenRequest:
+		*m = models.ValidateTokenRequest{}
+		return decodeValidateTokenRequest(b, m)
+	case *models.KeyValidation:
+		*m = models.KeyValidation{}
+		return decodeKeyValidation(b, m)
+	case *TxnPrepare:
+		*m = TxnPrepare{}
+		return walk(b, func(f *field) (err error) {
+			switch f.num {
+			case 1:
+				data, err := f.message()
+				if err != nil {
+					return err
+				}
+				var op storage.TxnOp
+				if err := decodeTxnOp(data, &op); err != nil {
+					return err
+				}
+				m.Ops = append(m.Ops, op)
+			case 2:
+				m.DecisionNode, err = f.string()
+			}
+			return err
+		})
+	case *TxnPrepared:
+		*m = TxnPrepared{}
+		return decodeTxnPrepared(b, m)
+	}
+	return fmt.Errorf("%w %T", ErrUnsupported, v)
+}
+
+// Encoding. Fields holding their zero value are left out, as proto3 does,
+// except those with explicit presence.
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendStrings(b []byte, num protowire.Number, list []string) []byte {
+	for _, s := range list {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	return b
+}
+
+func appendBytes(b []byte, num protowire.Number, data []byte) []byte {
+	if len(data) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, data)
+}
+
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendPresent(b, num, v)
+}
+
+// appendPresent encodes a varint field with explicit presence, zero included
+func appendPresent(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendInt encodes int64 and int32 fields (two's complement varints)
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	return appendUint(b, num, uint64(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendUint(b, num, 1)
+}
+
+func appendMessage(b []byte, num protowire.Number, data []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, data)
+}
+
+// Decoding
+
+// field is one decoded field; exactly one of varint and data is meaningful,
+// depending on typ
+type field struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	data   []byte
+}
+
+// walk calls fn for every field of the message in b
+func walk(b []byte, fn func(*field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrInvalid, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		f := &field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.data, n = protowire.ConsumeBytes(b)
+		default:
+			// No field of ours uses another type; skip it like any unknown field
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: field %d: %v", ErrInvalid, num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *field) want(typ protowire.Type) error {
+	if f.typ != typ {
+		return fmt.Errorf("%w: field %d has wire type %d, want %d", ErrInvalid, f.num, f.typ, typ)
+	}
+	return nil
+}
+
+func (f *field) string() (string, error) {
+	if err := f.want(protowire.BytesType); err != nil {
+		return "", err
+	}
+	return string(f.data), nil
+}
+
+func (f *field) bytes() ([]byte, error) {
+	if err := f.want(protowire.BytesType); err != nil {
+		return nil, err
+	}
+	return f.data, nil
+}
+
+func (f *field) message() ([]byte, error) {
+	return f.bytes()
+}
+
+func (f *field) uint() (uint64, error) {
+	if err := f.want(protowire.VarintType); err != nil {
+		return 0, err
+	}
+	return f.varint, nil
+}
+
+func (f *field) int64() (int64, error) {
+	v, err := f.uint()
+	return int64(v), err
+}
+
+// int32 decodes an int32 field into an int, as the Go types hold them
+func (f *field) int32() (int, error) {
+	v, err := f.int64()
+	if err == nil && (v < math.MinInt32 || v > math.MaxInt32) {
+		return 0, fmt.Errorf("%w: field %d overflows int32", ErrInvalid, f.num)
+	}
+	return int(v), err
+}
+
+func (f *field) bool() (bool, error) {
+	v, err := f.uint()
+	return v != 0, err
+}
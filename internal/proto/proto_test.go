@@ -0,0 +1,271 @@
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"dht/internal/models"
+	"dht/internal/storage"
+)
+
+// message is a test message and a constructor for an empty one of its type
+type message struct {
+	name  string
+	value interface{}
+	empty func() interface{}
+}
+
+func messages() []message {
+	zero, three := uint64(0), uint64(3)
+	yes, no := true, false
+	replicationRequest := func() interface{} { return &models.ReplicationRequest{} }
+	replicationResponse := func() interface{} { return &models.ReplicationResponse{} }
+	txnPrepare := func() interface{} { return &TxnPrepare{} }
+	txnPrepared := func() interface{} { return &TxnPrepared{} }
+
+	return []message{
+		{name: "replication request", empty: replicationRequest, value: &models.ReplicationRequest{
+			Key:               "users:42",
+			Value:             []byte("\x00binary\xff"),
+			Operation:         "SET",
+			TTL:               90 * time.Second,
+			Sliding:           true,
+			Consistency:       "strong",
+			PrimaryNode:       "http://node-1:8082",
+			ReplicaNodes:      []string{"http://node-2:8082", "http://node-3:8082"},
+			UserID:            7,
+			RequestID:         "4f1c2a9e7b3d4e5f",
+			Version:           1041,
+			ReplicationFactor: 5,
+			ShadowNodes:       []string{"http://node-4:8082"},
+		}},
+		{name: "replication delete", empty: replicationRequest, value: &models.ReplicationRequest{
+			Key:       "users:42",
+			Operation: "DELETE",
+			UserID:    -1,
+			Version:   1077,
+		}},
+		{name: "empty replication request", empty: replicationRequest, value: &models.ReplicationRequest{}},
+		{name: "replication response", empty: replicationResponse, value: &models.ReplicationResponse{
+			Success:     false,
+			NodeID:      "node-1",
+			AckedNodes:  []string{"node-2"},
+			FailedNodes: []string{"node-3"},
+			Error:       "replica timed out",
+		}},
+		{name: "empty replication response", empty: replicationResponse, value: &models.ReplicationResponse{}},
+		{name: "txn prepare", empty: txnPrepare, value: &TxnPrepare{Ops: []storage.TxnOp{
+			{Op: "put", Key: "a", Value: []byte("1"), TTL: time.Hour, Replicas: 2},
+			{Op: "delete", Key: "b", IfVersion: &three},
+			{Op: "check", Key: "c", IfVersion: &zero},
+			{Op: "check", Key: "d", IfExists: &yes},
+			{Op: "get", Key: "e", IfExists: &no},
+		}, DecisionNode: "http://node-2:8082"}},
+		{name: "empty txn prepare", empty: txnPrepare, value: &TxnPrepare{}},
+		{name: "txn prepared", empty: txnPrepared, value: &TxnPrepared{
+			Success: true,
+			TxnID:   "txn-1",
+			Node:    "node-1",
+			Reads: []storage.TxnRead{
+				{Key: "a", Exists: true, Value: []byte("1"), Version: 12},
+				{Key: "b"},
+			},
+		}},
+		{name: "empty txn prepared", empty: txnPrepared, value: &TxnPrepared{}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tt := range messages() {
+		t.Run(tt.name, func(t *testing.T) {
+			if !Supports(tt.value) {
+				t.Fatalf("%T has no protobuf encoding", tt.value)
+			}
+			data, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tt.empty()
+			if err := Unmarshal(data, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.value) {
+				t.Fatalf("round trip:\n got %+v\nwant %+v", got, tt.value)
+			}
+		})
+	}
+}
+
+// TestJSONCompatible checks that a message decodes to the same value from
+// protobuf and from JSON, so callers can switch encodings without a change
+// in meaning
+func TestJSONCompatible(t *testing.T) {
+	for _, tt := range messages() {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromProto := tt.empty()
+			if err := Decode(ContentType, data, fromProto); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err = json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromJSON := tt.empty()
+			if err := Decode("application/json", data, fromJSON); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(fromProto, fromJSON) {
+				t.Fatalf("decoded differently:\nprotobuf %+v\n    JSON %+v", fromProto, fromJSON)
+			}
+		})
+	}
+}
+
+// TestUnknownFields checks that fields added by a newer sender, of every wire
+// type, are skipped in both encodings
+func TestUnknownFields(t *testing.T) {
+	var unknown []byte
+	unknown = protowire.AppendTag(unknown, 90, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 12345)
+	unknown = protowire.AppendTag(unknown, 91, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, []byte("from the future"))
+	unknown = protowire.AppendTag(unknown, 92, protowire.Fixed32Type)
+	unknown = protowire.AppendFixed32(unknown, 7)
+	unknown = protowire.AppendTag(unknown, 93, protowire.Fixed64Type)
+	unknown = protowire.AppendFixed64(unknown, 7)
+
+	for _, tt := range messages() {
+		t.Run(tt.name, func(t *testing.T) {
+			data := mustMarshal(t, tt.value)
+			var fromProto interface{}
+			for _, withUnknown := range [][]byte{
+				append(append([]byte(nil), unknown...), data...),
+				append(append([]byte(nil), data...), unknown...),
+			} {
+				fromProto = tt.empty()
+				if err := Unmarshal(withUnknown, fromProto); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(fromProto, tt.value) {
+					t.Fatalf("with unknown fields:\n got %+v\nwant %+v", fromProto, tt.value)
+				}
+			}
+
+			// A JSON sender may add fields the same way
+			data, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var object map[string]interface{}
+			if err := json.Unmarshal(data, &object); err != nil {
+				t.Fatal(err)
+			}
+			object["added_later"] = map[string]interface{}{"nested": []int{1, 2}}
+			if data, err = json.Marshal(object); err != nil {
+				t.Fatal(err)
+			}
+			fromJSON := tt.empty()
+			if err := Decode("application/json", data, fromJSON); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fromJSON, fromProto) {
+				t.Fatalf("decoded differently:\nprotobuf %+v\n    JSON %+v", fromProto, fromJSON)
+			}
+		})
+	}
+}
+
+// TestUnknownFieldsNested checks that unknown fields inside a nested message
+// (a transaction operation or read) are skipped too
+func TestUnknownFieldsNested(t *testing.T) {
+	var extra []byte
+	extra = protowire.AppendTag(extra, 50, protowire.BytesType)
+	extra = protowire.AppendBytes(extra, []byte("x"))
+
+	op := storage.TxnOp{Op: "put", Key: "a", Value: []byte("1")}
+	var prepare []byte
+	prepare = protowire.AppendTag(prepare, 1, protowire.BytesType)
+	prepare = protowire.AppendBytes(prepare, append(appendTxnOp(nil, &op), extra...))
+	var gotPrepare TxnPrepare
+	if err := Unmarshal(prepare, &gotPrepare); err != nil {
+		t.Fatal(err)
+	}
+	if want := (TxnPrepare{Ops: []storage.TxnOp{op}}); !reflect.DeepEqual(gotPrepare, want) {
+		t.Fatalf("got %+v, want %+v", gotPrepare, want)
+	}
+
+	var read []byte
+	read = appendString(read, 1, "a")
+	read = appendBool(read, 2, true)
+	read = append(read, extra...)
+	prepared := appendString(nil, 2, "txn-1")
+	prepared = appendMessage(prepared, 4, read)
+	var gotPrepared TxnPrepared
+	if err := Unmarshal(prepared, &gotPrepared); err != nil {
+		t.Fatal(err)
+	}
+	want := TxnPrepared{TxnID: "txn-1", Reads: []storage.TxnRead{{Key: "a", Exists: true}}}
+	if !reflect.DeepEqual(gotPrepared, want) {
+		t.Fatalf("got %+v, want %+v", gotPrepared, want)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	for _, tt := range messages() {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every prefix either decodes or is rejected as invalid
+			data := mustMarshal(t, tt.value)
+			for n := range data {
+				if err := Unmarshal(data[:n], tt.empty()); err != nil && !errors.Is(err, ErrInvalid) {
+					t.Fatalf("first %d bytes: %v, want nil or %v", n, err, ErrInvalid)
+				}
+			}
+		})
+	}
+
+	// A length running past the end of the message
+	truncated := protowire.AppendTag(nil, 1, protowire.BytesType)
+	truncated = protowire.AppendVarint(truncated, 10)
+	truncated = append(truncated, "short"...)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		value interface{}
+	}{
+		{name: "string sent as varint", data: protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 1), value: &models.ReplicationRequest{}},
+		{name: "decision node sent as varint", data: protowire.AppendVarint(protowire.AppendTag(nil, 2, protowire.VarintType), 1), value: &TxnPrepare{}},
+		{name: "bool sent as bytes", data: protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), []byte("x")), value: &models.ReplicationResponse{}},
+		{name: "operation sent as varint", data: protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 1), value: &TxnPrepare{}},
+		{name: "read sent as varint", data: protowire.AppendVarint(protowire.AppendTag(nil, 4, protowire.VarintType), 1), value: &TxnPrepared{}},
+		{name: "truncated field", data: truncated, value: &models.ReplicationRequest{}},
+		{name: "bad tag", data: []byte{0x80}, value: &TxnPrepared{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Unmarshal(tt.data, tt.value); !errors.Is(err, ErrInvalid) {
+				t.Fatalf("Unmarshal: %v, want %v", err, ErrInvalid)
+			}
+		})
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
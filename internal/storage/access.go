@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AccessStats are approximate access counters for one key
+// Only one in SampleRate accesses is recorded (and counted SampleRate
+// times), so counts are estimates and last-access times may lag.
+type AccessStats struct {
+	Reads     uint64     `json:"reads"`
+	Writes    uint64     `json:"writes"`
+	LastRead  *time.Time `json:"last_read,omitempty"`
+	LastWrite *time.Time `json:"last_write,omitempty"`
+}
+
+// KeyAccess pairs a key with its access statistics
+type KeyAccess struct {
+	Key string `json:"key"`
+	AccessStats
+}
+
+// accessTracker holds sampled per-key statistics under its own lock, so
+// recording never contends with the storage lock
+type accessTracker struct {
+	sampleRate int
+	maxKeys    int
+	keys       map[string]*AccessStats
+	mu         sync.Mutex
+}
+
+// EnableAccessStats starts tracking reads and writes per key, sampling one
+// in sampleRate accesses and tracking at most maxKeys keys
+func (s *Storage) EnableAccessStats(sampleRate, maxKeys int) {
+	if sampleRate < 1 {
+		sampleRate = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.access = &accessTracker{
+		sampleRate: sampleRate,
+		maxKeys:    maxKeys,
+		keys:       make(map[string]*AccessStats),
+	}
+}
+
+// AccessSampleRate returns the sampling rate, or 0 if tracking is disabled
+func (s *Storage) AccessSampleRate() int {
+	if s.access == nil {
+		return 0
+	}
+	return s.access.sampleRate
+}
+
+// RecordRead counts a client read of key
+func (s *Storage) RecordRead(key string) {
+	s.recordAccess(key, false)
+}
+
+// RecordWrite counts a client write of key
+func (s *Storage) RecordWrite(key string) {
+	s.recordAccess(key, true)
+}
+
+func (s *Storage) recordAccess(key string, write bool) {
+	t := s.access
+	if t == nil {
+		return
+	}
+	if t.sampleRate > 1 && rand.Intn(t.sampleRate) != 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, exists := t.keys[key]
+	if !exists {
+		// Once full, keys seen for the first time are not tracked
+		if t.maxKeys > 0 && len(t.keys) >= t.maxKeys {
+			return
+		}
+		stats = &AccessStats{}
+		t.keys[key] = stats
+	}
+
+	now := time.Now()
+	if write {
+		stats.Writes += uint64(t.sampleRate)
+		stats.LastWrite = &now
+	} else {
+		stats.Reads += uint64(t.sampleRate)
+		stats.LastRead = &now
+	}
+}
+
+// forget drops the statistics of a removed key
+func (t *accessTracker) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.keys, key)
+}
+
+// AccessStats returns the statistics of key; ok is false if it was never sampled
+func (s *Storage) AccessStats(key string) (stats AccessStats, ok bool) {
+	t := s.access
+	if t == nil {
+		return AccessStats{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tracked, exists := t.keys[key]; exists {
+		return *tracked, true
+	}
+	return AccessStats{}, false
+}
+
+// TopKeys returns the most accessed live keys, ranked by "reads", "writes"
+// or "total". A non-zero owner limits the result to that tenant's keys.
+func (s *Storage) TopKeys(owner int64, by string, limit int) []KeyAccess {
+	t := s.access
+	if t == nil {
+		return []KeyAccess{}
+	}
+
+	t.mu.Lock()
+	candidates := make([]KeyAccess, 0, len(t.keys))
+	for key, stats := range t.keys {
+		candidates = append(candidates, KeyAccess{Key: key, AccessStats: *stats})
+	}
+	t.mu.Unlock()
+
+	score := func(k KeyAccess) uint64 {
+		switch by {
+		case "reads":
+			return k.Reads
+		case "writes":
+			return k.Writes
+		default:
+			return k.Reads + k.Writes
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if score(candidates[i]) != score(candidates[j]) {
+			return score(candidates[i]) > score(candidates[j])
+		}
+		return candidates[i].Key < candidates[j].Key
+	})
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	top := make([]KeyAccess, 0, limit)
+	for _, candidate := range candidates {
+		if len(top) >= limit {
+			break
+		}
+		entry, exists := s.data[candidate.Key]
+		if !exists || entry.ExpiresAt != nil && entry.ExpiresAt.Before(now) {
+			continue
+		}
+		if owner != 0 && entry.Owner != owner {
+			continue
+		}
+		top = append(top, candidate)
+	}
+	return top
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrCompactionRunning is returned by Compact while another compaction of the
+// same WAL is in progress
+var ErrCompactionRunning = errors.New("WAL compaction already running")
+
+// CompactOptions controls Compact
+type CompactOptions struct {
+	// Tombstone reports whether a key the log deleted (or that expired) may
+	// still exist in an older copy the log is replayed over, such as the
+	// node's snapshot. Its last DELETE is then kept; other deletes are dropped.
+	Tombstone func(key string) bool
+
+	// OutcomesSince keeps a record of the transactions resolved after it
+	// (a COMMIT without its writes, or the ABORT), so their outcomes survive
+	// a restart; zero drops them all
+	OutcomesSince time.Time
+}
+
+// CompactStats describes a completed compaction
+type CompactStats struct {
+	// Through is the last sequence number compacted; later entries were
+	// copied unchanged
+	Through       uint64 `json:"through"`
+	EntriesBefore int    `json:"entries_before"`
+	EntriesAfter  int    `json:"entries_after"`
+	BytesBefore   int64  `json:"bytes_before"`
+	BytesAfter    int64  `json:"bytes_after"`
+	DurationMs    int64  `json:"duration_ms"`
+}
+
+// compactKey is what the log says about one key: the entry that last wrote
+// it and the TOUCH that last extended it since
+type compactKey struct {
+	last      int // index of the last SET/DELETE/COMMIT writing the key, -1 if none
+	touch     int // index of the last TOUCH, -1 if none
+	deleted   bool
+	expiresAt time.Time // zero if the key does not expire
+}
+
+// Compact rewrites the WAL into a new segment holding only what replaying it
+// needs: the latest write of every live key, TOUCHes that still extend one,
+// transactions still prepared and the outcomes opts asks for. Superseded
+// SETs, expired keys, deletes and other resolved transactions are dropped. The log is read without blocking appends;
+// appends are only held while the entries written meanwhile are copied over
+// and the new segment replaces the old one. Sequence numbers are kept, and the
+// segment starts with a COMPACT entry recording the last one compacted.
+func (w *WAL) Compact(opts CompactOptions) (*CompactStats, error) {
+	if !w.compactMu.TryLock() {
+		return nil, ErrCompactionRunning
+	}
+	defer w.compactMu.Unlock()
+
+	started := time.Now()
+
+	// Entries up to the current end are compacted, later ones copied
+	w.mu.Lock()
+	current := w.file
+	through := w.seq
+	info, err := current.Stat()
+	w.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat WAL: %w", err)
+	}
+	stats := &CompactStats{Through: through, BytesBefore: info.Size()}
+
+	// First pass: find the entries that still matter
+	keys := make(map[string]*compactKey)
+	pending := make(map[string]int) // prepared transaction ID -> PREPARE index
+	lookup := func(key string) *compactKey {
+		k, ok := keys[key]
+		if !ok {
+			k = &compactKey{last: -1, touch: -1}
+			keys[key] = k
+		}
+		return k
+	}
+	write := func(entry *WALEntry, index int) {
+		k := lookup(entry.Key)
+		k.last = index
+		k.touch = -1
+		k.deleted = entry.Operation == "DELETE"
+		k.expiresAt = time.Time{}
+		if !k.deleted && entry.TTL > 0 {
+			k.expiresAt = entry.Timestamp.Add(entry.TTL)
+		}
+	}
+
+	if err := w.readCompactRange(info.Size(), func(entry *WALEntry, index int) error {
+		switch entry.Operation {
+		case "SET", "DELETE":
+			write(entry, index)
+		case "TOUCH":
+			k := lookup(entry.Key)
+			k.touch = index
+			k.expiresAt = entry.Timestamp.Add(entry.TTL)
+		case "PREPARE":
+			pending[entry.Key] = index
+		case "COMMIT":
+			delete(pending, entry.Key)
+			writes, err := entry.TxnWrites()
+			if err != nil {
+				return err
+			}
+			for _, txnWrite := range writes {
+				write(txnWrite, index)
+			}
+		case "ABORT":
+			delete(pending, entry.Key)
+		}
+		stats.EntriesBefore++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Second pass: write the entries that matter, in log order
+	now := time.Now()
+	expired := func(k *compactKey) bool {
+		return !k.expiresAt.IsZero() && !k.expiresAt.After(now)
+	}
+	keep := func(entry *WALEntry, index int) *WALEntry {
+		k := keys[entry.Key]
+		if k.last != index {
+			return nil
+		}
+		if k.deleted || expired(k) {
+			if opts.Tombstone == nil || !opts.Tombstone(entry.Key) {
+				return nil
+			}
+			return &WALEntry{Seq: entry.Seq, Operation: "DELETE", Key: entry.Key, Owner: entry.Owner, Timestamp: entry.Timestamp}
+		}
+		return entry
+	}
+
+	keepOutcome := func(entry *WALEntry) bool {
+		return !opts.OutcomesSince.IsZero() && entry.Timestamp.After(opts.OutcomesSince)
+	}
+
+	tmpPath := w.filepath + ".compact"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+	fail := func(err error) (*CompactStats, error) {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	encoder := newWALEncoder(file)
+	emit := func(entry *WALEntry) error {
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("failed to write WAL segment: %w", err)
+		}
+		stats.EntriesAfter++
+		return nil
+	}
+	if err := emit(&WALEntry{Operation: "COMPACT", Timestamp: now, Through: through}); err != nil {
+		return fail(err)
+	}
+
+	source, err := os.Open(w.filepath)
+	if err != nil {
+		return fail(fmt.Errorf("failed to open WAL: %w", err))
+	}
+	defer source.Close()
+	reader := &extendableReader{r: source, remaining: info.Size()}
+	decoder := gob.NewDecoder(reader)
+
+	for index := 0; index < stats.EntriesBefore; index++ {
+		var entry WALEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return fail(fmt.Errorf("failed to decode WAL entry: %w", err))
+		}
+
+		var out []*WALEntry
+		switch entry.Operation {
+		case "SET", "DELETE":
+			if e := keep(&entry, index); e != nil {
+				out = append(out, e)
+			}
+		case "TOUCH":
+			if k := keys[entry.Key]; k.touch == index && !k.deleted && !expired(k) {
+				out = append(out, &entry)
+			}
+		case "PREPARE":
+			if prepared, ok := pending[entry.Key]; ok && prepared == index {
+				out = append(out, &entry)
+			}
+		case "COMMIT":
+			writes, _ := entry.TxnWrites()
+			for _, txnWrite := range writes {
+				if e := keep(txnWrite, index); e != nil {
+					out = append(out, e)
+				}
+			}
+			if keepOutcome(&entry) {
+				out = append(out, &WALEntry{Seq: entry.Seq, Operation: "COMMIT", Key: entry.Key, Owner: entry.Owner, Timestamp: entry.Timestamp})
+			}
+		case "ABORT":
+			if keepOutcome(&entry) {
+				out = append(out, &entry)
+			}
+		case "COMPACT":
+		default:
+			out = append(out, &entry)
+		}
+
+		for _, e := range out {
+			if err := emit(e); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	// Copy what was appended meanwhile and install the segment, holding
+	// appends until the WAL writes to it
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != current {
+		return fail(errors.New("WAL was truncated during compaction"))
+	}
+	end, err := current.Stat()
+	if err != nil {
+		return fail(fmt.Errorf("failed to stat WAL: %w", err))
+	}
+	reader.remaining += end.Size() - info.Size()
+	for {
+		var entry WALEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fail(fmt.Errorf("failed to decode WAL entry: %w", err))
+		}
+		stats.EntriesBefore++
+		if err := emit(&entry); err != nil {
+			return fail(err)
+		}
+	}
+	stats.BytesBefore = end.Size()
+
+	if err := file.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync WAL segment: %w", err))
+	}
+	if err := os.Rename(tmpPath, w.filepath); err != nil {
+		return fail(fmt.Errorf("failed to install WAL segment: %w", err))
+	}
+	if info, err := file.Stat(); err == nil {
+		stats.BytesAfter = info.Size()
+	}
+
+	current.Close()
+	w.file = file
+	w.encoder = encoder
+	w.compactedThrough = through
+	stats.DurationMs = time.Since(started).Milliseconds()
+
+	return stats, nil
+}
+
+// CompactedThrough returns the last sequence number covered by the latest
+// compaction: entries up to it may be missing from the log, 0 if it was
+// never compacted
+func (w *WAL) CompactedThrough() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.compactedThrough
+}
+
+// readCompactRange decodes the first size bytes of the WAL, which end on an
+// entry boundary, calling fn with each entry and its index
+func (w *WAL) readCompactRange(size int64, fn func(entry *WALEntry, index int) error) error {
+	file, err := os.Open(w.filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer file.Close()
+
+	index := 0
+	return ReadWAL(io.LimitReader(file, size), func(entry *WALEntry) error {
+		err := fn(entry, index)
+		index++
+		return err
+	})
+}
+
+// extendableReader reads from r up to a limit that can be raised later, so
+// one gob decoder can read the log to a boundary and then continue past it
+type extendableReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *extendableReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// blob is a value shared by every key holding identical content
+type blob struct {
+	data []byte
+	refs int
+}
+
+// blobStore holds deduplicated values keyed by their SHA-256 content hash
+// Not safe for concurrent use; the owning Storage's lock guards it.
+type blobStore struct {
+	blobs   map[string]*blob
+	minSize int
+
+	storedBytes  int64
+	logicalBytes int64
+}
+
+// DedupStats describes how much space content-addressed storage is saving
+type DedupStats struct {
+	Enabled      bool  `json:"enabled"`
+	MinSize      int   `json:"min_size"`
+	Blobs        int   `json:"blobs"`
+	References   int   `json:"references"`
+	LogicalBytes int64 `json:"logical_bytes"`
+	StoredBytes  int64 `json:"stored_bytes"`
+	SavedBytes   int64 `json:"saved_bytes"`
+}
+
+// contentHash returns the hex-encoded SHA-256 of value
+func contentHash(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// intern returns the shared copy of value and its hash, adding a reference
+// Values below minSize are not worth a lookup and are returned as-is with
+// an empty hash.
+func (b *blobStore) intern(value []byte) ([]byte, string) {
+	if len(value) < b.minSize {
+		return value, ""
+	}
+
+	hash := contentHash(value)
+	existing, ok := b.blobs[hash]
+	if !ok {
+		existing = &blob{data: value}
+		b.blobs[hash] = existing
+		b.storedBytes += int64(len(value))
+	}
+	existing.refs++
+	b.logicalBytes += int64(len(existing.data))
+
+	return existing.data, hash
+}
+
+// release drops a reference, freeing the blob once nothing points at it
+func (b *blobStore) release(hash string) {
+	if hash == "" {
+		return
+	}
+
+	existing, ok := b.blobs[hash]
+	if !ok {
+		return
+	}
+	existing.refs--
+	b.logicalBytes -= int64(len(existing.data))
+
+	if existing.refs <= 0 {
+		delete(b.blobs, hash)
+		b.storedBytes -= int64(len(existing.data))
+	}
+}
+
+// EnableDedup turns on content-addressed storage: values of at least minSize
+// bytes are stored once per distinct content and shared between keys by
+// reference count. Existing entries are deduplicated immediately.
+func (s *Storage) EnableDedup(minSize int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if minSize < 1 {
+		minSize = 1
+	}
+	s.dedup = &blobStore{
+		blobs:   make(map[string]*blob),
+		minSize: minSize,
+	}
+
+	for key, entry := range s.data {
+		interned := *entry
+		interned.Value, interned.contentHash = s.dedup.intern(entry.Value)
+		s.data[key] = &interned
+	}
+}
+
+// DedupStats returns current deduplication counters
+func (s *Storage) DedupStats() DedupStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.dedup == nil {
+		return DedupStats{}
+	}
+
+	references := 0
+	for _, b := range s.dedup.blobs {
+		references += b.refs
+	}
+
+	return DedupStats{
+		Enabled:      true,
+		MinSize:      s.dedup.minSize,
+		Blobs:        len(s.dedup.blobs),
+		References:   references,
+		LogicalBytes: s.dedup.logicalBytes,
+		StoredBytes:  s.dedup.storedBytes,
+		SavedBytes:   s.dedup.logicalBytes - s.dedup.storedBytes,
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dedupStep is a write made to a store with deduplication of values of at
+// least 4 bytes
+type dedupStep struct {
+	op    string // set, delete or clear
+	key   string
+	value string
+}
+
+func TestDedupRefcounts(t *testing.T) {
+	const (
+		a     = "aaaa"     // exactly the minimum size
+		b     = "bbbbbbbb" // 8 bytes
+		small = "ss"       // below the minimum, stored inline
+	)
+	set := func(key, value string) dedupStep { return dedupStep{op: "set", key: key, value: value} }
+	del := func(key string) dedupStep { return dedupStep{op: "delete", key: key} }
+
+	tests := []struct {
+		name   string
+		before []dedupStep // applied before deduplication is enabled
+		steps  []dedupStep
+		want   DedupStats // Enabled and MinSize are filled in
+	}{
+		{name: "distinct values", steps: []dedupStep{set("k1", a), set("k2", b)}, want: DedupStats{Blobs: 2, References: 2, LogicalBytes: 12, StoredBytes: 12}},
+		{name: "shared value", steps: []dedupStep{set("k1", a), set("k2", a), set("k3", a)}, want: DedupStats{Blobs: 1, References: 3, LogicalBytes: 12, StoredBytes: 4, SavedBytes: 8}},
+		{name: "rewrite with the same value", steps: []dedupStep{set("k1", a), set("k1", a)}, want: DedupStats{Blobs: 1, References: 1, LogicalBytes: 4, StoredBytes: 4}},
+		{name: "rewrite with another value", steps: []dedupStep{set("k1", a), set("k2", a), set("k1", b)}, want: DedupStats{Blobs: 2, References: 2, LogicalBytes: 12, StoredBytes: 12}},
+		{name: "last rewrite frees the blob", steps: []dedupStep{set("k1", a), set("k1", b)}, want: DedupStats{Blobs: 1, References: 1, LogicalBytes: 8, StoredBytes: 8}},
+		{name: "delete one reference", steps: []dedupStep{set("k1", a), set("k2", a), del("k1")}, want: DedupStats{Blobs: 1, References: 1, LogicalBytes: 4, StoredBytes: 4}},
+		{name: "delete every reference", steps: []dedupStep{set("k1", a), set("k2", a), del("k1"), del("k2")}},
+		{name: "delete missing key", steps: []dedupStep{set("k1", a), del("k2")}, want: DedupStats{Blobs: 1, References: 1, LogicalBytes: 4, StoredBytes: 4}},
+		{name: "small values inline", steps: []dedupStep{set("k1", small), set("k2", small)}},
+		{name: "small value replaces a shared one", steps: []dedupStep{set("k1", a), set("k2", a), set("k1", small)}, want: DedupStats{Blobs: 1, References: 1, LogicalBytes: 4, StoredBytes: 4}},
+		{name: "clear", steps: []dedupStep{set("k1", a), set("k2", b), {op: "clear"}, set("k3", a)}, want: DedupStats{Blobs: 1, References: 1, LogicalBytes: 4, StoredBytes: 4}},
+		{name: "enabled over existing entries", before: []dedupStep{set("k1", a), set("k2", a), set("k3", small)}, steps: []dedupStep{set("k4", a)}, want: DedupStats{Blobs: 1, References: 3, LogicalBytes: 12, StoredBytes: 4, SavedBytes: 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStorage()
+			values := make(map[string]string) // what each key should hold
+			apply := func(steps []dedupStep) {
+				for _, step := range steps {
+					switch step.op {
+					case "set":
+						s.Set(step.key, []byte(step.value), 0)
+						values[step.key] = step.value
+					case "delete":
+						s.Delete(step.key)
+						delete(values, step.key)
+					case "clear":
+						s.Clear()
+						clear(values)
+					}
+				}
+			}
+			apply(tt.before)
+			s.EnableDedup(4)
+			apply(tt.steps)
+
+			want := tt.want
+			want.Enabled, want.MinSize = true, 4
+			if got := s.DedupStats(); got != want {
+				t.Fatalf("stats %+v, want %+v", got, want)
+			}
+			for key, value := range values {
+				if got, err := s.Get(key); err != nil || string(got) != value {
+					t.Fatalf("%s = %q (%v), want %q", key, got, err, value)
+				}
+			}
+
+			// A snapshot writes each shared value once, and loading it shares them again
+			path := filepath.Join(t.TempDir(), "snapshot.gob")
+			if _, err := WriteSnapshot(s, path); err != nil {
+				t.Fatal(err)
+			}
+			loaded := NewStorage()
+			loaded.EnableDedup(4)
+			if _, err := LoadSnapshot(path, loaded); err != nil {
+				t.Fatal(err)
+			}
+			if got := loaded.DedupStats(); got != want {
+				t.Fatalf("stats after loading the snapshot %+v, want %+v", got, want)
+			}
+			for key, value := range values {
+				if got, err := loaded.Get(key); err != nil || string(got) != value {
+					t.Fatalf("%s = %q (%v) after loading the snapshot, want %q", key, got, err, value)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupSnapshotWritesSharedValuesOnce(t *testing.T) {
+	value := strings.Repeat("v", 64<<10)
+	s := NewStorage()
+	s.EnableDedup(1)
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		s.Set(key, []byte(value), 0)
+	}
+
+	info, err := WriteSnapshot(s, filepath.Join(t.TempDir(), "snapshot.gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size >= 2*int64(len(value)) {
+		t.Fatalf("snapshot of one shared %d-byte value is %d bytes", len(value), info.Size)
+	}
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"dht/internal/jsondoc"
+)
+
+// IndexDefinition declares a secondary index on a JSON field for one tenant
+type IndexDefinition struct {
+	Owner int64  `json:"owner"`
+	Field string `json:"field"` // dotted field path, e.g. "email" or "address.city"
+}
+
+// Indexes maintains secondary indexes on JSON fields, scoped per tenant
+// Definitions are persisted to disk; postings are rebuilt from storage on startup.
+type Indexes struct {
+	path     string
+	defs     map[IndexDefinition]struct{}
+	postings map[IndexDefinition]map[string]map[string]struct{} // value -> keys
+	byKey    map[string]map[IndexDefinition]string              // key -> indexed value
+	mu       sync.RWMutex
+}
+
+// NewIndexes creates an index set, loading definitions from path if it exists
+func NewIndexes(path string) (*Indexes, error) {
+	idx := &Indexes{
+		path:     path,
+		defs:     make(map[IndexDefinition]struct{}),
+		postings: make(map[IndexDefinition]map[string]map[string]struct{}),
+		byKey:    make(map[string]map[IndexDefinition]string),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index definitions: %w", err)
+	}
+
+	var defs []IndexDefinition
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, fmt.Errorf("failed to parse index definitions: %w", err)
+	}
+	for _, def := range defs {
+		idx.defs[def] = struct{}{}
+		idx.postings[def] = make(map[string]map[string]struct{})
+	}
+
+	return idx, nil
+}
+
+// ValidateField checks that field is a usable dotted field path
+func ValidateField(field string) error {
+	if field == "" {
+		return fmt.Errorf("field is required")
+	}
+	if _, err := jsondoc.ParsePath(fieldPath(field)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fieldPath converts a dotted field name into a JSONPath
+func fieldPath(field string) string {
+	return "$." + field
+}
+
+// Define adds an index and backfills it from the tenant's existing keys
+func (idx *Indexes) Define(def IndexDefinition, s *Storage) error {
+	if err := ValidateField(def.Field); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, exists := idx.defs[def]; exists {
+		return nil
+	}
+
+	idx.defs[def] = struct{}{}
+	idx.postings[def] = make(map[string]map[string]struct{})
+	if err := idx.save(); err != nil {
+		delete(idx.defs, def)
+		delete(idx.postings, def)
+		return err
+	}
+
+	// Backfill from existing data
+	for key, entry := range s.GetAll() {
+		if entry.Owner == def.Owner {
+			idx.add(def, key, entry.Value)
+		}
+	}
+	return nil
+}
+
+// Drop removes an index
+func (idx *Indexes) Drop(def IndexDefinition) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, exists := idx.defs[def]; !exists {
+		return fmt.Errorf("index not found")
+	}
+
+	delete(idx.defs, def)
+	delete(idx.postings, def)
+	for key, values := range idx.byKey {
+		delete(values, def)
+		if len(values) == 0 {
+			delete(idx.byKey, key)
+		}
+	}
+	return idx.save()
+}
+
+// Fields returns the indexed fields of a tenant
+func (idx *Indexes) Fields(owner int64) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	fields := make([]string, 0)
+	for def := range idx.defs {
+		if def.Owner == owner {
+			fields = append(fields, def.Field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// Update re-indexes a key after a write
+func (idx *Indexes) Update(owner int64, key string, value []byte) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(key)
+	for def := range idx.defs {
+		if def.Owner == owner {
+			idx.add(def, key, value)
+		}
+	}
+}
+
+// Remove drops a key from all indexes after a delete
+func (idx *Indexes) Remove(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(key)
+}
+
+// Rebuild recomputes all postings from storage (after recovery)
+func (idx *Indexes) Rebuild(s *Storage) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.byKey = make(map[string]map[IndexDefinition]string)
+	for def := range idx.defs {
+		idx.postings[def] = make(map[string]map[string]struct{})
+	}
+
+	if len(idx.defs) == 0 {
+		return
+	}
+	for key, entry := range s.GetAll() {
+		for def := range idx.defs {
+			if def.Owner == entry.Owner {
+				idx.add(def, key, entry.Value)
+			}
+		}
+	}
+}
+
+// Lookup returns the keys whose indexed field equals value, sorted
+// Returns an error if the index does not exist.
+func (idx *Indexes) Lookup(def IndexDefinition, value string) ([]string, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	postings, exists := idx.postings[def]
+	if !exists {
+		return nil, fmt.Errorf("index not found")
+	}
+
+	keys := make([]string, 0, len(postings[value]))
+	for key := range postings[value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// add indexes a single key; caller must hold idx.mu
+func (idx *Indexes) add(def IndexDefinition, key string, value []byte) {
+	indexed, ok := jsondoc.Scalar(value, fieldPath(def.Field))
+	if !ok {
+		return
+	}
+
+	keys, exists := idx.postings[def][indexed]
+	if !exists {
+		keys = make(map[string]struct{})
+		idx.postings[def][indexed] = keys
+	}
+	keys[key] = struct{}{}
+
+	if idx.byKey[key] == nil {
+		idx.byKey[key] = make(map[IndexDefinition]string)
+	}
+	idx.byKey[key][def] = indexed
+}
+
+// remove drops a key from all postings; caller must hold idx.mu
+func (idx *Indexes) remove(key string) {
+	for def, indexed := range idx.byKey[key] {
+		keys := idx.postings[def][indexed]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(idx.postings[def], indexed)
+		}
+	}
+	delete(idx.byKey, key)
+}
+
+// save persists the definitions atomically; caller must hold idx.mu
+func (idx *Indexes) save() error {
+	defs := make([]IndexDefinition, 0, len(idx.defs))
+	for def := range idx.defs {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		if defs[i].Owner != defs[j].Owner {
+			return defs[i].Owner < defs[j].Owner
+		}
+		return defs[i].Field < defs[j].Field
+	})
+
+	data, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := idx.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write index definitions: %w", err)
+	}
+	if err := os.Rename(tmpPath, idx.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to install index definitions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxReportedGaps caps the gaps a WALCheck lists
+const maxReportedGaps = 100
+
+// SeqGap is a range of sequence numbers missing from a WAL
+type SeqGap struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// WALCheck describes the WAL as it was found when it was opened
+type WALCheck struct {
+	Entries          int      `json:"entries"`
+	FirstSeq         uint64   `json:"first_seq,omitempty"`
+	LastSeq          uint64   `json:"last_seq"`
+	CompactedThrough uint64   `json:"compacted_through,omitempty"`
+	Gaps             []SeqGap `json:"gaps,omitempty"`
+	OutOfOrder       int      `json:"out_of_order,omitempty"` // entries not after the one before
+	// Unreadable is why decoding stopped before the end of the file; the
+	// entries after that point were dropped
+	Unreadable string `json:"unreadable,omitempty"`
+	// DamagedCopy is where the log was kept as found when it was unreadable
+	DamagedCopy string `json:"damaged_copy,omitempty"`
+}
+
+// observe checks that entry follows the ones before it. Sequence numbers
+// up to the latest compaction may have gaps and repeat (a compacted commit
+// becomes one entry per key).
+func (c *WALCheck) observe(entry *WALEntry) {
+	c.Entries++
+	if entry.Operation == "COMPACT" {
+		if entry.Through > c.CompactedThrough {
+			c.CompactedThrough = entry.Through
+		}
+		return
+	}
+	if entry.Seq == 0 {
+		// Written before sequencing
+		return
+	}
+
+	switch {
+	case c.LastSeq == 0:
+		c.FirstSeq = entry.Seq
+	case entry.Seq < c.LastSeq || entry.Seq == c.LastSeq && entry.Seq > c.CompactedThrough:
+		c.OutOfOrder++
+		return
+	case entry.Seq > c.LastSeq+1:
+		from := max(c.LastSeq, c.CompactedThrough) + 1
+		if from < entry.Seq && len(c.Gaps) < maxReportedGaps {
+			c.Gaps = append(c.Gaps, SeqGap{From: from, To: entry.Seq - 1})
+		}
+	}
+	c.LastSeq = entry.Seq
+}
+
+// Check returns what was found checking the WAL when it was opened
+func (w *WAL) Check() WALCheck {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.check
+}
+
+// SnapshotManifest is kept next to a node's local snapshot so startup can
+// verify the snapshot and knows which WAL entries it already holds
+type SnapshotManifest struct {
+	Entries   int       `json:"entries"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+	// WALSeq is the last WAL sequence number applied before the snapshot
+	// was taken; later entries may be in it too
+	WALSeq uint64 `json:"wal_seq"`
+}
+
+// SnapshotManifestPath returns where the manifest of the snapshot at path is kept
+func SnapshotManifestPath(path string) string {
+	return strings.TrimSuffix(path, ".gob") + ".json"
+}
+
+// WriteSnapshotManifest records the snapshot described by info, taken after
+// WAL entry walSeq, atomically (temp file + rename)
+func WriteSnapshotManifest(info *SnapshotInfo, walSeq uint64) error {
+	data, err := json.MarshalIndent(SnapshotManifest{
+		Entries:   info.Entries,
+		Size:      info.Size,
+		SHA256:    info.SHA256,
+		CreatedAt: info.CreatedAt,
+		WALSeq:    walSeq,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := SnapshotManifestPath(info.Path)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to install snapshot manifest: %w", err)
+	}
+	return nil
+}
+
+// ReadSnapshotManifest reads the manifest of the snapshot at path
+func ReadSnapshotManifest(path string) (*SnapshotManifest, error) {
+	data, err := os.ReadFile(SnapshotManifestPath(path))
+	if err != nil {
+		return nil, err
+	}
+	var manifest SnapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// IntegrityReport is the result of checking a node's snapshot and WAL
+// against each other. Discrepancies mean data may have been lost; warnings
+// only limit what could be checked.
+type IntegrityReport struct {
+	OK            bool              `json:"ok"`
+	CheckedAt     time.Time         `json:"checked_at"`
+	Snapshot      *SnapshotManifest `json:"snapshot,omitempty"`
+	WAL           WALCheck          `json:"wal"`
+	Discrepancies []string          `json:"discrepancies"`
+	Warnings      []string          `json:"warnings"`
+}
+
+// CheckIntegrity verifies the snapshot at snapshotPath against its manifest
+// and checks that the WAL continues it without gaps: every sequence number
+// after the snapshot's (or the latest compaction's) must be in the WAL.
+func CheckIntegrity(snapshotPath string, wal *WAL) *IntegrityReport {
+	report := &IntegrityReport{
+		CheckedAt:     time.Now(),
+		WAL:           wal.Check(),
+		Discrepancies: []string{},
+		Warnings:      []string{},
+	}
+	discrepancy := func(format string, args ...interface{}) {
+		report.Discrepancies = append(report.Discrepancies, fmt.Sprintf(format, args...))
+	}
+	check := report.WAL
+
+	// The snapshot must match its manifest
+	_, statErr := os.Stat(snapshotPath)
+	haveSnapshot := statErr == nil
+	manifest, err := ReadSnapshotManifest(snapshotPath)
+	switch {
+	case err == nil:
+		report.Snapshot = manifest
+		if !haveSnapshot {
+			discrepancy("snapshot %s is missing (manifest lists %d entries taken at seq %d)", snapshotPath, manifest.Entries, manifest.WALSeq)
+			break
+		}
+		sum, err := FileSHA256(snapshotPath)
+		switch {
+		case err != nil:
+			discrepancy("snapshot %s is unreadable: %v", snapshotPath, err)
+		case sum != manifest.SHA256:
+			discrepancy("snapshot %s does not match its manifest checksum (sha256 %s, expected %s)", snapshotPath, sum, manifest.SHA256)
+		}
+	case os.IsNotExist(err):
+		if haveSnapshot {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("snapshot %s has no manifest; its checksum and WAL position cannot be verified", snapshotPath))
+		}
+	default:
+		discrepancy("snapshot manifest for %s: %v", snapshotPath, err)
+	}
+
+	// The WAL must be readable to the end and have no gaps
+	if check.Unreadable != "" {
+		msg := fmt.Sprintf("WAL has an unreadable entry after %d entries; later entries were dropped (%s)", check.Entries, check.Unreadable)
+		if check.DamagedCopy != "" {
+			msg += "; the log as found was kept at " + check.DamagedCopy
+		}
+		discrepancy("%s", msg)
+	}
+	if check.OutOfOrder > 0 {
+		discrepancy("WAL has %d entries out of sequence order", check.OutOfOrder)
+	}
+
+	// The WAL must continue where the snapshot (or compaction) left off;
+	// what the snapshot holds may be missing from the WAL
+	base := check.CompactedThrough
+	knownBase := manifest != nil || !haveSnapshot
+	if manifest != nil {
+		base = max(base, manifest.WALSeq)
+	}
+	var gaps []SeqGap
+	var missing uint64
+	for _, gap := range check.Gaps {
+		if gap.To <= base {
+			continue
+		}
+		gap.From = max(gap.From, base+1)
+		gaps = append(gaps, gap)
+		missing += gap.To - gap.From + 1
+	}
+	if len(gaps) > 0 {
+		discrepancy("WAL is missing %d sequence number(s) in %d gap(s), first %d-%d",
+			missing, len(gaps), gaps[0].From, gaps[0].To)
+	}
+	if manifest != nil {
+		if check.LastSeq > 0 && check.LastSeq < manifest.WALSeq {
+			discrepancy("WAL ends at seq %d, before the snapshot taken at seq %d", check.LastSeq, manifest.WALSeq)
+		}
+	}
+	if knownBase && check.FirstSeq > base+1 {
+		discrepancy("WAL starts at seq %d but seqs %d-%d are in neither the snapshot nor the WAL", check.FirstSeq, base+1, check.FirstSeq-1)
+	}
+
+	report.OK = len(report.Discrepancies) == 0
+	return report
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendSeqs writes a SET of key k<seq> for each sequence number, as a
+// standby copying its primary's log would
+func appendSeqs(t *testing.T, wal *WAL, seqs ...uint64) {
+	t.Helper()
+	for _, seq := range seqs {
+		entry := &WALEntry{Seq: seq, Operation: "SET", Key: fmt.Sprintf("k%d", seq), Value: []byte(fmt.Sprintf("v%d", seq)), Timestamp: time.Now()}
+		if err := wal.AppendEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func seqRange(from, to uint64) []uint64 {
+	var seqs []uint64
+	for seq := from; seq <= to; seq++ {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+func TestWALSequence(t *testing.T) {
+	tests := []struct {
+		name    string
+		written []uint64 // entries in the log before it is reopened
+		restart uint64   // if set, Restart(restart) after reopening
+		torn    bool     // a partial entry is left at the end of the file
+		wantSeq uint64   // assigned to the next append
+		want    WALCheck
+	}{
+		{name: "empty", wantSeq: 1},
+		{name: "reopened", written: seqRange(1, 3), wantSeq: 4, want: WALCheck{Entries: 3, FirstSeq: 1, LastSeq: 3}},
+		{name: "gap", written: []uint64{1, 2, 5}, wantSeq: 6, want: WALCheck{Entries: 3, FirstSeq: 1, LastSeq: 5, Gaps: []SeqGap{{From: 3, To: 4}}}},
+		{name: "out of order", written: []uint64{1, 3, 2}, wantSeq: 4, want: WALCheck{Entries: 3, FirstSeq: 1, LastSeq: 3, Gaps: []SeqGap{{From: 2, To: 2}}, OutOfOrder: 1}},
+		{name: "torn tail", written: seqRange(1, 3), torn: true, wantSeq: 4, want: WALCheck{Entries: 3, FirstSeq: 1, LastSeq: 3}},
+		{name: "restart behind the log", written: seqRange(1, 9), restart: 5, wantSeq: 6},
+		{name: "restart ahead of the log", written: seqRange(1, 3), restart: 20, wantSeq: 21},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal.log")
+			wal, err := NewWAL(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendSeqs(t, wal, tt.written...)
+			wal.Close()
+			if tt.torn {
+				f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Write([]byte{0x40, 0xff, 0x81})
+				f.Close()
+			}
+
+			wal, err = NewWAL(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			if tt.restart > 0 {
+				if err := wal.Restart(tt.restart); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check := wal.Check()
+			if tt.torn {
+				if check.Unreadable == "" || check.DamagedCopy == "" {
+					t.Fatalf("torn tail not reported: %+v", check)
+				}
+				if _, err := os.Stat(check.DamagedCopy); err != nil {
+					t.Fatalf("damaged copy: %v", err)
+				}
+				check.Unreadable, check.DamagedCopy = "", ""
+			}
+			if fmt.Sprint(check) != fmt.Sprint(tt.want) {
+				t.Fatalf("check %+v, want %+v", check, tt.want)
+			}
+
+			seq, err := wal.AppendWithOptions("SET", "next", []byte("v"), 0, WriteOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seq != tt.wantSeq {
+				t.Fatalf("next append got seq %d, want %d", seq, tt.wantSeq)
+			}
+
+			// The log holds what was kept plus the new entry, and reopens cleanly
+			wal.Close()
+			wal, err = NewWAL(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := wal.LastSeq(); got != tt.wantSeq {
+				t.Fatalf("reopened at seq %d, want %d", got, tt.wantSeq)
+			}
+			if check := wal.Check(); check.Unreadable != "" {
+				t.Fatalf("reopened log is unreadable: %s", check.Unreadable)
+			}
+		})
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	tests := []struct {
+		name        string
+		snapshotSeq uint64 // snapshot of k1..k<snapshotSeq>, 0 for none
+		manifest    string // "", "missing" (no manifest) or "corrupt" (snapshot changed after it)
+		wal         []uint64
+		discrepancy string // expected in the report, empty if the check passes
+		warning     string
+	}{
+		{name: "WAL only", wal: seqRange(1, 3)},
+		{name: "WAL only starting late", wal: seqRange(3, 4), discrepancy: "WAL starts at seq 3"},
+		{name: "WAL continues the snapshot", snapshotSeq: 5, wal: seqRange(6, 8)},
+		{name: "WAL overlaps the snapshot", snapshotSeq: 5, wal: seqRange(1, 8)},
+		{name: "snapshot is the latest state", snapshotSeq: 5},
+		{name: "entries after the snapshot lost", snapshotSeq: 5, wal: seqRange(7, 8), discrepancy: "seqs 6-6 are in neither"},
+		{name: "gap after the snapshot", snapshotSeq: 5, wal: []uint64{6, 8}, discrepancy: "missing 1 sequence number(s) in 1 gap(s), first 7-7"},
+		{name: "gap inside the snapshot", snapshotSeq: 5, wal: []uint64{1, 4, 5, 6}},
+		{name: "WAL behind the snapshot", snapshotSeq: 5, wal: seqRange(1, 3), discrepancy: "WAL ends at seq 3, before the snapshot taken at seq 5"},
+		{name: "snapshot changed", snapshotSeq: 5, manifest: "corrupt", wal: seqRange(6, 8), discrepancy: "does not match its manifest checksum"},
+		{name: "snapshot without manifest", snapshotSeq: 5, manifest: "missing", wal: seqRange(6, 8), warning: "has no manifest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			snapshotPath := filepath.Join(dir, "snapshot.gob")
+			if tt.snapshotSeq > 0 {
+				s := NewStorage()
+				for seq := uint64(1); seq <= tt.snapshotSeq; seq++ {
+					s.SetWithOptions(fmt.Sprintf("k%d", seq), []byte(fmt.Sprintf("v%d", seq)), 0, WriteOptions{Version: seq})
+				}
+				info, err := WriteSnapshot(s, snapshotPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.manifest != "missing" {
+					if err := WriteSnapshotManifest(info, tt.snapshotSeq); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if tt.manifest == "corrupt" {
+					f, err := os.OpenFile(snapshotPath, os.O_APPEND|os.O_WRONLY, 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+					f.Write([]byte{0})
+					f.Close()
+				}
+			}
+
+			walPath := filepath.Join(dir, "wal.log")
+			wal, err := NewWAL(walPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendSeqs(t, wal, tt.wal...)
+			wal.Close()
+			wal, err = NewWAL(walPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+
+			report := CheckIntegrity(snapshotPath, wal)
+			found := strings.Join(report.Discrepancies, "; ")
+			if tt.discrepancy == "" {
+				if !report.OK {
+					t.Fatalf("check failed: %s", found)
+				}
+			} else if report.OK || !strings.Contains(found, tt.discrepancy) {
+				t.Fatalf("discrepancies %q, want one containing %q", found, tt.discrepancy)
+			}
+			if warnings := strings.Join(report.Warnings, "; "); !strings.Contains(warnings, tt.warning) || tt.warning == "" && warnings != "" {
+				t.Fatalf("warnings %q, want %q", warnings, tt.warning)
+			}
+			if !report.OK {
+				return
+			}
+
+			// Starting from the snapshot and replaying the WAL gives every key
+			s := NewStorage()
+			if tt.snapshotSeq > 0 {
+				if _, err := LoadSnapshot(snapshotPath, s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := wal.Restore(s); err != nil {
+				t.Fatal(err)
+			}
+			last := tt.snapshotSeq
+			if n := len(tt.wal); n > 0 {
+				last = max(last, tt.wal[n-1])
+			}
+			for seq := uint64(1); seq <= last; seq++ {
+				key := fmt.Sprintf("k%d", seq)
+				if value, err := s.Get(key); err != nil || string(value) != fmt.Sprintf("v%d", seq) {
+					t.Fatalf("%s = %q (%v) after restore", key, value, err)
+				}
+			}
+			if got := s.KeyCount(); uint64(got) != last {
+				t.Fatalf("restored %d keys, want %d", got, last)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ttlJitter spreads the expiry of keys written with the same TTL, so a bulk
+// fill does not expire in a single sweep
+type ttlJitter struct {
+	fraction float64       // up to this fraction of the TTL is added
+	max      time.Duration // cap on the added time, 0 for none
+}
+
+// EnableTTLJitter makes JitterTTL extend TTLs by a random amount of up to
+// fraction of the TTL, capped at max (0 = uncapped)
+func (s *Storage) EnableTTLJitter(fraction float64, max time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jitter = &ttlJitter{fraction: fraction, max: max}
+}
+
+// TTLJitter returns the configured jitter fraction and cap, 0 if disabled
+func (s *Storage) TTLJitter() (fraction float64, max time.Duration) {
+	if s.jitter == nil {
+		return 0, 0
+	}
+	return s.jitter.fraction, s.jitter.max
+}
+
+// JitterTTL returns the TTL to store a key with: ttl plus a random share of
+// it when jitter is enabled. Keys never expire before the requested TTL.
+// The result is what must be logged and replicated, so every copy of the
+// key expires at the same time.
+func (s *Storage) JitterTTL(ttl time.Duration) time.Duration {
+	if s.jitter == nil || ttl <= 0 || s.jitter.fraction <= 0 {
+		return ttl
+	}
+
+	spread := time.Duration(float64(ttl) * s.jitter.fraction)
+	if s.jitter.max > 0 && spread > s.jitter.max {
+		spread = s.jitter.max
+	}
+	if spread <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int63n(int64(spread)+1))
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fixed bucket bounds, so the reports of different nodes can be added up
+// bucket by bucket. A bucket holds values up to and including its bound; the
+// last bucket is unbounded.
+var (
+	sizeBucketBounds = []int64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+	ttlBucketBounds  = []time.Duration{time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour}
+)
+
+// Bucket is one histogram bucket, labelled with its bound. Max is the
+// inclusive upper bound (bytes for sizes, seconds for TTLs), 0 for the
+// unbounded last bucket.
+type Bucket struct {
+	Label string `json:"label"`
+	Max   int64  `json:"max,omitempty"`
+	Keys  int64  `json:"keys"`
+	Bytes int64  `json:"bytes"`
+}
+
+// KeySize is one key with the size of its value
+type KeySize struct {
+	Key       string     `json:"key"`
+	Owner     int64      `json:"owner"`
+	Size      int64      `json:"size"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// PrefixCount is the keys and value bytes under one key prefix
+type PrefixCount struct {
+	Prefix string `json:"prefix"`
+	Keys   int64  `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// KeyspaceOptions controls AnalyzeKeyspace
+type KeyspaceOptions struct {
+	// Include, if set, limits the analysis to the keys it accepts
+	Include func(key string) bool
+	// Owner, if non-zero, limits the analysis to that tenant's keys
+	Owner int64
+	// Top is how many of the largest keys to list
+	Top int
+	// Delimiter and Depth define a key's prefix: up to its first Depth
+	// segments when split on Delimiter, never including the last one
+	Delimiter string
+	Depth     int
+	// MaxPrefixes caps the prefixes listed, keeping those with the most keys
+	MaxPrefixes int
+}
+
+// KeyspaceStats describes the shape of the stored data
+type KeyspaceStats struct {
+	Keys          int64         `json:"keys"`
+	Bytes         int64         `json:"bytes"`
+	SizeHistogram []Bucket      `json:"size_histogram"`
+	TTLHistogram  []Bucket      `json:"ttl_histogram"`
+	Largest       []KeySize     `json:"largest"`
+	Prefixes      []PrefixCount `json:"prefixes"`
+	// PrefixesTotal is the number of distinct prefixes before MaxPrefixes
+	PrefixesTotal int `json:"prefixes_total"`
+}
+
+// NewSizeHistogram returns the empty value size histogram
+func NewSizeHistogram() []Bucket {
+	buckets := make([]Bucket, 0, len(sizeBucketBounds)+1)
+	for _, bound := range sizeBucketBounds {
+		buckets = append(buckets, Bucket{Label: formatBytes(bound), Max: bound})
+	}
+	return append(buckets, Bucket{Label: "larger"})
+}
+
+// NewTTLHistogram returns the empty remaining-TTL histogram; its first
+// bucket holds the keys without a TTL
+func NewTTLHistogram() []Bucket {
+	buckets := make([]Bucket, 0, len(ttlBucketBounds)+2)
+	buckets = append(buckets, Bucket{Label: "none"})
+	for _, bound := range ttlBucketBounds {
+		buckets = append(buckets, Bucket{Label: formatDuration(bound), Max: int64(bound.Seconds())})
+	}
+	return append(buckets, Bucket{Label: "longer"})
+}
+
+// AnalyzeKeyspace walks the non-expired entries and reports their value
+// size and remaining TTL distributions, the largest keys and the keys and
+// bytes per prefix
+func (s *Storage) AnalyzeKeyspace(opts KeyspaceOptions) KeyspaceStats {
+	stats := KeyspaceStats{
+		SizeHistogram: NewSizeHistogram(),
+		TTLHistogram:  NewTTLHistogram(),
+	}
+	prefixes := make(map[string]*PrefixCount)
+	var largest []KeySize
+
+	s.mu.RLock()
+	now := time.Now()
+	for key, entry := range s.data {
+		if entry.ExpiresAt != nil && !entry.ExpiresAt.After(now) {
+			continue
+		}
+		if opts.Owner != 0 && entry.Owner != opts.Owner {
+			continue
+		}
+		if opts.Include != nil && !opts.Include(key) {
+			continue
+		}
+
+		size := entry.size()
+		stats.Keys++
+		stats.Bytes += size
+
+		b := &stats.SizeHistogram[sizeBucket(size)]
+		b.Keys++
+		b.Bytes += size
+
+		b = &stats.TTLHistogram[ttlBucket(entry.ExpiresAt, now)]
+		b.Keys++
+		b.Bytes += size
+
+		prefix := ""
+		if opts.Delimiter != "" {
+			prefix = keyPrefix(key, opts.Delimiter, opts.Depth)
+		}
+		p, exists := prefixes[prefix]
+		if !exists {
+			p = &PrefixCount{Prefix: prefix}
+			prefixes[prefix] = p
+		}
+		p.Keys++
+		p.Bytes += size
+
+		if opts.Top > 0 {
+			largest = append(largest, KeySize{Key: key, Owner: entry.Owner, Size: size, ExpiresAt: entry.ExpiresAt})
+			// Trim now and then rather than holding every key
+			if len(largest) >= 2*opts.Top+1024 {
+				largest = LargestKeys(largest, opts.Top)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	stats.Largest = LargestKeys(largest, opts.Top)
+
+	stats.PrefixesTotal = len(prefixes)
+	stats.Prefixes = make([]PrefixCount, 0, len(prefixes))
+	for _, p := range prefixes {
+		stats.Prefixes = append(stats.Prefixes, *p)
+	}
+	stats.Prefixes = TopPrefixes(stats.Prefixes, opts.MaxPrefixes)
+
+	return stats
+}
+
+// LargestKeys sorts keys by size, largest first, and keeps the first limit
+func LargestKeys(keys []KeySize, limit int) []KeySize {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Size != keys[j].Size {
+			return keys[i].Size > keys[j].Size
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	if keys == nil {
+		keys = []KeySize{}
+	}
+	return keys
+}
+
+// TopPrefixes sorts prefixes by key count, most first, and keeps the first
+// limit (all if limit is 0)
+func TopPrefixes(prefixes []PrefixCount, limit int) []PrefixCount {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Keys != prefixes[j].Keys {
+			return prefixes[i].Keys > prefixes[j].Keys
+		}
+		return prefixes[i].Prefix < prefixes[j].Prefix
+	})
+	if limit > 0 && len(prefixes) > limit {
+		prefixes = prefixes[:limit]
+	}
+	return prefixes
+}
+
+func sizeBucket(size int64) int {
+	for i, bound := range sizeBucketBounds {
+		if size <= bound {
+			return i
+		}
+	}
+	return len(sizeBucketBounds)
+}
+
+func ttlBucket(expiresAt *time.Time, now time.Time) int {
+	if expiresAt == nil {
+		return 0
+	}
+	remaining := expiresAt.Sub(now)
+	for i, bound := range ttlBucketBounds {
+		if remaining <= bound {
+			return i + 1
+		}
+	}
+	return len(ttlBucketBounds) + 1
+}
+
+// keyPrefix returns up to depth delimiter-separated segments of key, never
+// its last segment, so "user:42" and "user:43" share the prefix "user".
+// Keys without the delimiter have the empty prefix.
+func keyPrefix(key, delimiter string, depth int) string {
+	end := 0
+	for i := 0; i < depth; i++ {
+		next := strings.Index(key[end:], delimiter)
+		if next < 0 {
+			break
+		}
+		end += next + len(delimiter)
+	}
+	if end == 0 {
+		return ""
+	}
+	return key[:end-len(delimiter)]
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return itoa(n>>20) + "MiB"
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return itoa(n>>10) + "KiB"
+	default:
+		return itoa(n) + "B"
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		return itoa(int64(d/(24*time.Hour))) + "d"
+	case d >= time.Hour && d%time.Hour == 0:
+		return itoa(int64(d/time.Hour)) + "h"
+	default:
+		return itoa(int64(d/time.Minute)) + "m"
+	}
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxPooledBuffer keeps the odd huge value from pinning its buffer in the
+// pool; larger buffers are left to the garbage collector
+const maxPooledBuffer = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// GetBuffer returns an empty buffer from the pool. Return it with PutBuffer
+// once nothing refers to its bytes any more.
+func GetBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer returns buf to the pool
+func PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// ReadValue reads a value of size bytes from r (size < 0 if unknown) into a
+// slice of exactly the value's length, which the caller owns. A known size
+// is read straight into the result; otherwise the value is gathered in a
+// pooled buffer instead of a slice regrown for every few kilobytes. Sizes
+// above maxPooledBuffer are not trusted for the up-front allocation.
+func ReadValue(r io.Reader, size int64) ([]byte, error) {
+	if size >= 0 && size <= maxPooledBuffer {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	value := make([]byte, buf.Len())
+	copy(value, buf.Bytes())
+	return value, nil
+}
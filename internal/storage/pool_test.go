@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int   // bytes in the reader
+		declare int64 // size passed to ReadValue
+		wantErr bool
+	}{
+		{name: "empty", size: 0, declare: 0},
+		{name: "known size", size: 1000, declare: 1000},
+		{name: "unknown size", size: 1000, declare: -1},
+		{name: "unknown size above pooled", size: maxPooledBuffer + 10, declare: -1},
+		{name: "declared above pooled", size: maxPooledBuffer + 10, declare: maxPooledBuffer + 10},
+		{name: "short body", size: 10, declare: 20, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("x"), tt.size)
+			// One byte at a time, as a slow client would send it
+			got, err := ReadValue(iotest.HalfReader(bytes.NewReader(data)), tt.declare)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes, want %d", len(got), len(data))
+			}
+			if cap(got) != len(got) {
+				t.Fatalf("value has capacity %d for %d bytes", cap(got), len(got))
+			}
+		})
+	}
+}
+
+func TestPutBufferDropsLargeBuffers(t *testing.T) {
+	buf := GetBuffer()
+	buf.Write(make([]byte, maxPooledBuffer+1))
+	PutBuffer(buf)
+	// A dropped buffer is not handed out again; any buffer that is comes back empty
+	for i := 0; i < 10; i++ {
+		if got := GetBuffer(); got.Len() != 0 || got.Cap() > maxPooledBuffer {
+			t.Fatalf("GetBuffer returned a buffer of length %d, capacity %d", got.Len(), got.Cap())
+		}
+	}
+}
+
+// BenchmarkReadValue compares reading a request body of known and unknown
+// length with ReadValue against io.ReadAll, which regrows its slice as it
+// reads and leaves spare capacity in the stored value
+func BenchmarkReadValue(b *testing.B) {
+	for _, size := range []int{1 << 10, 16 << 10, 256 << 10} {
+		data := bytes.Repeat([]byte("v"), size)
+		for _, bench := range []struct {
+			name string
+			read func(r io.Reader) ([]byte, error)
+		}{
+			{"ReadAll", io.ReadAll},
+			{"ReadValue", func(r io.Reader) ([]byte, error) { return ReadValue(r, int64(size)) }},
+			{"ReadValueUnknownSize", func(r io.Reader) ([]byte, error) { return ReadValue(r, -1) }},
+		} {
+			b.Run(fmt.Sprintf("%s/%dKiB", bench.name, size>>10), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := bench.read(bytes.NewReader(data)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkWALAppend measures appending a SET entry, encoded through a
+// pooled buffer
+func BenchmarkWALAppend(b *testing.B) {
+	for _, size := range []int{1 << 10, 16 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			wal, err := NewWAL(b.TempDir() + "/wal.log")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer wal.Close()
+			value := bytes.Repeat([]byte("v"), size)
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := wal.AppendWithOptions("SET", "key", value, 0, WriteOptions{Owner: 1}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
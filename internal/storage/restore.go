@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RestoreProgress tracks a WAL restore; safe for concurrent readers
+type RestoreProgress struct {
+	totalBytes atomic.Int64
+	bytesRead  atomic.Int64
+	decoded    atomic.Int64
+	applied    atomic.Int64
+	startedAt  atomic.Int64 // unix nanos
+	finishedAt atomic.Int64 // unix nanos, 0 while running
+}
+
+// RestoreStatus is a point-in-time view of a RestoreProgress
+type RestoreStatus struct {
+	Done           bool    `json:"done"`
+	Percent        float64 `json:"percent"`
+	BytesRead      int64   `json:"bytes_read"`
+	TotalBytes     int64   `json:"total_bytes"`
+	EntriesDecoded int64   `json:"entries_decoded"`
+	EntriesApplied int64   `json:"entries_applied"`
+	ElapsedMs      int64   `json:"elapsed_ms"`
+	ETAMs          int64   `json:"eta_ms"`
+}
+
+// Status returns the current progress and an ETA extrapolated from bytes read
+func (p *RestoreProgress) Status() RestoreStatus {
+	status := RestoreStatus{
+		Done:           p.finishedAt.Load() != 0,
+		BytesRead:      p.bytesRead.Load(),
+		TotalBytes:     p.totalBytes.Load(),
+		EntriesDecoded: p.decoded.Load(),
+		EntriesApplied: p.applied.Load(),
+	}
+
+	started := p.startedAt.Load()
+	if started == 0 {
+		return status
+	}
+
+	end := time.Now()
+	if finished := p.finishedAt.Load(); finished != 0 {
+		end = time.Unix(0, finished)
+	}
+	elapsed := end.Sub(time.Unix(0, started))
+	status.ElapsedMs = elapsed.Milliseconds()
+
+	switch {
+	case status.Done || status.TotalBytes == 0:
+		status.Percent = 100
+	default:
+		status.Percent = float64(status.BytesRead) / float64(status.TotalBytes) * 100
+		if status.BytesRead > 0 {
+			remaining := float64(status.TotalBytes-status.BytesRead) / float64(status.BytesRead) * float64(elapsed)
+			status.ETAMs = time.Duration(remaining).Milliseconds()
+		}
+	}
+
+	return status
+}
+
+// RestoreParallel reads the WAL and applies entries to storage using a pool
+// of workers. Entries are decoded sequentially and routed to workers by key
+// hash, so operations on the same key are applied in WAL order.
+// progress may be nil.
+func (w *WAL) RestoreParallel(storage *Storage, workers int, progress *RestoreProgress) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if progress == nil {
+		progress = &RestoreProgress{}
+	}
+	progress.startedAt.Store(time.Now().UnixNano())
+	defer func() { progress.finishedAt.Store(time.Now().UnixNano()) }()
+
+	file, err := os.Open(w.filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// WAL doesn't exist yet, that's okay
+			return nil
+		}
+		return fmt.Errorf("failed to open WAL for restore: %w", err)
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err == nil {
+		progress.totalBytes.Store(info.Size())
+	}
+
+	queues := make([]chan *WALEntry, workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan *WALEntry, 256)
+		wg.Add(1)
+		go func(queue <-chan *WALEntry) {
+			defer wg.Done()
+			for entry := range queue {
+				ApplyWALEntry(storage, entry)
+				progress.applied.Add(1)
+			}
+		}(queues[i])
+	}
+
+	reader := &progressReader{r: file, n: &progress.bytesRead}
+	decoder := gob.NewDecoder(bufio.NewReader(reader))
+
+	var decodeErr error
+	for {
+		entry := &WALEntry{}
+		if err := decoder.Decode(entry); err != nil {
+			if err != io.EOF {
+				// A torn write at the tail is expected after a crash
+				decodeErr = err
+			}
+			break
+		}
+		progress.decoded.Add(1)
+
+		route := func(entry *WALEntry) {
+			h := fnv.New32a()
+			h.Write([]byte(entry.Key))
+			queues[h.Sum32()%uint32(workers)] <- entry
+		}
+
+		// A commit touches several keys; route each write to its key's
+		// worker, then resolve the transaction on the worker that saw PREPARE
+		if entry.Operation == "COMMIT" {
+			writes, err := entry.TxnWrites()
+			if err != nil {
+				fmt.Printf("WAL: Skipping %v\n", err)
+			}
+			for _, write := range writes {
+				route(write)
+			}
+			route(&WALEntry{Seq: entry.Seq, Operation: "COMMIT", Key: entry.Key, Timestamp: entry.Timestamp})
+			continue
+		}
+		route(entry)
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	if decodeErr != nil {
+		fmt.Printf("WAL: Stopped at corrupted entry after %d entries in %s: %v\n",
+			progress.decoded.Load(), w.filepath, decodeErr)
+	}
+	fmt.Printf("WAL: Restored %d entries from %s using %d workers\n", progress.applied.Load(), w.filepath, workers)
+	return nil
+}
+
+// ApplyWALEntry applies a single WAL entry, keeping the original expiry
+func ApplyWALEntry(storage *Storage, entry *WALEntry) {
+	switch entry.Operation {
+	case "SET":
+		opts := entry.WriteOptions()
+		ttl := entry.TTL
+		if ttl > 0 {
+			ttl -= time.Since(entry.Timestamp)
+			if ttl <= 0 && opts.SlidingTTL > 0 {
+				// A later TOUCH entry may still extend a sliding key, so keep it as expired
+				storage.SetWithOptions(entry.Key, entry.Value, entry.TTL, opts)
+				storage.SetExpiry(entry.Key, entry.Timestamp.Add(entry.TTL))
+				return
+			}
+			if ttl <= 0 {
+				// Expired since it was written; it also supersedes older values
+				storage.Delete(entry.Key)
+				return
+			}
+		}
+		storage.SetWithOptions(entry.Key, entry.Value, ttl, opts)
+	case "TOUCH":
+		// Applied even if already past, since a later TOUCH may extend it again
+		storage.SetExpiry(entry.Key, entry.Timestamp.Add(entry.TTL))
+	case "DELETE":
+		storage.Delete(entry.Key)
+	case "PREPARE", "COMMIT", "ABORT":
+		applyTxnEntry(storage, entry)
+	}
+}
+
+// progressReader counts bytes read through it
+type progressReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n.Add(int64(n))
+	return n, err
+}
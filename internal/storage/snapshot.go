@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// snapshotEntry is the on-disk representation of an entry in a snapshot
+type snapshotEntry struct {
+	Key           string
+	Value         []byte
+	Owner         int64
+	Version       uint64
+	ExpiresAt     *time.Time
+	SourceVersion uint64
+	Replicas      int
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	SlidingTTL    time.Duration
+
+	// ContentHash is set for deduplicated values; Value is only written
+	// with the first entry referencing each hash
+	ContentHash string
+}
+
+// SnapshotInfo describes a snapshot written to disk
+type SnapshotInfo struct {
+	Path      string
+	Entries   int
+	Size      int64
+	SHA256    string
+	CreatedAt time.Time
+
+	// WALSeq is the last WAL sequence number the snapshot holds, set by
+	// callers that know it
+	WALSeq uint64
+}
+
+// WriteSnapshot writes all live entries to path atomically (temp file + rename)
+func WriteSnapshot(s *Storage, path string) (*SnapshotInfo, error) {
+	createdAt := time.Now()
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+
+	hasher := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(file, hasher)}
+
+	entries, err := EncodeSnapshot(s, counter)
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	// Sync to disk before making the snapshot visible
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	file.Close()
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to install snapshot: %w", err)
+	}
+
+	return &SnapshotInfo{
+		Path:      path,
+		Entries:   entries,
+		Size:      counter.n,
+		SHA256:    hex.EncodeToString(hasher.Sum(nil)),
+		CreatedAt: createdAt,
+	}, nil
+}
+
+// EncodeSnapshot writes all live entries to w in snapshot format
+// Returns the number of entries written
+func EncodeSnapshot(s *Storage, w io.Writer) (int, error) {
+	entries := s.GetAll()
+
+	buffered := bufio.NewWriter(w)
+	encoder := gob.NewEncoder(buffered)
+	written := make(map[string]bool)
+
+	for _, entry := range entries {
+		se := snapshotEntry{
+			Key:           entry.Key,
+			Value:         entry.Value,
+			Owner:         entry.Owner,
+			Version:       entry.Version,
+			ExpiresAt:     entry.ExpiresAt,
+			SourceVersion: entry.SourceVersion,
+			Replicas:      entry.Replicas,
+			CreatedAt:     entry.CreatedAt,
+			UpdatedAt:     entry.UpdatedAt,
+			SlidingTTL:    entry.SlidingTTL,
+			ContentHash:   entry.contentHash,
+		}
+		if se.ContentHash != "" {
+			if written[se.ContentHash] {
+				se.Value = nil
+			}
+			written[se.ContentHash] = true
+		}
+		if err := encoder.Encode(se); err != nil {
+			return 0, fmt.Errorf("failed to encode snapshot entry: %w", err)
+		}
+	}
+
+	if err := buffered.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to flush snapshot: %w", err)
+	}
+
+	return len(entries), nil
+}
+
+// LoadSnapshot reads a snapshot from path and applies its entries to storage
+// Returns the number of entries loaded (expired entries are skipped)
+func LoadSnapshot(path string, s *Storage) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return ReadSnapshot(file, s)
+}
+
+// ReadSnapshot decodes a snapshot stream and applies its entries to storage
+func ReadSnapshot(r io.Reader, s *Storage) (int, error) {
+	decoder := gob.NewDecoder(bufio.NewReader(r))
+	loaded := 0
+	now := time.Now()
+	blobs := make(map[string][]byte)
+
+	for {
+		var se snapshotEntry
+		if err := decoder.Decode(&se); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return loaded, fmt.Errorf("failed to decode snapshot entry: %w", err)
+		}
+
+		// Resolve deduplicated values (even for expired entries, which may
+		// carry the only copy of a blob)
+		if se.ContentHash != "" {
+			if se.Value != nil {
+				blobs[se.ContentHash] = se.Value
+			} else if value, ok := blobs[se.ContentHash]; ok {
+				se.Value = value
+			} else {
+				return loaded, fmt.Errorf("snapshot entry %q references unknown content %s", se.Key, se.ContentHash)
+			}
+		}
+
+		// Skip entries that expired since the snapshot was taken
+		if se.ExpiresAt != nil && se.ExpiresAt.Before(now) {
+			continue
+		}
+
+		s.SetEntry(&Entry{
+			Key:           se.Key,
+			Value:         se.Value,
+			Owner:         se.Owner,
+			Version:       se.Version,
+			ExpiresAt:     se.ExpiresAt,
+			SourceVersion: se.SourceVersion,
+			Replicas:      se.Replicas,
+			CreatedAt:     se.CreatedAt,
+			UpdatedAt:     se.UpdatedAt,
+			SlidingTTL:    se.SlidingTTL,
+		})
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+// SnapshotKeys returns the keys of the snapshot at path that are still live,
+// without loading their values. A missing snapshot has no keys.
+func SnapshotKeys(path string) (map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keys, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := gob.NewDecoder(bufio.NewReader(file))
+	now := time.Now()
+	for {
+		var se snapshotEntry
+		if err := decoder.Decode(&se); err != nil {
+			if err == io.EOF {
+				return keys, nil
+			}
+			return nil, fmt.Errorf("failed to decode snapshot entry: %w", err)
+		}
+		if se.ExpiresAt != nil && se.ExpiresAt.Before(now) {
+			continue
+		}
+		keys[se.Key] = struct{}{}
+	}
+}
+
+// FileSHA256 returns the hex-encoded SHA-256 checksum of a file
+func FileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// countingWriter counts bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -1,30 +1,97 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"dht/internal/namespace"
 )
 
 // Entry represents a key-value entry with metadata
 type Entry struct {
 	Key       string
 	Value     []byte
+	Owner     int64  // ID of the user (tenant) that wrote the key, 0 if unknown
+	Version   uint64 // WAL sequence number of the write that produced the value, 0 if unknown
 	ExpiresAt *time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	// SlidingTTL, when set, pushes ExpiresAt to now+SlidingTTL on every read
+	SlidingTTL time.Duration
+
+	// SourceVersion is the primary's version of a replicated write, 0 if the
+	// key was written on this node (or by an older replicator)
+	SourceVersion uint64
+
+	// Replicas is the number of nodes that hold the key, 0 for the default;
+	// rebalancing copies the key to that many nodes
+	Replicas int
+
+	// loggedExpiry is the expiry recoverable from the WAL; sliding refreshes
+	// are only logged once the real expiry has moved far enough past it
+	loggedExpiry time.Time
+
+	// contentHash identifies the shared blob holding Value when
+	// deduplication is enabled, empty if the value is stored inline
+	contentHash string
+
+	// cold locates the value in the disk tier once it has been spilled,
+	// leaving Value nil
+	cold *coldRef
+
+	// atime is when the value was last read, for the spiller. It is
+	// allocated per write and shared by copies of the entry, so a shared
+	// pointer also means the same value. Nil unless tiering is enabled.
+	atime *atomic.Int64
+}
+
+// WriteOptions carries optional per-key metadata for a write
+type WriteOptions struct {
+	Owner      int64         // Tenant that wrote the key
+	SlidingTTL time.Duration // Refresh the expiry by this much on every read (0 = fixed expiry)
+	Version    uint64        // WAL sequence number of the write
+
+	// SourceVersion is the primary's version of a replicated write
+	SourceVersion uint64
+
+	// Replicas is the key's replication factor (0 = default)
+	Replicas int
 }
 
+// ErrVersionMismatch is returned by a conditional delete when the key is at
+// another version
+var ErrVersionMismatch = errors.New("version mismatch")
+
 // Storage provides in-memory key-value storage with TTL support
 type Storage struct {
-	data map[string]*Entry
-	mu   sync.RWMutex
+	data   map[string]*Entry
+	dedup  *blobStore     // nil unless content-addressed deduplication is enabled
+	access *accessTracker // nil unless per-key access statistics are enabled
+	jitter *ttlJitter     // nil unless TTL jitter is enabled
+	tier   *diskTier      // nil unless cold values are spilled to disk
+	txns   map[string]*PreparedTxn
+	locks  map[string]string // key -> ID of the prepared transaction holding it
+
+	// How finished transactions ended, kept until ForgetTxnOutcomes
+	txnOutcomes map[string]TxnOutcome
+
+	mu sync.RWMutex
 }
 
 // NewStorage creates a new storage instance
 func NewStorage() *Storage {
 	s := &Storage{
-		data: make(map[string]*Entry),
+		data:  make(map[string]*Entry),
+		txns:  make(map[string]*PreparedTxn),
+		locks: make(map[string]string),
+
+		txnOutcomes: make(map[string]TxnOutcome),
 	}
 
 	// Start cleanup goroutine for expired entries
@@ -35,43 +102,179 @@ func NewStorage() *Storage {
 
 // Set stores a key-value pair with optional TTL
 func (s *Storage) Set(key string, value []byte, ttl time.Duration) error {
+	return s.SetWithOptions(key, value, ttl, WriteOptions{})
+}
+
+// SetWithOptions stores a key-value pair with optional TTL and metadata
+func (s *Storage) SetWithOptions(key string, value []byte, ttl time.Duration, opts WriteOptions) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.setLocked(key, value, ttl, opts)
+	return nil
+}
+
+// setLocked stores a key-value pair; caller must hold s.mu
+func (s *Storage) setLocked(key string, value []byte, ttl time.Duration, opts WriteOptions) {
 	now := time.Now()
 	entry := &Entry{
-		Key:       key,
-		Value:     value,
-		CreatedAt: now,
-		UpdatedAt: now,
+		Key:           key,
+		Value:         value,
+		Owner:         opts.Owner,
+		Version:       opts.Version,
+		SourceVersion: opts.SourceVersion,
+		Replicas:      opts.Replicas,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		SlidingTTL:    opts.SlidingTTL,
 	}
 
 	// Set expiration if TTL provided
 	if ttl > 0 {
 		expiresAt := now.Add(ttl)
 		entry.ExpiresAt = &expiresAt
+		entry.loggedExpiry = expiresAt
 	}
 
-	s.data[key] = entry
-	return nil
+	s.put(entry)
+}
+
+// SetEntry stores an entry as-is, preserving its timestamps and expiry
+// (used when loading snapshots)
+func (s *Storage) SetEntry(entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *entry
+	s.put(&stored)
+}
+
+// Clear removes all entries (used before restoring from a backup)
+func (s *Storage) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data = make(map[string]*Entry)
+	s.txns = make(map[string]*PreparedTxn)
+	s.locks = make(map[string]string)
+	if s.access != nil {
+		s.access.mu.Lock()
+		s.access.keys = make(map[string]*AccessStats)
+		s.access.mu.Unlock()
+	}
+	if s.dedup != nil {
+		s.dedup = &blobStore{
+			blobs:   make(map[string]*blob),
+			minSize: s.dedup.minSize,
+		}
+	}
+	if s.tier != nil {
+		// The segments are reclaimed once the spiller sees nothing in them
+		for _, seg := range s.tier.segments {
+			seg.live = 0
+		}
+		s.tier.hotBytes, s.tier.coldKeys, s.tier.coldBytes = 0, 0, 0
+	}
 }
 
 // Get retrieves a value by key
 func (s *Storage) Get(key string) ([]byte, error) {
+	entry, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// GetEntry retrieves a copy of the entry (value plus metadata) by key
+func (s *Storage) GetEntry(key string) (*Entry, error) {
+	entry, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *entry
+	return &copied, nil
+}
+
+// lookup returns the live entry for key; a value spilled to disk is read
+// back and promoted to memory
+func (s *Storage) lookup(key string) (*Entry, error) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
 
 	entry, exists := s.data[key]
 	if !exists {
+		s.mu.RUnlock()
 		return nil, fmt.Errorf("key not found")
 	}
 
 	// Check if expired
 	if entry.ExpiresAt != nil && entry.ExpiresAt.Before(time.Now()) {
+		s.mu.RUnlock()
 		return nil, fmt.Errorf("key expired")
 	}
 
-	return entry.Value, nil
+	if entry.cold == nil {
+		entry.touch()
+		s.mu.RUnlock()
+		return entry, nil
+	}
+
+	value, err := s.tier.read(key, entry.cold)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.promote(entry, value), nil
+}
+
+// Touch refreshes the expiry of a sliding-TTL key to now+SlidingTTL
+// It returns the new expiry and whether the caller should log the refresh:
+// refreshes are only worth logging once the expiry recoverable from the WAL
+// trails the real one by more than a quarter of the TTL. ok is false if the
+// key does not exist, has expired or is not a sliding key.
+func (s *Storage) Touch(key string) (expiresAt time.Time, persist bool, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.data[key]
+	if !exists || entry.SlidingTTL <= 0 {
+		return time.Time{}, false, false
+	}
+
+	now := time.Now()
+	if entry.ExpiresAt != nil && entry.ExpiresAt.Before(now) {
+		return time.Time{}, false, false
+	}
+
+	// Replace rather than mutate, since readers may hold the old entry
+	touched := *entry
+	expiresAt = now.Add(entry.SlidingTTL)
+	touched.ExpiresAt = &expiresAt
+	if expiresAt.Sub(entry.loggedExpiry) > entry.SlidingTTL/4 {
+		touched.loggedExpiry = expiresAt
+		persist = true
+	}
+	s.data[key] = &touched
+
+	return expiresAt, persist, true
+}
+
+// SetExpiry moves the expiry of an existing key (used when replaying
+// logged sliding-TTL refreshes)
+func (s *Storage) SetExpiry(key string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.data[key]
+	if !exists {
+		return
+	}
+
+	updated := *entry
+	updated.ExpiresAt = &expiresAt
+	updated.loggedExpiry = expiresAt
+	s.data[key] = &updated
 }
 
 // Delete removes a key
@@ -83,7 +286,25 @@ func (s *Storage) Delete(key string) error {
 		return fmt.Errorf("key not found")
 	}
 
-	delete(s.data, key)
+	s.remove(key)
+	return nil
+}
+
+// DeleteIfVersion removes a key only if it is still at version, so a delete
+// decided on an earlier read cannot remove a newer write
+func (s *Storage) DeleteIfVersion(key string, version uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.data[key]
+	if !exists || (entry.ExpiresAt != nil && entry.ExpiresAt.Before(time.Now())) {
+		return fmt.Errorf("key not found")
+	}
+	if entry.Version != version {
+		return fmt.Errorf("%w: %q is at version %d, not %d", ErrVersionMismatch, key, entry.Version, version)
+	}
+
+	s.remove(key)
 	return nil
 }
 
@@ -122,7 +343,102 @@ func (s *Storage) KeyCount() int {
 	return count
 }
 
+// ValueBytes returns the total size of the values of non-expired keys
+func (s *Storage) ValueBytes() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	now := time.Now()
+	for _, entry := range s.data {
+		if entry.ExpiresAt == nil || entry.ExpiresAt.After(now) {
+			total += entry.size()
+		}
+	}
+
+	return total
+}
+
+// OwnerUsage is the storage held by one tenant
+type OwnerUsage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// UsageByOwner totals the keys and value bytes of non-expired entries per
+// owner. If include is set, only the keys it accepts are counted.
+func (s *Storage) UsageByOwner(include func(key string) bool) map[int64]OwnerUsage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	usage := make(map[int64]OwnerUsage)
+	now := time.Now()
+	for key, entry := range s.data {
+		if entry.ExpiresAt != nil && !entry.ExpiresAt.After(now) {
+			continue
+		}
+		if include != nil && !include(key) {
+			continue
+		}
+		u := usage[entry.Owner]
+		u.Keys++
+		u.Bytes += entry.size()
+		usage[entry.Owner] = u
+	}
+
+	return usage
+}
+
+// NamespaceUsage is the storage one tenant holds in one namespace
+type NamespaceUsage struct {
+	Owner     int64  `json:"owner"`
+	Namespace string `json:"namespace"` // empty for keys without a namespace
+	OwnerUsage
+}
+
+// UsageByNamespace totals the keys and value bytes of non-expired entries
+// per owner and namespace, ordered by owner then namespace. If include is
+// set, only the keys it accepts are counted.
+func (s *Storage) UsageByNamespace(include func(key string) bool) []NamespaceUsage {
+	type group struct {
+		owner     int64
+		namespace string
+	}
+
+	s.mu.RLock()
+	groups := make(map[group]OwnerUsage)
+	now := time.Now()
+	for key, entry := range s.data {
+		if entry.ExpiresAt != nil && !entry.ExpiresAt.After(now) {
+			continue
+		}
+		if include != nil && !include(key) {
+			continue
+		}
+		g := group{owner: entry.Owner, namespace: namespace.Of(key)}
+		u := groups[g]
+		u.Keys++
+		u.Bytes += entry.size()
+		groups[g] = u
+	}
+	s.mu.RUnlock()
+
+	usage := make([]NamespaceUsage, 0, len(groups))
+	for g, u := range groups {
+		usage = append(usage, NamespaceUsage{Owner: g.owner, Namespace: g.namespace, OwnerUsage: u})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Owner != usage[j].Owner {
+			return usage[i].Owner < usage[j].Owner
+		}
+		return usage[i].Namespace < usage[j].Namespace
+	})
+	return usage
+}
+
 // GetAll returns all non-expired entries (for WAL restore)
+// Values spilled to disk are read back (without promoting them); a key
+// whose value cannot be read is left out and logged.
 func (s *Storage) GetAll() map[string]*Entry {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -132,6 +448,37 @@ func (s *Storage) GetAll() map[string]*Entry {
 
 	for key, entry := range s.data {
 		// Only include non-expired entries
+		if entry.ExpiresAt != nil && !entry.ExpiresAt.After(now) {
+			continue
+		}
+		if entry.cold != nil {
+			value, err := s.tier.read(key, entry.cold)
+			if err != nil {
+				log.Printf("storage: %v\n", err)
+				continue
+			}
+			loaded := *entry
+			loaded.Value = value
+			loaded.cold = nil
+			entry = &loaded
+		}
+		result[key] = entry
+	}
+
+	return result
+}
+
+// GetAllMetadata returns all non-expired entries like GetAll, except that
+// values spilled to disk are not read: their Value is nil. It is for callers
+// that only need keys and metadata.
+func (s *Storage) GetAllMetadata() map[string]*Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]*Entry)
+	now := time.Now()
+
+	for key, entry := range s.data {
 		if entry.ExpiresAt == nil || entry.ExpiresAt.After(now) {
 			result[key] = entry
 		}
@@ -140,6 +487,56 @@ func (s *Storage) GetAll() map[string]*Entry {
 	return result
 }
 
+// put installs entry under its key, interning its value and releasing the
+// value it replaces; caller must hold s.mu
+func (s *Storage) put(entry *Entry) {
+	old, exists := s.data[entry.Key]
+	if s.dedup != nil {
+		entry.Value, entry.contentHash = s.dedup.intern(entry.Value)
+		if exists {
+			s.dedup.release(old.contentHash)
+		}
+	}
+	if s.tier != nil {
+		if exists {
+			s.releaseTiered(old)
+		}
+		entry.cold = nil
+		entry.atime = new(atomic.Int64)
+		entry.atime.Store(time.Now().UnixNano())
+		if entry.contentHash == "" {
+			s.tier.addHot(int64(len(entry.Value)))
+		}
+	}
+	s.data[entry.Key] = entry
+}
+
+// remove deletes key, releasing its value and access statistics; caller must hold s.mu
+func (s *Storage) remove(key string) {
+	if old, exists := s.data[key]; exists {
+		if s.dedup != nil {
+			s.dedup.release(old.contentHash)
+		}
+		if s.tier != nil {
+			s.releaseTiered(old)
+		}
+	}
+	if s.access != nil {
+		s.access.forget(key)
+	}
+	delete(s.data, key)
+}
+
+// releaseTiered uncounts the value of an entry being replaced or removed,
+// wherever the tier holds it; caller must hold s.mu
+func (s *Storage) releaseTiered(old *Entry) {
+	if old.cold != nil {
+		s.tier.release(old.cold)
+	} else if old.contentHash == "" {
+		s.tier.hotBytes -= int64(len(old.Value))
+	}
+}
+
 // cleanupExpired removes expired entries periodically
 func (s *Storage) cleanupExpired() {
 	ticker := time.NewTicker(1 * time.Minute)
@@ -150,7 +547,7 @@ func (s *Storage) cleanupExpired() {
 		now := time.Now()
 		for key, entry := range s.data {
 			if entry.ExpiresAt != nil && entry.ExpiresAt.Before(now) {
-				delete(s.data, key)
+				s.remove(key)
 			}
 		}
 		s.mu.Unlock()
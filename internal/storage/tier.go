@@ -0,0 +1,464 @@
+package storage
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tierSegmentSize   = 64 << 20        // segments are rolled once they reach this size
+	tierSpillBatch    = 16 << 20        // most value bytes one spill step writes before swapping entries
+	tierSpillInterval = 1 * time.Second // how often the watermark is checked between writes
+)
+
+// coldRef locates a value that was spilled to the disk tier
+type coldRef struct {
+	segment int
+	offset  int64
+	length  int
+	crc     uint32
+}
+
+// tierSegment is one append-only file of spilled values
+type tierSegment struct {
+	file    *os.File
+	written int64 // bytes appended; only the spiller touches it
+	live    int64 // bytes still referenced by entries; guarded by the storage lock
+}
+
+// diskTier keeps cold values in segment files once the values held in
+// memory pass the watermark. The files are a cache of what the WAL and
+// snapshots hold, so they are discarded on start.
+// Except where noted, fields are guarded by the owning Storage's lock.
+type diskTier struct {
+	dir       string
+	watermark int64
+	minSize   int
+
+	segments map[int]*tierSegment
+	active   int   // segment being appended to; only the spiller touches it
+	offset   int64 // end of the active segment; only the spiller touches it
+	nextID   int   // only the spiller touches it
+
+	hotBytes  int64 // inline values held in memory
+	coldKeys  int
+	coldBytes int64
+
+	spills     int64
+	promotions int64
+	coldReads  atomic.Int64
+	readErrors atomic.Int64
+	fileBytes  atomic.Int64
+
+	wake chan struct{}
+}
+
+// TieringStats describes how values are split between memory and disk
+type TieringStats struct {
+	Enabled         bool  `json:"enabled"`
+	MemoryWatermark int64 `json:"memory_watermark_bytes"`
+	MinSize         int   `json:"min_size"`
+	HotKeys         int   `json:"hot_keys"`
+	HotBytes        int64 `json:"hot_bytes"`
+	ColdKeys        int   `json:"cold_keys"`
+	ColdBytes       int64 `json:"cold_bytes"`
+	Segments        int   `json:"segments"`
+	FileBytes       int64 `json:"file_bytes"`
+	GarbageBytes    int64 `json:"garbage_bytes"`
+	Spills          int64 `json:"spills"`
+	Promotions      int64 `json:"promotions"`
+	ColdReads       int64 `json:"cold_reads"`
+	ReadErrors      int64 `json:"read_errors"`
+}
+
+// EnableTiering turns on the disk tier: once the values held in memory
+// exceed watermark bytes, the least recently read values of at least
+// minSize bytes are moved to segment files under dir until memory is back
+// under 90% of the watermark. A read of a spilled value loads it back into
+// memory. Values shared by deduplication always stay in memory. Anything
+// already in dir is removed.
+func (s *Storage) EnableTiering(dir string, watermark int64, minSize int) error {
+	if minSize < 1 {
+		minSize = 1
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clear tier directory: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create tier directory: %w", err)
+	}
+
+	t := &diskTier{
+		dir:       dir,
+		watermark: watermark,
+		minSize:   minSize,
+		segments:  make(map[int]*tierSegment),
+		wake:      make(chan struct{}, 1),
+	}
+	if err := s.rollSegment(t); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	now := time.Now().UnixNano()
+	for key, entry := range s.data {
+		tracked := *entry
+		tracked.atime = new(atomic.Int64)
+		tracked.atime.Store(now)
+		s.data[key] = &tracked
+		if entry.contentHash == "" {
+			t.hotBytes += int64(len(entry.Value))
+		}
+	}
+	s.tier = t
+	s.mu.Unlock()
+
+	go s.runTier(t)
+	return nil
+}
+
+// TieringStats returns current tiering counters
+func (s *Storage) TieringStats() TieringStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t := s.tier
+	if t == nil {
+		return TieringStats{}
+	}
+
+	fileBytes := t.fileBytes.Load()
+	return TieringStats{
+		Enabled:         true,
+		MemoryWatermark: t.watermark,
+		MinSize:         t.minSize,
+		HotKeys:         len(s.data) - t.coldKeys,
+		HotBytes:        t.hotBytes,
+		ColdKeys:        t.coldKeys,
+		ColdBytes:       t.coldBytes,
+		Segments:        len(t.segments),
+		FileBytes:       fileBytes,
+		GarbageBytes:    fileBytes - t.coldBytes,
+		Spills:          t.spills,
+		Promotions:      t.promotions,
+		ColdReads:       t.coldReads.Load(),
+		ReadErrors:      t.readErrors.Load(),
+	}
+}
+
+// size returns the length of the entry's value, wherever it is held
+func (e *Entry) size() int64 {
+	if e.cold != nil {
+		return int64(e.cold.length)
+	}
+	return int64(len(e.Value))
+}
+
+// touch records a read of the entry for the spiller
+func (e *Entry) touch() {
+	if e.atime != nil {
+		e.atime.Store(time.Now().UnixNano())
+	}
+}
+
+// addHot counts value bytes now held in memory, waking the spiller once
+// they pass the watermark
+func (t *diskTier) addHot(n int64) {
+	t.hotBytes += n
+	if t.hotBytes > t.watermark {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// addCold counts a value installed in the disk tier
+func (t *diskTier) addCold(ref *coldRef) {
+	t.segments[ref.segment].live += int64(ref.length)
+	t.coldKeys++
+	t.coldBytes += int64(ref.length)
+}
+
+// release forgets a spilled value; its bytes stay in the segment until the
+// segment is reclaimed
+func (t *diskTier) release(ref *coldRef) {
+	if seg, ok := t.segments[ref.segment]; ok {
+		seg.live -= int64(ref.length)
+	}
+	t.coldKeys--
+	t.coldBytes -= int64(ref.length)
+}
+
+// read loads a spilled value; caller must hold s.mu, which keeps the
+// segment from being removed
+func (t *diskTier) read(key string, ref *coldRef) ([]byte, error) {
+	t.coldReads.Add(1)
+
+	seg, ok := t.segments[ref.segment]
+	if !ok {
+		t.readErrors.Add(1)
+		return nil, fmt.Errorf("cold value of %q is in missing segment %d", key, ref.segment)
+	}
+	value := make([]byte, ref.length)
+	if _, err := seg.file.ReadAt(value, ref.offset); err != nil {
+		t.readErrors.Add(1)
+		return nil, fmt.Errorf("failed to read cold value of %q: %w", key, err)
+	}
+	if crc32.ChecksumIEEE(value) != ref.crc {
+		t.readErrors.Add(1)
+		return nil, fmt.Errorf("cold value of %q is corrupt", key)
+	}
+	return value, nil
+}
+
+// valueLocked returns the entry's value, reading it from the disk tier if
+// it was spilled; caller must hold s.mu
+func (s *Storage) valueLocked(entry *Entry) ([]byte, error) {
+	if entry.cold == nil {
+		return entry.Value, nil
+	}
+	return s.tier.read(entry.Key, entry.cold)
+}
+
+// promote moves a value read from the disk tier back into memory, unless
+// the entry was rewritten meanwhile. It returns the entry with its value
+// either way.
+func (s *Storage) promote(entry *Entry, value []byte) *Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists := s.data[entry.Key]
+	if !exists || current.cold != entry.cold {
+		loaded := *entry
+		loaded.Value = value
+		loaded.cold = nil
+		return &loaded
+	}
+
+	promoted := *current
+	promoted.Value = value
+	promoted.cold = nil
+	promoted.touch()
+	s.data[entry.Key] = &promoted
+
+	s.tier.release(current.cold)
+	s.tier.addHot(int64(len(value)))
+	s.tier.promotions++
+	return &promoted
+}
+
+// runTier is the spiller: it keeps memory under the watermark and reclaims
+// segments that are mostly garbage
+func (s *Storage) runTier(t *diskTier) {
+	ticker := time.NewTicker(tierSpillInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.wake:
+		}
+		if err := s.spill(t); err != nil {
+			log.Printf("storage: spilling to disk: %v\n", err)
+		}
+		if err := s.reclaimSegment(t); err != nil {
+			log.Printf("storage: reclaiming tier segment: %v\n", err)
+		}
+	}
+}
+
+// spill moves the least recently read values to disk once memory is over
+// the watermark, until it is back under 90% of it
+func (s *Storage) spill(t *diskTier) error {
+	s.mu.RLock()
+	if t.hotBytes <= t.watermark {
+		s.mu.RUnlock()
+		return nil
+	}
+	excess := t.hotBytes - t.watermark/10*9
+	type candidate struct {
+		entry *Entry
+		atime int64
+	}
+	var candidates []candidate
+	for _, entry := range s.data {
+		if entry.cold == nil && entry.contentHash == "" && len(entry.Value) >= t.minSize {
+			candidates = append(candidates, candidate{entry, entry.atime.Load()})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].atime < candidates[j].atime })
+
+	for len(candidates) > 0 && excess > 0 {
+		var batch []*Entry
+		for size := int64(0); len(candidates) > 0 && size < excess && size < tierSpillBatch; candidates = candidates[1:] {
+			batch = append(batch, candidates[0].entry)
+			size += int64(len(candidates[0].entry.Value))
+		}
+
+		// Entries are replaced rather than mutated, so their values can be
+		// written without the lock
+		refs := make([]*coldRef, len(batch))
+		for i, entry := range batch {
+			ref, err := s.appendCold(t, entry.Value)
+			if err != nil {
+				return err
+			}
+			refs[i] = ref
+		}
+
+		s.mu.Lock()
+		for i, entry := range batch {
+			// Skip keys rewritten or removed meanwhile; the atime pointer is
+			// allocated per write, so a shared one means the same value
+			current, exists := s.data[entry.Key]
+			if !exists || current.atime != entry.atime || current.cold != nil {
+				continue
+			}
+			spilled := *current
+			spilled.Value = nil
+			spilled.cold = refs[i]
+			s.data[entry.Key] = &spilled
+
+			t.hotBytes -= int64(refs[i].length)
+			t.addCold(refs[i])
+			t.spills++
+			excess -= int64(refs[i].length)
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// reclaimSegment removes segments nothing references any more, then
+// rewrites the live values of one segment that is mostly garbage so it can
+// be removed on the next pass
+func (s *Storage) reclaimSegment(t *diskTier) error {
+	s.mu.Lock()
+	emptyActive := t.segments[t.active].live <= 0 && t.offset > 0
+	s.mu.Unlock()
+	if emptyActive {
+		// Start afresh so the garbage written so far can go
+		if err := s.rollSegment(t); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	for id, seg := range t.segments {
+		if id != t.active && seg.live <= 0 {
+			seg.file.Close()
+			os.Remove(seg.file.Name())
+			delete(t.segments, id)
+			t.fileBytes.Add(-seg.written)
+		}
+	}
+	s.mu.Unlock()
+
+	s.mu.RLock()
+	victim := -1
+	for id, seg := range t.segments {
+		if id != t.active && seg.live*2 < seg.written {
+			victim = id
+			break
+		}
+	}
+	if victim < 0 {
+		s.mu.RUnlock()
+		return nil
+	}
+	var entries []*Entry
+	var values [][]byte
+	for key, entry := range s.data {
+		if entry.cold == nil || entry.cold.segment != victim {
+			continue
+		}
+		value, err := t.read(key, entry.cold)
+		if err != nil {
+			// Left where it is; the key reads back as an error either way
+			log.Printf("storage: %v\n", err)
+			continue
+		}
+		entries = append(entries, entry)
+		values = append(values, value)
+	}
+	s.mu.RUnlock()
+
+	refs := make([]*coldRef, len(values))
+	for i, value := range values {
+		ref, err := s.appendCold(t, value)
+		if err != nil {
+			return err
+		}
+		refs[i] = ref
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, entry := range entries {
+		current, exists := s.data[entry.Key]
+		if !exists || current.cold != entry.cold {
+			continue
+		}
+		moved := *current
+		moved.cold = refs[i]
+		s.data[entry.Key] = &moved
+		t.release(current.cold)
+		t.addCold(refs[i])
+	}
+	return nil
+}
+
+// appendCold writes value to the active segment, rolling it when full;
+// only the spiller calls it
+func (s *Storage) appendCold(t *diskTier, value []byte) (*coldRef, error) {
+	if t.offset > 0 && t.offset+int64(len(value)) > tierSegmentSize {
+		if err := s.rollSegment(t); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.RLock()
+	seg := t.segments[t.active]
+	s.mu.RUnlock()
+	if _, err := seg.file.WriteAt(value, t.offset); err != nil {
+		return nil, fmt.Errorf("failed to write segment %d: %w", t.active, err)
+	}
+
+	ref := &coldRef{
+		segment: t.active,
+		offset:  t.offset,
+		length:  len(value),
+		crc:     crc32.ChecksumIEEE(value),
+	}
+	t.offset += int64(len(value))
+	seg.written += int64(len(value))
+	t.fileBytes.Add(int64(len(value)))
+	return ref, nil
+}
+
+// rollSegment starts a new active segment
+func (s *Storage) rollSegment(t *diskTier) error {
+	id := t.nextID
+	file, err := os.OpenFile(filepath.Join(t.dir, fmt.Sprintf("%06d.seg", id)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create tier segment: %w", err)
+	}
+
+	s.mu.Lock()
+	t.segments[id] = &tierSegment{file: file}
+	s.mu.Unlock()
+
+	t.nextID++
+	t.active = id
+	t.offset = 0
+	return nil
+}
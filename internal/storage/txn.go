@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrTxnConflict means a key is locked by another prepared transaction
+	ErrTxnConflict = errors.New("key is locked by another transaction")
+	// ErrTxnConditionFailed means a compare in the transaction did not hold
+	ErrTxnConditionFailed = errors.New("transaction condition failed")
+	// ErrTxnNotFound means no prepared transaction has the given ID
+	ErrTxnNotFound = errors.New("transaction not found")
+)
+
+// TxnOp is one operation of a multi-key transaction
+type TxnOp struct {
+	Op        string        `json:"op"` // "get", "put", "delete" or "check"
+	Key       string        `json:"key"`
+	Value     []byte        `json:"value,omitempty"`
+	TTL       time.Duration `json:"ttl,omitempty"`
+	IfVersion *uint64       `json:"if_version,omitempty"` // Required current version (0 = key must not exist)
+	IfExists  *bool         `json:"if_exists,omitempty"`  // Required existence of the key
+	Replicas  int           `json:"replicas,omitempty"`   // Replication factor of a put (0 = default)
+}
+
+// IsWrite reports whether the operation modifies its key
+func (op *TxnOp) IsWrite() bool {
+	return op.Op == "put" || op.Op == "delete"
+}
+
+// PreparedTxn is a transaction whose conditions held on this node and whose
+// keys stay locked until it is committed or aborted
+type PreparedTxn struct {
+	ID         string    `json:"id"`
+	Owner      int64     `json:"owner"`
+	Ops        []TxnOp   `json:"ops"`
+	PreparedAt time.Time `json:"prepared_at"`
+
+	// DecisionNode is the participant whose outcome decides the transaction;
+	// empty on that participant itself
+	DecisionNode string `json:"decision_node,omitempty"`
+}
+
+// TxnOutcome is how a finished transaction ended
+type TxnOutcome struct {
+	Committed bool
+	Version   uint64 // Sequence number of the COMMIT entry
+	At        time.Time
+}
+
+// txnIntent is the payload of a PREPARE entry
+type txnIntent struct {
+	Ops          []TxnOp `json:"ops"`
+	DecisionNode string  `json:"decision_node,omitempty"`
+}
+
+// PrepareEntry encodes txn as the payload of its PREPARE entry
+func PrepareEntry(txn *PreparedTxn) ([]byte, error) {
+	return json.Marshal(&txnIntent{Ops: txn.Ops, DecisionNode: txn.DecisionNode})
+}
+
+// TxnRead is the state of a key observed while preparing
+type TxnRead struct {
+	Key     string `json:"key"`
+	Exists  bool   `json:"exists"`
+	Value   []byte `json:"value,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// PrepareTxn checks every condition of txn against the current state and, if
+// they all hold, locks its keys until CommitTxn or AbortTxn. The state of
+// each key as seen during the check is returned in operation order.
+func (s *Storage) PrepareTxn(txn *PreparedTxn) ([]TxnRead, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.txns[txn.ID]; exists {
+		return nil, fmt.Errorf("transaction %s is already prepared", txn.ID)
+	}
+
+	now := time.Now()
+	reads := make([]TxnRead, len(txn.Ops))
+	for i, op := range txn.Ops {
+		if holder, locked := s.locks[op.Key]; locked {
+			return nil, fmt.Errorf("%w: %q is held by %s", ErrTxnConflict, op.Key, holder)
+		}
+
+		read := TxnRead{Key: op.Key}
+		if entry, exists := s.data[op.Key]; exists && (entry.ExpiresAt == nil || entry.ExpiresAt.After(now)) {
+			read.Exists = true
+			read.Version = entry.Version
+			if op.Op == "get" {
+				value, err := s.valueLocked(entry)
+				if err != nil {
+					return nil, err
+				}
+				read.Value = value
+			}
+		}
+
+		if op.IfExists != nil && *op.IfExists != read.Exists {
+			return nil, fmt.Errorf("%w: %q exists=%t", ErrTxnConditionFailed, op.Key, read.Exists)
+		}
+		if op.IfVersion != nil {
+			if *op.IfVersion == 0 && read.Exists {
+				return nil, fmt.Errorf("%w: %q already exists (version %d)", ErrTxnConditionFailed, op.Key, read.Version)
+			}
+			if *op.IfVersion != 0 && (!read.Exists || read.Version != *op.IfVersion) {
+				return nil, fmt.Errorf("%w: %q is at version %d, not %d", ErrTxnConditionFailed, op.Key, read.Version, *op.IfVersion)
+			}
+		}
+
+		reads[i] = read
+	}
+
+	s.addTxnLocked(txn)
+	return reads, nil
+}
+
+// addTxnLocked records a prepared transaction and locks its keys; caller must hold s.mu
+func (s *Storage) addTxnLocked(txn *PreparedTxn) {
+	s.txns[txn.ID] = txn
+	for _, op := range txn.Ops {
+		s.locks[op.Key] = txn.ID
+	}
+}
+
+// removeTxnLocked forgets a transaction and unlocks its keys; caller must hold s.mu
+func (s *Storage) removeTxnLocked(id string) (*PreparedTxn, bool) {
+	txn, exists := s.txns[id]
+	if !exists {
+		return nil, false
+	}
+	for _, op := range txn.Ops {
+		if s.locks[op.Key] == id {
+			delete(s.locks, op.Key)
+		}
+	}
+	delete(s.txns, id)
+	return txn, true
+}
+
+// CommitTxn applies the writes of a prepared transaction at the given
+// version, releases its locks and records it as committed
+func (s *Storage) CommitTxn(id string, version uint64) (*PreparedTxn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txn, exists := s.removeTxnLocked(id)
+	if !exists {
+		return nil, ErrTxnNotFound
+	}
+	s.txnOutcomes[id] = TxnOutcome{Committed: true, Version: version, At: time.Now()}
+
+	for _, op := range txn.Ops {
+		switch op.Op {
+		case "put":
+			s.setLocked(op.Key, op.Value, op.TTL, WriteOptions{Owner: txn.Owner, Version: version, Replicas: op.Replicas})
+		case "delete":
+			s.remove(op.Key)
+		}
+	}
+	return txn, nil
+}
+
+// AbortTxn releases the locks of a prepared transaction without applying it
+// and records it as aborted, even if it was never prepared here
+func (s *Storage) AbortTxn(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.removeTxnLocked(id)
+	s.txnOutcomes[id] = TxnOutcome{At: time.Now()}
+	return exists
+}
+
+// TxnOutcome returns how a finished transaction ended. Outcomes are rebuilt
+// from COMMIT and ABORT entries on replay, so they survive a restart.
+func (s *Storage) TxnOutcome(id string) (TxnOutcome, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	outcome, done := s.txnOutcomes[id]
+	return outcome, done
+}
+
+// ForgetTxnOutcomes drops the outcomes of transactions finished before cutoff
+func (s *Storage) ForgetTxnOutcomes(cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, outcome := range s.txnOutcomes {
+		if outcome.At.Before(cutoff) {
+			delete(s.txnOutcomes, id)
+		}
+	}
+}
+
+// GetTxn returns a prepared transaction by ID
+func (s *Storage) GetTxn(id string) (*PreparedTxn, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	txn, exists := s.txns[id]
+	return txn, exists
+}
+
+// PreparedTxns returns all transactions currently holding locks
+func (s *Storage) PreparedTxns() []*PreparedTxn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	txns := make([]*PreparedTxn, 0, len(s.txns))
+	for _, txn := range s.txns {
+		txns = append(txns, txn)
+	}
+	return txns
+}
+
+// LockedBy returns the ID of the prepared transaction holding key, if any
+func (s *Storage) LockedBy(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, locked := s.locks[key]
+	return id, locked
+}
+
+// TxnWrites decodes the writes recorded in a COMMIT entry as SET and DELETE
+// entries carrying the commit's sequence number and timestamp
+func (e *WALEntry) TxnWrites() ([]*WALEntry, error) {
+	if e.Operation != "COMMIT" || e.Value == nil {
+		return nil, nil
+	}
+
+	var ops []TxnOp
+	if err := json.Unmarshal(e.Value, &ops); err != nil {
+		return nil, fmt.Errorf("invalid COMMIT entry for %s: %w", e.Key, err)
+	}
+
+	writes := make([]*WALEntry, 0, len(ops))
+	for _, op := range ops {
+		write := &WALEntry{
+			Seq:       e.Seq,
+			Key:       op.Key,
+			Owner:     e.Owner,
+			Timestamp: e.Timestamp,
+		}
+		switch op.Op {
+		case "put":
+			write.Operation = "SET"
+			write.Value = op.Value
+			write.TTL = op.TTL
+			write.Replicas = op.Replicas
+		case "delete":
+			write.Operation = "DELETE"
+		default:
+			continue
+		}
+		writes = append(writes, write)
+	}
+	return writes, nil
+}
+
+// decodeIntent reads the payload of a PREPARE entry; older entries hold
+// only the operations
+func decodeIntent(payload []byte) (*txnIntent, error) {
+	var intent txnIntent
+	if err := json.Unmarshal(payload, &intent.Ops); err == nil {
+		return &intent, nil
+	}
+	if err := json.Unmarshal(payload, &intent); err != nil {
+		return nil, err
+	}
+	return &intent, nil
+}
+
+// resolveTxn releases the locks taken by a replayed PREPARE and records the
+// outcome logged for it
+func (s *Storage) resolveTxn(id string, outcome TxnOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeTxnLocked(id)
+	s.txnOutcomes[id] = outcome
+}
+
+// applyTxnEntry replays a transaction entry; a COMMIT without a value only
+// resolves the transaction (its writes were applied separately)
+func applyTxnEntry(storage *Storage, entry *WALEntry) {
+	switch entry.Operation {
+	case "PREPARE":
+		intent, err := decodeIntent(entry.Value)
+		if err != nil {
+			fmt.Printf("WAL: Skipping invalid PREPARE entry for %s: %v\n", entry.Key, err)
+			return
+		}
+		storage.mu.Lock()
+		storage.addTxnLocked(&PreparedTxn{
+			ID:           entry.Key,
+			Owner:        entry.Owner,
+			Ops:          intent.Ops,
+			PreparedAt:   entry.Timestamp,
+			DecisionNode: intent.DecisionNode,
+		})
+		storage.mu.Unlock()
+	case "COMMIT":
+		writes, err := entry.TxnWrites()
+		if err != nil {
+			fmt.Printf("WAL: Skipping %v\n", err)
+		}
+		for _, write := range writes {
+			ApplyWALEntry(storage, write)
+		}
+		storage.resolveTxn(entry.Key, TxnOutcome{Committed: true, Version: entry.Seq, At: entry.Timestamp})
+	case "ABORT":
+		storage.resolveTxn(entry.Key, TxnOutcome{At: entry.Timestamp})
+	}
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func version(v uint64) *uint64 { return &v }
+func exists(e bool) *bool      { return &e }
+
+func TestTxn(t *testing.T) {
+	tests := []struct {
+		name      string
+		ops       []TxnOp
+		err       error  // from PrepareTxn
+		reads     []bool // Exists of each read
+		finish    string // "commit" or "abort" after a successful prepare
+		want      map[string]string
+		wantReads string // Value read by the first op
+	}{
+		{
+			name:   "create",
+			ops:    []TxnOp{{Op: "put", Key: "new", Value: []byte("n"), IfVersion: version(0)}},
+			reads:  []bool{false},
+			finish: "commit",
+			want:   map[string]string{"a": "a1", "b": "b1", "new": "n"},
+		},
+		{
+			name: "create over an existing key",
+			ops:  []TxnOp{{Op: "put", Key: "a", Value: []byte("x"), IfVersion: version(0)}},
+			err:  ErrTxnConditionFailed,
+		},
+		{
+			name:   "swap at the current versions",
+			ops:    []TxnOp{{Op: "put", Key: "a", Value: []byte("b1"), IfVersion: version(3)}, {Op: "put", Key: "b", Value: []byte("a1"), IfVersion: version(5)}},
+			reads:  []bool{true, true},
+			finish: "commit",
+			want:   map[string]string{"a": "b1", "b": "a1"},
+		},
+		{
+			name: "stale version",
+			ops:  []TxnOp{{Op: "put", Key: "a", Value: []byte("b1"), IfVersion: version(3)}, {Op: "put", Key: "b", Value: []byte("a1"), IfVersion: version(4)}},
+			err:  ErrTxnConditionFailed,
+		},
+		{
+			name: "version of a missing key",
+			ops:  []TxnOp{{Op: "check", Key: "missing", IfVersion: version(1)}},
+			err:  ErrTxnConditionFailed,
+		},
+		{
+			name:   "exists checks",
+			ops:    []TxnOp{{Op: "check", Key: "a", IfExists: exists(true)}, {Op: "delete", Key: "b"}, {Op: "check", Key: "missing", IfExists: exists(false)}},
+			reads:  []bool{true, true, false},
+			finish: "commit",
+			want:   map[string]string{"a": "a1"},
+		},
+		{
+			name: "exists check fails",
+			ops:  []TxnOp{{Op: "delete", Key: "b"}, {Op: "check", Key: "a", IfExists: exists(false)}},
+			err:  ErrTxnConditionFailed,
+		},
+		{
+			name: "expired key is missing",
+			ops:  []TxnOp{{Op: "check", Key: "expired", IfExists: exists(true)}},
+			err:  ErrTxnConditionFailed,
+		},
+		{
+			name:      "get reads the value",
+			ops:       []TxnOp{{Op: "get", Key: "a"}, {Op: "put", Key: "b", Value: []byte("b2")}},
+			reads:     []bool{true, true},
+			finish:    "commit",
+			want:      map[string]string{"a": "a1", "b": "b2"},
+			wantReads: "a1",
+		},
+		{
+			name: "key locked by another transaction",
+			ops:  []TxnOp{{Op: "put", Key: "held", Value: []byte("x")}},
+			err:  ErrTxnConflict,
+		},
+		{
+			name:   "abort leaves the keys alone",
+			ops:    []TxnOp{{Op: "put", Key: "a", Value: []byte("x")}, {Op: "delete", Key: "b"}},
+			reads:  []bool{true, true},
+			finish: "abort",
+			want:   map[string]string{"a": "a1", "b": "b1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStorage()
+			s.SetWithOptions("a", []byte("a1"), 0, WriteOptions{Version: 3})
+			s.SetWithOptions("b", []byte("b1"), 0, WriteOptions{Version: 5})
+			s.SetWithOptions("expired", []byte("e"), time.Nanosecond, WriteOptions{Version: 6})
+			if _, err := s.PrepareTxn(&PreparedTxn{ID: "other", Ops: []TxnOp{{Op: "put", Key: "held"}}}); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+
+			reads, err := s.PrepareTxn(&PreparedTxn{ID: "txn", Owner: 1, Ops: tt.ops})
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("prepare: %v, want %v", err, tt.err)
+				}
+				if _, prepared := s.GetTxn("txn"); prepared {
+					t.Fatal("failed prepare left the transaction prepared")
+				}
+				for _, op := range tt.ops {
+					if id, locked := s.LockedBy(op.Key); locked && id == "txn" {
+						t.Fatalf("failed prepare locked %q", op.Key)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("prepare: %v", err)
+			}
+			for i, read := range reads {
+				if read.Exists != tt.reads[i] {
+					t.Fatalf("read %d exists=%t, want %t", i, read.Exists, tt.reads[i])
+				}
+			}
+			if string(reads[0].Value) != tt.wantReads {
+				t.Fatalf("read %q, want %q", reads[0].Value, tt.wantReads)
+			}
+			for _, op := range tt.ops {
+				if id, _ := s.LockedBy(op.Key); id != "txn" {
+					t.Fatalf("%q is not locked by the prepared transaction", op.Key)
+				}
+			}
+			if _, err := s.PrepareTxn(&PreparedTxn{ID: "txn", Ops: []TxnOp{{Op: "check", Key: "other"}}}); err == nil {
+				t.Fatal("prepared the same transaction twice")
+			}
+
+			switch tt.finish {
+			case "commit":
+				if _, err := s.CommitTxn("txn", 10); err != nil {
+					t.Fatalf("commit: %v", err)
+				}
+				if _, err := s.CommitTxn("txn", 11); !errors.Is(err, ErrTxnNotFound) {
+					t.Fatalf("second commit: %v, want %v", err, ErrTxnNotFound)
+				}
+			case "abort":
+				if !s.AbortTxn("txn") {
+					t.Fatal("abort found no transaction")
+				}
+			}
+
+			for _, op := range tt.ops {
+				if _, locked := s.LockedBy(op.Key); locked {
+					t.Fatalf("%q is still locked", op.Key)
+				}
+			}
+			for _, key := range []string{"a", "b", "new"} {
+				entry, err := s.GetEntry(key)
+				want, ok := tt.want[key]
+				if !ok {
+					if err == nil {
+						t.Fatalf("%q = %q, want it missing", key, entry.Value)
+					}
+					continue
+				}
+				if err != nil || string(entry.Value) != want {
+					t.Fatalf("%q = %v %v, want %q", key, entry, err, want)
+				}
+			}
+			if tt.finish == "commit" {
+				for _, op := range tt.ops {
+					if op.Op == "put" {
+						if entry, _ := s.GetEntry(op.Key); entry.Version != 10 || entry.Owner != 1 {
+							t.Fatalf("%q at version %d owner %d, want 10 and 1", op.Key, entry.Version, entry.Owner)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTxnWALReplay(t *testing.T) {
+	ops := []TxnOp{{Op: "put", Key: "a", Value: []byte("a2")}, {Op: "delete", Key: "b"}, {Op: "check", Key: "c"}}
+	prepare, _ := PrepareEntry(&PreparedTxn{Ops: ops, DecisionNode: "http://node-2:8082"})
+	commit, _ := json.Marshal(ops[:2])
+
+	tests := []struct {
+		name     string
+		entries  []string // operations logged for the transaction after the writes of a and b
+		prepare  []byte   // PREPARE payload, if not the current one
+		compact  *CompactOptions
+		prepared bool
+		outcome  string // "committed" or "aborted" if one is recorded
+		want     map[string]string
+		version  uint64 // of a, which committed writes take from the COMMIT entry
+	}{
+		{name: "prepared", entries: []string{"PREPARE"}, prepared: true, want: map[string]string{"a": "a1", "b": "b1"}, version: 1},
+		{name: "prepared by an older node", entries: []string{"PREPARE"}, prepare: mustJSON(t, ops), prepared: true, want: map[string]string{"a": "a1", "b": "b1"}, version: 1},
+		{name: "committed", entries: []string{"PREPARE", "COMMIT"}, outcome: "committed", want: map[string]string{"a": "a2"}, version: 4},
+		{name: "aborted", entries: []string{"PREPARE", "ABORT"}, outcome: "aborted", want: map[string]string{"a": "a1", "b": "b1"}, version: 1},
+		{name: "aborted without a prepare", entries: []string{"ABORT"}, outcome: "aborted", want: map[string]string{"a": "a1", "b": "b1"}, version: 1},
+		{name: "prepared, compacted", entries: []string{"PREPARE"}, compact: &CompactOptions{}, prepared: true, want: map[string]string{"a": "a1", "b": "b1"}, version: 1},
+		{name: "committed, compacted keeping outcomes", entries: []string{"PREPARE", "COMMIT"}, compact: &CompactOptions{OutcomesSince: time.Now().Add(-time.Hour)}, outcome: "committed", want: map[string]string{"a": "a2"}, version: 4},
+		{name: "aborted, compacted keeping outcomes", entries: []string{"PREPARE", "ABORT"}, compact: &CompactOptions{OutcomesSince: time.Now().Add(-time.Hour)}, outcome: "aborted", want: map[string]string{"a": "a1", "b": "b1"}, version: 1},
+		{name: "committed, compacted", entries: []string{"PREPARE", "COMMIT"}, compact: &CompactOptions{}, want: map[string]string{"a": "a2"}, version: 4},
+		{name: "committed, outcome older than kept", entries: []string{"PREPARE", "COMMIT"}, compact: &CompactOptions{OutcomesSince: time.Now().Add(time.Hour)}, want: map[string]string{"a": "a2"}, version: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal.log")
+			wal, err := NewWAL(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wal.Append("SET", "a", []byte("a1"), 0)
+			wal.Append("SET", "b", []byte("b1"), 0)
+			for _, op := range tt.entries {
+				var payload []byte
+				switch op {
+				case "PREPARE":
+					payload = prepare
+					if tt.prepare != nil {
+						payload = tt.prepare
+					}
+				case "COMMIT":
+					payload = commit
+				}
+				if _, err := wal.AppendWithOptions(op, "txn", payload, 0, WriteOptions{Owner: 1}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.compact != nil {
+				if _, err := wal.Compact(*tt.compact); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wal.Close()
+
+			// Replay the log as a restarted node would
+			wal, err = NewWAL(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			s := NewStorage()
+			if err := wal.Restore(s); err != nil {
+				t.Fatal(err)
+			}
+
+			txn, prepared := s.GetTxn("txn")
+			if prepared != tt.prepared {
+				t.Fatalf("prepared=%t, want %t", prepared, tt.prepared)
+			}
+			if prepared && tt.prepare == nil && txn.DecisionNode != "http://node-2:8082" {
+				t.Fatalf("decision node %q was not replayed", txn.DecisionNode)
+			}
+			outcome, done := s.TxnOutcome("txn")
+			switch {
+			case tt.outcome == "" && done:
+				t.Fatalf("outcome %+v recorded, want none", outcome)
+			case tt.outcome == "committed" && (!done || !outcome.Committed || outcome.Version != 4):
+				t.Fatalf("outcome %+v (recorded=%t), want committed at version 4", outcome, done)
+			case tt.outcome == "aborted" && (!done || outcome.Committed):
+				t.Fatalf("outcome %+v (recorded=%t), want aborted", outcome, done)
+			}
+			for _, op := range ops {
+				if _, locked := s.LockedBy(op.Key); locked != tt.prepared {
+					t.Fatalf("%q locked=%t, want %t", op.Key, locked, tt.prepared)
+				}
+			}
+			for _, key := range []string{"a", "b"} {
+				value, err := s.Get(key)
+				want, ok := tt.want[key]
+				if ok != (err == nil) || string(value) != want {
+					t.Fatalf("%q = %q (%v), want %q", key, value, err, want)
+				}
+			}
+			if entry, _ := s.GetEntry("a"); entry.Version != tt.version {
+				t.Fatalf("a at version %d, want %d", entry.Version, tt.version)
+			}
+		})
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
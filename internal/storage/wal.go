@@ -2,8 +2,10 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -11,48 +13,222 @@ import (
 
 // WALEntry represents a write-ahead log entry
 type WALEntry struct {
-	Operation string // "SET" or "DELETE"
-	Key       string
-	Value     []byte
-	TTL       time.Duration
-	Timestamp time.Time
+	Seq       uint64        `json:"seq"`       // Monotonic sequence number (0 for entries written before sequencing)
+	Operation string        `json:"operation"` // "SET", "DELETE", "TOUCH" (sliding TTL refresh), "PREPARE"/"COMMIT"/"ABORT" (transactions) or "COMPACT"
+	Key       string        `json:"key"`       // Transaction ID for transaction entries
+	Value     []byte        `json:"value,omitempty"`
+	TTL       time.Duration `json:"ttl,omitempty"`
+	Owner     int64         `json:"owner,omitempty"`   // Tenant that wrote the key
+	Sliding   bool          `json:"sliding,omitempty"` // TTL is refreshed on every read
+	Timestamp time.Time     `json:"timestamp"`
+
+	// SourceVersion is the primary's version of a replicated SET
+	SourceVersion uint64 `json:"source_version,omitempty"`
+
+	// Replicas is the key's replication factor, 0 for the default
+	Replicas int `json:"replicas,omitempty"`
+
+	// Through is the last sequence number a COMPACT entry's segment compacted
+	Through uint64 `json:"through,omitempty"`
+}
+
+// WriteOptions returns the per-key metadata recorded in a SET entry
+func (e *WALEntry) WriteOptions() WriteOptions {
+	opts := WriteOptions{Owner: e.Owner, Version: e.Seq, SourceVersion: e.SourceVersion, Replicas: e.Replicas}
+	if e.Sliding {
+		opts.SlidingTTL = e.TTL
+	}
+	return opts
+}
+
+// subscriberBuffer is how many entries a WAL subscriber may fall behind
+// before it is dropped
+const subscriberBuffer = 1024
+
+// walEncoder continues a WAL's gob stream. Each entry is encoded into a
+// pooled buffer and reaches the file in a single write, type information
+// included, instead of one write per gob message.
+type walEncoder struct {
+	file *os.File
+	enc  *gob.Encoder
+	buf  *bytes.Buffer // entry being encoded
+}
+
+func newWALEncoder(file *os.File) *walEncoder {
+	e := &walEncoder{file: file}
+	e.enc = gob.NewEncoder(e)
+	return e
+}
+
+// Write collects the gob messages of the entry being encoded
+func (e *walEncoder) Write(p []byte) (int, error) {
+	return e.buf.Write(p)
+}
+
+// Encode appends entry to the file
+func (e *walEncoder) Encode(entry *WALEntry) error {
+	e.buf = GetBuffer()
+	defer func() {
+		PutBuffer(e.buf)
+		e.buf = nil
+	}()
+
+	if err := e.enc.Encode(entry); err != nil {
+		return err
+	}
+	_, err := e.file.Write(e.buf.Bytes())
+	return err
 }
 
 // WAL implements write-ahead logging
 type WAL struct {
-	file     *os.File
-	encoder  *gob.Encoder
-	filepath string
-	mu       sync.Mutex
+	file        *os.File
+	encoder     *walEncoder
+	filepath    string
+	seq         uint64
+	subscribers map[chan *WALEntry]struct{}
+	mu          sync.Mutex
+
+	// Last sequence number compacted (see Compact); compactMu allows one
+	// compaction at a time
+	compactedThrough uint64
+	compactMu        sync.Mutex
+
+	// What was found checking the log when it was opened
+	check WALCheck
 }
 
 // NewWAL creates or opens a WAL file
+// A gob stream can only be extended by the encoder that started it, so an
+// existing log is rewritten into a fresh stream that new appends continue
+// (this also drops a torn entry left at the tail by a crash).
 func NewWAL(filepath string) (*WAL, error) {
-	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	info, err := os.Stat(filepath)
+	if err != nil || info.Size() == 0 {
+		file, err := os.OpenFile(filepath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open WAL file: %w", err)
+		}
+		return &WAL{
+			file:        file,
+			encoder:     newWALEncoder(file),
+			filepath:    filepath,
+			subscribers: make(map[chan *WALEntry]struct{}),
+		}, nil
+	}
+
+	existing, err := os.Open(filepath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL file: %w", err)
 	}
+	defer existing.Close()
+
+	tmpPath := filepath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WAL file: %w", err)
+	}
+
+	// Copy entries into the new stream, recovering the last sequence number
+	encoder := newWALEncoder(file)
+	var lastSeq uint64
+	var copied int
+	var encodeErr error
+	var check WALCheck
+	readErr := ReadWAL(existing, func(entry *WALEntry) error {
+		if entry.Seq > lastSeq {
+			lastSeq = entry.Seq
+		}
+		check.observe(entry)
+		if encodeErr = encoder.Encode(entry); encodeErr != nil {
+			return encodeErr
+		}
+		copied++
+		return nil
+	})
+	if encodeErr != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to rewrite WAL: %w", encodeErr)
+	}
+	if readErr != nil {
+		fmt.Printf("WAL: Dropped unreadable tail after %d entries in %s: %v\n", copied, filepath, readErr)
+		check.Unreadable = readErr.Error()
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	if readErr != nil {
+		// Keep the log as found for inspection
+		damaged := filepath + ".damaged-" + time.Now().UTC().Format("20060102T150405Z")
+		if err := os.Rename(filepath, damaged); err == nil {
+			check.DamagedCopy = damaged
+		}
+	}
+	if err := os.Rename(tmpPath, filepath); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to install WAL: %w", err)
+	}
 
 	return &WAL{
-		file:     file,
-		encoder:  gob.NewEncoder(file),
-		filepath: filepath,
+		file:        file,
+		encoder:     encoder,
+		filepath:    filepath,
+		seq:         lastSeq,
+		subscribers: make(map[chan *WALEntry]struct{}),
+
+		compactedThrough: check.CompactedThrough,
+		check:            check,
 	}, nil
 }
 
 // Append writes an entry to the WAL
 func (w *WAL) Append(operation, key string, value []byte, ttl time.Duration) error {
+	_, err := w.AppendWithOptions(operation, key, value, ttl, WriteOptions{})
+	return err
+}
+
+// AppendWithOptions writes an entry to the WAL, recording per-key metadata
+// Returns the sequence number assigned to the entry.
+func (w *WAL) AppendWithOptions(operation, key string, value []byte, ttl time.Duration, opts WriteOptions) (uint64, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	entry := WALEntry{
+	entry := &WALEntry{
+		Seq:       w.seq + 1,
 		Operation: operation,
 		Key:       key,
 		Value:     value,
 		TTL:       ttl,
+		Owner:     opts.Owner,
+		Sliding:   opts.SlidingTTL > 0,
 		Timestamp: time.Now(),
+
+		SourceVersion: opts.SourceVersion,
+		Replicas:      opts.Replicas,
 	}
 
+	if err := w.write(entry); err != nil {
+		return 0, err
+	}
+	return entry.Seq, nil
+}
+
+// AppendEntry writes an entry received from another node, preserving its
+// sequence number and timestamp (used by warm standbys)
+func (w *WAL) AppendEntry(entry *WALEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.write(entry)
+}
+
+// write encodes, syncs and publishes an entry; caller must hold w.mu
+func (w *WAL) write(entry *WALEntry) error {
 	if err := w.encoder.Encode(entry); err != nil {
 		return fmt.Errorf("failed to encode WAL entry: %w", err)
 	}
@@ -62,59 +238,132 @@ func (w *WAL) Append(operation, key string, value []byte, ttl time.Duration) err
 		return fmt.Errorf("failed to sync WAL: %w", err)
 	}
 
+	if entry.Seq > w.seq {
+		w.seq = entry.Seq
+	}
+
+	// Publish to subscribers; drop any that have fallen too far behind
+	for ch := range w.subscribers {
+		select {
+		case ch <- entry:
+		default:
+			delete(w.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return nil
+}
+
+// LastSeq returns the sequence number of the last entry written
+func (w *WAL) LastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// SetLastSeq moves the sequence counter forward (after bootstrapping from a
+// primary's snapshot taken at seq)
+func (w *WAL) SetLastSeq(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq > w.seq {
+		w.seq = seq
+	}
+}
+
+// Restart empties the WAL and continues sequence numbers after seq, for a
+// node whose state was replaced by a snapshot taken at seq. The check of the
+// log as opened no longer applies and is cleared.
+func (w *WAL) Restart(seq uint64) error {
+	if err := w.Truncate(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seq = seq
+	w.check = WALCheck{}
 	return nil
 }
 
+// Subscribe returns a channel receiving every entry appended from now on
+// The channel is closed if the subscriber falls behind; call cancel when done.
+// Every entry appended before Subscribe returns is already durable on disk.
+func (w *WAL) Subscribe() (<-chan *WALEntry, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ch := make(chan *WALEntry, subscriberBuffer)
+	w.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.subscribers[ch]; ok {
+			delete(w.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// ReadEntries decodes the WAL file from the start and calls fn for each entry
+func (w *WAL) ReadEntries(fn func(entry *WALEntry) error) error {
+	file, err := os.Open(w.filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer file.Close()
+
+	return ReadWAL(file, fn)
+}
+
 // Restore reads the WAL and applies entries to storage
 func (w *WAL) Restore(storage *Storage) error {
-	// Open file for reading
+	return w.RestoreParallel(storage, 1, nil)
+}
+
+// CopyTo copies the current WAL contents to dst
+// Appends are blocked during the copy so the result ends on an entry boundary
+func (w *WAL) CopyTo(dst io.Writer) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	file, err := os.Open(w.filepath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			// WAL doesn't exist yet, that's okay
-			return nil
+			return 0, nil
 		}
-		return fmt.Errorf("failed to open WAL for restore: %w", err)
+		return 0, fmt.Errorf("failed to open WAL: %w", err)
 	}
 	defer file.Close()
 
-	decoder := gob.NewDecoder(bufio.NewReader(file))
-	entriesRestored := 0
-	now := time.Now()
+	return io.Copy(dst, file)
+}
+
+// ReadWAL decodes WAL entries from r in order and calls fn for each one
+// Decoding stops at the first corrupted or truncated entry
+func ReadWAL(r io.Reader, fn func(entry *WALEntry) error) error {
+	decoder := gob.NewDecoder(bufio.NewReader(r))
 
 	for {
 		var entry WALEntry
-		err := decoder.Decode(&entry)
-		if err != nil {
-			// EOF is expected
-			if err.Error() == "EOF" {
-				break
-			}
-			// Skip corrupted entries and continue
-			continue
-		}
-
-		// Check if entry is expired
-		if entry.TTL > 0 {
-			expiresAt := entry.Timestamp.Add(entry.TTL)
-			if expiresAt.Before(now) {
-				// Skip expired entry
-				continue
+		if err := decoder.Decode(&entry); err != nil {
+			if err == io.EOF {
+				return nil
 			}
+			return fmt.Errorf("failed to decode WAL entry: %w", err)
 		}
 
-		// Apply operation
-		switch entry.Operation {
-		case "SET":
-			storage.Set(entry.Key, entry.Value, entry.TTL)
-			entriesRestored++
-		case "DELETE":
-			storage.Delete(entry.Key)
+		if err := fn(&entry); err != nil {
+			return err
 		}
 	}
-
-	fmt.Printf("WAL: Restored %d entries from %s\n", entriesRestored, w.filepath)
-	return nil
 }
 
 // Size returns the size of the WAL file in bytes
@@ -136,7 +385,7 @@ func (w *WAL) Close() error {
 	return w.file.Close()
 }
 
-// Truncate creates a new WAL file (after compaction/snapshot)
+// Truncate creates a new WAL file (after restoring or bootstrapping from a snapshot)
 func (w *WAL) Truncate() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -156,7 +405,7 @@ func (w *WAL) Truncate() error {
 	}
 
 	w.file = file
-	w.encoder = gob.NewEncoder(file)
+	w.encoder = newWALEncoder(file)
 
 	return nil
 }
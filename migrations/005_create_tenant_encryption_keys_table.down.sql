@@ -0,0 +1,5 @@
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_tenant_encryption_keys_updated_at ON tenant_encryption_keys;
+
+-- Drop tenant_encryption_keys table
+DROP TABLE IF EXISTS tenant_encryption_keys;
@@ -0,0 +1,17 @@
+-- Create tenant_encryption_keys table
+CREATE TABLE IF NOT EXISTS tenant_encryption_keys (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    source VARCHAR(10) NOT NULL CHECK (source IN ('key', 'kms')),
+    key_id VARCHAR(32),
+    wrapped_key TEXT,
+    kms_uri TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    CHECK ((source = 'key' AND wrapped_key IS NOT NULL) OR (source = 'kms' AND kms_uri IS NOT NULL))
+);
+
+-- Create trigger for updated_at
+CREATE TRIGGER update_tenant_encryption_keys_updated_at
+    BEFORE UPDATE ON tenant_encryption_keys
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,5 @@
+-- Drop index
+DROP INDEX IF EXISTS idx_usage_records_request_id;
+
+-- Drop request_id column
+ALTER TABLE usage_records DROP COLUMN IF EXISTS request_id;
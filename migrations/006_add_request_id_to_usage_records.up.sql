@@ -0,0 +1,6 @@
+-- Add request_id to usage_records so a record can be matched with service logs
+ALTER TABLE usage_records ADD COLUMN IF NOT EXISTS request_id VARCHAR(128);
+
+-- Create index on request_id for correlation lookups
+CREATE INDEX IF NOT EXISTS idx_usage_records_request_id ON usage_records(request_id)
+    WHERE request_id IS NOT NULL;
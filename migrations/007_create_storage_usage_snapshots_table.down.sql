@@ -0,0 +1,9 @@
+-- Drop storage_quota_bytes column
+ALTER TABLE users DROP COLUMN IF EXISTS storage_quota_bytes;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_storage_usage_snapshots_taken_at;
+DROP INDEX IF EXISTS idx_storage_usage_snapshots_user_taken_at;
+
+-- Drop storage_usage_snapshots table
+DROP TABLE IF EXISTS storage_usage_snapshots;
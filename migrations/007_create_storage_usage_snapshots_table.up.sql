@@ -0,0 +1,15 @@
+-- Create storage_usage_snapshots table (one row per user per metering pass)
+CREATE TABLE IF NOT EXISTS storage_usage_snapshots (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key_count BIGINT NOT NULL DEFAULT 0,
+    value_bytes BIGINT NOT NULL DEFAULT 0,
+    taken_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Create indexes for per-user history and billing periods
+CREATE INDEX IF NOT EXISTS idx_storage_usage_snapshots_user_taken_at ON storage_usage_snapshots(user_id, taken_at DESC);
+CREATE INDEX IF NOT EXISTS idx_storage_usage_snapshots_taken_at ON storage_usage_snapshots(taken_at);
+
+-- Per-user storage quota (NULL uses the deployment default)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS storage_quota_bytes BIGINT;
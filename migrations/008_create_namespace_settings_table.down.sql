@@ -0,0 +1,5 @@
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_namespace_settings_updated_at ON namespace_settings;
+
+-- Drop namespace_settings table
+DROP TABLE IF EXISTS namespace_settings;
@@ -0,0 +1,15 @@
+-- Create namespace_settings table (per-user policies for key namespaces)
+CREATE TABLE IF NOT EXISTS namespace_settings (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    namespace VARCHAR(64) NOT NULL,
+    consistency VARCHAR(10) CHECK (consistency IN ('strong', 'eventual')),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, namespace)
+);
+
+-- Create trigger for updated_at
+CREATE TRIGGER update_namespace_settings_updated_at
+    BEFORE UPDATE ON namespace_settings
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
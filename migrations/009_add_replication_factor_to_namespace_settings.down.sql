@@ -0,0 +1,2 @@
+-- Drop per-namespace replication factor
+ALTER TABLE namespace_settings DROP COLUMN IF EXISTS replication_factor;
@@ -0,0 +1,3 @@
+-- Add per-namespace replication factor (NULL = service default)
+ALTER TABLE namespace_settings
+    ADD COLUMN IF NOT EXISTS replication_factor SMALLINT CHECK (replication_factor BETWEEN 1 AND 5);
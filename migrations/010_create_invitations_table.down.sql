@@ -0,0 +1,12 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_invitation_redemptions_user_id;
+DROP INDEX IF EXISTS idx_invitations_created_at;
+
+-- Drop invitation_redemptions table
+DROP TABLE IF EXISTS invitation_redemptions;
+
+-- Drop trigger
+DROP TRIGGER IF EXISTS update_invitations_updated_at ON invitations;
+
+-- Drop invitations table
+DROP TABLE IF EXISTS invitations;
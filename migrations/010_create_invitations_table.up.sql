@@ -0,0 +1,35 @@
+-- Create invitations table (admin-issued signup codes)
+CREATE TABLE IF NOT EXISTS invitations (
+    id BIGSERIAL PRIMARY KEY,
+    code_hash VARCHAR(64) NOT NULL UNIQUE,
+    code_prefix VARCHAR(20) NOT NULL,
+    email VARCHAR(255),
+    note VARCHAR(255) NOT NULL DEFAULT '',
+    max_uses INTEGER NOT NULL DEFAULT 1 CHECK (max_uses > 0),
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    last_redeemed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- Create invitation_redemptions table (the accounts created with each invitation)
+CREATE TABLE IF NOT EXISTS invitation_redemptions (
+    invitation_id BIGINT NOT NULL REFERENCES invitations(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    redeemed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (invitation_id, user_id)
+);
+
+-- Create index for listing invitations newest first
+CREATE INDEX IF NOT EXISTS idx_invitations_created_at ON invitations(created_at DESC);
+
+-- Create index for finding the invitation a user signed up with
+CREATE INDEX IF NOT EXISTS idx_invitation_redemptions_user_id ON invitation_redemptions(user_id);
+
+-- Create trigger for updated_at
+CREATE TRIGGER update_invitations_updated_at
+    BEFORE UPDATE ON invitations
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,5 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_used_scoped_tokens_expires_at;
+
+-- Drop used_scoped_tokens table
+DROP TABLE IF EXISTS used_scoped_tokens;
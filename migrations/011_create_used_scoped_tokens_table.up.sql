@@ -0,0 +1,11 @@
+-- Create used_scoped_tokens table (single-use scoped tokens that were redeemed)
+CREATE TABLE IF NOT EXISTS used_scoped_tokens (
+    token_id VARCHAR(64) PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    api_key_id BIGINT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- Create index for removing rows of tokens that have expired
+CREATE INDEX IF NOT EXISTS idx_used_scoped_tokens_expires_at ON used_scoped_tokens(expires_at);
@@ -0,0 +1,5 @@
+-- Drop index
+DROP INDEX IF EXISTS idx_users_deleted_at;
+
+-- Drop anonymized_at column
+ALTER TABLE users DROP COLUMN IF EXISTS anonymized_at;
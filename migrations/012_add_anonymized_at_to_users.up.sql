@@ -0,0 +1,6 @@
+-- Add anonymized_at to users: when the purge job scrubbed a soft-deleted account
+ALTER TABLE users ADD COLUMN IF NOT EXISTS anonymized_at TIMESTAMP WITH TIME ZONE;
+
+-- Create index for finding soft-deleted users due for purging
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users(deleted_at)
+    WHERE deleted_at IS NOT NULL;
@@ -65,6 +65,7 @@ export interface SignupRequest {
     email: string;
     username: string;
     password: string;
+    invite_code?: string;
 }
 
 export interface APIKey {
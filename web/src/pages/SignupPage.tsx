@@ -1,15 +1,17 @@
 import { useState } from 'react';
-import { useNavigate, Link } from 'react-router-dom';
+import { useNavigate, useSearchParams, Link } from 'react-router-dom';
 import { Button } from '@/components/ui/button';
 import { Input } from '@/components/ui/input';
 import { Label } from '@/components/ui/label';
 import { Card, CardContent, CardDescription, CardFooter, CardHeader, CardTitle } from '@/components/ui/card';
 import { authAPI } from '@/lib/api';
-import { Database, Loader2, Mail, Lock, User, Sparkles, Shield, CheckCircle2 } from 'lucide-react';
+import { Database, Loader2, Mail, Lock, User, Sparkles, Shield, CheckCircle2, Ticket } from 'lucide-react';
 import { ThemeToggle } from '@/components/ThemeToggle';
 import { motion } from 'framer-motion';
 
 export function SignupPage() {
+    const [searchParams] = useSearchParams();
+    const [inviteCode, setInviteCode] = useState(searchParams.get('invite') || '');
     const [email, setEmail] = useState('');
     const [username, setUsername] = useState('');
     const [password, setPassword] = useState('');
@@ -46,13 +48,18 @@ export function SignupPage() {
         setLoading(true);
 
         try {
-            await authAPI.signup({ email, username, password });
+            await authAPI.signup({
+                email,
+                username,
+                password,
+                invite_code: inviteCode.trim() || undefined,
+            });
             navigate('/login', {
                 state: { message: 'Account created successfully! Please login.' }
             });
         } catch (err: any) {
             setError(
-                err.response?.data?.error ||
+                err.response?.data?.error?.message ||
                 'Signup failed. Email or username may already exist.'
             );
         } finally {
@@ -221,6 +228,22 @@ export function SignupPage() {
                                 />
                             </motion.div>
 
+                            <motion.div variants={itemVariants} className="space-y-2">
+                                <Label htmlFor="inviteCode" className="flex items-center gap-2">
+                                    <Ticket className="h-4 w-4" />
+                                    Invitation code
+                                </Label>
+                                <Input
+                                    id="inviteCode"
+                                    type="text"
+                                    placeholder="Only needed if signup is by invitation"
+                                    value={inviteCode}
+                                    onChange={(e) => setInviteCode(e.target.value)}
+                                    disabled={loading}
+                                    className="transition-all duration-200 focus:scale-[1.02] focus:shadow-lg"
+                                />
+                            </motion.div>
+
                             <motion.div variants={itemVariants} className="space-y-2">
                                 <Label htmlFor="password" className="flex items-center gap-2">
                                     <Lock className="h-4 w-4" />